@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// accessLog writes one line per request to its output
+type accessLog struct {
+	format string // common, combined or json
+	out    *logOutput
+}
+
+// accessLogger is the log requests are written to, nil while it is off
+var accessLogger atomic.Pointer[accessLog]
+
+// accessEntry is what is logged about a request
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Micros    int64     `json:"micros"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// clfField returns s as a Common Log Format field, "-" when empty
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// line formats e without the trailing newline. common and combined are the
+// Apache formats followed by the time taken in microseconds, like %D.
+func (e *accessEntry) line(format string) []byte {
+	if format == "json" {
+		b, _ := json.Marshal(e)
+		return b
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	b := fmt.Appendf(nil, "%s - %s [%s] %s %d %s", e.Remote, clfField(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, size)
+	if format == "combined" {
+		b = fmt.Appendf(b, " %s %s", strconv.Quote(clfField(e.Referer)), strconv.Quote(clfField(e.UserAgent)))
+	}
+	return fmt.Appendf(b, " %d", e.Micros)
+}
+
+func (l *accessLog) write(e *accessEntry) {
+	l.out.write(append(e.line(l.format), '\n'))
+}
+
+// accessWriter records the status and size of a response for the access log
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	user   string // set by setAccessUser once auth has verified the user
+}
+
+func (a *accessWriter) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessWriter) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps serveFile's sendfile path when the access log is on
+func (a *accessWriter) ReadFrom(src io.Reader) (int64, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := a.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(a.ResponseWriter, src)
+	}
+	a.bytes += n
+	return n, err
+}
+
+func (a *accessWriter) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *accessWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// setAccessUser records the authenticated user for the access log entry
+// of the response w, if it is being logged
+func setAccessUser(w http.ResponseWriter, user string) {
+	for {
+		if a, ok := w.(*accessWriter); ok {
+			a.user = user
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// accessLogHandler logs every request next serves while the access log is
+// on. A held connection is logged when it closes.
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLogger.Load() == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		l := accessLogger.Load()
+		if l == nil {
+			return
+		}
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		l.write(&accessEntry{
+			Time:      start,
+			Remote:    remote,
+			User:      aw.user,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    status,
+			Bytes:     aw.bytes,
+			Micros:    time.Since(start).Microseconds(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
+
+func registerAccessLogCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "accesslog",
+		Help:  "Log every request served",
+		Usage: "accesslog ?on ?-format FORMAT? ?-output FILE|stdout|syslog? ?-rotate SIZE|hourly|daily? ?-keep N?|off?",
+		Long: `While the access log is on, every request gets one line once its
+response is done (for a held connection, when it closes): remote
+address, user, time, request line, status, bytes sent, referer, user
+agent and time taken. The user is the one auth verified, "-" when the
+request wasn't authenticated. Routes, static files, proxies and the built-in
+endpoints are all logged. With no arguments, accesslog returns its
+state as a dict.
+
+-format is one of:
+  common     Apache Common Log Format, followed by the microseconds taken
+  combined   common plus referer and user agent (default)
+  json       one JSON object per line
+
+-output, -rotate and -keep are as for log config: the log goes to stdout
+(default), syslog or a file, which can be rotated by size or time.
+Turning the log on again switches to the new format and output.
+
+Example:
+  accesslog on -format json -output /var/log/app/access.log`,
+	})
+
+	interp.RegisterCommand("accesslog", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) == 0 {
+			l := accessLogger.Load()
+			if l == nil {
+				return feather.OK(i.DictKV("enabled", false))
+			}
+			return feather.OK(l.out.dict(i, "enabled", true, "format", l.format))
+		}
+		switch args[0].String() {
+		case "on":
+			format, spec := "combined", defaultLogOutputSpec()
+			opts := args[1:]
+			if len(opts)%2 != 0 {
+				return feather.Error("wrong # args: should be \"accesslog on ?-format format? ?-output file|stdout|syslog? ?-rotate size|hourly|daily? ?-keep n?\"")
+			}
+			for k := 0; k < len(opts); k += 2 {
+				name, value := opts[k].String(), opts[k+1].String()
+				if name == "-format" {
+					switch value {
+					case "common", "combined", "json":
+					default:
+						return feather.Errorf("accesslog on: unknown format %q (must be common, combined, json)", value)
+					}
+					format = value
+					continue
+				}
+				ok, err := spec.option(name, value)
+				if err != nil {
+					return feather.Errorf("accesslog on: %v", err)
+				}
+				if !ok {
+					return feather.Errorf("accesslog on: unknown option %q (must be -format, -output, -rotate, -keep)", name)
+				}
+			}
+			out, err := openLogOutput(spec)
+			if err != nil {
+				return feather.Errorf("accesslog on: %v", err)
+			}
+			if old := accessLogger.Swap(&accessLog{format: format, out: out}); old != nil {
+				old.out.close()
+			}
+			return feather.OK("")
+		case "off":
+			if len(args) != 1 {
+				return feather.Error("wrong # args: should be \"accesslog off\"")
+			}
+			if old := accessLogger.Swap(nil); old != nil {
+				old.out.close()
+			}
+			return feather.OK("")
+		default:
+			return feather.Errorf("accesslog: expected on or off, got %q", args[0].String())
+		}
+	})
+}
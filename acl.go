@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// Eval channels identify where a script came from, so command access can
+// differ between them
+const (
+	ChannelScript = "script" // startup script and internal callbacks
+	ChannelRoute  = "route"  // route bodies
+	ChannelTelnet = "telnet" // telnet REPL
+	ChannelWeb    = "web"    // web REPL, notebooks and shared sessions
+)
+
+var aclChannels = []string{ChannelScript, ChannelRoute, ChannelTelnet, ChannelWeb}
+
+// channelPolicy restricts host commands for one channel. In allow mode only
+// the listed commands may run; in deny mode the listed ones are refused.
+type channelPolicy struct {
+	allowMode bool
+	commands  map[string]bool
+}
+
+// commandACL holds the per-channel policies. Channels without a policy are
+// unrestricted.
+type commandACL struct {
+	mu       sync.RWMutex
+	policies map[string]*channelPolicy
+}
+
+func newCommandACL() *commandACL {
+	return &commandACL{policies: make(map[string]*channelPolicy)}
+}
+
+// check returns an error if cmd may not run in channel
+func (a *commandACL) check(channel, cmd string) error {
+	// The acl command itself can only be used by the operator, otherwise a
+	// restricted channel could simply lift its own restrictions
+	if cmd == "acl" && (channel == ChannelRoute || channel == ChannelWeb) {
+		return fmt.Errorf("command %q is not allowed from %s", cmd, channelDescription(channel))
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	p := a.policies[channel]
+	if p == nil {
+		return nil
+	}
+	if p.commands[cmd] != p.allowMode {
+		return fmt.Errorf("command %q is not allowed from %s", cmd, channelDescription(channel))
+	}
+	return nil
+}
+
+func (a *commandACL) set(channel string, allowMode bool, cmds []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.policies[channel]
+	if p == nil || p.allowMode != allowMode {
+		p = &channelPolicy{allowMode: allowMode, commands: make(map[string]bool)}
+		a.policies[channel] = p
+	}
+	for _, c := range cmds {
+		p.commands[c] = true
+	}
+}
+
+func (a *commandACL) reset(channel string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.policies, channel)
+}
+
+// show returns the mode and sorted command list for a channel
+func (a *commandACL) show(channel string) (string, []string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	p := a.policies[channel]
+	if p == nil {
+		return "open", nil
+	}
+	cmds := make([]string, 0, len(p.commands))
+	for c := range p.commands {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	if p.allowMode {
+		return "allow", cmds
+	}
+	return "deny", cmds
+}
+
+func channelDescription(channel string) string {
+	switch channel {
+	case ChannelRoute:
+		return "route bodies"
+	case ChannelTelnet:
+		return "the telnet REPL"
+	case ChannelWeb:
+		return "the web REPL"
+	default:
+		return "the startup script"
+	}
+}
+
+func validChannel(channel string) bool {
+	for _, c := range aclChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func registerACLCommand(interp *feather.Interp, state *ServerState) {
+	aclCmd := &Command{
+		Name:  "acl",
+		Help:  "Restrict which commands each eval channel may call",
+		Usage: "acl SUBCOMMAND CHANNEL ?COMMAND ...?",
+		Long: `Restrict host commands per channel. Channels are script (startup
+script), route (route bodies), telnet (telnet REPL) and web (web REPL,
+notebooks and shared sessions). Channels are unrestricted by default.
+Tcl builtins such as set and proc are always available. The acl command
+itself can never be used from route or web.
+
+Example:
+  acl deny web shutdown restart
+  acl allow route respond status header param query request template json`,
+		Subcommands: []*Command{
+			{Name: "allow", Help: "Only allow the listed commands", Usage: "acl allow CHANNEL COMMAND ?COMMAND ...?"},
+			{Name: "deny", Help: "Refuse the listed commands", Usage: "acl deny CHANNEL COMMAND ?COMMAND ...?"},
+			{Name: "reset", Help: "Remove all restrictions", Usage: "acl reset CHANNEL"},
+			{Name: "show", Help: "Show mode and commands as a dict", Usage: "acl show CHANNEL"},
+		},
+	}
+	registry.Register(aclCmd)
+	interp.RegisterCommand("acl", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 {
+			return feather.Error("wrong # args: should be \"acl subcommand channel ?command ...?\"")
+		}
+		subcmd := args[0].String()
+		channel := args[1].String()
+		if !validChannel(channel) {
+			return feather.Errorf("acl: unknown channel %q (must be %s)", channel, strings.Join(aclChannels, ", "))
+		}
+		var cmds []string
+		for _, a := range args[2:] {
+			cmds = append(cmds, a.String())
+		}
+
+		switch subcmd {
+		case "allow", "deny":
+			if len(cmds) == 0 {
+				return feather.Errorf("wrong # args: should be \"acl %s channel command ?command ...?\"", subcmd)
+			}
+			state.acl.set(channel, subcmd == "allow", cmds)
+			return feather.OK("")
+		case "reset":
+			state.acl.reset(channel)
+			return feather.OK("")
+		case "show":
+			mode, list := state.acl.show(channel)
+			return feather.OK(i.DictKV("mode", mode, "commands", i.ListFrom(list)))
+		default:
+			return feather.Errorf("acl: unknown subcommand %q (must be allow, deny, reset, show)", subcmd)
+		}
+	})
+}
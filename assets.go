@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// assetMount serves a fingerprinted directory under a URL prefix
+type assetMount struct {
+	Prefix string
+	Dir    string
+	files  map[string]string // fingerprinted relative path -> relative path
+}
+
+var (
+	assetMu     sync.RWMutex
+	assetMounts = make(map[string]*assetMount) // by prefix
+	assetURLs   = make(map[string]string)      // logical name -> fingerprinted URL
+)
+
+// assetURL resolves a logical asset name such as "css/app.css" to its
+// fingerprinted URL. Unknown names are returned as given so templates
+// still render before assets are fingerprinted.
+func assetURL(name string) string {
+	assetMu.RLock()
+	defer assetMu.RUnlock()
+	if u, ok := assetURLs[strings.TrimPrefix(name, "/")]; ok {
+		return u
+	}
+	return name
+}
+
+// fingerprintName inserts a content hash before the extension:
+// css/app.css -> css/app.3f2a9c01d4.css
+func fingerprintName(rel string, data []byte) string {
+	sum := sha256.Sum256(data)
+	ext := path.Ext(rel)
+	return strings.TrimSuffix(rel, ext) + "." + hex.EncodeToString(sum[:5]) + ext
+}
+
+// fingerprintDir hashes every regular file under dir
+func fingerprintDir(dir, prefix string) (*assetMount, map[string]string, error) {
+	m := &assetMount{Prefix: prefix, Dir: dir, files: make(map[string]string)}
+	urls := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		fp := fingerprintName(rel, h.Sum(nil))
+		m.files[fp] = rel
+		urls[rel] = prefix + "/" + fp
+		return nil
+	})
+	return m, urls, err
+}
+
+// findAssetMount returns the mount with the longest prefix matching path
+func findAssetMount(p string) *assetMount {
+	assetMu.RLock()
+	defer assetMu.RUnlock()
+	var best *assetMount
+	for prefix, m := range assetMounts {
+		if strings.HasPrefix(p, prefix+"/") {
+			if best == nil || len(prefix) > len(best.Prefix) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// serveAsset serves a file from an asset mount. Fingerprinted names never
+// change content, so they are cached for a year; plain names must be
+// revalidated. It reports false when the path isn't an asset.
+func serveAsset(m *assetMount, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	rel := strings.TrimPrefix(r.URL.Path, m.Prefix+"/")
+	cache := "no-cache"
+	if orig, ok := m.files[rel]; ok {
+		rel = orig
+		cache = "public, max-age=31536000, immutable"
+	} else if !fs.ValidPath(rel) {
+		return false
+	}
+	name := filepath.Join(m.Dir, filepath.FromSlash(rel))
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+	w.Header().Set("Cache-Control", cache)
+	serveFile(w, r, name, file, stat)
+	return true
+}
+
+func registerAssetsCommand(interp *feather.Interp, state *ServerState) {
+	assetsCmd := &Command{
+		Name:  "assets",
+		Help:  "Serve static assets under content-hashed names",
+		Usage: "assets SUBCOMMAND ?ARG ...?",
+		Long: `Fingerprinting hashes every file in a directory and serves it under
+PREFIX with the hash in its name, e.g. /assets/css/app.3f2a9c01d4.css, with
+a one-year immutable Cache-Control. Deploying a changed file changes its
+URL, so browsers never see stale assets. Files are also served under their
+plain names with Cache-Control: no-cache.
+
+Templates resolve names with the asset function:
+  <link rel="stylesheet" href="{{asset "css/app.css"}}">
+
+Run fingerprint again after files change.
+
+Example:
+  assets fingerprint ./public -prefix /assets -manifest public/manifest.json`,
+		Subcommands: []*Command{
+			{Name: "fingerprint", Help: "Hash and serve a directory", Usage: "assets fingerprint DIR ?-prefix URL? ?-manifest FILE?"},
+			{Name: "path", Help: "Get the fingerprinted URL of an asset", Usage: "assets path NAME"},
+			{Name: "manifest", Help: "Get all asset names and URLs as a dict", Usage: "assets manifest"},
+			{Name: "clear", Help: "Stop serving fingerprinted assets", Usage: "assets clear"},
+		},
+	}
+	registry.Register(assetsCmd)
+	interp.RegisterCommand("assets", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"assets subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "fingerprint":
+			if len(args) < 2 || len(args)%2 != 0 {
+				return feather.Error("wrong # args: should be \"assets fingerprint dir ?-prefix url? ?-manifest file?\"")
+			}
+			dir := args[1].String()
+			prefix := "/assets"
+			var manifest string
+			for j := 2; j < len(args); j += 2 {
+				switch args[j].String() {
+				case "-prefix":
+					prefix = "/" + strings.Trim(args[j+1].String(), "/")
+				case "-manifest":
+					manifest = args[j+1].String()
+				default:
+					return feather.Errorf("assets fingerprint: unknown option %q (must be -prefix, -manifest)", args[j].String())
+				}
+			}
+			if prefix == "/" {
+				return feather.Error("assets fingerprint: -prefix can't be /")
+			}
+			m, urls, err := fingerprintDir(dir, prefix)
+			if err != nil {
+				return feather.Errorf("assets fingerprint: %v", err)
+			}
+			if manifest != "" {
+				data, err := json.MarshalIndent(urls, "", "  ")
+				if err != nil {
+					return feather.Errorf("assets fingerprint: %v", err)
+				}
+				if err := os.WriteFile(manifest, append(data, '\n'), 0o644); err != nil {
+					return feather.Errorf("assets fingerprint: %v", err)
+				}
+			}
+
+			assetMu.Lock()
+			if old, ok := assetMounts[prefix]; ok {
+				for _, rel := range old.files {
+					delete(assetURLs, rel)
+				}
+			}
+			assetMounts[prefix] = m
+			for rel, u := range urls {
+				assetURLs[rel] = u
+			}
+			assetMu.Unlock()
+			return feather.OK(len(urls))
+		case "path":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"assets path name\"")
+			}
+			return feather.OK(i.String(assetURL(args[1].String())))
+		case "manifest":
+			assetMu.RLock()
+			names := make([]string, 0, len(assetURLs))
+			for rel := range assetURLs {
+				names = append(names, rel)
+			}
+			sort.Strings(names)
+			items := make([]*feather.Obj, 0, 2*len(names))
+			for _, rel := range names {
+				items = append(items, i.String(rel), i.String(assetURLs[rel]))
+			}
+			assetMu.RUnlock()
+			return feather.OK(i.List(items...))
+		case "clear":
+			assetMu.Lock()
+			assetMounts = make(map[string]*assetMount)
+			assetURLs = make(map[string]string)
+			assetMu.Unlock()
+			return feather.OK("")
+		default:
+			return feather.Errorf("assets: unknown subcommand %q (must be fingerprint, path, manifest, clear)", subcmd)
+		}
+	})
+}
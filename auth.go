@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// AuthSpec describes an authentication check as given to the auth command
+// or the route -auth option
+type AuthSpec struct {
+	Scheme string // "basic" or "bearer"
+	Realm  string
+	Check  string // proc called with the credentials, returns a boolean
+}
+
+// parseAuthSpec parses SCHEME followed by -realm and -check options
+func parseAuthSpec(args []string) (*AuthSpec, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("missing scheme (must be basic or bearer)")
+	}
+	spec := &AuthSpec{Scheme: args[0]}
+	switch spec.Scheme {
+	case "basic":
+		spec.Realm = "Restricted"
+	case "bearer":
+	default:
+		return nil, fmt.Errorf("unknown scheme %q (must be basic or bearer)", spec.Scheme)
+	}
+	for j := 1; j < len(args); j++ {
+		opt := args[j]
+		j++
+		if j >= len(args) {
+			return nil, fmt.Errorf("%s: missing value", opt)
+		}
+		switch opt {
+		case "-realm":
+			spec.Realm = args[j]
+		case "-check":
+			spec.Check = args[j]
+		default:
+			return nil, fmt.Errorf("unknown option %q (must be -realm, -check)", opt)
+		}
+	}
+	if spec.Check == "" {
+		return nil, fmt.Errorf("missing -check")
+	}
+	return spec, nil
+}
+
+// String renders the spec back into command arguments
+func (s *AuthSpec) String() string {
+	str := s.Scheme
+	if s.Realm != "" {
+		str += " -realm " + tclQuote(s.Realm)
+	}
+	return str + " -check " + tclQuote(s.Check)
+}
+
+// authResult is the outcome of an authentication check
+type authResult struct {
+	ok      bool
+	user    string // basic auth user name
+	invalid bool   // credentials were given but rejected or malformed
+}
+
+// check extracts credentials from the Authorization header and passes them
+// to the -check proc through eval
+func (s *AuthSpec) check(ctx *RequestContext, eval func(string) (string, error)) (authResult, error) {
+	header := ctx.Request.Header.Get("Authorization")
+	scheme, cred, _ := strings.Cut(header, " ")
+	cred = strings.TrimSpace(cred)
+	if header == "" {
+		return authResult{}, nil
+	}
+
+	var script string
+	var res authResult
+	switch s.Scheme {
+	case "basic":
+		if !strings.EqualFold(scheme, "Basic") {
+			return authResult{invalid: true}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			return authResult{invalid: true}, nil
+		}
+		user, pass, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return authResult{invalid: true}, nil
+		}
+		res.user = user
+		script = tclQuote(s.Check, user, pass)
+	case "bearer":
+		if !strings.EqualFold(scheme, "Bearer") || cred == "" {
+			return authResult{invalid: true}, nil
+		}
+		script = tclQuote(s.Check, cred)
+	}
+
+	out, err := eval(script)
+	if err != nil {
+		return authResult{}, err
+	}
+	if !tclTrue(out) {
+		return authResult{invalid: true}, nil
+	}
+	res.ok = true
+	return res, nil
+}
+
+// challenge sends a 401 with the WWW-Authenticate header for the scheme.
+// ctx.mu must not be held.
+func (s *AuthSpec) challenge(ctx *RequestContext, res authResult) {
+	var challenge string
+	switch s.Scheme {
+	case "basic":
+		challenge = fmt.Sprintf("Basic realm=%s, charset=\"UTF-8\"", strconv.Quote(s.Realm))
+	case "bearer":
+		challenge = "Bearer"
+		if s.Realm != "" {
+			challenge += fmt.Sprintf(" realm=%s", strconv.Quote(s.Realm))
+		}
+		if res.invalid {
+			if s.Realm != "" {
+				challenge += ","
+			}
+			challenge += ` error="invalid_token"`
+		}
+	}
+	ctx.Headers.Store("WWW-Authenticate", challenge)
+	ctx.Headers.Store("Content-Type", "text/plain; charset=utf-8")
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.Written {
+		return
+	}
+	ctx.Status = 401
+	ctx.writeHeader()
+	ctx.Writer.Write([]byte("unauthorized\n"))
+}
+
+// authenticate runs the check and either records the user on the request
+// or sends the challenge. It reports whether the request may proceed.
+func (s *AuthSpec) authenticate(ctx *RequestContext, eval func(string) (string, error)) (bool, error) {
+	res, err := s.check(ctx, eval)
+	if err != nil {
+		return false, err
+	}
+	if !res.ok {
+		s.challenge(ctx, res)
+		return false, nil
+	}
+	ctx.mu.Lock()
+	ctx.authUser = res.user
+	ctx.mu.Unlock()
+	setAccessUser(ctx.Writer, res.user)
+	return true, nil
+}
+
+// tclTrue interprets a script result as a boolean the way Tcl does
+func tclTrue(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		return n != 0
+	}
+	return false
+}
+
+func registerAuthCommand(fi *feather.Interp, state *ServerState) {
+	authCmd := &Command{
+		Name:  "auth",
+		Help:  "HTTP Basic and Bearer authentication",
+		Usage: "auth SUBCOMMAND ?ARG ...?",
+		Long: `Check the request's Authorization header. Called at the top of a route
+body, auth basic and auth bearer act as filters: when credentials are
+missing or the -check proc rejects them, they respond 401 with a
+WWW-Authenticate challenge and stop the handler. The same options can be
+given per route with route -auth {...}.
+
+The -check proc gets the user name and password (basic) or the token
+(bearer) and returns a boolean. Use auth equal to compare secrets in
+constant time.
+
+Example:
+  set adminPassword [dict get [toml load secrets.toml] admin_password]
+  proc checkAdmin {user pass} {
+      auth equal $pass $::adminPassword
+  }
+  route GET /admin {
+      auth basic -realm "Admin" -check checkAdmin
+      respond "hello [auth user]"
+  }`,
+		Subcommands: []*Command{
+			{Name: "basic", Help: "Require HTTP Basic credentials", Usage: "auth basic ?-realm REALM? -check PROC"},
+			{Name: "bearer", Help: "Require a Bearer token", Usage: "auth bearer ?-realm REALM? -check PROC"},
+			{Name: "user", Help: "Get the authenticated Basic user name", Usage: "auth user"},
+			{Name: "equal", Help: "Compare two strings in constant time", Usage: "auth equal A B"},
+		},
+	}
+	registry.Register(authCmd)
+
+	// Use low-level registration so a rejected request can stop the handler
+	// with a return code, like a filter
+	fi.Internal().Register("auth", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) < 1 {
+			i.SetErrorString("wrong # args: should be \"auth subcommand ?arg ...?\"")
+			return feather.ResultError
+		}
+		strArgs := make([]string, len(args))
+		for j, a := range args {
+			strArgs[j] = i.GetString(a)
+		}
+
+		subcmd := strArgs[0]
+		switch subcmd {
+		case "equal":
+			if len(args) != 3 {
+				i.SetErrorString("wrong # args: should be \"auth equal a b\"")
+				return feather.ResultError
+			}
+			eq := subtle.ConstantTimeCompare([]byte(strArgs[1]), []byte(strArgs[2])) == 1
+			if eq {
+				i.SetResultString("1")
+			} else {
+				i.SetResultString("0")
+			}
+			return feather.ResultOK
+		}
+
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			i.SetErrorString(fmt.Sprintf("auth %s: not in request context", subcmd))
+			return feather.ResultError
+		}
+
+		switch subcmd {
+		case "user":
+			ctx.mu.Lock()
+			user := ctx.authUser
+			ctx.mu.Unlock()
+			i.SetResultString(user)
+			return feather.ResultOK
+		case "basic", "bearer":
+			spec, err := parseAuthSpec(strArgs)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("auth %s: %v", subcmd, err))
+				return feather.ResultError
+			}
+			ok, err := spec.authenticate(ctx, i.Eval)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("auth %s -check: %v", subcmd, err))
+				return feather.ResultError
+			}
+			if !ok {
+				i.SetResultString("0")
+				return feather.ResultReturn
+			}
+			i.SetResultString("1")
+			return feather.ResultOK
+		default:
+			i.SetErrorString(fmt.Sprintf("auth: unknown subcommand %q (must be basic, bearer, user, equal)", subcmd))
+			return feather.ResultError
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops sending requests to an upstream whose error rate
+// crossed a threshold. Outcomes are counted per window; once a window has
+// at least minRequests and the failure ratio reaches threshold, the breaker
+// opens and requests are refused for cooldown. Then one probe request is let
+// through (half-open): success closes the breaker, failure opens it again.
+type circuitBreaker struct {
+	threshold   float64 // failure ratio that opens the breaker, 0 < t <= 1
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probe       *breakerTicket // the request testing a half-open upstream
+	opens       int            // times opened, for stats
+}
+
+// breakerTicket is handed out by allow for each request let through, so
+// that outcomes are matched to the state they were admitted in: only the
+// probe decides a half-open breaker, and requests admitted before the
+// breaker opened don't count once it has.
+type breakerTicket struct {
+	probe bool
+	done  bool
+}
+
+type breakerTicketKey struct{}
+
+// withBreakerTicket returns ctx carrying t, for the proxy callbacks
+func withBreakerTicket(ctx context.Context, t *breakerTicket) context.Context {
+	return context.WithValue(ctx, breakerTicketKey{}, t)
+}
+
+func breakerTicketFrom(ctx context.Context) *breakerTicket {
+	t, _ := ctx.Value(breakerTicketKey{}).(*breakerTicket)
+	return t
+}
+
+func newCircuitBreaker(threshold float64, minRequests int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:   threshold,
+		minRequests: minRequests,
+		window:      window,
+		cooldown:    cooldown,
+		state:       breakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+// allow returns a ticket if a request may go to the upstream. When it may
+// not, the ticket is nil and retryAfter is how long until the next probe.
+func (b *circuitBreaker) allow() (t *breakerTicket, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+			return nil, wait
+		}
+		b.state = breakerHalfOpen
+		b.probe = &breakerTicket{probe: true}
+		return b.probe, 0
+	case breakerHalfOpen:
+		if b.probe != nil {
+			return nil, time.Second
+		}
+		b.probe = &breakerTicket{probe: true}
+		return b.probe, 0
+	}
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	return &breakerTicket{}, 0
+}
+
+// record counts the outcome of the request holding t. Each ticket counts
+// once; a nil ticket is ignored.
+func (b *circuitBreaker) record(t *breakerTicket, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	now := time.Now()
+	if t.probe {
+		// A reset may have closed the breaker, or made this probe stale
+		if b.state != breakerHalfOpen || b.probe != t {
+			return
+		}
+		b.probe = nil
+		if success {
+			b.state = breakerClosed
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		} else {
+			b.trip(now)
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return
+	}
+	b.requests++
+	if !success {
+		b.failures++
+	}
+	if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.threshold {
+		b.trip(now)
+	}
+}
+
+func (b *circuitBreaker) trip(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.opens++
+}
+
+// abandon gives up the request holding t without counting it, e.g.
+// because the client went away
+func (b *circuitBreaker) abandon(t *breakerTicket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	if t.probe && b.probe == t {
+		b.probe = nil
+	}
+}
+
+// reset closes the breaker and clears its counts
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.probe = nil
+	b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+}
+
+// stats returns the state and counters as key/value pairs for a dict
+func (b *circuitBreaker) stats() []any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return []any{
+		"state", b.state,
+		"requests", b.requests,
+		"failures", b.failures,
+		"opens", b.opens,
+		"threshold", b.threshold,
+		"min_requests", b.minRequests,
+		"window", b.window.String(),
+		"cooldown", b.cooldown.String(),
+	}
+}
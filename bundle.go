@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// embedScheme marks paths that are read from the bundled file tree
+const embedScheme = "embed://"
+
+// bundleFS holds the ./bundle directory when built with -tags bundle, so
+// scripts, templates and static files can ship inside the binary. It is
+// nil in normal builds.
+var bundleFS fs.FS
+
+// embedPath reports whether p names a bundled file and returns its path
+// within the bundle
+func embedPath(p string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, embedScheme)
+	if !ok {
+		return "", false
+	}
+	rest = path.Clean("/" + rest)[1:]
+	if rest == "" {
+		rest = "."
+	}
+	return rest, true
+}
+
+// errNoBundle is returned for embed:// paths in a build without a bundle
+var errNoBundle = fmt.Errorf("no files bundled (build with -tags bundle)")
+
+// The helpers below take either a file system path or an embed:// path.
+
+func readPath(p string) ([]byte, error) {
+	if name, ok := embedPath(p); ok {
+		if bundleFS == nil {
+			return nil, errNoBundle
+		}
+		return fs.ReadFile(bundleFS, name)
+	}
+	return os.ReadFile(p)
+}
+
+func openPath(p string) (fs.File, error) {
+	if name, ok := embedPath(p); ok {
+		if bundleFS == nil {
+			return nil, errNoBundle
+		}
+		return bundleFS.Open(name)
+	}
+	return os.Open(p)
+}
+
+func statPath(p string) (fs.FileInfo, error) {
+	if name, ok := embedPath(p); ok {
+		if bundleFS == nil {
+			return nil, errNoBundle
+		}
+		return fs.Stat(bundleFS, name)
+	}
+	return os.Stat(p)
+}
+
+func readDirPath(p string) ([]fs.DirEntry, error) {
+	if name, ok := embedPath(p); ok {
+		if bundleFS == nil {
+			return nil, errNoBundle
+		}
+		return fs.ReadDir(bundleFS, name)
+	}
+	return os.ReadDir(p)
+}
+
+// globPath matches pattern in dir, returning paths in the same form as dir
+func globPath(dir, pattern string) ([]string, error) {
+	if name, ok := embedPath(dir); ok {
+		if bundleFS == nil {
+			return nil, errNoBundle
+		}
+		matches, err := fs.Glob(bundleFS, path.Join(name, pattern))
+		for k, m := range matches {
+			matches[k] = embedScheme + m
+		}
+		return matches, err
+	}
+	return filepath.Glob(filepath.Join(dir, pattern))
+}
+
+// joinPath joins a relative slash-separated path onto dir
+func joinPath(dir, rel string) string {
+	if _, ok := embedPath(dir); ok {
+		return strings.TrimSuffix(dir, "/") + "/" + strings.TrimPrefix(path.Clean("/"+rel), "/")
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel))
+}
+
+// serveFSFile is serveFile for files opened with openPath. Bundled files
+// are served from memory.
+func serveFSFile(w http.ResponseWriter, r *http.Request, name string, file fs.File, stat fs.FileInfo) {
+	if f, ok := file.(*os.File); ok {
+		serveFile(w, r, name, f, stat)
+		return
+	}
+	if rs, ok := file.(io.ReadSeeker); ok {
+		fileStats.copied.Add(1)
+		http.ServeContent(w, r, name, stat.ModTime(), rs)
+		return
+	}
+	http.Error(w, "file not seekable", http.StatusInternalServerError)
+}
+
+func registerBundleCommand(interp *feather.Interp, state *ServerState) {
+	bundleCmd := &Command{
+		Name:  "bundle",
+		Help:  "Files compiled into the binary",
+		Usage: "bundle SUBCOMMAND ?ARG ...?",
+		Long: `Built with -tags bundle, the ./bundle directory is compiled into the
+binary. Bundled files are read with embed://PATH wherever a file path is
+accepted: template load, template loaddir, static, sendfile and -f. A
+bundled feather-httpd.tcl runs at startup unless -f is given.
+
+Example:
+  template loaddir embed://templates
+  static /assets embed://public -cache 1h`,
+		Subcommands: []*Command{
+			{Name: "enabled", Help: "Whether this binary has bundled files", Usage: "bundle enabled"},
+			{Name: "files", Help: "List bundled files as embed:// paths", Usage: "bundle files ?PATTERN?"},
+			{Name: "read", Help: "Read a bundled file", Usage: "bundle read PATH"},
+		},
+	}
+	registry.Register(bundleCmd)
+	interp.RegisterCommand("bundle", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"bundle subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "enabled":
+			return feather.OK(bundleFS != nil)
+		case "files":
+			if len(args) > 2 {
+				return feather.Error("wrong # args: should be \"bundle files ?pattern?\"")
+			}
+			pattern := "*"
+			if len(args) == 2 {
+				pattern = args[1].String()
+			}
+			var items []*feather.Obj
+			if bundleFS != nil {
+				var names []string
+				err := fs.WalkDir(bundleFS, ".", func(p string, d fs.DirEntry, err error) error {
+					if err == nil && !d.IsDir() && globMatch(pattern, p) {
+						names = append(names, p)
+					}
+					return err
+				})
+				if err != nil {
+					return feather.Errorf("bundle files: %v", err)
+				}
+				sort.Strings(names)
+				for _, n := range names {
+					items = append(items, i.String(embedScheme+n))
+				}
+			}
+			return feather.OK(i.List(items...))
+		case "read":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"bundle read path\"")
+			}
+			p := args[1].String()
+			if !strings.HasPrefix(p, embedScheme) {
+				p = embedScheme + p
+			}
+			data, err := readPath(p)
+			if err != nil {
+				return feather.Errorf("bundle read: %v", err)
+			}
+			return feather.OK(i.String(string(data)))
+		default:
+			return feather.Errorf("bundle: unknown subcommand %q (must be enabled, files, read)", subcmd)
+		}
+	})
+}
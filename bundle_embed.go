@@ -0,0 +1,22 @@
+//go:build bundle
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Everything under ./bundle, dot files included, is compiled in and
+// readable as embed://PATH
+//
+//go:embed all:bundle
+var bundleFiles embed.FS
+
+func init() {
+	sub, err := fs.Sub(bundleFiles, "bundle")
+	if err != nil {
+		panic(err)
+	}
+	bundleFS = sub
+}
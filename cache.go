@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// cacheSweepInterval is how often expired cache entries are removed
+const cacheSweepInterval = time.Second
+
+// cacheStore is the shared in-memory cache behind the cache command
+type cacheStore struct {
+	mu        sync.Mutex
+	items     map[string]cacheItem
+	sweepOnce sync.Once
+}
+
+type cacheItem struct {
+	value   string
+	expires time.Time // zero for no expiry
+}
+
+func (it cacheItem) expired(now time.Time) bool {
+	return !it.expires.IsZero() && now.After(it.expires)
+}
+
+var cache = &cacheStore{items: make(map[string]cacheItem)}
+
+func (c *cacheStore) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.items[key]
+	if !ok || it.expired(time.Now()) {
+		return "", false
+	}
+	return it.value, true
+}
+
+func (c *cacheStore) set(key, value string, ttl time.Duration) {
+	it := cacheItem{value: value}
+	if ttl > 0 {
+		it.expires = time.Now().Add(ttl)
+		c.startSweep()
+	}
+	c.mu.Lock()
+	c.items[key] = it
+	c.mu.Unlock()
+}
+
+// incr adds by to the integer at key, creating it with ttl when missing.
+// An existing entry keeps its expiry.
+func (c *cacheStore) incr(key string, by int64, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	it, ok := c.items[key]
+	if !ok || it.expired(now) {
+		it = cacheItem{value: "0"}
+		if ttl > 0 {
+			it.expires = now.Add(ttl)
+			c.startSweep()
+		}
+	}
+	n, err := strconv.ParseInt(it.value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n += by
+	it.value = strconv.FormatInt(n, 10)
+	c.items[key] = it
+	return n, nil
+}
+
+func (c *cacheStore) delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.items[key]
+	delete(c.items, key)
+	return ok && !it.expired(time.Now())
+}
+
+// startSweep starts the goroutine that drops expired entries, the first
+// time anything is given a TTL
+func (c *cacheStore) startSweep() {
+	c.sweepOnce.Do(func() {
+		go func() {
+			for now := range time.Tick(cacheSweepInterval) {
+				c.mu.Lock()
+				for k, it := range c.items {
+					if it.expired(now) {
+						delete(c.items, k)
+					}
+				}
+				c.mu.Unlock()
+			}
+		}()
+	})
+}
+
+// parseCacheTTL reads the -ttl option that may end a cache command
+func parseCacheTTL(sub string, args []*feather.Obj) ([]*feather.Obj, time.Duration, error) {
+	if n := len(args); n >= 2 && args[n-2].String() == "-ttl" {
+		d, err := time.ParseDuration(args[n-1].String())
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("cache %s: invalid ttl %q", sub, args[n-1].String())
+		}
+		return args[:n-2], d, nil
+	}
+	return args, 0, nil
+}
+
+func registerCacheCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "cache",
+		Help:  "Share values between requests, with expiry",
+		Usage: "cache set|get|exists|incr|delete ...",
+		Long: `An in-memory key-value cache shared by every request. Entries given a
+-ttl disappear once it passes: reads never see an expired entry, and a
+background sweep frees them. Entries without one stay until deleted.
+The cache is lost when the server stops; use kv or db for data that
+must survive.
+
+cache incr treats the entry as an integer, starting from 0, and returns
+the new value. Its -ttl applies only when it creates the entry, so a
+counter expires a fixed time after its first increment.
+
+Example:
+  route GET /report {
+      set html [cache get report]
+      if {$html eq ""} {
+          set html [build_report]
+          cache set report $html -ttl 5m
+      }
+      respond $html
+  }
+  set views [cache incr views:[request path] 1 -ttl 1h]`,
+		Subcommands: []*Command{
+			{Name: "set", Help: "Set an entry and return the value", Usage: "cache set KEY VALUE ?-ttl DURATION?"},
+			{Name: "get", Help: "Get an entry, or DEFAULT when missing", Usage: "cache get KEY ?DEFAULT?"},
+			{Name: "exists", Help: "Report whether an entry is present", Usage: "cache exists KEY"},
+			{Name: "incr", Help: "Add to a counter and return the new value", Usage: "cache incr KEY ?BY? ?-ttl DURATION?"},
+			{Name: "delete", Help: "Remove an entry, returning whether it was present", Usage: "cache delete KEY"},
+		},
+	})
+
+	interp.RegisterCommand("cache", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 {
+			return feather.Error("wrong # args: should be \"cache subcommand key ?arg ...?\"")
+		}
+		sub, key := args[0].String(), args[1].String()
+		switch sub {
+		case "set":
+			rest, ttl, err := parseCacheTTL(sub, args[2:])
+			if err != nil {
+				return feather.Error(err.Error())
+			}
+			if len(rest) != 1 {
+				return feather.Error("wrong # args: should be \"cache set key value ?-ttl duration?\"")
+			}
+			cache.set(key, rest[0].String(), ttl)
+			return feather.OK(rest[0])
+		case "get":
+			if len(args) > 3 {
+				return feather.Error("wrong # args: should be \"cache get key ?default?\"")
+			}
+			if v, ok := cache.get(key); ok {
+				return feather.OK(i.String(v))
+			}
+			if len(args) == 3 {
+				return feather.OK(args[2])
+			}
+			return feather.OK("")
+		case "exists":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"cache exists key\"")
+			}
+			_, ok := cache.get(key)
+			return feather.OK(ok)
+		case "incr":
+			rest, ttl, err := parseCacheTTL(sub, args[2:])
+			if err != nil {
+				return feather.Error(err.Error())
+			}
+			if len(rest) > 1 {
+				return feather.Error("wrong # args: should be \"cache incr key ?by? ?-ttl duration?\"")
+			}
+			by := int64(1)
+			if len(rest) == 1 {
+				if by, err = strconv.ParseInt(rest[0].String(), 10, 64); err != nil {
+					return feather.Errorf("cache incr: expected integer but got %q", rest[0].String())
+				}
+			}
+			n, err := cache.incr(key, by, ttl)
+			if err != nil {
+				return feather.Errorf("cache incr: %s is not an integer", key)
+			}
+			return feather.OK(n)
+		case "delete":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"cache delete key\"")
+			}
+			return feather.OK(cache.delete(key))
+		}
+		return feather.Errorf("cache: unknown subcommand %q (must be set, get, exists, incr, delete)", sub)
+	})
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// CBOR major types (RFC 8949)
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// maxCBORDepth bounds nesting when decoding, like maxJSONDepth
+const maxCBORDepth = 512
+
+// cborEncoder writes CBOR directly to a pooled buffer based on schema,
+// the same way jsonEncoder does for JSON
+type cborEncoder struct {
+	i   *feather.InternalInterp
+	buf *bytes.Buffer
+}
+
+func newCBOREncoder(i *feather.InternalInterp) *cborEncoder {
+	return &cborEncoder{i: i, buf: getBuffer()}
+}
+
+func (e *cborEncoder) String() string {
+	return e.buf.String()
+}
+
+// release returns the encoder's buffer to the pool
+func (e *cborEncoder) release() {
+	putBuffer(e.buf)
+	e.buf = nil
+}
+
+// head writes a major type with its argument in the shortest form
+func (e *cborEncoder) head(major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		e.buf.WriteByte(m | byte(n))
+	case n <= math.MaxUint8:
+		e.buf.Write([]byte{m | 24, byte(n)})
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(m | 25)
+		e.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(m | 26)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		e.buf.WriteByte(m | 27)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func (e *cborEncoder) text(s string) {
+	e.head(cborText, uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *cborEncoder) encodeDict(dict map[string]feather.FeatherObj, schema []*SchemaNode) error {
+	n := 0
+	for _, node := range schema {
+		if _, ok := dict[node.Name]; ok {
+			n++
+		}
+	}
+	e.head(cborMap, uint64(n))
+	for _, node := range schema {
+		val, ok := dict[node.Name]
+		if !ok {
+			continue
+		}
+		e.text(node.Name)
+		if err := e.encodeValue(val, node); err != nil {
+			return fmt.Errorf("field %s: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *cborEncoder) encodeValue(val feather.FeatherObj, node *SchemaNode) error {
+	switch node.Type {
+	case "string":
+		e.text(schemaString(e.i, val))
+		return nil
+
+	case "number":
+		s := schemaString(e.i, val)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if n >= 0 {
+				e.head(cborUint, uint64(n))
+			} else {
+				e.head(cborNegInt, uint64(-1-n))
+			}
+			return nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number: %s", s)
+		}
+		if f32 := float32(f); float64(f32) == f {
+			e.buf.WriteByte(cborSimple<<5 | 26)
+			e.buf.Write(binary.BigEndian.AppendUint32(nil, math.Float32bits(f32)))
+		} else {
+			e.buf.WriteByte(cborSimple<<5 | 27)
+			e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+		}
+		return nil
+
+	case "bool":
+		switch s := schemaString(e.i, val); s {
+		case "1", "true":
+			e.buf.WriteByte(0xf5)
+		case "0", "false":
+			e.buf.WriteByte(0xf4)
+		default:
+			return fmt.Errorf("invalid bool: %s", s)
+		}
+		return nil
+
+	case "object":
+		dictVal, _, err := e.i.GetDict(val)
+		if err != nil {
+			return fmt.Errorf("expected dict for object: %v", err)
+		}
+		return e.encodeDict(dictVal, node.Children)
+
+	case "array":
+		list, err := e.i.GetList(val)
+		if err != nil {
+			return fmt.Errorf("expected list for array: %v", err)
+		}
+		elemNode := node.Children[0]
+		e.head(cborArray, uint64(len(list)))
+		for idx, item := range list {
+			if err := e.encodeValue(item, elemNode); err != nil {
+				return fmt.Errorf("index %d: %v", idx, err)
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown type: %s", node.Type)
+	}
+}
+
+var errCBORTruncated = errors.New("unexpected end of data")
+
+// cborDecoder decodes CBOR into the same Go values encoding/json produces
+// (map[string]any, []any, string, float64, bool, nil), so the result can go
+// through decodeObject. Byte strings become strings; tags are dropped.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeCBORWithSchema is decodeWithSchema for CBOR input
+func decodeCBORWithSchema(data string, schema []*SchemaNode) (map[string]any, error) {
+	d := &cborDecoder{data: []byte(data)}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("unexpected data after CBOR value")
+	}
+	raw, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected map at top level, got %T", v)
+	}
+	return decodeObject(raw, schema)
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// head reads an initial byte and its argument. indefinite is set for
+// additional info 31.
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, indefinite bool, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info == 24:
+		b, err = d.next(1)
+		if err != nil {
+			return
+		}
+		return major, info, uint64(b[0]), false, nil
+	case info == 25:
+		b, err = d.next(2)
+		if err != nil {
+			return
+		}
+		return major, info, uint64(binary.BigEndian.Uint16(b)), false, nil
+	case info == 26:
+		b, err = d.next(4)
+		if err != nil {
+			return
+		}
+		return major, info, uint64(binary.BigEndian.Uint32(b)), false, nil
+	case info == 27:
+		b, err = d.next(8)
+		if err != nil {
+			return
+		}
+		return major, info, binary.BigEndian.Uint64(b), false, nil
+	case info == 31 && major >= cborBytes && major <= cborMap || info == 31 && major == cborSimple:
+		return major, info, 0, true, nil
+	}
+	return 0, 0, 0, false, fmt.Errorf("invalid additional info %d for major type %d", info, major)
+}
+
+// isBreak consumes the 0xff that ends an indefinite-length item
+func (d *cborDecoder) isBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == 0xff {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) value(depth int) (any, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("nested too deeply")
+	}
+	major, info, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		return float64(arg), nil
+	case cborNegInt:
+		return -1 - float64(arg), nil
+
+	case cborBytes, cborText:
+		if !indefinite {
+			b, err := d.next(int(min(arg, uint64(len(d.data)+1))))
+			if err != nil {
+				return nil, err
+			}
+			return string(b), nil
+		}
+		var buf bytes.Buffer
+		for !d.isBreak() {
+			chunk, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := chunk.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid chunk in indefinite-length string")
+			}
+			buf.WriteString(s)
+		}
+		return buf.String(), nil
+
+	case cborArray:
+		var items []any
+		for k := uint64(0); indefinite || k < arg; k++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+
+	case cborMap:
+		m := make(map[string]any)
+		for k := uint64(0); indefinite || k < arg; k++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			key, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			val, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = val
+		}
+		return m, nil
+
+	case cborTag:
+		return d.value(depth + 1)
+
+	default: // cborSimple
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil // null, undefined
+		case 25:
+			return halfToFloat(uint16(arg)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case 27:
+			return math.Float64frombits(arg), nil
+		}
+		if indefinite {
+			return nil, fmt.Errorf("unexpected break")
+		}
+		return float64(arg), nil
+	}
+}
+
+// halfToFloat converts an IEEE 754 half-precision float
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+func registerCBORCommand(fi *feather.Interp, state *ServerState) {
+	cborCmd := &Command{
+		Name:  "cbor",
+		Help:  "Encode or decode CBOR with schema",
+		Usage: "cbor VALUE -as SCHEMA ?-base64? | cbor DATA -from SCHEMA ?-base64?",
+		Long: `cbor takes the same schema DSL as json. -as encodes a dict to CBOR
+(RFC 8949) and returns the raw bytes; -from decodes raw CBOR bytes, such as
+[request body], into a dict. Integers are encoded as CBOR integers and
+other numbers as the shortest lossless float. On decode, byte strings are
+read as strings and tags are ignored.
+
+Raw CBOR is binary and only survives being passed along unchanged: string
+commands such as string range treat it as text and replace invalid bytes.
+With -base64 the encoded result, or the data to decode, is base64 instead,
+which is safe to store and manipulate; send it with respond -base64.
+
+Example:
+  route POST /readings {
+      set r [cbor [request body] -from {string sensor number value}]
+      respond -base64 -type application/cbor [cbor [dict create ok true] -as {bool ok} -base64]
+  }`,
+		Subcommands: []*Command{
+			{Name: "-as", Help: "Encode TCL value to CBOR using schema", Usage: "cbor VALUE -as SCHEMA ?-base64?"},
+			{Name: "-from", Help: "Decode CBOR bytes to TCL value using schema", Usage: "cbor DATA -from SCHEMA ?-base64?"},
+		},
+	}
+	registry.Register(cborCmd)
+
+	// Low-level registration, like json, so the bytes aren't list-quoted
+	fi.Internal().Register("cbor", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) != 3 && (len(args) != 4 || i.GetString(args[3]) != "-base64") {
+			i.SetErrorString("wrong # args: should be \"cbor value -as schema ?-base64?\" or \"cbor data -from schema ?-base64?\"")
+			return feather.ResultError
+		}
+		b64 := len(args) == 4
+		schema, err := parseSchema(i.GetString(args[2]))
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("cbor: invalid schema: %v", err))
+			return feather.ResultError
+		}
+
+		switch flag := i.GetString(args[1]); flag {
+		case "-as":
+			dictVal, _, err := i.GetDict(args[0])
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("cbor: expected dict: %v", err))
+				return feather.ResultError
+			}
+			enc := newCBOREncoder(i)
+			defer enc.release()
+			if err := enc.encodeDict(dictVal, schema); err != nil {
+				i.SetErrorString(fmt.Sprintf("cbor: encode error: %v", err))
+				return feather.ResultError
+			}
+			out := enc.String()
+			if b64 {
+				out = base64.StdEncoding.EncodeToString([]byte(out))
+			}
+			i.SetResult(i.InternString(out))
+			return feather.ResultOK
+
+		case "-from":
+			data := i.GetString(args[0])
+			if b64 {
+				raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+				if err != nil {
+					i.SetErrorString(fmt.Sprintf("cbor: invalid base64: %v", err))
+					return feather.ResultError
+				}
+				data = string(raw)
+			}
+			decoded, err := decodeCBORWithSchema(data, schema)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("cbor: decode error: %v", err))
+				return feather.ResultError
+			}
+			dict := i.NewDict()
+			for k, v := range decoded {
+				dict = setDictValue(i, dict, k, v)
+			}
+			i.SetResult(dict)
+			return feather.ResultOK
+
+		default:
+			i.SetErrorString(fmt.Sprintf("cbor: unknown flag %q (use -as or -from)", flag))
+			return feather.ResultError
+		}
+	})
+}
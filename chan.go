@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// msgChan is a named queue made by chan create
+type msgChan struct {
+	name   string
+	ch     chan string
+	closed chan struct{} // closed by chan close; ch itself never is, so senders can't panic
+	once   sync.Once
+}
+
+var (
+	chansMu sync.Mutex
+	chans   = make(map[string]*msgChan)
+)
+
+func getMsgChan(name string) (*msgChan, bool) {
+	chansMu.Lock()
+	defer chansMu.Unlock()
+	c, ok := chans[name]
+	return c, ok
+}
+
+func (c *msgChan) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	errChanClosed  = errors.New("closed")
+	errChanTimeout = errors.New("timed out")
+)
+
+// wait runs op, which blocks until it is done or stop is closed, without
+// holding up the interpreter: the interpreter loop keeps serving until op
+// returns or timeout passes. op must report whether it finished, so a
+// result that arrives as the timeout fires isn't lost.
+func (c *msgChan) wait(i *feather.Interp, state *ServerState, timeout time.Duration, op func(stop <-chan struct{}) bool) error {
+	stop, wake := make(chan struct{}), make(chan struct{})
+	var ok bool
+	go func() {
+		ok = op(stop)
+		close(wake)
+	}()
+	woken, err := state.serveUntil(i, wake, timeout)
+	if err != nil {
+		close(stop)
+		<-wake
+		return err
+	}
+	if !woken {
+		close(stop)
+		<-wake
+		if !ok {
+			select {
+			case <-state.shutdown:
+				return errors.New("server shutting down")
+			default:
+			}
+			return errChanTimeout
+		}
+	}
+	if !ok {
+		return errChanClosed
+	}
+	return nil
+}
+
+// send queues value, waiting while the buffer is full
+func (c *msgChan) send(i *feather.Interp, state *ServerState, value string, timeout time.Duration) error {
+	if c.isClosed() {
+		return errChanClosed
+	}
+	select {
+	case c.ch <- value:
+		return nil
+	default:
+	}
+	var closed bool
+	err := c.wait(i, state, timeout, func(stop <-chan struct{}) bool {
+		select {
+		case c.ch <- value:
+			return true
+		case <-c.closed:
+			closed = true
+		case <-stop:
+		}
+		return false
+	})
+	if err == errChanTimeout && closed {
+		return errChanClosed
+	}
+	return err
+}
+
+// receive takes the next value, waiting while there is none. Values
+// queued before chan close can still be received.
+func (c *msgChan) receive(i *feather.Interp, state *ServerState, timeout time.Duration) (string, error) {
+	select {
+	case v := <-c.ch:
+		return v, nil
+	default:
+	}
+	var v string
+	err := c.wait(i, state, timeout, func(stop <-chan struct{}) bool {
+		select {
+		case v = <-c.ch:
+			return true
+		case <-c.closed:
+			select {
+			case v = <-c.ch:
+				return true
+			default:
+			}
+		case <-stop:
+		}
+		return false
+	})
+	return v, err
+}
+
+// parseChanTimeout reads the -timeout option that may end chan send and
+// chan receive; zero means wait as long as it takes
+func parseChanTimeout(sub string, args []*feather.Obj) ([]*feather.Obj, time.Duration, error) {
+	if n := len(args); n >= 2 && args[n-2].String() == "-timeout" {
+		d, err := time.ParseDuration(args[n-1].String())
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("chan %s: invalid timeout %q", sub, args[n-1].String())
+		}
+		return args[:n-2], d, nil
+	}
+	return args, 0, nil
+}
+
+func registerChanCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "chan",
+		Help:  "Pass values between handlers, jobs and timers",
+		Usage: "chan create|send|receive|close ...",
+		Long: `Named queues for handing work between request handlers, background
+jobs and timers, instead of sharing global variables. chan create makes
+a queue that holds up to -buffer values (default 0: each send waits for
+a receiver, as in Go).
+
+chan send waits while the queue is full and chan receive while it is
+empty; both raise an error once -timeout passes. On the interpreter
+loop, other requests are served while they wait; in a job they block
+only the job. chan close makes further sends fail; receivers get the
+values still queued, then an error. A closed chan's name can be created
+again.
+
+Example:
+  chan create thumbnails -buffer 100
+  foreach n {1 2} {
+      async {
+          while 1 {
+              set path [chan receive thumbnails]
+              http post $resizer -body $path
+          }
+      }
+  }
+  route POST /photos {
+      set path [save_upload]
+      chan send thumbnails $path -timeout 2s
+      respond "queued"
+  }`,
+		Subcommands: []*Command{
+			{Name: "create", Help: "Make a named queue", Usage: "chan create NAME ?-buffer N?"},
+			{Name: "send", Help: "Queue a value, waiting while full", Usage: "chan send NAME VALUE ?-timeout DURATION?"},
+			{Name: "receive", Help: "Take the next value, waiting while empty", Usage: "chan receive NAME ?-timeout DURATION?"},
+			{Name: "close", Help: "Stop accepting values", Usage: "chan close NAME"},
+		},
+	})
+
+	interp.RegisterCommand("chan", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 {
+			return feather.Error("wrong # args: should be \"chan subcommand name ?arg ...?\"")
+		}
+		sub, name := args[0].String(), args[1].String()
+		if sub == "create" {
+			buffer := 0
+			switch {
+			case len(args) == 4 && args[2].String() == "-buffer":
+				var err error
+				if buffer, err = parseNonNegativeInt(args[3].String()); err != nil {
+					return feather.Errorf("chan create: -buffer: %v", err)
+				}
+			case len(args) != 2:
+				return feather.Error("wrong # args: should be \"chan create name ?-buffer n?\"")
+			}
+			chansMu.Lock()
+			defer chansMu.Unlock()
+			if c, ok := chans[name]; ok && !c.isClosed() {
+				return feather.Errorf("chan create: %q already exists", name)
+			}
+			chans[name] = &msgChan{name: name, ch: make(chan string, buffer), closed: make(chan struct{})}
+			return feather.OK(name)
+		}
+		switch sub {
+		case "send", "receive", "close":
+		default:
+			return feather.Errorf("chan: unknown subcommand %q (must be create, send, receive, close)", sub)
+		}
+		c, ok := getMsgChan(name)
+		if !ok {
+			return feather.Errorf("chan %s: unknown chan %q", sub, name)
+		}
+
+		switch sub {
+		case "send":
+			rest, timeout, err := parseChanTimeout(sub, args[2:])
+			if err != nil {
+				return feather.Error(err.Error())
+			}
+			if len(rest) != 1 {
+				return feather.Error("wrong # args: should be \"chan send name value ?-timeout duration?\"")
+			}
+			if err := c.send(i, state, rest[0].String(), timeout); err != nil {
+				return feather.Errorf("chan send: %s %v", name, err)
+			}
+			return feather.OK("")
+		case "receive":
+			rest, timeout, err := parseChanTimeout(sub, args[2:])
+			if err != nil {
+				return feather.Error(err.Error())
+			}
+			if len(rest) != 0 {
+				return feather.Error("wrong # args: should be \"chan receive name ?-timeout duration?\"")
+			}
+			v, err := c.receive(i, state, timeout)
+			if err != nil {
+				return feather.Errorf("chan receive: %s %v", name, err)
+			}
+			return feather.OK(i.String(v))
+		default: // close
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"chan close name\"")
+			}
+			c.once.Do(func() { close(c.closed) })
+			return feather.OK("")
+		}
+	})
+}
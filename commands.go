@@ -1,10 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -12,18 +15,20 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/feather-lang/feather"
 )
 
 // Command represents a command or subcommand with help text and optional children
 type Command struct {
-	Name        string
-	Help        string // short description
-	Long        string // long description
-	Usage       string
-	Subcommands []*Command
-	Handler     func(*feather.Interp, *feather.Obj, []*feather.Obj) feather.Result
+	Name        string                                                             `json:"name"`
+	Help        string                                                             `json:"help,omitempty"` // short description
+	Long        string                                                             `json:"long,omitempty"` // long description
+	Usage       string                                                             `json:"usage,omitempty"`
+	Subcommands []*Command                                                         `json:"subcommands,omitempty"`
+	Handler     func(*feather.Interp, *feather.Obj, []*feather.Obj) feather.Result `json:"-"`
 }
 
 // FindSubcommand looks up a subcommand by name
@@ -65,18 +70,32 @@ func (c *Command) FormatLongHelp() string {
 	return sb.String()
 }
 
-// CommandRegistry holds all registered commands
+// CommandRegistry holds all registered commands. mu guards the list and,
+// since help -for edits entries in place, the help text too: the /_commands
+// endpoint reads it from HTTP goroutines.
 type CommandRegistry struct {
+	mu       sync.RWMutex
 	commands []*Command
 }
 
-// Register adds a command to the registry
+// Register adds a command to the registry. A name that is already
+// registered keeps its first entry, so job interpreters can register the
+// same commands again.
 func (r *CommandRegistry) Register(cmd *Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.commands {
+		if c.Name == cmd.Name {
+			return
+		}
+	}
 	r.commands = append(r.commands, cmd)
 }
 
 // Find looks up a command by name
 func (r *CommandRegistry) Find(name string) *Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	for _, cmd := range r.commands {
 		if cmd.Name == name {
 			return cmd
@@ -87,13 +106,74 @@ func (r *CommandRegistry) Find(name string) *Command {
 
 // All returns all registered commands
 func (r *CommandRegistry) All() []*Command {
-	return r.commands
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Command(nil), r.commands...)
 }
 
 var registry = &CommandRegistry{}
 
 func registerCommands(interp *feather.Interp, state *ServerState) {
 	registerJSONCommand(interp, state)
+	registerCBORCommand(interp, state)
+	registerXMLCommand(interp, state)
+	registerYAMLCommand(interp, state)
+	registerTOMLCommand(interp, state)
+	registerProtoCommand(interp, state)
+	registerConfigCommand(interp, state)
+	registerLimitConfig()
+	registerConnectionConfig(state)
+	registerOutboundConfig()
+	registerFileServeConfig()
+	registerRouteHistoryConfig()
+	registerHelpConfig()
+	registerHandlerTimeoutConfig()
+	registerStatsCommand(interp, state)
+	registerMetricCommand(interp, state)
+	registerRateLimitCommand(interp, state)
+	registerAuthCommand(interp, state)
+	registerResourceCommand(interp, state)
+	registerFormCommand(interp, state)
+	registerOAuth2Command(interp, state)
+	registerOIDCCommand(interp, state)
+	registerPaginateCommand(interp, state)
+	registerUseCommand(interp, state)
+	registerWebDAVCommand(interp, state)
+	registerICSCommand(interp, state)
+	registerTOTPCommand(interp, state)
+	registerCryptoCommand(interp, state)
+	registerAssetsCommand(interp, state)
+	registerEncodingCommands(interp, state)
+	registerTransformCommand(interp, state)
+	registerURLCommand(interp, state)
+	registerHTMLCommand(interp, state)
+	registerMarkdownCommand(interp, state)
+	registerStreamCommand(interp, state)
+	registerStaticCommand(interp, state)
+	registerTusCommand(interp, state)
+	registerUploadCommand(interp, state)
+	registerBundleCommand(interp, state)
+	registerHeadersCommand(interp, state)
+	registerSourceCommand(interp, state)
+	registerProxyCommand(interp, state)
+	registerHTTPCommand(interp, state)
+	registerRedisCommand(interp, state)
+	registerDBCommand(interp, state)
+	registerCacheCommand(interp, state)
+	registerKVCommand(interp, state)
+	registerPubsubCommand(interp, state)
+	registerJobCommands(interp, state)
+	registerTimerCommands(interp, state)
+	registerCronCommand(interp, state)
+	registerDeferCommand(interp, state)
+	registerChanCommand(interp, state)
+	registerOpenAPICommand(interp, state)
+	registerGraphQLCommand(interp, state)
+	registerSessionCommand(interp, state)
+	registerDebugCommand(interp, state)
+	registerAccessLogCommand(interp, state)
+	registerLogCommand(interp, state)
+	registerACLCommand(interp, state)
 
 	// Default config command - returns embedded config
 	interp.Register("default_config", func() string {
@@ -104,61 +184,278 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 	routeCmd := &Command{
 		Name:  "route",
 		Help:  "Define a route handler",
-		Usage: "route METHOD PATH BODY",
+		Usage: "route ?-maxconcurrent N? ?-ratelimit SPEC? ?-auth SPEC? ?-active-from TIME? ?-active-until TIME? ?-timeout DURATION? METHOD PATH BODY",
+		Long: `Define a route handler for METHOD and PATH. Path segments starting
+with : are captured as parameters (see param).
+
+Redefining a route keeps the previous version (see config route_history).
+route history lists them newest first; route rollback METHOD PATH -1
+restores the previous one, -2 the one before it, and so on.
+
+Options:
+  -maxconcurrent N  Allow at most N concurrent executions of this route;
+                    further requests get 503 with Retry-After
+  -ratelimit SPEC   Rate limit the route with ratelimit options, e.g.
+                    {-per ip -rate 10/s -burst 20}; see help ratelimit
+  -auth SPEC        Require authentication with auth options, e.g.
+                    {basic -realm Admin -check checkAdmin}; see help auth
+  -active-from TIME   Only match from TIME on, e.g. 2025-01-01T00:00Z
+  -active-until TIME  Stop matching at TIME
+  -timeout DURATION   Answer 503 if the handler runs longer, e.g. 5s;
+                      overrides config handler_timeout (see below)
+
+Outside its activation window a route is skipped as if it didn't exist,
+so a later, more general route (or 404) answers instead.
+
+When a handler times out, the client gets 503 unless a response was
+already started, and the next server command the handler calls (respond,
+http, db, ...) raises an error so it unwinds. The timeout can't stop
+Tcl builtins such as while, for, set and expr, which don't pass through
+the server: a loop made only of them holds the interpreter, and with it
+every other request, timer and REPL, until it ends; while 1 {} never
+does and needs a restart. A loop that can run long should call a server
+command on each pass; sleep 0 costs nothing and lets the timeout in.
+
+When a handler raises an error before responding, the client gets 500
+with the message. Define a proc named onerror to answer instead: it is
+called with the message while the request is still open. A panic in a
+Go command becomes an error too; its stack is logged and the default
+page hides the details.
+
+Example:
+  proc onerror {msg} {
+      status 500
+      template respond error message $msg
+  }`,
+	}
+	routeCmd.Subcommands = []*Command{
+		{Name: "history", Help: "List previous versions of a route", Usage: "route history METHOD PATH"},
+		{Name: "rollback", Help: "Restore a previous version", Usage: "route rollback METHOD PATH -N"},
 	}
 	registry.Register(routeCmd)
-	interp.Register("route", func(method, pattern, body string) error {
-		state.AddRoute(method, pattern, body)
-		return nil
+	interp.RegisterCommand("route", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) > 0 {
+			switch args[0].String() {
+			case "history":
+				if len(args) != 3 {
+					return feather.Error("wrong # args: should be \"route history method path\"")
+				}
+				versions := state.RouteHistory(args[1].String(), args[2].String())
+				items := make([]*feather.Obj, len(versions))
+				for k, v := range versions {
+					items[k] = i.DictKV("version", -(k + 1), "time", v.when.Format(time.RFC3339),
+						"removed", v.removed, "options", v.route.Options.args(), "body", v.route.Body)
+				}
+				return feather.OK(i.List(items...))
+			case "rollback":
+				if len(args) != 4 {
+					return feather.Error("wrong # args: should be \"route rollback method path -n\"")
+				}
+				n, err := strconv.Atoi(args[3].String())
+				if err != nil {
+					return feather.Errorf("route rollback: expected version such as -1, got %q", args[3].String())
+				}
+				if _, err := state.RollbackRoute(args[1].String(), args[2].String(), n); err != nil {
+					return feather.Errorf("route rollback: %v", err)
+				}
+				return feather.OK("")
+			}
+		}
+		var opts RouteOptions
+		j := 0
+		for ; j < len(args) && strings.HasPrefix(args[j].String(), "-"); j++ {
+			switch args[j].String() {
+			case "-maxconcurrent":
+				j++
+				if j >= len(args) {
+					return feather.Error("route -maxconcurrent: missing value")
+				}
+				n, err := args[j].Int()
+				if err != nil || n < 0 {
+					return feather.Errorf("route: -maxconcurrent expects non-negative integer, got %s", args[j].String())
+				}
+				opts.MaxConcurrent = int(n)
+			case "-ratelimit":
+				j++
+				if j >= len(args) {
+					return feather.Error("route -ratelimit: missing spec")
+				}
+				specArgs, err := i.ParseList(args[j].String())
+				if err != nil {
+					return feather.Errorf("route -ratelimit: %v", err)
+				}
+				strArgs := make([]string, len(specArgs))
+				for k, a := range specArgs {
+					strArgs[k] = a.String()
+				}
+				spec, err := parseRateLimitSpec(strArgs)
+				if err != nil {
+					return feather.Errorf("route -ratelimit: %v", err)
+				}
+				opts.RateLimit = spec
+			case "-auth":
+				j++
+				if j >= len(args) {
+					return feather.Error("route -auth: missing spec")
+				}
+				specArgs, err := i.ParseList(args[j].String())
+				if err != nil {
+					return feather.Errorf("route -auth: %v", err)
+				}
+				strArgs := make([]string, len(specArgs))
+				for k, a := range specArgs {
+					strArgs[k] = a.String()
+				}
+				spec, err := parseAuthSpec(strArgs)
+				if err != nil {
+					return feather.Errorf("route -auth: %v", err)
+				}
+				opts.Auth = spec
+			case "-active-from", "-active-until":
+				opt := args[j].String()
+				j++
+				if j >= len(args) {
+					return feather.Errorf("route %s: missing time", opt)
+				}
+				t, err := parseActiveTime(args[j].String())
+				if err != nil {
+					return feather.Errorf("route %s: %v", opt, err)
+				}
+				if opt == "-active-from" {
+					opts.ActiveFrom = t
+				} else {
+					opts.ActiveUntil = t
+				}
+			case "-timeout":
+				j++
+				if j >= len(args) {
+					return feather.Error("route -timeout: missing duration")
+				}
+				d, err := time.ParseDuration(args[j].String())
+				if err != nil || d <= 0 {
+					return feather.Errorf("route -timeout: invalid duration %q", args[j].String())
+				}
+				opts.Timeout = d
+			default:
+				return feather.Errorf("route: unknown option %q (must be -maxconcurrent, -ratelimit, -auth, -active-from, -active-until, -timeout)", args[j].String())
+			}
+		}
+		if len(args)-j != 3 {
+			return feather.Error("wrong # args: should be \"route ?options? method path body\"")
+		}
+		if !opts.ActiveFrom.IsZero() && !opts.ActiveUntil.IsZero() && !opts.ActiveUntil.After(opts.ActiveFrom) {
+			return feather.Error("route: -active-until must be after -active-from")
+		}
+		body := args[j+2].String()
+		if err := checkRouteBody(body); err != nil {
+			return feather.Errorf("route %s %s: %v", args[j].String(), args[j+1].String(), err)
+		}
+		state.AddRoute(args[j].String(), args[j+1].String(), body, opts)
+		return feather.OK("")
 	})
 
 	// Respond command
 	respondCmd := &Command{
 		Name:  "respond",
 		Help:  "Write response body to client",
-		Usage: "respond ?-to HANDLE? BODY",
+		Usage: "respond ?-to HANDLE | -group GROUP? ?-base64? ?-type CONTENT-TYPE? BODY",
+		Long: `With -base64, BODY is decoded first, so binary data such as audio or
+video chunks and protobuf frames can be written, e.g. to a held connection.
+
+-type sets the Content-Type header if the response headers haven't been sent
+yet. Binary bodies without a Content-Type get application/octet-stream
+instead of a sniffed type.
+
+-group writes BODY to every held connection in GROUP (see connection
+join), flushes it, and returns how many connections it reached.
+Connections that close meanwhile are skipped, so a broadcast never
+fails because a client left.`,
 	}
 	registry.Register(respondCmd)
 	interp.RegisterCommand("respond", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
-		var ctx *RequestContext
-		bodyIdx := 0
+		var handle, group, contentType string
+		binary := false
+		j := 0
+	options:
+		for ; j < len(args)-1; j++ {
+			switch args[j].String() {
+			case "-to":
+				j++
+				handle = args[j].String()
+			case "-group":
+				j++
+				group = args[j].String()
+			case "-base64":
+				binary = true
+			case "-type":
+				j++
+				contentType = args[j].String()
+			default:
+				break options
+			}
+		}
+		if len(args)-j != 1 {
+			return feather.Error("wrong # args: should be \"respond ?-to handle | -group group? ?-base64? ?-type content-type? body\"")
+		}
+		if handle != "" && group != "" {
+			return feather.Error("respond: -to and -group can't be combined")
+		}
 
-		// Check for -to HANDLE
-		if len(args) >= 2 && args[0].String() == "-to" {
-			handle := args[1].String()
-			conn := state.GetConnection(handle)
+		body := []byte(args[j].String())
+		if binary {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(args[j].String()))
+			if err != nil {
+				return feather.Errorf("respond: invalid base64: %v", err)
+			}
+			body = decoded
+		}
+
+		if group != "" {
+			members := state.groups.members(group)
+			for _, c := range members {
+				if contentType != "" {
+					c.Ctx.Headers.Store("Content-Type", contentType)
+				} else if _, set := c.Ctx.Headers.Load("Content-Type"); binary && !set {
+					c.Ctx.Headers.Store("Content-Type", "application/octet-stream")
+				}
+				c.send(body)
+			}
+			return feather.OK(len(members))
+		}
+
+		var conn *Connection
+		var ctx *RequestContext
+		if handle != "" {
+			conn = state.GetConnection(handle)
 			if conn == nil {
 				// Connection gone, silently succeed
 				return feather.OK("")
 			}
 			ctx = conn.Ctx
-			bodyIdx = 2
 		} else {
 			ctx = state.GetRequestContext()
 			if ctx == nil {
 				return feather.Error("respond: not in request context")
 			}
 		}
-		if len(args) <= bodyIdx {
-			return feather.Error("wrong # args: should be \"respond ?-to handle? body\"")
+		if contentType != "" {
+			ctx.Headers.Store("Content-Type", contentType)
+		} else if _, set := ctx.Headers.Load("Content-Type"); binary && !set {
+			ctx.Headers.Store("Content-Type", "application/octet-stream")
+		}
+		if conn != nil {
+			conn.touch()
+			if conn.shaper != nil {
+				conn.shaper.send(body)
+				return feather.OK("")
+			}
 		}
 
 		ctx.mu.Lock()
 		defer ctx.mu.Unlock()
 
-		if !ctx.Written {
-			ctx.Headers.Range(func(k, v any) bool {
-				ctx.Writer.Header().Set(k.(string), v.(string))
-				return true
-			})
-			if ctx.Status != 0 {
-				ctx.Writer.WriteHeader(ctx.Status)
-			}
-			ctx.Written = true
-		}
-
-		body := args[bodyIdx].String()
-		ctx.Writer.Write([]byte(body))
+		ctx.writeHeader()
+		ctx.Writer.Write(body)
 		return feather.OK("")
 	})
 
@@ -364,9 +661,38 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			{Name: "loaddir", Help: "Load all templates from directory", Usage: "template loaddir DIR ?GLOB?"},
 			{Name: "list", Help: "List loaded template names", Usage: "template list"},
 			{Name: "show", Help: "Show template source", Usage: "template show NAME"},
-			{Name: "respond", Help: "Render template to HTTP response", Usage: "template respond NAME ?KEY VAL ...?"},
-			{Name: "string", Help: "Render template to string", Usage: "template string NAME ?KEY VAL ...?"},
+			{Name: "respond", Help: "Render template to HTTP response", Usage: "template respond NAME ?-layout LAYOUT? ?KEY VAL ...?"},
+			{Name: "string", Help: "Render template to string", Usage: "template string NAME ?-layout LAYOUT? ?KEY VAL ...?"},
+			{Name: "blocks", Help: "List the blocks a layout lets pages fill", Usage: "template blocks NAME"},
+			{Name: "globals", Help: "Values available to every template", Usage: "template globals set|get|unset|list ?KEY? ?VALUE?"},
 		},
+		Long: `Values built with dict create or list (including lappend and dict set
+results) reach templates as maps and slices, nested as deep as they go:
+
+  set user [dict create name Ada roles [list admin dev]]
+  template respond profile user $user
+  {{.user.name}} {{range .user.roles}}<li>{{.}}</li>{{end}}
+
+Other values are passed as strings.
+
+Every render also gets the globals set with template globals and, during
+a request, a reserved ctx map with method, path, url, host, params, query,
+user (the authenticated or session user), csrf (the session's CSRF token,
+see help session) and flash (the queued flash messages, taken from the
+session by the render), so layouts can show login state and messages
+without each handler passing them:
+
+  {{if .ctx.user}}Signed in as {{.ctx.user}}{{end}}
+  {{range .ctx.flash}}<p class="{{.category}}">{{.message}}</p>{{end}}
+  <input type="hidden" name="csrf_token" value="{{.ctx.csrf}}">
+
+With -layout, the template is rendered as the "content" block of LAYOUT,
+and any blocks it defines replace the layout's defaults:
+
+  template define base {<title>{{block "title" .}}Site{{end}}</title>
+  <main>{{block "content" .}}{{end}}</main>}
+  template define home {{{define "title"}}Home{{end}}<h1>Hi {{.name}}</h1>}
+  template respond home -layout base name Ada`,
 	}
 	registry.Register(templateCmd)
 	interp.RegisterCommand("template", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
@@ -403,7 +729,7 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 				name = args[3].String()
 			}
 
-			content, err := os.ReadFile(tmplPath)
+			content, err := readPath(tmplPath)
 			if err != nil {
 				return feather.Errorf("template load: %v", err)
 			}
@@ -427,8 +753,7 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 				glob = args[2].String()
 			}
 
-			pattern := filepath.Join(dir, glob)
-			files, err := filepath.Glob(pattern)
+			files, err := globPath(dir, glob)
 			if err != nil {
 				return feather.Errorf("template loaddir: %v", err)
 			}
@@ -436,7 +761,7 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			var loaded []string
 			for _, file := range files {
 				name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
-				content, err := os.ReadFile(file)
+				content, err := readPath(file)
 				if err != nil {
 					return feather.Errorf("template loaddir: %v", err)
 				}
@@ -478,15 +803,31 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 				return feather.Error("wrong # args: should be \"template respond name ?key val ...?\"")
 			}
 			name := args[1].String()
+			layout, rest := splitLayoutOption(args[2:])
 			tmpl := state.GetTemplate(name)
 			if tmpl == nil {
 				return feather.Errorf("template respond: unknown template %q", name)
 			}
+			if layout != "" {
+				var err error
+				if tmpl, err = state.GetTemplateWithLayout(name, layout); err != nil {
+					return feather.Errorf("template respond: %v", err)
+				}
+			}
 
-			data, err := parseTemplateData(args[2:])
+			data, err := parseTemplateData(rest)
 			if err != nil {
 				return feather.Errorf("template respond: %v", err)
 			}
+			data = withTemplateContext(state, data)
+
+			// Render into a pooled buffer first so a template error can
+			// still produce a proper 500 instead of a truncated page
+			buf := getBuffer()
+			defer putBuffer(buf)
+			if err := tmpl.Execute(buf, data); err != nil {
+				return feather.Errorf("template respond: %v", err)
+			}
 
 			ctx.mu.Lock()
 			defer ctx.mu.Unlock()
@@ -494,18 +835,9 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			if _, ok := ctx.Headers.Load("Content-Type"); !ok {
 				ctx.Headers.Store("Content-Type", "text/html; charset=utf-8")
 			}
-			ctx.Headers.Range(func(k, v any) bool {
-				ctx.Writer.Header().Set(k.(string), v.(string))
-				return true
-			})
-			if ctx.Status != 0 {
-				ctx.Writer.WriteHeader(ctx.Status)
-			}
-			ctx.Written = true
+			ctx.writeHeader()
 
-			if err := tmpl.Execute(ctx.Writer, data); err != nil {
-				return feather.Errorf("template respond: %v", err)
-			}
+			buf.WriteTo(ctx.Writer)
 			return feather.OK("")
 
 		case "string":
@@ -515,24 +847,51 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 				return feather.Error("wrong # args: should be \"template string name ?key val ...?\"")
 			}
 			name := args[1].String()
+			layout, rest := splitLayoutOption(args[2:])
 			tmpl := state.GetTemplate(name)
 			if tmpl == nil {
 				return feather.Errorf("template string: unknown template %q", name)
 			}
+			if layout != "" {
+				var err error
+				if tmpl, err = state.GetTemplateWithLayout(name, layout); err != nil {
+					return feather.Errorf("template string: %v", err)
+				}
+			}
 
-			data, err := parseTemplateData(args[2:])
+			data, err := parseTemplateData(rest)
 			if err != nil {
 				return feather.Errorf("template string: %v", err)
 			}
+			data = withTemplateContext(state, data)
 
-			var buf bytes.Buffer
-			if err := tmpl.Execute(&buf, data); err != nil {
+			buf := getBuffer()
+			defer putBuffer(buf)
+			if err := tmpl.Execute(buf, data); err != nil {
 				return feather.Errorf("template string: %v", err)
 			}
 			return feather.OK(buf.String())
 
+		case "globals":
+			return templateGlobalsCommand(i, args[1:])
+
+		case "blocks":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"template blocks name\"")
+			}
+			tmpl := state.GetTemplate(args[1].String())
+			if tmpl == nil || tmpl.Tree == nil {
+				return feather.Errorf("template blocks: unknown template %q", args[1].String())
+			}
+			slots := templateSlots(tmpl.Tree.Root)
+			items := make([]*feather.Obj, len(slots))
+			for k, name := range slots {
+				items[k] = i.String(name)
+			}
+			return feather.OK(i.List(items...))
+
 		default:
-			return feather.Errorf("template: unknown subcommand %q (must be load, loaddir, list, respond, string)", subcmd)
+			return feather.Errorf("template: unknown subcommand %q (must be define, load, loaddir, list, show, respond, string, globals, blocks)", subcmd)
 		}
 	})
 
@@ -540,7 +899,20 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 	sendfileCmd := &Command{
 		Name:  "sendfile",
 		Help:  "Serve file content with auto-detected MIME type",
-		Usage: "sendfile PATH",
+		Usage: "sendfile PATH ?-type MIME? ?-download? ?-filename NAME?",
+		Long: `The Content-Type comes from the file extension unless a header or -type
+sets it. -download sends Content-Disposition: attachment so browsers save
+the file instead of showing it, under its own name or -filename. Names
+outside ASCII are sent RFC 2231 encoded.
+
+Range and conditional requests are answered with 206 and 304 as for
+static files. If the handler set a status other than 200, the whole file
+is sent with that status instead.
+
+Example:
+  route GET /reports/:id {
+      sendfile ./reports/[param id].csv -download -filename report.csv
+  }`,
 	}
 	registry.Register(sendfileCmd)
 	interp.RegisterCommand("sendfile", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
@@ -549,11 +921,34 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			return feather.Error("sendfile: not in request context")
 		}
 		if len(args) < 1 {
-			return feather.Error("wrong # args: should be \"sendfile path\"")
+			return feather.Error("wrong # args: should be \"sendfile path ?-type mime? ?-download? ?-filename name?\"")
 		}
 		filepath := args[0].String()
+		var contentType, filename string
+		download := false
+		for j := 1; j < len(args); j++ {
+			switch opt := args[j].String(); opt {
+			case "-download":
+				download = true
+			case "-type", "-filename":
+				if j+1 >= len(args) {
+					return feather.Errorf("sendfile: %s needs a value", opt)
+				}
+				j++
+				if opt == "-type" {
+					contentType = args[j].String()
+				} else {
+					filename = args[j].String()
+				}
+			default:
+				return feather.Errorf("sendfile: unknown option %q (must be -type, -download, -filename)", opt)
+			}
+		}
+		if filename != "" && !download {
+			return feather.Error("sendfile: -filename needs -download")
+		}
 
-		file, err := os.Open(filepath)
+		file, err := openPath(filepath)
 		if err != nil {
 			return feather.Errorf("sendfile: %v", err)
 		}
@@ -567,24 +962,39 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		ctx.mu.Lock()
 		defer ctx.mu.Unlock()
 
-		if _, ok := ctx.Headers.Load("Content-Type"); !ok {
+		if contentType != "" {
+			ctx.Headers.Store("Content-Type", contentType)
+		} else if _, ok := ctx.Headers.Load("Content-Type"); !ok {
 			ct := mime.TypeByExtension(path.Ext(filepath))
 			if ct == "" {
 				ct = "application/octet-stream"
 			}
 			ctx.Headers.Store("Content-Type", ct)
 		}
+		if download {
+			if filename == "" {
+				filename = path.Base(strings.TrimPrefix(filepath, embedScheme))
+			}
+			ctx.Headers.Store("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		}
 
-		ctx.Headers.Range(func(k, v any) bool {
-			ctx.Writer.Header().Set(k.(string), v.(string))
-			return true
-		})
-		if ctx.Status != 0 {
-			ctx.Writer.WriteHeader(ctx.Status)
+		// A status the script set goes out as is, with the whole file;
+		// otherwise ServeContent picks it, 206 for a range and 304 for a
+		// fresh copy
+		if ctx.Status != 0 && ctx.Status != http.StatusOK && !ctx.Written {
+			ctx.Headers.Store("Content-Length", strconv.FormatInt(stat.Size(), 10))
+			ctx.writeHeader()
+			if _, err := io.Copy(ctx.Writer, file); err != nil {
+				return feather.Errorf("sendfile: %v", err)
+			}
+			return feather.OK("")
+		}
+		if !ctx.Written {
+			ctx.copyHeaders()
+			ctx.Written = true
 		}
-		ctx.Written = true
 
-		http.ServeContent(ctx.Writer, ctx.Request, filepath, stat.ModTime(), file)
+		serveFSFile(ctx.Writer, ctx.Request, filepath, file, stat)
 		return feather.OK("")
 	})
 
@@ -598,6 +1008,9 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			{Name: "path", Help: "Get request path", Usage: "request path"},
 			{Name: "body", Help: "Get request body", Usage: "request body"},
 			{Name: "header", Help: "Get request header", Usage: "request header NAME"},
+			{Name: "deadline", Help: "Get or set the deadline as unix milliseconds", Usage: "request deadline ?DURATION?"},
+			{Name: "remaining", Help: "Milliseconds left before the deadline, -1 if none", Usage: "request remaining"},
+			{Name: "tmpdir", Help: "Temporary directory removed when the request ends", Usage: "request tmpdir"},
 		},
 	}
 	registry.Register(requestCmd)
@@ -616,7 +1029,7 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		case "path":
 			return feather.OK(ctx.Request.URL.Path)
 		case "body":
-			body, err := io.ReadAll(ctx.Request.Body)
+			body, err := ctx.readBody()
 			if err != nil {
 				return feather.Errorf("request body: %v", err)
 			}
@@ -626,6 +1039,34 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 				return feather.Error("wrong # args: should be \"request header name\"")
 			}
 			return feather.OK(ctx.Request.Header.Get(args[1].String()))
+		case "deadline":
+			if len(args) > 2 {
+				return feather.Error("wrong # args: should be \"request deadline ?duration?\"")
+			}
+			if len(args) == 2 {
+				d, err := time.ParseDuration(args[1].String())
+				if err != nil || d <= 0 {
+					return feather.Errorf("request deadline: expected positive duration, got %q", args[1].String())
+				}
+				ctx.setDeadline(time.Now().Add(d))
+			}
+			deadline, ok := ctx.getDeadline()
+			if !ok {
+				return feather.OK("")
+			}
+			return feather.OK(deadline.UnixMilli())
+		case "remaining":
+			left, ok := ctx.remaining()
+			if !ok {
+				return feather.OK(-1)
+			}
+			return feather.OK(left.Milliseconds())
+		case "tmpdir":
+			dir, err := ctx.tempDir()
+			if err != nil {
+				return feather.Errorf("request tmpdir: %v", err)
+			}
+			return feather.OK(dir)
 		default:
 			return feather.Errorf("request: unknown subcommand %q", subcmd)
 		}
@@ -646,7 +1087,7 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		if evalCtx := state.GetEvalContext(); evalCtx != nil && evalCtx.Output != nil {
 			evalCtx.Output(msg)
 		} else {
-			fmt.Println(msg)
+			logf("%s\n", msg)
 		}
 		return feather.OK("")
 	})
@@ -655,15 +1096,51 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 	routesCmd := &Command{
 		Name:  "routes",
 		Help:  "List all defined routes",
-		Usage: "routes",
+		Usage: "routes ?transaction ?-replace? SCRIPT?",
+		Long: `With no arguments, list the routes as route commands.
+
+routes transaction runs SCRIPT with route changes staged, then swaps the
+whole route table in at once, so requests never see a half-applied
+reload. If SCRIPT fails, no change is applied. With -replace the staged
+table starts empty, so routes the script doesn't define are removed.
+
+Example:
+  routes transaction -replace {
+      route GET / { respond "home" }
+      resource /users -handlers users
+  }`,
+		Subcommands: []*Command{
+			{Name: "transaction", Help: "Apply route changes atomically", Usage: "routes transaction ?-replace? SCRIPT"},
+		},
 	}
 	registry.Register(routesCmd)
 	interp.RegisterCommand("routes", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) > 0 {
+			if args[0].String() != "transaction" {
+				return feather.Errorf("routes: unknown subcommand %q (must be transaction)", args[0].String())
+			}
+			replace := len(args) == 3 && args[1].String() == "-replace"
+			if len(args) != 2 && !replace {
+				return feather.Error("wrong # args: should be \"routes transaction ?-replace? script\"")
+			}
+			if err := state.BeginRoutes(replace); err != nil {
+				return feather.Errorf("routes transaction: %v", err)
+			}
+			if _, err := i.Eval(args[len(args)-1].String()); err != nil {
+				state.EndRoutes(false)
+				return feather.Errorf("routes transaction: rolled back: %v", err)
+			}
+			state.EndRoutes(true)
+			return feather.OK("")
+		}
 		routes := state.GetRoutes()
 		var items []string
 		for _, r := range routes {
 			// Each item is a properly quoted list element
 			item := fmt.Sprintf("route %s %s {%s}", r.Method, r.Pattern, r.Body)
+			if opts := r.Options.args(); opts != "" {
+				item = fmt.Sprintf("route %s %s %s {%s}", opts, r.Method, r.Pattern, r.Body)
+			}
 			items = append(items, item)
 		}
 		return feather.OK(items)
@@ -673,46 +1150,155 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 	listenCmd := &Command{
 		Name:  "listen",
 		Help:  "Start the HTTP server on specified port",
-		Usage: "listen PORT",
+		Usage: "listen PORT ?-replace?",
+		Long: `Start serving on PORT and return the port actually bound, which is useful
+with port 0 (any free port). Errors such as a port already in use are
+returned to the script, so it can catch them and try another port:
+
+  if {[catch {listen 8080} err]} {
+      puts "8080 unavailable ($err), using a free port"
+      listen 0
+  }
+
+Calling listen again while listening is an error unless -replace is given.
+-replace moves the server to PORT: the old listener stops accepting and its
+in-flight requests finish in the background; held connections stay open.`,
 	}
 	registry.Register(listenCmd)
-	interp.Register("listen", func(port int) error {
+	interp.RegisterCommand("listen", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		replace := false
+		switch {
+		case len(args) == 2 && args[1].String() == "-replace":
+			replace = true
+		case len(args) != 1:
+			return feather.Error("wrong # args: should be \"listen port ?-replace?\"")
+		}
+		port, err := strconv.Atoi(args[0].String())
+		if err != nil || port < 0 || port > 65535 {
+			return feather.Errorf("listen: invalid port %q", args[0].String())
+		}
 		addr := fmt.Sprintf(":%d", port)
+
+		old, oldLn := state.server, state.listener
+		if old != nil && !replace {
+			return feather.Errorf("listen: already listening on %s (use listen %d -replace to move)", oldLn.Addr(), port)
+		}
+		// Replacing on the same port has to give it up before binding again
+		samePort := old != nil && port != 0 && listenerPort(oldLn) == port
+		if samePort {
+			oldLn.Close()
+		}
+
+		// Reuse the socket handed over by a restarting parent, if any
+		ln, err := inheritedListener(addr)
+		if err != nil {
+			return feather.Errorf("listen: %v", err)
+		}
+		if ln == nil {
+			ln, err = net.Listen("tcp", addr)
+			if err != nil {
+				if samePort {
+					state.server, state.listener = nil, nil
+					go old.Shutdown(context.Background())
+				}
+				return feather.Errorf("listen: %v", err)
+			}
+		}
+
+		state.listener = ln
 		state.server = &http.Server{
-			Addr:    addr,
-			Handler: createHandler(state),
+			Addr:           addr,
+			Handler:        accessLogHandler(recoverHandler(createHandler(state))),
+			MaxHeaderBytes: int(maxHeaderBytes.Load()),
+			IdleTimeout:    time.Duration(idleTimeout.Load()),
+			ConnState:      state.conns.track,
+		}
+		state.server.SetKeepAlivesEnabled(keepAliveEnabled.Load())
+		if old != nil {
+			// Shutdown closes the old listener and drains its requests
+			go old.Shutdown(context.Background())
 		}
 
-		fmt.Printf("Listening on %s\n", addr)
+		logf("Listening on %s\n", ln.Addr())
+		server := state.server
 		go func() {
-			if err := state.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				fmt.Printf("Server error: %v\n", err)
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+				logf("Server error: %v\n", err)
 			}
 		}()
 
-		return nil
+		return feather.OK(listenerPort(ln))
+	})
+
+	// Restart command
+	restartCmd := &Command{
+		Name:  "restart",
+		Help:  "Restart the process without dropping requests",
+		Usage: "restart",
+		Long: `Start a new copy of feather-httpd (same binary and arguments) that
+inherits the listening socket. Once its startup script has run without
+error, this process closes held connections, drains in-flight requests
+and exits; if the new copy fails first, this one keeps serving. Sending
+SIGUSR2 has the same effect.`,
+	}
+	registry.Register(restartCmd)
+	interp.Register("restart", func() error {
+		return state.Restart()
 	})
 
 	// Shutdown command
 	shutdownCmd := &Command{
 		Name:  "shutdown",
 		Help:  "Stop the server gracefully",
-		Usage: "shutdown",
+		Usage: "shutdown ?-timeout DURATION? ?-force?",
+		Long: `Stop accepting new requests and wait for in-flight requests to finish.
+
+Held connections are closed first, running the on_shutdown_connection
+proc (see config describe on_shutdown_connection) and their onclose procs,
+so streaming clients can be told to reconnect elsewhere. Requests
+still running after the drain timeout (default from -drain-timeout, 30s)
+are cut off. With -force, all connections are closed immediately.`,
 	}
 	registry.Register(shutdownCmd)
-	interp.Register("shutdown", func() error {
-		close(state.shutdown)
-		if state.server != nil {
-			return state.server.Close()
+	interp.RegisterCommand("shutdown", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		timeout := state.drainTimeout
+		force := false
+		for j := 0; j < len(args); j++ {
+			switch args[j].String() {
+			case "-timeout":
+				j++
+				if j >= len(args) {
+					return feather.Error("shutdown -timeout: missing duration")
+				}
+				d, err := time.ParseDuration(args[j].String())
+				if err != nil {
+					return feather.Errorf("shutdown: invalid timeout %q", args[j].String())
+				}
+				timeout = d
+			case "-force":
+				force = true
+			default:
+				return feather.Errorf("shutdown: unknown option %q (must be -timeout, -force)", args[j].String())
+			}
 		}
-		return nil
+
+		// We are on the interpreter goroutine, so onclose procs run directly
+		// and the drain happens in the background while the loop keeps
+		// serving the requests being drained.
+		state.CloseAllConnections(i.Eval)
+		go state.Drain(timeout, force)
+		return feather.OK("")
 	})
 
 	// Help command
 	helpCmd := &Command{
 		Name:  "help",
 		Help:  "Show or set help for commands",
-		Usage: "help ?COMMAND? | help -for CMD -usage USAGE -short SHORT ?-long LONG?",
+		Usage: "help ?COMMAND? | help -markdown|-json ?COMMAND? | help -for CMD -usage USAGE -short SHORT ?-long LONG?",
+		Long: `help -markdown and help -json return the reference for every command (or
+one) instead of printing it, e.g. to generate documentation that matches
+this binary. With config set help_endpoint 1, the same JSON is served at
+GET /_commands.`,
 	}
 	registry.Register(helpCmd)
 	interp.RegisterCommand("help", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
@@ -750,22 +1336,29 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 					}
 				}
 			}
-			// Find or create command entry
-			c := registry.Find(cmdName)
-			if c == nil {
-				c = &Command{Name: cmdName}
-				registry.Register(c)
+			registry.SetHelp(cmdName, usage, short, long)
+			return feather.Result{}
+		}
+
+		if len(args) >= 1 && (args[0].String() == "-markdown" || args[0].String() == "-json") {
+			if len(args) > 2 {
+				return feather.Errorf("wrong # args: should be \"help %s ?command?\"", args[0].String())
 			}
-			if usage != "" {
-				c.Usage = usage
+			var name string
+			if len(args) == 2 {
+				name = args[1].String()
 			}
-			if short != "" {
-				c.Help = short
+			var out string
+			var err error
+			if args[0].String() == "-markdown" {
+				out, err = registry.Markdown(name)
+			} else {
+				out, err = registry.JSON(name)
 			}
-			if long != "" {
-				c.Long = long
+			if err != nil {
+				return feather.Errorf("help: %v", err)
 			}
-			return feather.Result{}
+			return feather.OK(i.String(out))
 		}
 
 		if len(args) == 0 {
@@ -803,11 +1396,62 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		Name:  "connection",
 		Help:  "Manage held HTTP connections for streaming",
 		Usage: "connection SUBCOMMAND ?ARG ...?",
+		Long: `hold -max-rate (e.g. 100/s) and -max-bytes-per-sec (e.g. 1MB) pace
+writes made with respond -to HANDLE. Writes are queued (up to 256) and sent
+from the background, flushed one by one; while the queue is full, new writes
+are dropped. connection info reports queued, sent and dropped counts.
+
+hold -keepalive writes a ping whenever nothing has been written for that
+long, so proxies and load balancers don't cut a quiet stream. The ping
+is an SSE comment unless -ping gives other DATA, e.g. a newline for a
+plain chunked stream. hold -idle-timeout closes the connection once the
+script has written nothing (pings don't count) for that long, calling
+its onclose proc first, so clients that vanished without a disconnect
+are reaped.
+
+connection wait is for long polling: it parks the handler until
+connection notify sends HANDLE a message, a message is published to
+-topic, the client disconnects, or -timeout (default 30s) passes, and
+returns a dict whose event is notify, message, closed or timeout, with
+the message as data. Other requests are served while it waits. A
+notification sent while nobody waits is kept for the next wait.
+
+Example:
+  route GET /poll {
+      set h [connection hold]
+      set ev [connection wait $h -topic orders -timeout 25s]
+      if {[dict get $ev event] eq "timeout"} {
+          status 204
+          respond ""
+      } elseif {[dict get $ev event] ne "closed"} {
+          respond [dict get $ev data]
+      }
+      connection close $h
+  }
+
+connection join puts a connection in a named group, such as a chat room,
+and respond -group GROUP writes to all of its members at once. A
+connection can be in any number of groups and leaves them all when it
+closes.
+
+Example:
+  route GET /rooms/:room {
+      header Content-Type text/event-stream
+      connection join [connection hold] [param room]
+  }
+  route POST /rooms/:room {
+      respond -group [param room] "data: [request body]\n\n"
+  }`,
 		Subcommands: []*Command{
-			{Name: "hold", Help: "Hold current response open for streaming", Usage: "connection hold ?-as NAME?"},
+			{Name: "hold", Help: "Hold current response open for streaming", Usage: "connection hold ?-as NAME? ?-max-rate RATE? ?-max-bytes-per-sec SIZE? ?-keepalive DURATION? ?-ping DATA? ?-idle-timeout DURATION?"},
 			{Name: "close", Help: "Close a held connection", Usage: "connection close HANDLE"},
 			{Name: "info", Help: "Get connection info", Usage: "connection info HANDLE"},
 			{Name: "onclose", Help: "Register a proc to call when connection closes", Usage: "connection onclose HANDLE PROC"},
+			{Name: "wait", Help: "Park the handler until the connection gets an event", Usage: "connection wait HANDLE ?-timeout DURATION? ?-topic TOPIC?"},
+			{Name: "notify", Help: "Wake a connection wait with a message", Usage: "connection notify HANDLE ?DATA?"},
+			{Name: "join", Help: "Add a connection to a group", Usage: "connection join HANDLE GROUP"},
+			{Name: "leave", Help: "Remove a connection from a group", Usage: "connection leave HANDLE GROUP"},
+			{Name: "members", Help: "List the connections in a group", Usage: "connection members GROUP"},
 		},
 	}
 	registry.Register(connectionCmd)
@@ -818,15 +1462,59 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		subcmd := args[0].String()
 		switch subcmd {
 		case "hold":
-			var name string
-			// Check for -as NAME
-			if len(args) >= 3 && args[1].String() == "-as" {
-				name = args[2].String()
+			var name, rate string
+			var perSec float64
+			var maxBytes int64
+			keepalive := &connKeepalive{ping: []byte(connKeepalivePing)}
+			for j := 1; j < len(args); j += 2 {
+				opt := args[j].String()
+				if j+1 >= len(args) {
+					return feather.Errorf("connection hold %s: missing value", opt)
+				}
+				val := args[j+1].String()
+				var err error
+				switch opt {
+				case "-as":
+					name = val
+				case "-max-rate":
+					perSec, err = parseRate(val)
+					rate = val
+				case "-max-bytes-per-sec":
+					maxBytes, err = parseByteSize(val)
+				case "-keepalive", "-idle-timeout":
+					var d time.Duration
+					if d, err = time.ParseDuration(val); err == nil && d <= 0 {
+						err = fmt.Errorf("must be positive")
+					}
+					if opt == "-keepalive" {
+						keepalive.interval = d
+					} else {
+						keepalive.idle = d
+					}
+				case "-ping":
+					keepalive.ping = []byte(val)
+				default:
+					return feather.Errorf("connection hold: unknown option %q (must be -as, -max-rate, -max-bytes-per-sec, -keepalive, -ping, -idle-timeout)", opt)
+				}
+				if err != nil {
+					return feather.Errorf("connection hold %s: %v", opt, err)
+				}
 			}
 			conn, err := state.HoldConnection(name)
 			if err != nil {
 				return feather.Errorf("connection hold: %v", err)
 			}
+			if perSec > 0 || maxBytes > 0 {
+				conn.shaper = newConnShaper(conn, rate, perSec, maxBytes)
+				// The writer goroutine must be done with the response
+				// before the handler returns
+				conn.Ctx.mu.Lock()
+				conn.Ctx.closers = append(conn.Ctx.closers, conn.shaper.wait)
+				conn.Ctx.mu.Unlock()
+			}
+			if keepalive.interval > 0 || keepalive.idle > 0 {
+				go keepalive.run(state, conn)
+			}
 			if name != "" {
 				return feather.OK(name)
 			}
@@ -859,6 +1547,9 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			if conn.Name != "" {
 				info = fmt.Sprintf("%s name %s", info, conn.Name)
 			}
+			if conn.shaper != nil {
+				info = fmt.Sprintf("%s %s", info, conn.shaper.info())
+			}
 			return feather.OK(info)
 
 		case "onclose":
@@ -874,8 +1565,84 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 			conn.OnClose = proc
 			return feather.OK("")
 
+		case "wait":
+			if len(args) < 2 || len(args)%2 != 0 {
+				return feather.Error("wrong # args: should be \"connection wait handle ?-timeout duration? ?-topic topic?\"")
+			}
+			handle := args[1].String()
+			conn := state.GetConnection(handle)
+			if conn == nil {
+				return feather.Errorf("connection wait: unknown connection %q", handle)
+			}
+			timeout := connWaitDefault
+			var topic string
+			for j := 2; j < len(args); j += 2 {
+				switch opt, val := args[j].String(), args[j+1].String(); opt {
+				case "-timeout":
+					d, err := time.ParseDuration(val)
+					if err != nil || d <= 0 {
+						return feather.Errorf("connection wait: invalid timeout %q", val)
+					}
+					timeout = d
+				case "-topic":
+					topic = val
+				default:
+					return feather.Errorf("connection wait: unknown option %q (must be -timeout, -topic)", opt)
+				}
+			}
+			res, err := connectionWait(i, state, conn, topic, timeout)
+			if err != nil {
+				return feather.Errorf("connection wait: %v", err)
+			}
+			return feather.OK(res)
+
+		case "notify":
+			if len(args) != 2 && len(args) != 3 {
+				return feather.Error("wrong # args: should be \"connection notify handle ?data?\"")
+			}
+			conn := state.GetConnection(args[1].String())
+			if conn == nil {
+				return feather.OK(false)
+			}
+			var data string
+			if len(args) == 3 {
+				data = args[2].String()
+			}
+			select {
+			case conn.notify <- data:
+				return feather.OK(true)
+			default:
+				// One is already pending
+				return feather.OK(false)
+			}
+
+		case "join", "leave":
+			if len(args) != 3 {
+				return feather.Errorf("wrong # args: should be \"connection %s handle group\"", subcmd)
+			}
+			handle := args[1].String()
+			conn := state.GetConnection(handle)
+			if conn == nil {
+				return feather.Errorf("connection %s: unknown connection %q", subcmd, handle)
+			}
+			if subcmd == "leave" {
+				return feather.OK(state.groups.leave(conn, args[2].String()))
+			}
+			state.groups.join(conn, args[2].String())
+			return feather.OK("")
+
+		case "members":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"connection members group\"")
+			}
+			var handles []string
+			for _, c := range state.groups.members(args[1].String()) {
+				handles = append(handles, c.handle())
+			}
+			return feather.OK(handles)
+
 		default:
-			return feather.Errorf("connection: unknown subcommand %q (must be hold, close, info, onclose)", subcmd)
+			return feather.Errorf("connection: unknown subcommand %q (must be hold, close, info, onclose, wait, notify, join, leave, members)", subcmd)
 		}
 	})
 
@@ -905,7 +1672,8 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		if len(args) >= 2 && args[0].String() == "-to" {
 			handle := args[1].String()
 			conn := state.GetConnection(handle)
-			if conn == nil {
+			if conn == nil || conn.shaper != nil {
+				// Shaped connections flush after every write
 				return feather.OK("")
 			}
 			ctx = conn.Ctx
@@ -921,6 +1689,9 @@ func registerCommands(interp *feather.Interp, state *ServerState) {
 		}
 		return feather.OK("")
 	})
+
+	// Must come last so every command above is covered
+	installCommandHooks(interp, state)
 }
 
 func parseTemplateData(args []*feather.Obj) (map[string]any, error) {
@@ -931,7 +1702,7 @@ func parseTemplateData(args []*feather.Obj) (map[string]any, error) {
 		dict, err := feather.AsDict(args[0])
 		if err == nil {
 			for k, v := range dict.Items {
-				data[k] = v.String()
+				data[k] = templateValue(v)
 			}
 			return data, nil
 		}
@@ -939,7 +1710,7 @@ func parseTemplateData(args []*feather.Obj) (map[string]any, error) {
 		list, err := args[0].List()
 		if err == nil && len(list)%2 == 0 {
 			for i := 0; i+1 < len(list); i += 2 {
-				data[list[i].String()] = list[i+1].String()
+				data[list[i].String()] = templateValue(list[i+1])
 			}
 			return data, nil
 		}
@@ -947,11 +1718,50 @@ func parseTemplateData(args []*feather.Obj) (map[string]any, error) {
 
 	// Key value pairs as separate arguments
 	for i := 0; i+1 < len(args); i += 2 {
-		data[args[i].String()] = args[i+1].String()
+		data[args[i].String()] = templateValue(args[i+1])
 	}
 	return data, nil
 }
 
+// templateValue converts a value for template data. Values built as dicts
+// or lists (dict create, list, lappend, ...) become map[string]any and
+// []any, recursively, so templates can range over them and reach nested
+// fields; everything else stays a string. A plain string that merely looks
+// like a list is not split.
+func templateValue(v *feather.Obj) any {
+	switch v.Type() {
+	case "dict":
+		dict, err := feather.AsDict(v)
+		if err != nil {
+			return v.String()
+		}
+		m := make(map[string]any, len(dict.Items))
+		for k, item := range dict.Items {
+			m[k] = templateValue(item)
+		}
+		return m
+	case "list":
+		items, err := v.List()
+		if err != nil {
+			return v.String()
+		}
+		l := make([]any, len(items))
+		for k, item := range items {
+			l[k] = templateValue(item)
+		}
+		return l
+	}
+	return v.String()
+}
+
+// listenerPort returns the TCP port ln is bound to, or 0
+func listenerPort(ln net.Listener) int {
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		return tcp.Port
+	}
+	return 0
+}
+
 func createHandler(state *ServerState) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Handle web REPL endpoints
@@ -963,26 +1773,154 @@ func createHandler(state *ServerState) http.Handler {
 			handleReplEval(state, w, r)
 			return
 		}
+		if strings.HasPrefix(r.URL.Path, "/_repl/session/") {
+			handleReplSession(state, w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/_repl/notebooks") {
+			handleNotebooks(state, w, r)
+			return
+		}
+		if r.URL.Path == "/_metrics" && r.Method == "GET" {
+			serveMetrics(state, w, r)
+			return
+		}
+		if r.URL.Path == "/_commands" && r.Method == "GET" && helpEndpoint.Load() {
+			serveHelp(w, r)
+			return
+		}
+		if p := pprofState.Load(); p != nil && p.listener == "" && strings.HasPrefix(r.URL.Path, "/_debug/pprof") {
+			servePprof(state, p, w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/_debug") && r.Method == "GET" {
+			handleDebug(state, w, r)
+			return
+		}
+
+		if policies := findHeaderPolicies(r.URL.Path); len(policies) > 0 {
+			w = &policyWriter{ResponseWriter: w, policies: policies}
+		}
+
+		if m := findAssetMount(r.URL.Path); m != nil && serveAsset(m, w, r) {
+			return
+		}
+
+		if m := findStaticMount(r.URL.Path); m != nil && serveStatic(state, m, w, r) {
+			return
+		}
+
+		if m := findTusMount(r.URL.Path); m != nil {
+			serveTus(state, m, w, r, state.routeEval(nil))
+			return
+		}
+
+		if m := findDAVMount(r.URL.Path); m != nil {
+			serveDAV(state, m, w, r)
+			return
+		}
+
+		if m := findProxyMount(r.URL.Path); m != nil {
+			serveProxy(state, m, w, r)
+			return
+		}
+
+		if m := findFcgiMount(r.URL.Path); m != nil && serveFcgi(m, w, r) {
+			return
+		}
+
+		if m := findDocsMount(r.URL.Path); m != nil {
+			serveDocs(state, m, w, r)
+			return
+		}
+
+		if m := findGraphQLMount(r.URL.Path); m != nil {
+			serveGraphQL(state, w, r)
+			return
+		}
 
 		routes := state.GetRoutes()
 
-		for _, route := range routes {
+		now := time.Now()
+		for k := range routes {
+			route := &routes[k]
+			if !route.Options.activeAt(now) {
+				continue
+			}
 			if matched, params := matchRoute(route, r.Method, r.URL.Path); matched {
-				ctx := &RequestContext{
-					Writer:  w,
-					Request: r,
-					Params:  params,
-					Status:  200,
+				// Shed load before queueing for the interpreter. Slots are
+				// held only while the body runs, not while a connection is held.
+				global := globalLimiter.Load()
+				if !global.tryAcquire() {
+					rejectOverloaded(w)
+					return
+				}
+				if !route.limiter.tryAcquire() {
+					global.release()
+					rejectOverloaded(w)
+					return
 				}
-				state.SetRequestContext(ctx)
 
-				_, err := state.Eval(route.Body)
-				if err != nil {
-					if !ctx.Written {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+				ctx := newRequestContext(w, r, params)
+				ctx.capture = state.debug.start(r, *route)
+				eval := state.routeEval(ctx)
+
+				if route.rate != nil {
+					key, err := route.rate.bucketKey(ctx, eval)
+					if err == nil {
+						d := route.rate.take(key)
+						d.apply(ctx)
+						if !d.allowed {
+							route.limiter.release()
+							global.release()
+							ctx.release()
+							return
+						}
+					} else {
+						logf("ratelimit %s %s: %v\n", route.Method, route.Pattern, err)
+					}
+				}
+
+				if route.Options.Auth != nil {
+					ok, err := route.Options.Auth.authenticate(ctx, eval)
+					if err != nil {
+						// Fail closed: a broken check must not let requests through
+						logf("auth %s %s: %v\n", route.Method, route.Pattern, err)
+						http.Error(w, "internal server error", http.StatusInternalServerError)
+					}
+					if !ok {
+						route.limiter.release()
+						global.release()
+						ctx.release()
+						return
 					}
 				}
 
+				start := time.Now()
+				timeout := route.Options.Timeout
+				if timeout == 0 {
+					timeout = time.Duration(handlerTimeout.Load())
+				}
+				var expiry *time.Timer
+				if timeout > 0 {
+					expiry = time.AfterFunc(timeout, func() { ctx.expire(timeout) })
+				}
+				proceed, err := runMiddlewares(ctx, eval)
+				if proceed {
+					_, err = state.EvalFor(ctx, route.Body)
+				}
+				// A timeout that fired may still be using ctx
+				reusable := expiry == nil || expiry.Stop()
+				route.limiter.release()
+				global.release()
+				took := time.Since(start)
+				if err != nil {
+					state.handlerFailed(ctx, err)
+				}
+				if ctx.capture != nil {
+					state.debug.finish(ctx.capture, ctx.Status, took, err)
+				}
+
 				// Check if this request was held as a connection
 				conn := state.findConnectionByContext(ctx)
 				if conn != nil {
@@ -997,14 +1935,21 @@ func createHandler(state *ServerState) http.Handler {
 							if handle == "" {
 								handle = conn.ID
 							}
-							state.Eval(fmt.Sprintf("%s %s", conn.OnClose, handle))
+							state.EvalFor(ctx, fmt.Sprintf("%s %s", conn.OnClose, handle))
 						}
 						// Clean up the connection
 						state.CloseConnection(conn.ID)
 					}
 				}
 
-				state.SetRequestContext(nil)
+				ctx.finishWriters()
+				// finished is set, so nothing more can be deferred
+				if deferred := ctx.deferred; len(deferred) > 0 {
+					go runDeferred(state, r.Method, r.URL.Path, deferred)
+				}
+				if reusable && !ctx.held {
+					ctx.release()
+				}
 				return
 			}
 		}
@@ -1019,6 +1964,10 @@ func handleReplEval(state *ServerState, w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		handleReplBatch(state, w, r, body)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -1040,7 +1989,7 @@ func handleReplEval(state *ServerState, w http.ResponseWriter, r *http.Request)
 	state.SetEvalContext(evalCtx)
 	defer state.SetEvalContext(nil)
 
-	result, err := state.Eval(string(body))
+	result, err := state.EvalIn(ChannelWeb, string(body))
 	if err != nil {
 		writeSSE(w, "error", err.Error())
 	} else if result.String() != "" {
@@ -1118,11 +2067,12 @@ const replHTML = `<!DOCTYPE html>
     </style>
 </head>
 <body>
-    <h1>feather REPL</h1>
+    <h1>feather REPL <a href="/_repl/notebooks" style="color: #569cd6">(notebooks)</a></h1>
     <div id="output"><div class="prompt">Type help to get help</div></div>
     <div id="input-area">
         <textarea id="input" placeholder="Enter TCL command... (Cmd+Enter to eval)" autofocus></textarea>
         <button onclick="evaluate()">Eval</button>
+        <button onclick="runSelection()" title="Run each blank-line separated block of the selection">Run selection</button>
     </div>
     <script>
         const output = document.getElementById('output');
@@ -1130,6 +2080,29 @@ const replHTML = `<!DOCTYPE html>
         const history = [];
         let historyIndex = -1;
 
+        // Shared session mode: /_repl?session=NAME&user=ME attaches to a
+        // session whose inputs and outputs are broadcast to every participant
+        const params = new URLSearchParams(location.search);
+        const session = params.get('session');
+        const user = params.get('user') || 'anon';
+        if (session) {
+            const base = '/_repl/session/' + encodeURIComponent(session);
+            const query = '?user=' + encodeURIComponent(user);
+            document.querySelector('h1').textContent = 'feather REPL - session ' + session + ' as ' + user;
+            const es = new EventSource(base + '/events' + query);
+            es.addEventListener('participants', (e) => appendLine('participants: ' + e.data, 'prompt'));
+            es.addEventListener('join', (e) => appendLine(e.data + ' joined', 'prompt'));
+            es.addEventListener('leave', (e) => appendLine(e.data + ' left', 'prompt'));
+            es.addEventListener('input', (e) => {
+                const nl = e.data.indexOf('\n');
+                appendLine(e.data.slice(0, nl) + '> ' + e.data.slice(nl + 1), 'input-line');
+            });
+            es.addEventListener('output', (e) => appendLine(e.data, 'output-line'));
+            es.addEventListener('result', (e) => appendLine(e.data, 'result-line'));
+            es.addEventListener('error', (e) => { if (e.data) appendLine('error: ' + e.data, 'error-line'); });
+            window.sessionEval = (code) => fetch(base + '/eval' + query, {method: 'POST', body: code});
+        }
+
         function appendLine(text, className) {
             const line = document.createElement('div');
             line.className = className;
@@ -1144,10 +2117,16 @@ const replHTML = `<!DOCTYPE html>
 
             history.unshift(code);
             historyIndex = -1;
-            
-            appendLine('feather> ' + code, 'input-line');
             input.value = '';
 
+            if (session) {
+                // Input and results arrive through the session stream
+                window.sessionEval(code);
+                return;
+            }
+
+            appendLine('feather> ' + code, 'input-line');
+
             try {
                 const response = await fetch('/_repl/eval', {
                     method: 'POST',
@@ -1189,6 +2168,56 @@ const replHTML = `<!DOCTYPE html>
             }
         }
 
+        // Run the selected text (or everything) as a batch: each block
+        // separated by blank lines is a statement, results are shown per block
+        async function runSelection() {
+            const text = input.value.substring(input.selectionStart, input.selectionEnd) || input.value;
+            const blocks = text.split(/\n\s*\n/).map(b => b.trim()).filter(b => b);
+            if (blocks.length === 0) return;
+
+            try {
+                const response = await fetch('/_repl/eval', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify(blocks),
+                });
+
+                const reader = response.body.getReader();
+                const decoder = new TextDecoder();
+                let buffer = '';
+                const shown = new Set();
+
+                while (true) {
+                    const {done, value} = await reader.read();
+                    if (done) break;
+
+                    buffer += decoder.decode(value, {stream: true});
+                    const chunks = buffer.split('\n\n');
+                    buffer = chunks.pop();
+
+                    for (const chunk of chunks) {
+                        const lines = chunk.split('\n');
+                        const event = (lines.find(l => l.startsWith('event: ')) || '').slice(7);
+                        const id = (lines.find(l => l.startsWith('id: ')) || '').slice(4);
+                        const data = lines.filter(l => l.startsWith('data: ')).map(l => l.slice(6)).join('\n');
+                        if (id !== '' && !shown.has(id)) {
+                            shown.add(id);
+                            appendLine('[' + id + '] feather> ' + blocks[+id], 'input-line');
+                        }
+                        if (event === 'output') {
+                            appendLine(data, 'output-line');
+                        } else if (event === 'result' && data) {
+                            appendLine(data, 'result-line');
+                        } else if (event === 'error') {
+                            appendLine('error: ' + data, 'error-line');
+                        }
+                    }
+                }
+            } catch (err) {
+                appendLine('error: ' + err.message, 'error-line');
+            }
+        }
+
         input.addEventListener('keydown', (e) => {
             if (e.key === 'Enter' && (e.metaKey || e.ctrlKey)) {
                 e.preventDefault();
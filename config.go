@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// ConfigKey is a runtime setting that scripts can read and change with the
+// config command. Features register their own keys. Values are checked
+// against Type before Set is called, so Set only sees valid input: ints
+// are non-negative, bools are normalized to 1 or 0, and enums are one of
+// Choices.
+type ConfigKey struct {
+	Name    string
+	Help    string
+	Type    string   // int, bool, duration, enum or string (default)
+	Default string   // value the key starts with, restored by config reset
+	Choices []string // allowed values of an enum
+	Get     func() string
+	Set     func(string) error
+}
+
+// Config key types
+const (
+	ConfigInt      = "int"
+	ConfigBool     = "bool"
+	ConfigDuration = "duration"
+	ConfigEnum     = "enum"
+	ConfigString   = "string"
+)
+
+// validate checks value against the key's type and returns it normalized
+func (k *ConfigKey) validate(value string) (string, error) {
+	switch k.Type {
+	case ConfigInt:
+		n, err := parseNonNegativeInt(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n), nil
+	case ConfigBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("expected boolean, got %q", value)
+		}
+		if b {
+			return "1", nil
+		}
+		return "0", nil
+	case ConfigDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return "", fmt.Errorf("expected duration such as 500ms or 30s, got %q", value)
+		}
+		return value, nil
+	case ConfigEnum:
+		for _, c := range k.Choices {
+			if value == c {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("must be %s, got %q", strings.Join(k.Choices, ", "), value)
+	}
+	return value, nil
+}
+
+// set validates and applies a value
+func (k *ConfigKey) set(value string) error {
+	v, err := k.validate(value)
+	if err != nil {
+		return err
+	}
+	return k.Set(v)
+}
+
+// describe returns the key's metadata and current value as a dict
+func (k *ConfigKey) describe(i *feather.Interp) *feather.Obj {
+	choices := make([]*feather.Obj, len(k.Choices))
+	for j, c := range k.Choices {
+		choices[j] = i.String(c)
+	}
+	return i.DictKV("name", k.Name, "type", k.Type, "value", k.Get(), "default", k.Default,
+		"choices", i.List(choices...), "help", k.Help)
+}
+
+var (
+	configMu   sync.RWMutex
+	configKeys = make(map[string]*ConfigKey)
+)
+
+// registerConfigKey makes a setting available to the config command
+func registerConfigKey(key *ConfigKey) {
+	if key.Type == "" {
+		key.Type = ConfigString
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	configKeys[key.Name] = key
+}
+
+func findConfigKey(name string) *ConfigKey {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return configKeys[name]
+}
+
+func configKeyNames() []string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	names := make([]string, 0, len(configKeys))
+	for name := range configKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func registerConfigCommand(interp *feather.Interp, state *ServerState) {
+	configCmd := &Command{
+		Name:  "config",
+		Help:  "Get or set runtime configuration",
+		Usage: "config SUBCOMMAND ?ARG ...?",
+		Long: `Every runtime setting is a typed config key with a default; config list
+shows all of them with their current values. Values are validated by type
+(int, bool, duration, enum, string) before they take effect.`,
+		Subcommands: []*Command{
+			{Name: "set", Help: "Change a setting", Usage: "config set KEY VALUE"},
+			{Name: "get", Help: "Read a setting", Usage: "config get KEY"},
+			{Name: "list", Help: "All settings and their values as a dict", Usage: "config list ?PATTERN?"},
+			{Name: "describe", Help: "Type, default, choices and help for a setting", Usage: "config describe KEY"},
+			{Name: "reset", Help: "Restore a setting to its default", Usage: "config reset KEY"},
+		},
+	}
+	registry.Register(configCmd)
+	interp.RegisterCommand("config", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"config subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "set":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"config set key value\"")
+			}
+			key := findConfigKey(args[1].String())
+			if key == nil {
+				return feather.Errorf("config set: unknown key %q (must be %s)", args[1].String(), strings.Join(configKeyNames(), ", "))
+			}
+			if err := key.set(args[2].String()); err != nil {
+				return feather.Errorf("config set %s: %v", key.Name, err)
+			}
+			return feather.OK(i.String(key.Get()))
+
+		case "get":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"config get key\"")
+			}
+			key := findConfigKey(args[1].String())
+			if key == nil {
+				return feather.Errorf("config get: unknown key %q", args[1].String())
+			}
+			return feather.OK(i.String(key.Get()))
+
+		case "list":
+			if len(args) > 2 {
+				return feather.Error("wrong # args: should be \"config list ?pattern?\"")
+			}
+			pattern := "*"
+			if len(args) == 2 {
+				pattern = args[1].String()
+			}
+			items := make([]*feather.Obj, 0)
+			for _, name := range configKeyNames() {
+				if globMatch(pattern, name) {
+					items = append(items, i.String(name), i.String(findConfigKey(name).Get()))
+				}
+			}
+			return feather.OK(i.List(items...))
+
+		case "describe":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"config describe key\"")
+			}
+			key := findConfigKey(args[1].String())
+			if key == nil {
+				return feather.Errorf("config describe: unknown key %q", args[1].String())
+			}
+			return feather.OK(key.describe(i))
+
+		case "reset":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"config reset key\"")
+			}
+			key := findConfigKey(args[1].String())
+			if key == nil {
+				return feather.Errorf("config reset: unknown key %q", args[1].String())
+			}
+			if err := key.set(key.Default); err != nil {
+				return feather.Errorf("config reset %s: %v", key.Name, err)
+			}
+			return feather.OK(i.String(key.Get()))
+
+		default:
+			return feather.Errorf("config: unknown subcommand %q (must be set, get, list, describe, reset)", subcmd)
+		}
+	})
+}
+
+// parseNonNegativeInt parses a setting that must be a non-negative integer
+func parseNonNegativeInt(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected non-negative integer, got %q", value)
+	}
+	return n, nil
+}
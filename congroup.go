@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// connGroups tracks which held connections belong to which named groups,
+// for respond -group
+type connGroups struct {
+	mu     sync.Mutex
+	groups map[string]map[*Connection]bool
+}
+
+func newConnGroups() *connGroups {
+	return &connGroups{groups: make(map[string]map[*Connection]bool)}
+}
+
+func (g *connGroups) join(conn *Connection, group string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members := g.groups[group]
+	if members == nil {
+		members = make(map[*Connection]bool)
+		g.groups[group] = members
+	}
+	members[conn] = true
+}
+
+func (g *connGroups) leave(conn *Connection, group string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members := g.groups[group]
+	if !members[conn] {
+		return false
+	}
+	delete(members, conn)
+	if len(members) == 0 {
+		delete(g.groups, group)
+	}
+	return true
+}
+
+// drop removes a closed connection from every group
+func (g *connGroups) drop(conn *Connection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, members := range g.groups {
+		delete(members, conn)
+		if len(members) == 0 {
+			delete(g.groups, name)
+		}
+	}
+}
+
+// members returns the open connections of a group, oldest first
+func (g *connGroups) members(group string) []*Connection {
+	g.mu.Lock()
+	conns := make([]*Connection, 0, len(g.groups[group]))
+	for c := range g.groups[group] {
+		conns = append(conns, c)
+	}
+	g.mu.Unlock()
+
+	open := conns[:0]
+	for _, c := range conns {
+		select {
+		case <-c.Done:
+		default:
+			open = append(open, c)
+		}
+	}
+	sort.Slice(open, func(a, b int) bool { return open[a].Opened.Before(open[b].Opened) })
+	return open
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// connKeepalivePing is the default keepalive payload: an SSE comment,
+// which EventSource clients ignore
+const connKeepalivePing = ": keepalive\n\n"
+
+// connKeepalive sends pings on a held connection that has been quiet for
+// interval, and closes it once nothing but pings has been written for idle.
+// Either may be zero.
+type connKeepalive struct {
+	interval time.Duration
+	idle     time.Duration
+	ping     []byte
+}
+
+// run watches conn until it is closed. Pings keep proxies from dropping
+// the stream; the idle timeout reaps connections nothing writes to
+// anymore, calling their onclose proc first as a client disconnect would.
+func (k *connKeepalive) run(state *ServerState, conn *Connection) {
+	tick := k.interval
+	if tick == 0 || (k.idle > 0 && k.idle < tick) {
+		tick = k.idle
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-conn.Done:
+			return
+		case now := <-t.C:
+			if k.idle > 0 && now.Sub(time.Unix(0, conn.lastActive.Load())) >= k.idle {
+				if conn.OnClose != "" {
+					if _, err := state.EvalFor(conn.Ctx, fmt.Sprintf("%s %s", conn.OnClose, conn.handle())); err != nil {
+						logf("onclose %s: %v\n", conn.handle(), err)
+					}
+				}
+				state.CloseConnection(conn.ID)
+				return
+			}
+			if k.interval > 0 && now.Sub(time.Unix(0, conn.lastWrite.Load())) >= k.interval {
+				conn.write(k.ping)
+			}
+		}
+	}
+}
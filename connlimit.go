@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connShaperQueue is how many writes a shaped connection buffers before
+// further writes are dropped
+const connShaperQueue = 256
+
+// connShaper paces writes to a held connection. Writes are queued and sent
+// by a goroutine at no more than maxRate messages and maxBytes bytes per
+// second; when the queue is full, new writes are dropped and counted.
+type connShaper struct {
+	ctx      *RequestContext
+	rate     string  // -max-rate as written, e.g. "100/s"
+	perSec   float64 // messages per second, 0 = unlimited
+	maxBytes int64   // bytes per second, 0 = unlimited
+
+	queue   chan []byte
+	stop    <-chan struct{}
+	exited  chan struct{}
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// newConnShaper starts the writer goroutine for conn. It stops once
+// conn.Done is closed, after writing what is already queued.
+func newConnShaper(conn *Connection, rate string, perSec float64, maxBytes int64) *connShaper {
+	s := &connShaper{
+		ctx:      conn.Ctx,
+		rate:     rate,
+		perSec:   perSec,
+		maxBytes: maxBytes,
+		queue:    make(chan []byte, connShaperQueue),
+		stop:     conn.Done,
+		exited:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// send queues data, reporting false if it was dropped
+func (s *connShaper) send(data []byte) bool {
+	select {
+	case s.queue <- data:
+		return true
+	default:
+		s.dropped.Add(1)
+		return false
+	}
+}
+
+// wait blocks until the writer goroutine has exited
+func (s *connShaper) wait() {
+	<-s.exited
+}
+
+func (s *connShaper) run() {
+	defer close(s.exited)
+
+	msgs := newPacer(s.perSec, math.Max(1, math.Ceil(s.perSec)))
+	bytes := newPacer(float64(s.maxBytes), float64(s.maxBytes))
+	for {
+		var data []byte
+		select {
+		case data = <-s.queue:
+		case <-s.stop:
+			s.drain()
+			return
+		}
+		if !msgs.wait(1, s.stop) || !bytes.wait(float64(len(data)), s.stop) {
+			s.write(data)
+			s.drain()
+			return
+		}
+		s.write(data)
+	}
+}
+
+// drain writes whatever is still queued without pacing, so a final
+// message sent just before the connection is closed still goes out
+func (s *connShaper) drain() {
+	for {
+		select {
+		case data := <-s.queue:
+			s.write(data)
+		default:
+			return
+		}
+	}
+}
+
+func (s *connShaper) write(data []byte) {
+	s.ctx.mu.Lock()
+	defer s.ctx.mu.Unlock()
+	s.ctx.writeHeader()
+	s.ctx.Writer.Write(data)
+	if f, ok := s.ctx.Writer.(http.Flusher); ok {
+		f.Flush()
+	}
+	s.sent.Add(1)
+}
+
+// info renders the limits and counters for connection info
+func (s *connShaper) info() string {
+	var parts []string
+	if s.perSec > 0 {
+		parts = append(parts, "max_rate "+s.rate)
+	}
+	if s.maxBytes > 0 {
+		parts = append(parts, fmt.Sprintf("max_bytes_per_sec %d", s.maxBytes))
+	}
+	parts = append(parts, fmt.Sprintf("queued %d sent %d dropped %d", len(s.queue), s.sent.Load(), s.dropped.Load()))
+	return strings.Join(parts, " ")
+}
+
+// pacer is a token bucket that waits instead of rejecting. A cost larger
+// than the bucket is allowed once it is full and leaves it in debt.
+type pacer struct {
+	rate   float64 // tokens per second, 0 = unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(rate, burst float64) *pacer {
+	return &pacer{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until cost can be spent, reporting false if stop closed first
+func (p *pacer) wait(cost float64, stop <-chan struct{}) bool {
+	if p.rate <= 0 {
+		return true
+	}
+	for {
+		now := time.Now()
+		p.tokens = math.Min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+		p.last = now
+		need := math.Min(cost, p.burst)
+		if p.tokens >= need {
+			p.tokens -= cost
+			return true
+		}
+		timer := time.NewTimer(time.Duration((need - p.tokens) / p.rate * float64(time.Second)))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// parseByteSize parses a byte count with an optional KB, MB or GB suffix
+// (powers of 1024), e.g. "1MB" or "512KB"
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	mult := int64(1)
+	upper := strings.ToUpper(num)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, u.suffix) {
+			num, mult = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 65536, 512KB or 1MB)", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTracker follows client connections through their http.ConnState
+// transitions so operators can see how many are open, idle or hijacked, and
+// enforces the idle connection limit.
+type connTracker struct {
+	mu       sync.Mutex
+	states   map[net.Conn]http.ConnState
+	hijacked uint64 // cumulative; hijacked conns leave the server's control
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{states: make(map[net.Conn]http.ConnState)}
+}
+
+// ConnStats is a snapshot of connection counts
+type ConnStats struct {
+	Open     int
+	Active   int
+	Idle     int
+	Hijacked uint64
+}
+
+// track is installed as http.Server.ConnState
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	switch state {
+	case http.StateClosed:
+		delete(t.states, c)
+	case http.StateHijacked:
+		delete(t.states, c)
+		t.hijacked++
+	default:
+		t.states[c] = state
+	}
+
+	// Close the connection going idle if that puts us over the limit, so
+	// idle keep-alive connections can't pile up under bursty load
+	closeIt := false
+	if state == http.StateIdle {
+		if max := int(maxIdleConns.Load()); max > 0 && t.countLocked(http.StateIdle) > max {
+			closeIt = true
+		}
+	}
+	t.mu.Unlock()
+
+	if closeIt {
+		c.Close()
+	}
+}
+
+func (t *connTracker) countLocked(state http.ConnState) int {
+	n := 0
+	for _, s := range t.states {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Stats returns current connection counts
+func (t *connTracker) Stats() ConnStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ConnStats{
+		Open:     len(t.states),
+		Active:   t.countLocked(http.StateActive),
+		Idle:     t.countLocked(http.StateIdle),
+		Hijacked: t.hijacked,
+	}
+}
+
+// Server connection settings. They are applied when listen creates the
+// server; keepalive also takes effect immediately on a running server.
+var (
+	maxHeaderBytes   atomic.Int64
+	keepAliveEnabled atomic.Bool
+	idleTimeout      atomic.Int64 // nanoseconds, 0 = Go default
+	maxIdleConns     atomic.Int64 // 0 = unlimited
+)
+
+// registerConnectionConfig registers the server connection settings
+func registerConnectionConfig(state *ServerState) {
+	maxHeaderBytes.Store(http.DefaultMaxHeaderBytes)
+	keepAliveEnabled.Store(true)
+
+	registerConfigKey(&ConfigKey{
+		Name:    "max_header_bytes",
+		Help:    "Maximum size of request headers in bytes (applied on listen)",
+		Type:    ConfigInt,
+		Default: strconv.Itoa(http.DefaultMaxHeaderBytes),
+		Get:     func() string { return strconv.FormatInt(maxHeaderBytes.Load(), 10) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			maxHeaderBytes.Store(int64(n))
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "keepalive",
+		Help:    "Enable HTTP keep-alive",
+		Type:    ConfigBool,
+		Default: "1",
+		Get: func() string {
+			if keepAliveEnabled.Load() {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(value string) error {
+			b := value == "1"
+			keepAliveEnabled.Store(b)
+			if state.server != nil {
+				state.server.SetKeepAlivesEnabled(b)
+			}
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "idle_timeout",
+		Help:    "How long keep-alive connections may stay idle, e.g. 90s (applied on listen; 0s = Go default)",
+		Type:    ConfigDuration,
+		Default: "0s",
+		Get:     func() string { return time.Duration(idleTimeout.Load()).String() },
+		Set: func(value string) error {
+			d, _ := time.ParseDuration(value)
+			idleTimeout.Store(int64(d))
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "max_idle_conns",
+		Help:    "Maximum idle keep-alive connections; extra ones are closed (0 = unlimited)",
+		Type:    ConfigInt,
+		Default: "0",
+		Get:     func() string { return strconv.FormatInt(maxIdleConns.Load(), 10) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			maxIdleConns.Store(int64(n))
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "drain_timeout",
+		Help:    "Grace period for in-flight requests on shutdown and restart (-drain-timeout flag)",
+		Type:    ConfigDuration,
+		Default: "30s",
+		Get:     func() string { return state.drainTimeout.String() },
+		Set: func(value string) error {
+			state.drainTimeout, _ = time.ParseDuration(value)
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name: "on_shutdown_connection",
+		Help: "Proc called with each held connection's handle on shutdown and restart, before it is closed",
+		Type: ConfigString,
+		Get:  func() string { return state.shutdownConnProc },
+		Set: func(value string) error {
+			state.shutdownConnProc = value
+			return nil
+		},
+	})
+}
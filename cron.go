@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// cronMacros are the shorthand schedules cron add accepts
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a parsed five-field cron expression, one bit per
+// allowed value of each field
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// parseCronSchedule parses "MIN HOUR DOM MONTH DOW". Fields take *, N,
+// N-M, lists of those and /STEP; day of week 7 is Sunday, as is 0.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	if m, ok := cronMacros[spec]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day month weekday) but got %d", len(fields))
+	}
+	s := &cronSchedule{domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}
+	for j, f := range []struct {
+		name     string
+		bits     *uint64
+		min, max int
+	}{
+		{"minute", &s.minute, 0, 59},
+		{"hour", &s.hour, 0, 23},
+		{"day", &s.dom, 1, 31},
+		{"month", &s.month, 1, 12},
+		{"weekday", &s.dow, 0, 7},
+	} {
+		bits, err := parseCronField(fields[j], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		*f.bits = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, st, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(st)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", st)
+			}
+			rng, step = r, n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value %q", b)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q out of range %d-%d", rng, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether the schedule fires in t's minute. As in cron,
+// when both day fields are restricted either one matching is enough.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t the schedule fires in, or the
+// zero time if it never does (such as on February 30th)
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// cronEntry is a script run by the scheduler
+type cronEntry struct {
+	id      string
+	spec    string
+	script  string
+	channel string // channel that added it, whose command policy applies
+	sched   *cronSchedule
+	last    time.Time
+}
+
+// cronTable holds the scheduled entries. They live outside the script, so
+// sourcing it again doesn't drop them, and adding an entry that is
+// already there returns the existing one instead of running it twice.
+type cronTable struct {
+	mu        sync.Mutex
+	entries   []*cronEntry
+	nextID    int
+	file      string // where entries are saved, if set
+	startOnce sync.Once
+}
+
+var crontab = &cronTable{}
+
+func (c *cronTable) add(spec, script, channel string) (*cronEntry, error) {
+	sched, err := parseCronSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.addLocked(spec, script, channel, sched)
+	return e, c.saveLocked()
+}
+
+func (c *cronTable) addLocked(spec, script, channel string, sched *cronSchedule) *cronEntry {
+	for _, e := range c.entries {
+		if e.spec == spec && e.script == script && e.channel == channel {
+			return e
+		}
+	}
+	c.nextID++
+	e := &cronEntry{id: "cron" + strconv.Itoa(c.nextID), spec: spec, script: script, channel: channel, sched: sched}
+	c.entries = append(c.entries, e)
+	return e
+}
+
+func (c *cronTable) remove(id string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for j, e := range c.entries {
+		if e.id == id {
+			c.entries = append(c.entries[:j:j], c.entries[j+1:]...)
+			return true, c.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// cronFileEntry is how an entry is saved to cron_file
+type cronFileEntry struct {
+	Spec    string `json:"spec"`
+	Script  string `json:"script"`
+	Channel string `json:"channel,omitempty"` // empty in files from before it was saved
+}
+
+// saveLocked writes the entries to the cron file, replacing it whole so a
+// crash never leaves it half written
+func (c *cronTable) saveLocked() error {
+	if c.file == "" {
+		return nil
+	}
+	saved := make([]cronFileEntry, len(c.entries))
+	for j, e := range c.entries {
+		saved[j] = cronFileEntry{Spec: e.spec, Script: e.script, Channel: e.channel}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+// setFile starts saving entries to file, first adding the ones it holds
+func (c *cronTable) setFile(file string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		var saved []cronFileEntry
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+		for _, s := range saved {
+			sched, err := parseCronSchedule(s.Spec)
+			if err != nil {
+				return fmt.Errorf("%s: %q: %v", file, s.Spec, err)
+			}
+			channel := s.Channel
+			if channel == "" {
+				channel = ChannelScript
+			} else if !slices.Contains(aclChannels, channel) {
+				return fmt.Errorf("%s: unknown channel %q", file, channel)
+			}
+			c.addLocked(s.Spec, s.Script, channel, sched)
+		}
+	}
+	c.file = file
+	return c.saveLocked()
+}
+
+// start runs the scheduler until shutdown, checking the entries at the
+// top of every minute. Entries run on the interpreter loop one after
+// another; their errors are logged.
+func (c *cronTable) start(state *ServerState) {
+	c.startOnce.Do(func() {
+		go func() {
+			for {
+				minute := time.Now().Truncate(time.Minute).Add(time.Minute)
+				wait := time.NewTimer(time.Until(minute))
+				select {
+				case <-state.shutdown:
+					wait.Stop()
+					return
+				case <-wait.C:
+				}
+				c.mu.Lock()
+				var due []*cronEntry
+				for _, e := range c.entries {
+					if e.sched.matches(minute) {
+						e.last = minute
+						due = append(due, e)
+					}
+				}
+				c.mu.Unlock()
+				if len(due) > 0 {
+					go func() {
+						for _, e := range due {
+							if _, err := state.EvalIn(e.channel, e.script); err != nil {
+								logf("%s: %v\n", e.id, err)
+							}
+						}
+					}()
+				}
+			}
+		}()
+	})
+}
+
+func registerCronCommand(interp *feather.Interp, state *ServerState) {
+	registerConfigKey(&ConfigKey{
+		Name:    "cron_file",
+		Help:    "File the cron entries are saved to and restored from on startup; empty keeps them in memory",
+		Default: "",
+		Get: func() string {
+			crontab.mu.Lock()
+			defer crontab.mu.Unlock()
+			return crontab.file
+		},
+		Set: func(value string) error {
+			if err := crontab.setFile(value); err != nil {
+				return err
+			}
+			crontab.start(state)
+			return nil
+		},
+	})
+
+	registry.Register(&Command{
+		Name:  "cron",
+		Help:  "Run scripts on a schedule",
+		Usage: "cron add|list|remove ...",
+		Long: `Schedule scripts with cron expressions, for nightly reports, cache
+warming and cleanup without an external cron calling curl. SPEC has the
+five cron fields, minute hour day month weekday, each *, N, N-M, a list
+of those or any of them with /STEP; weekday 0 or 7 is Sunday. @hourly,
+@daily, @weekly, @monthly and @yearly are shorthands. Times are local.
+
+Scripts run at the top level on the interpreter loop; errors are
+logged. They run under the command policy (see acl) of where they were
+added, so an entry added from a route can only do what the route could. Entries are kept apart from the script,
+so sourcing it again doesn't lose them, and adding the same SPEC and
+SCRIPT again returns the existing entry rather than a duplicate; an
+entry the script no longer adds stays until cron remove. Set the
+cron_file config key to also keep them across restarts.
+
+cron list returns a dict per entry with its id, spec, script, the
+channel that added it, next run and last run.
+
+Example:
+  config set cron_file cron.json
+  cron add "0 3 * * *" {send_report [db query $store "SELECT ..."]}
+  cron add "*/5 * * * *" {cache set stats [build_stats]}`,
+		Subcommands: []*Command{
+			{Name: "add", Help: "Schedule a script and return its id", Usage: "cron add SPEC SCRIPT"},
+			{Name: "list", Help: "Describe the scheduled entries", Usage: "cron list"},
+			{Name: "remove", Help: "Unschedule an entry, returning whether it existed", Usage: "cron remove ID"},
+		},
+	})
+
+	interp.RegisterCommand("cron", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"cron subcommand ?arg ...?\"")
+		}
+		switch sub := args[0].String(); sub {
+		case "add":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"cron add spec script\"")
+			}
+			e, err := crontab.add(args[1].String(), args[2].String(), state.originChannel())
+			if err != nil {
+				return feather.Errorf("cron add: %v", err)
+			}
+			crontab.start(state)
+			return feather.OK(e.id)
+		case "list":
+			if len(args) != 1 {
+				return feather.Error("wrong # args: should be \"cron list\"")
+			}
+			now := time.Now()
+			crontab.mu.Lock()
+			defer crontab.mu.Unlock()
+			items := make([]*feather.Obj, len(crontab.entries))
+			for j, e := range crontab.entries {
+				var next, last string
+				if t := e.sched.next(now); !t.IsZero() {
+					next = t.Format(time.RFC3339)
+				}
+				if !e.last.IsZero() {
+					last = e.last.Format(time.RFC3339)
+				}
+				items[j] = i.DictKV("id", e.id, "spec", e.spec, "script", e.script, "channel", e.channel, "next", next, "last", last)
+			}
+			return feather.OK(i.List(items...))
+		case "remove":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"cron remove id\"")
+			}
+			ok, err := crontab.remove(args[1].String())
+			if err != nil {
+				return feather.Errorf("cron remove: %v", err)
+			}
+			return feather.OK(ok)
+		default:
+			return feather.Errorf("cron: unknown subcommand %q (must be add, list, remove)", sub)
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// cryptoHashes maps algorithm names to constructors
+var cryptoHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// cryptoEncode renders digest bytes as -hex (default), -base64 or -base64url
+func cryptoEncode(b []byte, enc string) (string, bool) {
+	switch enc {
+	case "", "-hex":
+		return hex.EncodeToString(b), true
+	case "-base64":
+		return base64.StdEncoding.EncodeToString(b), true
+	case "-base64url":
+		return base64.RawURLEncoding.EncodeToString(b), true
+	}
+	return "", false
+}
+
+// cryptoAEAD returns AES-256-GCM keyed by the SHA-256 of key, so any
+// secret string can be used. Use a long random key (crypto random 32).
+func cryptoAEAD(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptoEncrypt seals data with a random nonce and returns
+// base64url(nonce || ciphertext || tag)
+func cryptoEncrypt(key, data, aad string) (string, error) {
+	aead, err := cryptoAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(data), []byte(aad))), nil
+}
+
+var errDecrypt = errors.New("decryption failed (wrong key or tampered data)")
+
+func cryptoDecrypt(key, data, aad string) (string, error) {
+	aead, err := cryptoAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+	if err != nil || len(raw) < aead.NonceSize()+aead.Overhead() {
+		return "", errDecrypt
+	}
+	nonce, sealed := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(aad))
+	if err != nil {
+		return "", errDecrypt
+	}
+	return string(plain), nil
+}
+
+func registerCryptoCommand(interp *feather.Interp, state *ServerState) {
+	cryptoCmd := &Command{
+		Name:  "crypto",
+		Help:  "Hashes, HMAC, encryption and secure random bytes",
+		Usage: "crypto SUBCOMMAND ?ARG ...?",
+		Long: `Output is lowercase hex unless -base64 or -base64url is given. Data is
+hashed as its UTF-8 bytes.
+
+encrypt uses AES-256-GCM with a random nonce and returns URL-safe base64,
+so the result can go in a cookie or a file as is. Any tampering makes
+decrypt fail. -aad binds the ciphertext to extra data (e.g. a user ID)
+that must match on decrypt but isn't stored in it.
+
+Example (verifying a GitHub webhook):
+  set sig "sha256=[crypto hmac -sha256 $secret [request body]]"
+  if {![auth equal $sig [request header X-Hub-Signature-256]]} {
+      respond 401 "bad signature"
+  }`,
+		Subcommands: []*Command{
+			{Name: "md5", Help: "MD5 digest (not for security)", Usage: "crypto md5 DATA ?-hex|-base64|-base64url?"},
+			{Name: "sha1", Help: "SHA-1 digest", Usage: "crypto sha1 DATA ?-hex|-base64|-base64url?"},
+			{Name: "sha256", Help: "SHA-256 digest", Usage: "crypto sha256 DATA ?-hex|-base64|-base64url?"},
+			{Name: "sha512", Help: "SHA-512 digest", Usage: "crypto sha512 DATA ?-hex|-base64|-base64url?"},
+			{Name: "hmac", Help: "HMAC of DATA with KEY", Usage: "crypto hmac ?-sha256|-sha1|-sha512|-md5? KEY DATA ?-hex|-base64|-base64url?"},
+			{Name: "random", Help: "N cryptographically secure random bytes", Usage: "crypto random N ?-hex|-base64|-base64url?"},
+			{Name: "encrypt", Help: "Encrypt DATA with AES-GCM", Usage: "crypto encrypt -key KEY ?-aad DATA? DATA"},
+			{Name: "decrypt", Help: "Decrypt the result of crypto encrypt", Usage: "crypto decrypt -key KEY ?-aad DATA? DATA"},
+		},
+	}
+	registry.Register(cryptoCmd)
+	interp.RegisterCommand("crypto", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"crypto subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "md5", "sha1", "sha256", "sha512":
+			if len(args) != 2 && len(args) != 3 {
+				return feather.Errorf("wrong # args: should be \"crypto %s data ?-hex|-base64|-base64url?\"", subcmd)
+			}
+			var enc string
+			if len(args) == 3 {
+				enc = args[2].String()
+			}
+			h := cryptoHashes[subcmd]()
+			h.Write([]byte(args[1].String()))
+			out, ok := cryptoEncode(h.Sum(nil), enc)
+			if !ok {
+				return feather.Errorf("crypto %s: unknown encoding %q (must be -hex, -base64, -base64url)", subcmd, enc)
+			}
+			return feather.OK(i.String(out))
+		case "hmac":
+			rest := args[1:]
+			alg := "sha256"
+			if len(rest) > 0 {
+				if name, ok := strings.CutPrefix(rest[0].String(), "-"); ok {
+					if _, known := cryptoHashes[name]; !known {
+						return feather.Errorf("crypto hmac: unknown algorithm %q (must be -sha256, -sha1, -sha512, -md5)", rest[0].String())
+					}
+					alg = name
+					rest = rest[1:]
+				}
+			}
+			if len(rest) != 2 && len(rest) != 3 {
+				return feather.Error("wrong # args: should be \"crypto hmac ?-sha256|-sha1|-sha512|-md5? key data ?-hex|-base64|-base64url?\"")
+			}
+			var enc string
+			if len(rest) == 3 {
+				enc = rest[2].String()
+			}
+			mac := hmac.New(cryptoHashes[alg], []byte(rest[0].String()))
+			mac.Write([]byte(rest[1].String()))
+			out, ok := cryptoEncode(mac.Sum(nil), enc)
+			if !ok {
+				return feather.Errorf("crypto hmac: unknown encoding %q (must be -hex, -base64, -base64url)", enc)
+			}
+			return feather.OK(i.String(out))
+		case "random":
+			if len(args) != 2 && len(args) != 3 {
+				return feather.Error("wrong # args: should be \"crypto random n ?-hex|-base64|-base64url?\"")
+			}
+			n, err := strconv.Atoi(args[1].String())
+			if err != nil || n < 1 || n > 1<<16 {
+				return feather.Errorf("crypto random: count must be an integer between 1 and 65536, got %q", args[1].String())
+			}
+			var enc string
+			if len(args) == 3 {
+				enc = args[2].String()
+			}
+			buf := make([]byte, n)
+			if _, err := rand.Read(buf); err != nil {
+				return feather.Errorf("crypto random: %v", err)
+			}
+			out, ok := cryptoEncode(buf, enc)
+			if !ok {
+				return feather.Errorf("crypto random: unknown encoding %q (must be -hex, -base64, -base64url)", enc)
+			}
+			return feather.OK(i.String(out))
+		case "encrypt", "decrypt":
+			if len(args) != 4 && len(args) != 6 {
+				return feather.Errorf("wrong # args: should be \"crypto %s -key key ?-aad data? data\"", subcmd)
+			}
+			var key, aad string
+			haveKey := false
+			for j := 1; j < len(args)-1; j += 2 {
+				switch args[j].String() {
+				case "-key":
+					key, haveKey = args[j+1].String(), true
+				case "-aad":
+					aad = args[j+1].String()
+				default:
+					return feather.Errorf("crypto %s: unknown option %q (must be -key, -aad)", subcmd, args[j].String())
+				}
+			}
+			if !haveKey || key == "" {
+				return feather.Errorf("crypto %s: missing -key", subcmd)
+			}
+			data := args[len(args)-1].String()
+			var out string
+			var err error
+			if subcmd == "encrypt" {
+				out, err = cryptoEncrypt(key, data, aad)
+			} else {
+				out, err = cryptoDecrypt(key, data, aad)
+			}
+			if err != nil {
+				return feather.Errorf("crypto %s: %v", subcmd, err)
+			}
+			return feather.OK(i.String(out))
+		default:
+			return feather.Errorf("crypto: unknown subcommand %q (must be md5, sha1, sha256, sha512, hmac, random, encrypt, decrypt)", subcmd)
+		}
+	})
+}
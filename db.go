@@ -0,0 +1,539 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dbDrivers maps the names db open accepts to database/sql driver names
+var dbDrivers = map[string]string{"sqlite": "sqlite3", "postgres": "postgres", "mysql": "mysql"}
+
+// dbHandle is a database opened by db open
+type dbHandle struct {
+	driver string
+	db     *sql.DB
+	tx     *sql.Tx         // the transaction db tx is running, nil outside one
+	stmts  map[string]bool // statements prepared on the handle, closed with it
+
+	// pool settings, as last given to db pool
+	maxOpen  int
+	maxIdle  int
+	lifetime time.Duration
+	idleTime time.Duration
+}
+
+// dbStmt is a statement prepared by db prepare
+type dbStmt struct {
+	h     *dbHandle
+	stmt  *sql.Stmt
+	names []string // placeholder names in order, "" for ?
+}
+
+// dbConn is what queries run on: the database, or the open transaction
+type dbConn interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (h *dbHandle) conn() dbConn {
+	if h.tx != nil {
+		return h.tx
+	}
+	return h.db
+}
+
+var (
+	dbHandlesMu sync.Mutex
+	dbHandles   = make(map[string]*dbHandle)
+	dbStmts     = make(map[string]*dbStmt)
+	dbNextID    int
+)
+
+func getDBHandle(name string) (*dbHandle, bool) {
+	dbHandlesMu.Lock()
+	defer dbHandlesMu.Unlock()
+	h, ok := dbHandles[name]
+	return h, ok
+}
+
+func getDBStmt(name string) (*dbStmt, bool) {
+	dbHandlesMu.Lock()
+	defer dbHandlesMu.Unlock()
+	st, ok := dbStmts[name]
+	return st, ok
+}
+
+// dbBind rewrites the ? and :name placeholders in query to the driver's
+// own style ($1, $2... for postgres) and returns the placeholder names in
+// order, "" for each ?. Quoted strings and identifiers, comments and
+// postgres :: casts are left alone.
+func dbBind(driver, query string) (string, []string) {
+	var b strings.Builder
+	var names []string
+	placeholder := func(name string) {
+		names = append(names, name)
+		if driver == "postgres" {
+			b.WriteString("$" + strconv.Itoa(len(names)))
+		} else {
+			b.WriteByte('?')
+		}
+	}
+	isName := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+	for j := 0; j < len(query); j++ {
+		c := query[j]
+		var next byte
+		if j+1 < len(query) {
+			next = query[j+1]
+		}
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(query[j+1:], c)
+			if end < 0 {
+				end = len(query) - j - 1
+			}
+			b.WriteString(query[j : j+end+2])
+			j += end + 1
+		case c == '-' && next == '-':
+			end := strings.IndexByte(query[j:], '\n')
+			if end < 0 {
+				end = len(query) - j
+			}
+			b.WriteString(query[j : j+end])
+			j += end - 1
+		case c == '/' && next == '*':
+			end := strings.Index(query[j+2:], "*/")
+			if end < 0 {
+				end = len(query) - j - 2
+			} else {
+				end += 2
+			}
+			b.WriteString(query[j : j+end+2])
+			j += end + 1
+		case c == ':' && next == ':':
+			b.WriteString("::")
+			j++
+		case c == ':' && isName(next) && !(next >= '0' && next <= '9'):
+			k := j + 1
+			for k < len(query) && isName(query[k]) {
+				k++
+			}
+			placeholder(query[j+1 : k])
+			j = k - 1
+		case c == '?':
+			placeholder("")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), names
+}
+
+// dbValueObj converts a scanned column: numbers stay numbers, text and
+// blobs become strings, NULL becomes the empty string
+func dbValueObj(i *feather.Interp, v any) *feather.Obj {
+	switch v := v.(type) {
+	case nil:
+		return i.String("")
+	case int64:
+		return i.Int(v)
+	case float64:
+		return i.Float(v)
+	case bool:
+		return i.Bool(v)
+	case []byte:
+		return i.String(string(v))
+	case string:
+		return i.String(v)
+	case time.Time:
+		return i.String(v.Format(time.RFC3339Nano))
+	}
+	return i.String(fmt.Sprint(v))
+}
+
+// dbParams turns PARAMS into driver arguments for the placeholders in
+// names: a list for ? placeholders, a dict for :name ones
+func dbParams(i *feather.Interp, names []string, params string) ([]any, error) {
+	named := 0
+	for _, n := range names {
+		if n != "" {
+			named++
+		}
+	}
+	vals := make([]any, len(names))
+	switch {
+	case named == 0:
+		items, err := i.ParseList(params)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) != len(names) {
+			return nil, fmt.Errorf("expected %d values, got %d", len(names), len(items))
+		}
+		for j, item := range items {
+			vals[j] = item.String()
+		}
+	case named == len(names):
+		d, err := i.ParseDict(params)
+		if err != nil {
+			return nil, err
+		}
+		for j, n := range names {
+			v, ok := d.Items[n]
+			if !ok {
+				return nil, fmt.Errorf("no value for :%s", n)
+			}
+			vals[j] = v.String()
+		}
+	default:
+		return nil, errors.New("can't mix ? and :name placeholders")
+	}
+	return vals, nil
+}
+
+// dbRows reads all rows as a list of dicts keyed by column name
+func dbRows(i *feather.Interp, rows *sql.Rows) (*feather.Obj, error) {
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for j := range vals {
+		ptrs[j] = &vals[j]
+	}
+	var out []*feather.Obj
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		kvs := make([]any, 0, 2*len(cols))
+		for j, c := range cols {
+			kvs = append(kvs, c, dbValueObj(i, vals[j]))
+		}
+		out = append(out, i.DictKV(kvs...))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return i.List(out...), nil
+}
+
+func registerDBCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "db",
+		Help:  "Query an SQL database",
+		Usage: "db open|query|exec|prepare|tx|pool|close ...",
+		Long: `Open a database and run SQL against it. db open returns a handle for the
+other subcommands. The drivers are sqlite, postgres and mysql. SQLite
+needs no server: FILE is created if missing, and :memory: gives a
+private in-memory database. For postgres the DSN is a postgres:// URL or
+"host=... dbname=..." settings; for mysql it is
+USER:PASSWORD@tcp(HOST:PORT)/DBNAME.
+
+db query returns the rows as a list of dicts keyed by column name. db
+exec runs a statement that returns no rows and gives a dict with rows
+(the number changed) and, where the driver reports it, id (the last
+inserted id; use RETURNING with db query on postgres). NULL reads as the
+empty string.
+
+Values are never spliced into the SQL text. Write ? for each value and
+give PARAMS as a list, or :name and give PARAMS as a dict. Both are
+turned into the driver's own placeholders, so the same SQL runs on
+every driver; placeholders inside quotes and comments are left alone.
+
+db prepare parses SQL once and returns a statement handle, used in place
+of HANDLE and SQL: db query STMT ?PARAMS?. Statements are closed with
+db close or with their database.
+
+db tx runs BODY in a transaction: queries on the handle inside BODY are
+part of it, which commits when BODY finishes and rolls back if it
+fails. It returns BODY's result.
+
+db pool sets how many connections a handle keeps and returns its
+settings and current use. A SQLite handle starts with a single
+connection, so writes from different requests never contend for the
+file lock. Each call blocks the interpreter until the database answers.
+
+Example:
+  set db [db open postgres postgres://app@localhost/app?sslmode=disable]
+  db pool $db -max-open 10 -max-idle 5 -lifetime 30m
+  db tx $db {
+      db exec $db {INSERT INTO users (name, email) VALUES (:name, :email)} \
+          [dict create name alice email alice@example.com]
+  }
+  set byName [db prepare $db {SELECT id, name FROM users WHERE name = ?}]
+  foreach u [db query $byName [list alice]] {
+      puts [dict get $u id]
+  }`,
+		Subcommands: []*Command{
+			{Name: "open", Help: "Open a database and return a handle", Usage: "db open sqlite|postgres|mysql DSN"},
+			{Name: "query", Help: "Run a query and return its rows as dicts", Usage: "db query HANDLE SQL ?PARAMS? | db query STMT ?PARAMS?"},
+			{Name: "exec", Help: "Run a statement and return the rows changed and last id", Usage: "db exec HANDLE SQL ?PARAMS? | db exec STMT ?PARAMS?"},
+			{Name: "prepare", Help: "Prepare SQL and return a statement handle", Usage: "db prepare HANDLE SQL"},
+			{Name: "tx", Help: "Run a script in a transaction", Usage: "db tx HANDLE BODY"},
+			{Name: "pool", Help: "Set and show connection pool settings", Usage: "db pool HANDLE ?-max-open N? ?-max-idle N? ?-lifetime DURATION? ?-idle-time DURATION?"},
+			{Name: "close", Help: "Close a database or statement handle", Usage: "db close HANDLE|STMT"},
+		},
+	})
+
+	interp.RegisterCommand("db", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 {
+			return feather.Error("wrong # args: should be \"db subcommand ?arg ...?\"")
+		}
+		sub := args[0].String()
+		if sub == "open" {
+			return dbOpen(args[1:])
+		}
+		switch sub {
+		case "query", "exec", "prepare", "tx", "pool", "close":
+		default:
+			return feather.Errorf("db: unknown subcommand %q (must be open, query, exec, prepare, tx, pool, close)", sub)
+		}
+		name := args[1].String()
+
+		// A statement handle stands in for HANDLE and SQL
+		if st, ok := getDBStmt(name); ok {
+			switch sub {
+			case "query", "exec":
+				if len(args) != 2 && len(args) != 3 {
+					return feather.Errorf("wrong # args: should be \"db %s stmt ?params?\"", sub)
+				}
+				params := ""
+				if len(args) == 3 {
+					params = args[2].String()
+				}
+				stmt := st.stmt
+				if st.h.tx != nil {
+					stmt = st.h.tx.Stmt(stmt)
+					defer stmt.Close()
+				}
+				return dbRun(i, sub, stmt, st.names, params)
+			case "close":
+				if len(args) != 2 {
+					return feather.Error("wrong # args: should be \"db close stmt\"")
+				}
+				dbHandlesMu.Lock()
+				delete(dbStmts, name)
+				delete(st.h.stmts, name)
+				dbHandlesMu.Unlock()
+				st.stmt.Close()
+				return feather.OK("")
+			}
+			return feather.Errorf("db %s: %s is a statement, not a database handle", sub, name)
+		}
+
+		h, ok := getDBHandle(name)
+		if !ok {
+			return feather.Errorf("db %s: unknown handle %q", sub, name)
+		}
+
+		switch sub {
+		case "query", "exec":
+			if len(args) != 3 && len(args) != 4 {
+				return feather.Errorf("wrong # args: should be \"db %s handle sql ?params?\"", sub)
+			}
+			params := ""
+			if len(args) == 4 {
+				params = args[3].String()
+			}
+			query, names := dbBind(h.driver, args[2].String())
+			return dbRun(i, sub, dbQuery{h.conn(), query}, names, params)
+		case "prepare":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"db prepare handle sql\"")
+			}
+			query, names := dbBind(h.driver, args[2].String())
+			stmt, err := h.db.Prepare(query)
+			if err != nil {
+				return feather.Errorf("db prepare: %v", err)
+			}
+			dbHandlesMu.Lock()
+			dbNextID++
+			sname := "stmt" + strconv.Itoa(dbNextID)
+			dbStmts[sname] = &dbStmt{h: h, stmt: stmt, names: names}
+			h.stmts[sname] = true
+			dbHandlesMu.Unlock()
+			return feather.OK(sname)
+		case "tx":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"db tx handle body\"")
+			}
+			if h.tx != nil {
+				return feather.Errorf("db tx: %s is already in a transaction", name)
+			}
+			tx, err := h.db.Begin()
+			if err != nil {
+				return feather.Errorf("db tx: %v", err)
+			}
+			h.tx = tx
+			res, err := i.Eval(args[2].String())
+			h.tx = nil
+			if err != nil {
+				tx.Rollback()
+				return feather.Errorf("db tx: rolled back: %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				return feather.Errorf("db tx: %v", err)
+			}
+			return feather.OK(res)
+		case "pool":
+			return dbPool(i, h, args[2:])
+		default: // close
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"db close handle\"")
+			}
+			if h.tx != nil {
+				return feather.Errorf("db close: %s is in a transaction", name)
+			}
+			dbHandlesMu.Lock()
+			delete(dbHandles, name)
+			for sname := range h.stmts {
+				dbStmts[sname].stmt.Close()
+				delete(dbStmts, sname)
+			}
+			dbHandlesMu.Unlock()
+			if err := h.db.Close(); err != nil {
+				return feather.Errorf("db close: %v", err)
+			}
+			return feather.OK("")
+		}
+	})
+}
+
+// dbRunner is a prepared statement, or SQL waiting to run on a connection
+type dbRunner interface {
+	Query(args ...any) (*sql.Rows, error)
+	Exec(args ...any) (sql.Result, error)
+}
+
+type dbQuery struct {
+	conn  dbConn
+	query string
+}
+
+func (q dbQuery) Query(args ...any) (*sql.Rows, error) { return q.conn.Query(q.query, args...) }
+func (q dbQuery) Exec(args ...any) (sql.Result, error) { return q.conn.Exec(q.query, args...) }
+
+// dbRun binds params and runs a query or exec, returning its result
+func dbRun(i *feather.Interp, sub string, r dbRunner, names []string, params string) feather.Result {
+	vals, err := dbParams(i, names, params)
+	if err != nil {
+		return feather.Errorf("db %s: params: %v", sub, err)
+	}
+	if sub == "query" {
+		rows, err := r.Query(vals...)
+		if err != nil {
+			return feather.Errorf("db query: %v", err)
+		}
+		list, err := dbRows(i, rows)
+		if err != nil {
+			return feather.Errorf("db query: %v", err)
+		}
+		return feather.OK(list)
+	}
+	res, err := r.Exec(vals...)
+	if err != nil {
+		return feather.Errorf("db exec: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	if id, err := res.LastInsertId(); err == nil {
+		return feather.OK(i.DictKV("rows", n, "id", id))
+	}
+	return feather.OK(i.DictKV("rows", n))
+}
+
+// dbPool applies db pool options and returns the settings and pool use
+func dbPool(i *feather.Interp, h *dbHandle, args []*feather.Obj) feather.Result {
+	if len(args)%2 != 0 {
+		return feather.Error("wrong # args: should be \"db pool handle ?-option value ...?\"")
+	}
+	for j := 0; j < len(args); j += 2 {
+		opt, val := args[j].String(), args[j+1].String()
+		switch opt {
+		case "-max-open", "-max-idle":
+			n, err := parseNonNegativeInt(val)
+			if err != nil {
+				return feather.Errorf("db pool: %s: %v", opt, err)
+			}
+			if opt == "-max-open" {
+				h.maxOpen = n
+				h.db.SetMaxOpenConns(n)
+			} else {
+				h.maxIdle = n
+				h.db.SetMaxIdleConns(n)
+			}
+		case "-lifetime", "-idle-time":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return feather.Errorf("db pool: invalid %s %q", opt[1:], val)
+			}
+			if opt == "-lifetime" {
+				h.lifetime = d
+				h.db.SetConnMaxLifetime(d)
+			} else {
+				h.idleTime = d
+				h.db.SetConnMaxIdleTime(d)
+			}
+		default:
+			return feather.Errorf("db pool: unknown option %q (must be -max-open, -max-idle, -lifetime, -idle-time)", opt)
+		}
+	}
+	st := h.db.Stats()
+	return feather.OK(i.DictKV(
+		"max-open", h.maxOpen,
+		"max-idle", h.maxIdle,
+		"lifetime", h.lifetime.String(),
+		"idle-time", h.idleTime.String(),
+		"open", st.OpenConnections,
+		"in-use", st.InUse,
+		"idle", st.Idle,
+		"waits", st.WaitCount,
+	))
+}
+
+func dbOpen(args []*feather.Obj) feather.Result {
+	if len(args) != 2 {
+		return feather.Error("wrong # args: should be \"db open driver dsn\"")
+	}
+	driver, dsn := args[0].String(), args[1].String()
+	name, ok := dbDrivers[driver]
+	if !ok {
+		return feather.Errorf("db open: unknown driver %q (must be sqlite, postgres, mysql)", driver)
+	}
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return feather.Errorf("db open: %v", err)
+	}
+	// database/sql keeps 2 idle connections and no other limits by default
+	h := &dbHandle{driver: driver, db: db, stmts: make(map[string]bool), maxIdle: 2}
+	if driver == "sqlite" {
+		// One connection: writes never hit "database is locked" from our
+		// own pool, and :memory: stays one database
+		h.maxOpen = 1
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return feather.Errorf("db open: %v", err)
+	}
+
+	dbHandlesMu.Lock()
+	dbNextID++
+	hname := "db" + strconv.Itoa(dbNextID)
+	dbHandles[hname] = h
+	dbHandlesMu.Unlock()
+	return feather.OK(hname)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+const (
+	maxCaptures       = 100  // captured requests kept, oldest dropped first
+	maxCaptureSteps   = 1000 // steps recorded per request
+	maxCaptureValue   = 1024 // bytes kept per argument or result
+	captureTruncation = "..."
+)
+
+// captureStep is one host command call made while a captured request ran
+type captureStep struct {
+	Index    int      `json:"index"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Result   string   `json:"result"`
+	Error    bool     `json:"error,omitempty"`
+	Micros   int64    `json:"micros"`
+	Returned bool     `json:"returned,omitempty"` // stopped the route body
+}
+
+// requestCapture is the step-by-step record of one sampled request. It is
+// written only by the interpreter goroutine while the request runs and is
+// read-only once added to the capture list.
+type requestCapture struct {
+	ID        int64         `json:"id"`
+	Time      time.Time     `json:"time"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Route     string        `json:"route"`
+	Status    int           `json:"status"`
+	Micros    int64         `json:"micros"`
+	Error     string        `json:"error,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Steps     []captureStep `json:"steps"`
+}
+
+func (c *requestCapture) record(i *feather.InternalInterp, name string, args []feather.FeatherObj, res feather.FeatherResult, took time.Duration) {
+	if len(c.Steps) >= maxCaptureSteps {
+		c.Truncated = true
+		return
+	}
+	step := captureStep{
+		Index:    len(c.Steps),
+		Command:  name,
+		Args:     make([]string, len(args)),
+		Result:   truncateCapture(i.Result()),
+		Error:    res == feather.ResultError,
+		Returned: res == feather.ResultReturn,
+		Micros:   took.Microseconds(),
+	}
+	for j, a := range args {
+		step.Args[j] = truncateCapture(i.GetString(a))
+	}
+	c.Steps = append(c.Steps, step)
+}
+
+func truncateCapture(s string) string {
+	if len(s) <= maxCaptureValue {
+		return s
+	}
+	return s[:maxCaptureValue] + captureTruncation
+}
+
+// debugCapture decides which requests to capture and keeps the results
+type debugCapture struct {
+	mu       sync.Mutex
+	enabled  bool
+	sample   float64 // fraction of requests captured
+	nextID   int64
+	captures []*requestCapture // oldest first
+}
+
+func newDebugCapture() *debugCapture {
+	return &debugCapture{sample: 1}
+}
+
+// start returns a capture for the request if capturing is on and the
+// request is sampled, nil otherwise
+func (d *debugCapture) start(r *http.Request, route Route) *requestCapture {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.enabled || (d.sample < 1 && rand.Float64() >= d.sample) {
+		return nil
+	}
+	d.nextID++
+	return &requestCapture{
+		ID:     d.nextID,
+		Time:   time.Now(),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Route:  route.Method + " " + route.Pattern,
+	}
+}
+
+// finish completes a capture and adds it to the list
+func (d *debugCapture) finish(c *requestCapture, status int, took time.Duration, err error) {
+	c.Status = status
+	c.Micros = took.Microseconds()
+	if err != nil {
+		c.Error = err.Error()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.captures) >= maxCaptures {
+		d.captures = d.captures[1:]
+	}
+	d.captures = append(d.captures, c)
+}
+
+func (d *debugCapture) list() []*requestCapture {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*requestCapture(nil), d.captures...)
+}
+
+func (d *debugCapture) find(id int64) *requestCapture {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.captures {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// captureSummary is the list view of a capture, without its steps
+type captureSummary struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Route  string    `json:"route"`
+	Status int       `json:"status"`
+	Micros int64     `json:"micros"`
+	Steps  int       `json:"steps"`
+	Error  bool      `json:"error,omitempty"`
+}
+
+func (c *requestCapture) summary() captureSummary {
+	return captureSummary{
+		ID: c.ID, Time: c.Time, Method: c.Method, Path: c.Path, Route: c.Route,
+		Status: c.Status, Micros: c.Micros, Steps: len(c.Steps), Error: c.Error != "",
+	}
+}
+
+// handleDebug serves the capture viewer at /_debug and its JSON API at
+// /_debug/captures and /_debug/captures/ID
+func handleDebug(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_debug"), "/")
+	switch {
+	case rest == "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(debugHTML))
+	case rest == "captures":
+		captures := state.debug.list()
+		summaries := make([]captureSummary, len(captures))
+		for j, c := range captures {
+			summaries[len(captures)-1-j] = c.summary() // newest first
+		}
+		writeJSON(w, summaries)
+	case strings.HasPrefix(rest, "captures/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(rest, "captures/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid capture id", http.StatusBadRequest)
+			return
+		}
+		c := state.debug.find(id)
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, c)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func registerDebugCommand(interp *feather.Interp, state *ServerState) {
+	debugCmd := &Command{
+		Name:  "debug",
+		Help:  "Capture step-by-step traces of route executions and profile the server",
+		Usage: "debug SUBCOMMAND ?ARG ...?",
+		Long: `While capture is on, sampled requests record every host command the
+route body calls (respond, header, session, json, ...) with its arguments
+and result. Tcl builtins such as set and if are not recorded. The last
+100 captures can be stepped through at /_debug.
+
+debug pprof on serves the net/http/pprof CPU, heap, goroutine, trace
+and other profiles, for when the interpreter loop backs up. They are
+under /_debug/pprof/ on the main listener, where -auth (as for route,
+e.g. {basic -check checkAdmin}) is required. With -listener ADDR they
+are instead served at /debug/pprof/ on a listener of their own; -auth
+is optional only if it is a loopback address, such as 127.0.0.1:6060
+or localhost:6060, and required for any other (:6060 listens on every
+interface). The check proc runs on the interpreter, so when the loop is
+stuck only a loopback -listener without -auth still answers.
+
+Example:
+  debug capture on -sample 0.05
+  debug pprof on -listener 127.0.0.1:6060
+  # go tool pprof http://127.0.0.1:6060/debug/pprof/profile?seconds=10`,
+		Subcommands: []*Command{
+			{Name: "capture", Help: "Turn capturing on or off, or show its state", Usage: "debug capture ?on ?-sample FRACTION?|off?"},
+			{Name: "captures", Help: "List captured requests as dicts", Usage: "debug captures"},
+			{Name: "trace", Help: "Get the steps of a capture as a list of dicts", Usage: "debug trace ID"},
+			{Name: "clear", Help: "Drop all captures", Usage: "debug clear"},
+			{Name: "pprof", Help: "Serve Go profiling endpoints, or show their state", Usage: "debug pprof ?on ?-auth SPEC? ?-listener ADDR?|off?"},
+		},
+	}
+	registry.Register(debugCmd)
+	interp.RegisterCommand("debug", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"debug subcommand ?arg ...?\"")
+		}
+		d := state.debug
+		subcmd := args[0].String()
+		switch subcmd {
+		case "capture":
+			if len(args) == 1 {
+				d.mu.Lock()
+				defer d.mu.Unlock()
+				return feather.OK(i.DictKV("enabled", d.enabled, "sample", d.sample))
+			}
+			switch args[1].String() {
+			case "on":
+				sample := 1.0
+				if len(args) == 4 && args[2].String() == "-sample" {
+					f, err := strconv.ParseFloat(args[3].String(), 64)
+					if err != nil || f <= 0 || f > 1 {
+						return feather.Errorf("debug capture: -sample expects a fraction in (0, 1], got %q", args[3].String())
+					}
+					sample = f
+				} else if len(args) != 2 {
+					return feather.Error("wrong # args: should be \"debug capture on ?-sample fraction?\"")
+				}
+				d.mu.Lock()
+				d.enabled, d.sample = true, sample
+				d.mu.Unlock()
+				return feather.OK("")
+			case "off":
+				d.mu.Lock()
+				d.enabled = false
+				d.mu.Unlock()
+				return feather.OK("")
+			default:
+				return feather.Errorf("debug capture: expected on or off, got %q", args[1].String())
+			}
+		case "captures":
+			captures := d.list()
+			items := make([]*feather.Obj, len(captures))
+			for j, c := range captures {
+				items[j] = i.DictKV("id", c.ID, "method", c.Method, "path", c.Path,
+					"status", c.Status, "micros", c.Micros, "steps", len(c.Steps))
+			}
+			return feather.OK(i.List(items...))
+		case "trace":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"debug trace id\"")
+			}
+			id, err := args[1].Int()
+			if err != nil {
+				return feather.Errorf("debug trace: expected integer, got %s", args[1].String())
+			}
+			c := d.find(id)
+			if c == nil {
+				return feather.Errorf("debug trace: no capture %d", id)
+			}
+			steps := make([]*feather.Obj, len(c.Steps))
+			for j, s := range c.Steps {
+				steps[j] = i.DictKV("command", s.Command, "args", i.ListFrom(s.Args),
+					"result", s.Result, "error", s.Error, "micros", s.Micros)
+			}
+			return feather.OK(i.List(steps...))
+		case "clear":
+			d.mu.Lock()
+			d.captures = nil
+			d.mu.Unlock()
+			return feather.OK("")
+		case "pprof":
+			return debugPprofCommand(i, state, args[1:])
+		default:
+			return feather.Errorf("debug: unknown subcommand %q (must be capture, captures, trace, clear, pprof)", subcmd)
+		}
+	})
+}
+
+const debugHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>feather debug</title>
+    <style>
+        * { box-sizing: border-box; }
+        body {
+            font-family: ui-monospace, monospace;
+            margin: 0; padding: 1rem;
+            background: #1e1e1e; color: #d4d4d4;
+        }
+        h1 { margin: 0 0 1rem 0; font-size: 1.2rem; color: #569cd6; }
+        a { color: #569cd6; }
+        #layout { display: flex; gap: 1rem; }
+        #list { width: 24rem; flex-shrink: 0; }
+        #detail { flex: 1; min-width: 0; }
+        .capture { padding: 0.3rem 0.5rem; cursor: pointer; border-radius: 4px; }
+        .capture:hover, .capture.selected { background: #252526; }
+        .status-err { color: #f14c4c; }
+        .step { background: #252526; border-radius: 4px; padding: 0.5rem; margin-bottom: 0.5rem; opacity: 0.5; }
+        .step.current { opacity: 1; outline: 1px solid #569cd6; }
+        .cmd { color: #dcdcaa; }
+        .result { color: #4ec9b0; white-space: pre-wrap; }
+        .error { color: #f14c4c; white-space: pre-wrap; }
+        .meta { color: #808080; }
+        #bar { display: flex; gap: 0.5rem; margin-bottom: 0.75rem; align-items: center; }
+        button {
+            padding: 0.4rem 0.8rem;
+            background: #0e639c; border: none; border-radius: 4px;
+            color: white; cursor: pointer;
+        }
+        button:hover { background: #1177bb; }
+    </style>
+</head>
+<body>
+    <h1>feather request captures <a href="/_repl">(REPL)</a></h1>
+    <div id="layout">
+        <div id="list"></div>
+        <div id="detail"></div>
+    </div>
+    <script>
+        let capture = null, current = 0;
+
+        function esc(s) {
+            return String(s).replace(/[&<>"]/g, c => ({'&':'&amp;','<':'&lt;','>':'&gt;','"':'&quot;'}[c]));
+        }
+
+        async function loadList() {
+            const list = await (await fetch('/_debug/captures')).json();
+            const el = document.getElementById('list');
+            if (!list.length) {
+                el.innerHTML = '<div class="meta">No captures. Run "debug capture on" and send some requests.</div>';
+                return;
+            }
+            el.innerHTML = list.map(c =>
+                '<div class="capture" data-id="' + c.id + '" onclick="openCapture(' + c.id + ')">' +
+                '<span class="' + (c.status >= 500 || c.error ? 'status-err' : '') + '">' + c.status + '</span> ' +
+                esc(c.method) + ' ' + esc(c.path) +
+                ' <span class="meta">' + c.steps + ' steps, ' + c.micros + 'µs</span></div>').join('');
+        }
+
+        async function openCapture(id) {
+            const res = await fetch('/_debug/captures/' + id);
+            if (!res.ok) return;
+            capture = await res.json();
+            current = 0;
+            document.querySelectorAll('.capture').forEach(el =>
+                el.classList.toggle('selected', el.dataset.id == id));
+            render();
+        }
+
+        function step(delta) {
+            if (!capture || !capture.steps.length) return;
+            current = Math.max(0, Math.min(capture.steps.length - 1, current + delta));
+            render();
+            document.querySelector('.step.current').scrollIntoView({block: 'nearest'});
+        }
+
+        function render() {
+            const c = capture;
+            let html = '<div id="bar"><button onclick="step(-1)">&larr; Prev</button>' +
+                '<button onclick="step(1)">Next &rarr;</button>' +
+                '<span class="meta">' + esc(c.route) + ' &middot; ' + esc(c.time) +
+                (c.truncated ? ' &middot; truncated' : '') + '</span></div>';
+            if (c.error) html += '<div class="error">' + esc(c.error) + '</div>';
+            html += c.steps.map((s, n) =>
+                '<div class="step' + (n === current ? ' current' : '') + '" onclick="current=' + n + ';render()">' +
+                '<span class="meta">#' + s.index + '</span> <span class="cmd">' + esc(s.command) + '</span> ' +
+                s.args.map(a => esc(JSON.stringify(a))).join(' ') +
+                ' <span class="meta">' + s.micros + 'µs' + (s.returned ? ', returned' : '') + '</span>' +
+                '<div class="' + (s.error ? 'error' : 'result') + '">' + esc(s.result) + '</div></div>').join('');
+            document.getElementById('detail').innerHTML = html;
+        }
+
+        document.addEventListener('keydown', e => {
+            if (e.key === 'ArrowDown' || e.key === 'j') step(1);
+            if (e.key === 'ArrowUp' || e.key === 'k') step(-1);
+        });
+        loadList();
+    </script>
+</body>
+</html>
+`
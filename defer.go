@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/feather-lang/feather"
+)
+
+// runDeferred evaluates the scripts a request deferred, last first, once
+// its response is done. Errors are logged: the client is already gone.
+func runDeferred(state *ServerState, method, path string, scripts []string) {
+	for j := len(scripts) - 1; j >= 0; j-- {
+		if _, err := state.EvalIn(ChannelRoute, scripts[j]); err != nil {
+			logf("defer %s %s: %v\n", method, path, err)
+		}
+	}
+}
+
+func registerDeferCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "defer",
+		Help:  "Run a script after the response has been sent",
+		Usage: "defer SCRIPT",
+		Long: `Run SCRIPT once the handler has finished and the response has been
+written, for audit logging, metrics and cleanup that shouldn't delay
+the client. For a held connection that is when it closes. Scripts run
+in the reverse order they were deferred, as in Go, and their errors are
+logged.
+
+SCRIPT runs at the top level after the request is gone, so request,
+respond and the other request commands aren't available to it. Capture
+what it needs when deferring it, with list.
+
+Example:
+  route POST /orders {
+      set id [save_order [request body]]
+      defer [list audit order_created $id [request header X-User]]
+      respond $id
+  }`,
+	})
+
+	interp.RegisterCommand("defer", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"defer script\"")
+		}
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			return feather.Error("defer: not in request context")
+		}
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+		if ctx.finished {
+			return feather.Error("defer: request already finished")
+		}
+		ctx.deferred = append(ctx.deferred, args[0].String())
+		return feather.OK("")
+	})
+}
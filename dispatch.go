@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// installCommandHooks wraps every registered Go command so per-call
+// concerns apply at dispatch, no matter how the command is reached
+// (directly, from a proc, via eval): the channel's command policy is
+// enforced, a handler past its timeout is stopped, a panic becomes an
+// error and, for captured requests, the call is recorded. It must run
+// after all commands are registered. Tcl builtins like set and proc are
+// not affected.
+func installCommandHooks(interp *feather.Interp, state *ServerState) {
+	// A panic in a handler's command gets it the generic error page
+	onPanic := func() {
+		if ctx := state.GetRequestContext(); ctx != nil {
+			ctx.panicked = true
+		}
+	}
+	cmds := interp.Internal().Commands
+	for name, fn := range cmds {
+		cmds[name] = func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+			channel := state.currentChannel()
+			if err := state.acl.check(channel, name); err != nil {
+				i.SetErrorString(err.Error())
+				return feather.ResultError
+			}
+
+			var capture *requestCapture
+			if channel == ChannelRoute {
+				if ctx := state.GetRequestContext(); ctx != nil {
+					if err := ctx.expiredErr(); err != nil {
+						i.SetErrorString(err.Error())
+						return feather.ResultError
+					}
+					capture = ctx.capture
+				}
+			}
+			if capture == nil {
+				return callRecovered(name, fn, i, cmd, args, onPanic)
+			}
+
+			start := time.Now()
+			res := callRecovered(name, fn, i, cmd, args, onPanic)
+			capture.record(i, name, args, res, time.Since(start))
+			return res
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// encodingFormats lists the formats accepted by encode and decode
+const encodingFormats = "base64, base64url, hex, url"
+
+func encodeAs(format, data string) (string, error) {
+	switch format {
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(data)), nil
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString([]byte(data)), nil
+	case "hex":
+		return hex.EncodeToString([]byte(data)), nil
+	case "url":
+		return url.QueryEscape(data), nil
+	}
+	return "", fmt.Errorf("unknown format %q (must be %s)", format, encodingFormats)
+}
+
+func decodeAs(format, data string) (string, error) {
+	var b []byte
+	var err error
+	switch format {
+	case "base64":
+		b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	case "base64url":
+		// Accept both padded and unpadded input; JWTs and most APIs omit it
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(data), "="))
+	case "hex":
+		b, err = hex.DecodeString(strings.TrimSpace(data))
+	case "url":
+		var s string
+		s, err = url.QueryUnescape(data)
+		b = []byte(s)
+	default:
+		return "", fmt.Errorf("unknown format %q (must be %s)", format, encodingFormats)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", format, err)
+	}
+	return string(b), nil
+}
+
+func registerEncodingCommands(interp *feather.Interp, state *ServerState) {
+	encodeCmd := &Command{
+		Name:  "encode",
+		Help:  "Encode data as base64, base64url, hex or URL query text",
+		Usage: "encode FORMAT DATA",
+		Long: `Formats:
+  base64     Standard alphabet with padding (RFC 4648)
+  base64url  URL-safe alphabet without padding, as used by JWTs
+  hex        Lowercase hexadecimal
+  url        Query-string escaping (spaces become +)`,
+	}
+	registry.Register(encodeCmd)
+	interp.RegisterCommand("encode", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"encode format data\"")
+		}
+		out, err := encodeAs(args[0].String(), args[1].String())
+		if err != nil {
+			return feather.Errorf("encode: %v", err)
+		}
+		return feather.OK(i.String(out))
+	})
+
+	decodeCmd := &Command{
+		Name:  "decode",
+		Help:  "Decode base64, base64url, hex or URL query text",
+		Usage: "decode FORMAT DATA",
+		Long: `Formats are the same as for encode. base64url input may be padded or
+unpadded.`,
+	}
+	registry.Register(decodeCmd)
+	interp.RegisterCommand("decode", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"decode format data\"")
+		}
+		out, err := decodeAs(args[0].String(), args[1].String())
+		if err != nil {
+			return feather.Errorf("decode: %v", err)
+		}
+		return feather.OK(i.String(out))
+	})
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types (FastCGI specification 1.0)
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiMaxRecord = 65535
+)
+
+// fcgiMount passes requests for scripts under a path prefix to a FastCGI
+// application server such as php-fpm
+type fcgiMount struct {
+	Prefix  string
+	Socket  string // unix socket path, or host:port
+	Root    string // document root, absolute
+	Index   string // script for directory requests
+	Ext     string // script extension, e.g. ".php"
+	Front   bool   // send requests that match no script to Index
+	MaxBody int64  // largest buffered chunked request body
+	Timeout time.Duration
+}
+
+var (
+	fcgiMu     sync.RWMutex
+	fcgiMounts = make(map[string]*fcgiMount) // by prefix
+)
+
+// findFcgiMount returns the mount with the longest prefix matching p
+func findFcgiMount(p string) *fcgiMount {
+	fcgiMu.RLock()
+	defer fcgiMu.RUnlock()
+	var best *fcgiMount
+	for prefix, m := range fcgiMounts {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			if best == nil || len(prefix) > len(best.Prefix) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// resolve maps a request path to the script to run and the PATH_INFO after
+// it: /app/index.php/users gives index.php and /users. ok is false when
+// no script matches.
+func (m *fcgiMount) resolve(urlPath string) (script, pathInfo string, ok bool) {
+	rel := path.Clean("/" + strings.TrimPrefix(urlPath, strings.TrimSuffix(m.Prefix, "/")))
+	for _, seg := range strings.Split(rel, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return "", "", false
+		}
+	}
+	isFile := func(p string) bool {
+		fi, err := os.Stat(filepath.Join(m.Root, filepath.FromSlash(p)))
+		return err == nil && fi.Mode().IsRegular()
+	}
+	if i := strings.Index(rel+"/", m.Ext+"/"); i >= 0 {
+		script, pathInfo = rel[:i+len(m.Ext)], rel[i+len(m.Ext):]
+		if isFile(script) {
+			return script, pathInfo, true
+		}
+		return "", "", false
+	}
+	if fi, err := os.Stat(filepath.Join(m.Root, filepath.FromSlash(rel))); err == nil && fi.IsDir() && m.Index != "" {
+		if index := path.Join(rel, m.Index); isFile(index) {
+			return index, "", true
+		}
+	}
+	if m.Front && m.Index != "" && isFile("/"+m.Index) {
+		// Leave real files (images, CSS) to static mounts and routes
+		if !isFile(rel) {
+			return "/" + m.Index, rel, true
+		}
+	}
+	return "", "", false
+}
+
+// params builds the CGI environment for a request
+func (m *fcgiMount) params(r *http.Request, script, pathInfo string) map[string]string {
+	scriptName := strings.TrimSuffix(m.Prefix, "/") + script
+	p := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "feather-httpd",
+		"SERVER_PROTOCOL":   r.Proto,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.RequestURI,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     m.Root,
+		"DOCUMENT_URI":      scriptName + pathInfo,
+		"SCRIPT_FILENAME":   filepath.Join(m.Root, filepath.FromSlash(script)),
+		"SCRIPT_NAME":       scriptName,
+		"PATH_INFO":         pathInfo,
+		"REDIRECT_STATUS":   "200", // php-cgi refuses to run without it
+	}
+	if pathInfo != "" {
+		p["PATH_TRANSLATED"] = filepath.Join(m.Root, filepath.FromSlash(pathInfo))
+	}
+	if r.ContentLength >= 0 {
+		p["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		p["CONTENT_TYPE"] = ct
+	}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		p["REMOTE_ADDR"], p["REMOTE_PORT"] = host, port
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	p["SERVER_NAME"] = host
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if h, port, err := net.SplitHostPort(addr.String()); err == nil {
+			p["SERVER_ADDR"], p["SERVER_PORT"] = h, port
+		}
+	}
+	if r.TLS != nil {
+		p["HTTPS"] = "on"
+		p["REQUEST_SCHEME"] = "https"
+	} else {
+		p["REQUEST_SCHEME"] = "http"
+	}
+	for name, values := range r.Header {
+		// Proxy would become HTTP_PROXY, which CGI programs take as their
+		// outbound proxy (httpoxy)
+		if name == "Proxy" || name == "Content-Type" || name == "Content-Length" {
+			continue
+		}
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		p[key] = strings.Join(values, ", ")
+	}
+	return p
+}
+
+// fcgiWriter writes FastCGI records for one request
+type fcgiWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+}
+
+func (fw *fcgiWriter) record(typ uint8, content []byte) error {
+	pad := (8 - len(content)%8) % 8
+	h := fw.buf[:]
+	h[0], h[1] = 1, typ
+	binary.BigEndian.PutUint16(h[2:], 1) // request ID
+	binary.BigEndian.PutUint16(h[4:], uint16(len(content)))
+	h[6], h[7] = uint8(pad), 0
+	fw.w.Write(h)
+	fw.w.Write(content)
+	_, err := fw.w.Write(make([]byte, pad))
+	return err
+}
+
+// stream writes data as records of typ, followed by the empty record that
+// ends the stream
+func (fw *fcgiWriter) stream(typ uint8, data io.Reader) error {
+	chunk := make([]byte, fcgiMaxRecord)
+	for data != nil {
+		n, err := data.Read(chunk)
+		if n > 0 {
+			if werr := fw.record(typ, chunk[:n]); werr != nil {
+				return werr
+			}
+			if werr := fw.w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := fw.record(typ, nil); err != nil {
+		return err
+	}
+	return fw.w.Flush()
+}
+
+func fcgiPutLength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+	b.Write(l[:])
+}
+
+func fcgiEncodeParams(params map[string]string) []byte {
+	var b bytes.Buffer
+	for k, v := range params {
+		fcgiPutLength(&b, len(k))
+		fcgiPutLength(&b, len(v))
+		b.WriteString(k)
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
+
+// fcgiStdoutReader turns the records coming back into the application's
+// stdout stream, logging stderr and stopping at END_REQUEST
+type fcgiStdoutReader struct {
+	r      *bufio.Reader
+	prefix string
+	left   int // stdout bytes left in the current record
+	pad    int
+	done   bool
+}
+
+func (fr *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for fr.left == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+		if fr.pad > 0 {
+			if _, err := fr.r.Discard(fr.pad); err != nil {
+				return 0, err
+			}
+			fr.pad = 0
+		}
+		var h [8]byte
+		if _, err := io.ReadFull(fr.r, h[:]); err != nil {
+			return 0, fmt.Errorf("reading FastCGI response: %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(h[4:]))
+		fr.pad = int(h[6])
+		switch h[1] {
+		case fcgiStdout:
+			fr.left = length
+		case fcgiStderr:
+			msg := make([]byte, length)
+			if _, err := io.ReadFull(fr.r, msg); err != nil {
+				return 0, err
+			}
+			if s := strings.TrimSpace(string(msg)); s != "" {
+				logf("fcgi %s: %s\n", fr.prefix, s)
+			}
+		case fcgiEndRequest:
+			fr.done = true
+			if _, err := fr.r.Discard(length); err != nil {
+				return 0, err
+			}
+		default:
+			if _, err := fr.r.Discard(length); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(p) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	fr.left -= n
+	return n, err
+}
+
+func (m *fcgiMount) dial(ctx context.Context) (net.Conn, error) {
+	if sock, ok := strings.CutPrefix(m.Socket, "unix:"); ok || strings.HasPrefix(m.Socket, "/") {
+		if !ok {
+			sock = m.Socket
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sock)
+	}
+	return outboundDial(ctx, "tcp", m.Socket)
+}
+
+// serveFcgi runs the script a request resolves to. It reports false,
+// without writing anything, when the path matches no script.
+func serveFcgi(m *fcgiMount, w http.ResponseWriter, r *http.Request) bool {
+	script, pathInfo, ok := m.resolve(r.URL.Path)
+	if !ok {
+		return false
+	}
+	if err := m.run(w, r, script, pathInfo); err != nil {
+		logf("fcgi %s: %s %s: %v\n", m.Prefix, r.Method, r.URL.Path, err)
+	}
+	return true
+}
+
+func (m *fcgiMount) run(w http.ResponseWriter, r *http.Request, script, pathInfo string) error {
+	// CGI programs need CONTENT_LENGTH, so chunked bodies are buffered
+	if r.ContentLength < 0 {
+		body, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+		if err != nil {
+			http.Error(w, "error reading request body", http.StatusBadRequest)
+			return err
+		}
+		if int64(len(body)) > m.MaxBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+
+	ctx := r.Context()
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+	conn, err := m.dial(ctx)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	fw := &fcgiWriter{w: bufio.NewWriter(conn)}
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	fw.record(fcgiBeginRequest, begin)
+	fw.stream(fcgiParams, bytes.NewReader(fcgiEncodeParams(m.params(r, script, pathInfo))))
+
+	// Send the body while the response is read, so large uploads and
+	// early responses both work
+	stdinErr := make(chan error, 1)
+	go func() {
+		var body io.Reader
+		if r.Body != nil && r.ContentLength != 0 {
+			body = r.Body
+		}
+		stdinErr <- fw.stream(fcgiStdin, body)
+	}()
+
+	stdout := &fcgiStdoutReader{r: bufio.NewReader(conn), prefix: m.Prefix}
+	tp := textproto.NewReader(bufio.NewReader(stdout))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && len(header) > 0) {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return err
+	}
+
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return fmt.Errorf("invalid Status header %q", s)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(status)
+
+	// Stream the body as it is produced
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := tp.R.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return nil
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := <-stdinErr; err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Files between these sizes are memory-mapped when mmap serving is enabled
+// and the kernel sendfile path isn't available. Small files are cheaper to
+// read, and very large ones would map too much address space at once.
+const (
+	mmapMinSize = 64 << 10
+	mmapMaxSize = 16 << 20
+)
+
+// mmapEnabled turns on mmap serving for medium files (config mmap, -mmap flag)
+var mmapEnabled atomic.Bool
+
+// fileServeStats counts which path each served file took
+type fileServeStats struct {
+	sendfile atomic.Uint64 // handed to the kernel via sendfile
+	mmap     atomic.Uint64 // served from a memory mapping
+	copied   atomic.Uint64 // read through userspace buffers
+}
+
+var fileStats fileServeStats
+
+// serveFile writes an open file as the response body, honoring range and
+// conditional requests. The *os.File is passed straight to
+// http.ServeContent, so when w is net/http's own writer on a plain TCP
+// connection it uses sendfile(2) and the file is never read into
+// userspace. TLS, and writers that wrap the response such as gzip,
+// transform and headers policies, copy it instead, or with mmap on, serve
+// medium files from a memory mapping.
+func serveFile(w http.ResponseWriter, r *http.Request, name string, file *os.File, stat os.FileInfo) {
+	if _, ok := w.(io.ReaderFrom); ok && r.TLS == nil {
+		fileStats.sendfile.Add(1)
+		http.ServeContent(w, r, name, stat.ModTime(), file)
+		return
+	}
+	if size := stat.Size(); mmapEnabled.Load() && size >= mmapMinSize && size <= mmapMaxSize {
+		if data, err := mmapFile(file, size); err == nil {
+			defer munmapFile(data)
+			// A file truncated while mapped faults on access; that must
+			// abort the response rather than crash the server
+			defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+			defer func() {
+				if v := recover(); v != nil {
+					if _, ok := v.(interface{ Addr() uintptr }); ok {
+						logf("serve %s: file changed while mapped\n", name)
+						panic(http.ErrAbortHandler)
+					}
+					panic(v)
+				}
+			}()
+			fileStats.mmap.Add(1)
+			http.ServeContent(w, r, name, stat.ModTime(), bytes.NewReader(data))
+			return
+		}
+	}
+	fileStats.copied.Add(1)
+	http.ServeContent(w, r, name, stat.ModTime(), file)
+}
+
+// registerFileServeConfig registers the file serving settings
+func registerFileServeConfig() {
+	registerConfigKey(&ConfigKey{
+		Name:    "mmap",
+		Help:    "Memory-map files of 64KB to 16MB when sendfile is unavailable, e.g. over TLS (-mmap flag; not on Windows)",
+		Type:    ConfigBool,
+		Default: "0",
+		Get: func() string {
+			if mmapEnabled.Load() {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(value string) error {
+			mmapEnabled.Store(value == "1")
+			return nil
+		},
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// maxFormMemory is the multipart memory limit before files spill to disk
+const maxFormMemory = 32 << 20
+
+// readBody returns the request body, reading it on first use. The body
+// stays readable for later consumers such as multipart parsing.
+func (ctx *RequestContext) readBody() ([]byte, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if !ctx.bodyRead {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		ctx.body, ctx.bodyRead = body, true
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(ctx.body))
+	return ctx.body, nil
+}
+
+// formFields returns the submitted fields of a request: a JSON object,
+// multipart or urlencoded form, falling back to the query string. Only the
+// first value of repeated fields is used.
+func formFields(ctx *RequestContext) (map[string]string, error) {
+	fields := make(map[string]string)
+	for k, v := range ctx.Request.URL.Query() {
+		fields[k] = v[0]
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(ctx.Request.Header.Get("Content-Type"))
+	body, err := ctx.readBody()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if len(bytes.TrimSpace(body)) == 0 {
+			return fields, nil
+		}
+		var obj map[string]any
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+		for k, v := range obj {
+			switch v := v.(type) {
+			case string:
+				fields[k] = v
+			case float64:
+				fields[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				fields[k] = strconv.FormatBool(v)
+			case nil:
+				delete(fields, k)
+			default:
+				return nil, fmt.Errorf("field %q: expected a scalar value", k)
+			}
+		}
+	case mediaType == "multipart/form-data":
+		if err := ctx.Request.ParseMultipartForm(maxFormMemory); err != nil {
+			return nil, err
+		}
+		for k, v := range ctx.Request.MultipartForm.Value {
+			if len(v) > 0 {
+				fields[k] = v[0]
+			}
+		}
+	default:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid form body: %v", err)
+		}
+		for k, v := range values {
+			fields[k] = v[0]
+		}
+	}
+	return fields, nil
+}
+
+// formField is one entry of a form bind schema: NAME {TYPE ?FLAG ...?}
+type formField struct {
+	name     string
+	kind     string
+	required bool
+	trim     bool
+}
+
+var formTypes = []string{"string", "int", "float", "bool", "email"}
+
+func parseFormSchema(i *feather.Interp, schema string) ([]formField, error) {
+	items, err := i.ParseList(schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(items)%2 != 0 {
+		return nil, fmt.Errorf("schema must be a list of name/type pairs")
+	}
+	fields := make([]formField, 0, len(items)/2)
+	for j := 0; j < len(items); j += 2 {
+		spec, err := i.ParseList(items[j+1].String())
+		if err != nil || len(spec) == 0 {
+			return nil, fmt.Errorf("field %q: missing type", items[j].String())
+		}
+		f := formField{name: items[j].String(), kind: spec[0].String(), trim: true}
+		if !validFormType(f.kind) {
+			return nil, fmt.Errorf("field %q: unknown type %q (must be %s)", f.name, f.kind, strings.Join(formTypes, ", "))
+		}
+		for _, flag := range spec[1:] {
+			switch flag.String() {
+			case "required":
+				f.required = true
+			case "notrim":
+				f.trim = false
+			default:
+				return nil, fmt.Errorf("field %q: unknown flag %q (must be required, notrim)", f.name, flag.String())
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func validFormType(kind string) bool {
+	for _, t := range formTypes {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// convert type-checks one raw value
+func (f formField) convert(raw string) (any, error) {
+	switch f.kind {
+	case "int":
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return n, nil
+	case "float":
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return n, nil
+	case "bool":
+		switch strings.ToLower(raw) {
+		case "1", "true", "yes", "on":
+			return true, nil
+		case "0", "false", "no", "off":
+			return false, nil
+		}
+		return nil, fmt.Errorf("must be a boolean")
+	case "email":
+		addr, err := mail.ParseAddress(raw)
+		if err != nil || addr.Name != "" {
+			return nil, fmt.Errorf("must be an email address")
+		}
+		return addr.Address, nil
+	default:
+		return raw, nil
+	}
+}
+
+func registerFormCommand(interp *feather.Interp, state *ServerState) {
+	formCmd := &Command{
+		Name:  "form",
+		Help:  "Read and bind submitted form or JSON fields",
+		Usage: "form SUBCOMMAND ?ARG ...?",
+		Long: `Fields are read from a JSON object body, a multipart or urlencoded form,
+and the query string, in that order of precedence.
+
+form bind sets VAR to a dict holding only the schema's fields, trimmed
+and converted to their type, and returns a dict of field -> error message
+that is empty when the input is valid. Absent and empty fields are left
+out unless flagged required.
+
+Types: string, int, float, bool, email. Flags: required, notrim.
+
+Example:
+  set errors [form bind user {name {string required} email email age int}]
+  if {[dict size $errors] > 0} {
+      status 422
+      respond [json stringify $errors]
+      return
+  }`,
+		Subcommands: []*Command{
+			{Name: "bind", Help: "Bind fields to a dict by schema", Usage: "form bind VAR SCHEMA"},
+			{Name: "values", Help: "Get all submitted fields as a dict", Usage: "form values"},
+			{Name: "get", Help: "Get one submitted field", Usage: "form get NAME ?DEFAULT?"},
+		},
+	}
+	registry.Register(formCmd)
+	interp.RegisterCommand("form", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"form subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			return feather.Errorf("form %s: not in request context", subcmd)
+		}
+
+		switch subcmd {
+		case "bind":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"form bind var schema\"")
+			}
+			schema, err := parseFormSchema(i, args[2].String())
+			if err != nil {
+				return feather.Errorf("form bind: %v", err)
+			}
+			fields, err := formFields(ctx)
+			if err != nil {
+				return feather.Errorf("form bind: %v", err)
+			}
+			var clean, errs []any
+			for _, f := range schema {
+				raw, ok := fields[f.name]
+				if f.trim {
+					raw = strings.TrimSpace(raw)
+				}
+				if !ok || raw == "" {
+					if f.required {
+						errs = append(errs, f.name, "is required")
+					}
+					continue
+				}
+				v, err := f.convert(raw)
+				if err != nil {
+					errs = append(errs, f.name, err.Error())
+					continue
+				}
+				clean = append(clean, f.name, v)
+			}
+			// Interp.SetVar would quote the dict as a single list element
+			i.Internal().SetVar(args[1].String(), i.DictKV(clean...).String())
+			return feather.OK(i.DictKV(errs...))
+		case "values":
+			fields, err := formFields(ctx)
+			if err != nil {
+				return feather.Errorf("form values: %v", err)
+			}
+			m := make(map[string]any, len(fields))
+			for k, v := range fields {
+				m[k] = v
+			}
+			return feather.OK(i.DictFrom(m))
+		case "get":
+			if len(args) != 2 && len(args) != 3 {
+				return feather.Error("wrong # args: should be \"form get name ?default?\"")
+			}
+			fields, err := formFields(ctx)
+			if err != nil {
+				return feather.Errorf("form get: %v", err)
+			}
+			if v, ok := fields[args[1].String()]; ok {
+				return feather.OK(i.String(v))
+			}
+			if len(args) == 3 {
+				return feather.OK(args[2])
+			}
+			return feather.OK("")
+		default:
+			return feather.Errorf("form: unknown subcommand %q (must be bind, values, get)", subcmd)
+		}
+	})
+}
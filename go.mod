@@ -2,4 +2,17 @@ module github.com/feather-lang/feather-httpd
 
 go 1.25.5
 
-require github.com/feather-lang/feather v0.0.0-20251227222940-8b153391b49e
+require (
+	github.com/feather-lang/feather v0.0.0-20251227222940-8b153391b49e
+	github.com/go-sql-driver/mysql v1.9.3
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.33
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/net v0.50.0
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+	golang.org/x/text v0.34.0 // indirect
+)
@@ -0,0 +1,2138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/feather-lang/feather"
+)
+
+// GraphQL support: a schema from SDL, resolvers that are Tcl procs, and an
+// endpoint that executes queries against them. Introspection other than
+// __typename and subscriptions are not supported.
+
+// gqlMount serves the schema's endpoint at Path
+type gqlMount struct {
+	Path   string
+	Schema *gqlSchema
+}
+
+var (
+	gqlMu        sync.RWMutex
+	gqlEndpoint  *gqlMount
+	gqlResolvers = make(map[string]string) // TYPE.FIELD -> proc
+)
+
+// Largest request body the endpoint reads
+const maxGraphQLBody = 1 << 20
+
+// findGraphQLMount returns the endpoint if it is served at p
+func findGraphQLMount(p string) *gqlMount {
+	gqlMu.RLock()
+	defer gqlMu.RUnlock()
+	if gqlEndpoint != nil && gqlEndpoint.Path == p {
+		return gqlEndpoint
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Lexer, shared by SDL and query documents
+
+type gqlToken struct {
+	kind      byte // 'n' name, 'i' int, 'f' float, 's' string, 'p' punctuator, 0 end
+	val       string
+	line, col int
+}
+
+func gqlNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func gqlDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func gqlLex(src string) ([]gqlToken, error) {
+	src = strings.TrimPrefix(src, "\ufeff")
+	var toks []gqlToken
+	line, lineStart := 1, 0
+	p := 0
+	for p < len(src) {
+		c := src[p]
+		switch c {
+		case '\n':
+			p++
+			line, lineStart = line+1, p
+			continue
+		case ' ', '\t', '\r', ',':
+			p++
+			continue
+		case '#':
+			for p < len(src) && src[p] != '\n' {
+				p++
+			}
+			continue
+		}
+
+		tok := gqlToken{line: line, col: p - lineStart + 1}
+		start := p
+		switch {
+		case strings.HasPrefix(src[p:], "..."):
+			tok.kind, tok.val = 'p', "..."
+			p += 3
+
+		case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+			tok.kind, tok.val = 'p', string(c)
+			p++
+
+		case gqlNameStart(c):
+			for p < len(src) && (gqlNameStart(src[p]) || gqlDigit(src[p])) {
+				p++
+			}
+			tok.kind, tok.val = 'n', src[start:p]
+
+		case c == '-' || gqlDigit(c):
+			tok.kind = 'i'
+			if c == '-' {
+				p++
+			}
+			digits := p
+			for p < len(src) && gqlDigit(src[p]) {
+				p++
+			}
+			if p == digits || p-digits > 1 && src[digits] == '0' {
+				return nil, fmt.Errorf("%d:%d: invalid number", tok.line, tok.col)
+			}
+			if p < len(src) && src[p] == '.' {
+				tok.kind = 'f'
+				p++
+				frac := p
+				for p < len(src) && gqlDigit(src[p]) {
+					p++
+				}
+				if p == frac {
+					return nil, fmt.Errorf("%d:%d: invalid number", tok.line, tok.col)
+				}
+			}
+			if p < len(src) && (src[p] == 'e' || src[p] == 'E') {
+				tok.kind = 'f'
+				p++
+				if p < len(src) && (src[p] == '+' || src[p] == '-') {
+					p++
+				}
+				exp := p
+				for p < len(src) && gqlDigit(src[p]) {
+					p++
+				}
+				if p == exp {
+					return nil, fmt.Errorf("%d:%d: invalid number", tok.line, tok.col)
+				}
+			}
+			if p < len(src) && (gqlNameStart(src[p]) || src[p] == '.') {
+				return nil, fmt.Errorf("%d:%d: invalid number", tok.line, tok.col)
+			}
+			tok.val = src[start:p]
+
+		case strings.HasPrefix(src[p:], `"""`):
+			p += 3
+			var raw strings.Builder
+			for {
+				if p >= len(src) {
+					return nil, fmt.Errorf("%d:%d: unterminated string", tok.line, tok.col)
+				}
+				if strings.HasPrefix(src[p:], `\"""`) {
+					raw.WriteString(`"""`)
+					p += 4
+					continue
+				}
+				if strings.HasPrefix(src[p:], `"""`) {
+					p += 3
+					break
+				}
+				if src[p] == '\n' {
+					line, lineStart = line+1, p+1
+				}
+				raw.WriteByte(src[p])
+				p++
+			}
+			tok.kind, tok.val = 's', gqlBlockString(raw.String())
+
+		case c == '"':
+			p++
+			var sb strings.Builder
+			for {
+				if p >= len(src) || src[p] == '\n' {
+					return nil, fmt.Errorf("%d:%d: unterminated string", tok.line, tok.col)
+				}
+				if src[p] == '"' {
+					p++
+					break
+				}
+				if src[p] != '\\' {
+					sb.WriteByte(src[p])
+					p++
+					continue
+				}
+				if p+1 >= len(src) {
+					return nil, fmt.Errorf("%d:%d: unterminated string", tok.line, tok.col)
+				}
+				switch e := src[p+1]; e {
+				case '"', '\\', '/':
+					sb.WriteByte(e)
+				case 'b':
+					sb.WriteByte('\b')
+				case 'f':
+					sb.WriteByte('\f')
+				case 'n':
+					sb.WriteByte('\n')
+				case 'r':
+					sb.WriteByte('\r')
+				case 't':
+					sb.WriteByte('\t')
+				case 'u':
+					if p+6 > len(src) {
+						return nil, fmt.Errorf("%d:%d: invalid unicode escape", tok.line, tok.col)
+					}
+					r, err := strconv.ParseUint(src[p+2:p+6], 16, 32)
+					if err != nil {
+						return nil, fmt.Errorf("%d:%d: invalid unicode escape", tok.line, tok.col)
+					}
+					sb.WriteRune(rune(r))
+					p += 4
+				default:
+					return nil, fmt.Errorf("%d:%d: invalid escape \\%c", tok.line, tok.col, e)
+				}
+				p += 2
+			}
+			tok.kind, tok.val = 's', sb.String()
+
+		default:
+			r, _ := utf8.DecodeRuneInString(src[p:])
+			return nil, fmt.Errorf("%d:%d: unexpected character %q", tok.line, tok.col, r)
+		}
+		toks = append(toks, tok)
+	}
+	return append(toks, gqlToken{line: line, col: p - lineStart + 1}), nil
+}
+
+// gqlBlockString removes the common indentation and the blank first and
+// last lines of a """block string"""
+func gqlBlockString(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	common := -1
+	for _, l := range lines[1:] {
+		indent := len(l) - len(strings.TrimLeft(l, " \t"))
+		if indent < len(l) && (common < 0 || indent < common) {
+			common = indent
+		}
+	}
+	if common > 0 {
+		for k := 1; k < len(lines); k++ {
+			if len(lines[k]) >= common {
+				lines[k] = lines[k][common:]
+			} else {
+				lines[k] = ""
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ---------------------------------------------------------------------------
+// Parser
+
+type gqlParser struct {
+	toks []gqlToken
+	pos  int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.toks[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the punctuator v
+func (p *gqlParser) is(v string) bool {
+	t := p.peek()
+	return t.kind == 'p' && t.val == v
+}
+
+// isKeyword reports whether the next token is the name v
+func (p *gqlParser) isKeyword(v string) bool {
+	t := p.peek()
+	return t.kind == 'n' && t.val == v
+}
+
+// skip consumes the punctuator v if it is next
+func (p *gqlParser) skip(v string) bool {
+	if p.is(v) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) errorf(format string, args ...any) error {
+	t := p.peek()
+	return fmt.Errorf("%d:%d: %s", t.line, t.col, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return p.errorf("unexpected end of document")
+	}
+	return p.errorf("unexpected %q", t.val)
+}
+
+func (p *gqlParser) expect(v string) error {
+	if !p.skip(v) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != 'n' {
+		return "", p.unexpected()
+	}
+	return p.next().val, nil
+}
+
+func (p *gqlParser) expectKeyword(v string) error {
+	if !p.isKeyword(v) {
+		return p.unexpected()
+	}
+	p.pos++
+	return nil
+}
+
+// gqlTypeRef is a type reference such as [String!]!
+type gqlTypeRef struct {
+	Kind byte // 'n' named, 'l' list, '!' non-null
+	Name string
+	Of   *gqlTypeRef
+}
+
+func (t *gqlTypeRef) String() string {
+	switch t.Kind {
+	case 'l':
+		return "[" + t.Of.String() + "]"
+	case '!':
+		return t.Of.String() + "!"
+	}
+	return t.Name
+}
+
+// named returns the named type at the core of t
+func (t *gqlTypeRef) named() string {
+	for t.Kind != 'n' {
+		t = t.Of
+	}
+	return t.Name
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	var t *gqlTypeRef
+	if p.skip("[") {
+		of, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		t = &gqlTypeRef{Kind: 'l', Of: of}
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		t = &gqlTypeRef{Kind: 'n', Name: name}
+	}
+	if p.skip("!") {
+		t = &gqlTypeRef{Kind: '!', Of: t}
+	}
+	return t, nil
+}
+
+// gqlValue is a literal in a document
+type gqlValue struct {
+	Kind   byte // '$' variable, 'i' int, 'f' float, 's' string, 'b' bool, '0' null, 'e' enum, '[' list, '{' object
+	Str    string
+	List   []*gqlValue
+	Fields []gqlNamedValue
+}
+
+// gqlNamedValue is an argument or an input object field
+type gqlNamedValue struct {
+	Name  string
+	Value *gqlValue
+}
+
+func (v *gqlValue) describe() string {
+	switch v.Kind {
+	case 'i', 'f', 'b':
+		return v.Str
+	case 's':
+		return strconv.Quote(v.Str)
+	case 'e':
+		return v.Str
+	case '[':
+		return "a list"
+	case '{':
+		return "an object"
+	}
+	return "null"
+}
+
+func (p *gqlParser) value(isConst bool, depth int) (*gqlValue, error) {
+	if depth > maxJSONDepth {
+		return nil, p.errorf("nested too deeply")
+	}
+	t := p.peek()
+	switch t.kind {
+	case 'i', 'f', 's':
+		p.pos++
+		return &gqlValue{Kind: t.kind, Str: t.val}, nil
+	case 'n':
+		p.pos++
+		switch t.val {
+		case "true", "false":
+			return &gqlValue{Kind: 'b', Str: t.val}, nil
+		case "null":
+			return &gqlValue{Kind: '0'}, nil
+		}
+		return &gqlValue{Kind: 'e', Str: t.val}, nil
+	}
+	switch {
+	case p.is("$") && !isConst:
+		p.pos++
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return &gqlValue{Kind: '$', Str: name}, nil
+	case p.skip("["):
+		v := &gqlValue{Kind: '['}
+		for !p.skip("]") {
+			item, err := p.value(isConst, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			v.List = append(v.List, item)
+		}
+		return v, nil
+	case p.skip("{"):
+		v := &gqlValue{Kind: '{'}
+		for !p.skip("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			field, err := p.value(isConst, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			v.Fields = append(v.Fields, gqlNamedValue{name, field})
+		}
+		return v, nil
+	}
+	return nil, p.unexpected()
+}
+
+func (p *gqlParser) arguments(isConst bool) ([]gqlNamedValue, error) {
+	var args []gqlNamedValue
+	if !p.skip("(") {
+		return nil, nil
+	}
+	for !p.skip(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(isConst, 0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gqlNamedValue{name, v})
+	}
+	if len(args) == 0 {
+		return nil, p.errorf("expected an argument")
+	}
+	return args, nil
+}
+
+type gqlDirective struct {
+	Name string
+	Args []gqlNamedValue
+}
+
+func (p *gqlParser) directives(isConst bool) ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.skip("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(isConst)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, gqlDirective{name, args})
+	}
+	return dirs, nil
+}
+
+// ---------------------------------------------------------------------------
+// Schema definition language
+
+type gqlSchema struct {
+	Types    map[string]*gqlType
+	Order    []string // type names in definition order
+	Query    string
+	Mutation string
+}
+
+type gqlType struct {
+	Kind       string // "scalar", "object", "interface", "union", "enum", "input"
+	Name       string
+	Fields     []*gqlFieldDef // object and interface
+	Inputs     []*gqlInputDef // input object
+	Interfaces []string       // implemented by an object
+	Members    []string       // of a union
+	Values     []string       // of an enum
+	fields     map[string]*gqlFieldDef
+}
+
+type gqlFieldDef struct {
+	Name string
+	Args []*gqlInputDef
+	Type *gqlTypeRef
+}
+
+// gqlInputDef is an argument or input object field
+type gqlInputDef struct {
+	Name    string
+	Type    *gqlTypeRef
+	Default *gqlValue
+}
+
+func (s *gqlSchema) define(p *gqlParser, t *gqlType) error {
+	if _, ok := s.Types[t.Name]; ok {
+		return p.errorf("type %s defined more than once", t.Name)
+	}
+	if strings.HasPrefix(t.Name, "__") {
+		return p.errorf("type name %s is reserved", t.Name)
+	}
+	s.Types[t.Name] = t
+	s.Order = append(s.Order, t.Name)
+	return nil
+}
+
+// description skips the description before a definition
+func (p *gqlParser) description() {
+	if p.peek().kind == 's' {
+		p.pos++
+	}
+}
+
+func (p *gqlParser) inputDefs(open, close string) ([]*gqlInputDef, error) {
+	var defs []*gqlInputDef
+	if !p.skip(open) {
+		return nil, nil
+	}
+	for !p.skip(close) {
+		p.description()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		d := &gqlInputDef{Name: name}
+		if d.Type, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if p.skip("=") {
+			if d.Default, err = p.value(true, 0); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.directives(true); err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	return defs, nil
+}
+
+// parseGraphQLSchema parses SDL type definitions into a schema
+func parseGraphQLSchema(sdl string) (*gqlSchema, error) {
+	toks, err := gqlLex(sdl)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	s := &gqlSchema{Types: make(map[string]*gqlType)}
+	for _, name := range []string{"Int", "Float", "String", "Boolean", "ID"} {
+		s.Types[name] = &gqlType{Kind: "scalar", Name: name}
+	}
+	hasSchema := false
+
+	for p.peek().kind != 0 {
+		p.description()
+		keyword, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch keyword {
+		case "schema":
+			if hasSchema {
+				return nil, p.errorf("schema defined more than once")
+			}
+			hasSchema = true
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			for !p.skip("}") {
+				op, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				switch op {
+				case "query":
+					s.Query = name
+				case "mutation":
+					s.Mutation = name
+				case "subscription":
+					return nil, p.errorf("subscriptions are not supported")
+				default:
+					return nil, p.errorf("unknown operation type %q", op)
+				}
+			}
+
+		case "scalar":
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			if err := s.define(p, &gqlType{Kind: "scalar", Name: name}); err != nil {
+				return nil, err
+			}
+
+		case "type", "interface":
+			t := &gqlType{Kind: "object", fields: make(map[string]*gqlFieldDef)}
+			if keyword == "interface" {
+				t.Kind = "interface"
+			}
+			if t.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if p.isKeyword("implements") {
+				p.pos++
+				p.skip("&")
+				for {
+					name, err := p.name()
+					if err != nil {
+						return nil, err
+					}
+					t.Interfaces = append(t.Interfaces, name)
+					if !p.skip("&") {
+						break
+					}
+				}
+			}
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			for !p.skip("}") {
+				p.description()
+				f := &gqlFieldDef{}
+				if f.Name, err = p.name(); err != nil {
+					return nil, err
+				}
+				if f.Args, err = p.inputDefs("(", ")"); err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if f.Type, err = p.typeRef(); err != nil {
+					return nil, err
+				}
+				if _, err := p.directives(true); err != nil {
+					return nil, err
+				}
+				if _, ok := t.fields[f.Name]; ok {
+					return nil, p.errorf("field %s.%s defined more than once", t.Name, f.Name)
+				}
+				t.fields[f.Name] = f
+				t.Fields = append(t.Fields, f)
+			}
+			if err := s.define(p, t); err != nil {
+				return nil, err
+			}
+
+		case "union":
+			t := &gqlType{Kind: "union"}
+			if t.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			p.skip("|")
+			for {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				t.Members = append(t.Members, name)
+				if !p.skip("|") {
+					break
+				}
+			}
+			if err := s.define(p, t); err != nil {
+				return nil, err
+			}
+
+		case "enum":
+			t := &gqlType{Kind: "enum"}
+			if t.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			for !p.skip("}") {
+				p.description()
+				v, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if v == "true" || v == "false" || v == "null" {
+					return nil, p.errorf("invalid enum value %s", v)
+				}
+				if _, err := p.directives(true); err != nil {
+					return nil, err
+				}
+				t.Values = append(t.Values, v)
+			}
+			if err := s.define(p, t); err != nil {
+				return nil, err
+			}
+
+		case "input":
+			t := &gqlType{Kind: "input"}
+			if t.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			if !p.is("{") {
+				return nil, p.unexpected()
+			}
+			if t.Inputs, err = p.inputDefs("{", "}"); err != nil {
+				return nil, err
+			}
+			if err := s.define(p, t); err != nil {
+				return nil, err
+			}
+
+		case "directive":
+			// Custom directives are accepted and ignored
+			if err := p.expect("@"); err != nil {
+				return nil, err
+			}
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.inputDefs("(", ")"); err != nil {
+				return nil, err
+			}
+			if p.isKeyword("repeatable") {
+				p.pos++
+			}
+			if err := p.expectKeyword("on"); err != nil {
+				return nil, err
+			}
+			p.skip("|")
+			for {
+				if _, err := p.name(); err != nil {
+					return nil, err
+				}
+				if !p.skip("|") {
+					break
+				}
+			}
+
+		default:
+			p.pos--
+			return nil, p.errorf("unsupported definition %q", keyword)
+		}
+	}
+
+	if !hasSchema {
+		s.Query = "Query"
+		if _, ok := s.Types["Mutation"]; ok {
+			s.Mutation = "Mutation"
+		}
+	}
+	return s, s.check()
+}
+
+// check verifies that the types the schema refers to exist and fit
+func (s *gqlSchema) check() error {
+	isKind := func(name string, kinds ...string) bool {
+		t, ok := s.Types[name]
+		return ok && slices.Contains(kinds, t.Kind)
+	}
+	if !isKind(s.Query, "object") {
+		return fmt.Errorf("query type %s is not defined", s.Query)
+	}
+	if s.Mutation != "" && !isKind(s.Mutation, "object") {
+		return fmt.Errorf("mutation type %s is not defined", s.Mutation)
+	}
+	checkInputs := func(where string, defs []*gqlInputDef) error {
+		for _, d := range defs {
+			if !isKind(d.Type.named(), "scalar", "enum", "input") {
+				return fmt.Errorf("%s.%s: %s is not an input type", where, d.Name, d.Type.named())
+			}
+		}
+		return nil
+	}
+	for _, name := range s.Order {
+		t := s.Types[name]
+		for _, f := range t.Fields {
+			if !isKind(f.Type.named(), "scalar", "enum", "object", "interface", "union") {
+				return fmt.Errorf("%s.%s: %s is not an output type", t.Name, f.Name, f.Type.named())
+			}
+			if err := checkInputs(t.Name+"."+f.Name, f.Args); err != nil {
+				return err
+			}
+		}
+		if err := checkInputs(t.Name, t.Inputs); err != nil {
+			return err
+		}
+		for _, iface := range t.Interfaces {
+			if !isKind(iface, "interface") {
+				return fmt.Errorf("%s implements %s, which is not an interface", t.Name, iface)
+			}
+			for _, f := range s.Types[iface].Fields {
+				if _, ok := t.fields[f.Name]; !ok {
+					return fmt.Errorf("%s implements %s but has no field %s", t.Name, iface, f.Name)
+				}
+			}
+		}
+		for _, m := range t.Members {
+			if !isKind(m, "object") {
+				return fmt.Errorf("union %s: %s is not an object type", t.Name, m)
+			}
+		}
+	}
+	return nil
+}
+
+// possibleTypes returns the object types an abstract type can resolve to
+func (s *gqlSchema) possibleTypes(t *gqlType) []string {
+	if t.Kind == "union" {
+		return t.Members
+	}
+	var names []string
+	for _, name := range s.Order {
+		if slices.Contains(s.Types[name].Interfaces, t.Name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// applies reports whether a fragment on typeCond applies to the object type t
+func (s *gqlSchema) applies(typeCond string, t *gqlType) bool {
+	if typeCond == t.Name {
+		return true
+	}
+	cond, ok := s.Types[typeCond]
+	return ok && (cond.Kind == "interface" || cond.Kind == "union") && slices.Contains(s.possibleTypes(cond), t.Name)
+}
+
+// emptyIsNull reports whether an empty resolver result means null for
+// ref. For strings and lists the empty string is a value of its own.
+func (s *gqlSchema) emptyIsNull(ref *gqlTypeRef) bool {
+	for ref.Kind == '!' {
+		ref = ref.Of
+	}
+	if ref.Kind == 'l' {
+		return false
+	}
+	t := s.Types[ref.Name]
+	return t.Kind != "scalar" || t.Name == "Int" || t.Name == "Float" || t.Name == "Boolean"
+}
+
+// ---------------------------------------------------------------------------
+// Query documents
+
+type gqlSelection struct {
+	Alias, Name string // field
+	Args        []gqlNamedValue
+	Directives  []gqlDirective
+	Selections  []*gqlSelection
+	Fragment    string // fragment spread
+	Inline      bool   // inline fragment
+	On          string // type condition of an inline fragment
+	Line, Col   int
+}
+
+func (s *gqlSelection) key() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+type gqlOperation struct {
+	Kind       string // "query" or "mutation"
+	Name       string
+	Vars       []*gqlInputDef
+	Selections []*gqlSelection
+}
+
+type gqlFragment struct {
+	On         string
+	Selections []*gqlSelection
+}
+
+type gqlDocument struct {
+	Operations []*gqlOperation
+	Fragments  map[string]*gqlFragment
+}
+
+func (p *gqlParser) selectionSet(depth int) ([]*gqlSelection, error) {
+	if depth > maxJSONDepth {
+		return nil, p.errorf("nested too deeply")
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.skip("}") {
+		t := p.peek()
+		sel := &gqlSelection{Line: t.line, Col: t.col}
+		var err error
+		if p.skip("...") {
+			if p.peek().kind == 'n' && !p.isKeyword("on") {
+				sel.Fragment = p.next().val
+				if sel.Directives, err = p.directives(false); err != nil {
+					return nil, err
+				}
+				sels = append(sels, sel)
+				continue
+			}
+			sel.Inline = true
+			if p.isKeyword("on") {
+				p.pos++
+				if sel.On, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			if sel.Directives, err = p.directives(false); err != nil {
+				return nil, err
+			}
+			if sel.Selections, err = p.selectionSet(depth + 1); err != nil {
+				return nil, err
+			}
+			sels = append(sels, sel)
+			continue
+		}
+
+		if sel.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.skip(":") {
+			sel.Alias = sel.Name
+			if sel.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.Args, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+		if sel.Directives, err = p.directives(false); err != nil {
+			return nil, err
+		}
+		if p.is("{") {
+			if sel.Selections, err = p.selectionSet(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return sels, nil
+}
+
+func parseGraphQLDocument(query string) (*gqlDocument, error) {
+	toks, err := gqlLex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{Fragments: make(map[string]*gqlFragment)}
+	for p.peek().kind != 0 {
+		if p.is("{") {
+			sels, err := p.selectionSet(0)
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &gqlOperation{Kind: "query", Selections: sels})
+			continue
+		}
+		keyword, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch keyword {
+		case "query", "mutation", "subscription":
+			op := &gqlOperation{Kind: keyword}
+			if p.peek().kind == 'n' {
+				op.Name = p.next().val
+			}
+			if p.skip("(") {
+				for !p.skip(")") {
+					if err := p.expect("$"); err != nil {
+						return nil, err
+					}
+					v := &gqlInputDef{}
+					if v.Name, err = p.name(); err != nil {
+						return nil, err
+					}
+					if err := p.expect(":"); err != nil {
+						return nil, err
+					}
+					if v.Type, err = p.typeRef(); err != nil {
+						return nil, err
+					}
+					if p.skip("=") {
+						if v.Default, err = p.value(true, 0); err != nil {
+							return nil, err
+						}
+					}
+					if _, err := p.directives(true); err != nil {
+						return nil, err
+					}
+					op.Vars = append(op.Vars, v)
+				}
+			}
+			if _, err := p.directives(false); err != nil {
+				return nil, err
+			}
+			if op.Selections, err = p.selectionSet(0); err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+
+		case "fragment":
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if name == "on" {
+				p.pos--
+				return nil, p.unexpected()
+			}
+			if err := p.expectKeyword("on"); err != nil {
+				return nil, err
+			}
+			f := &gqlFragment{}
+			if f.On, err = p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(false); err != nil {
+				return nil, err
+			}
+			if f.Selections, err = p.selectionSet(0); err != nil {
+				return nil, err
+			}
+			if _, ok := doc.Fragments[name]; ok {
+				return nil, fmt.Errorf("fragment %s defined more than once", name)
+			}
+			doc.Fragments[name] = f
+
+		default:
+			p.pos--
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("no operation in document")
+	}
+	return doc, nil
+}
+
+// ---------------------------------------------------------------------------
+// Execution
+
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []any         `json:"path,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlObject is a result object; it keeps the order of the selection
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	Key   string
+	Value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for k, e := range o {
+		if k > 0 {
+			b = append(b, ',')
+		}
+		key, _ := json.Marshal(e.Key)
+		val, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(append(append(b, key...), ':'), val...)
+	}
+	return append(b, '}'), nil
+}
+
+var gqlBooleanNonNull = &gqlTypeRef{Kind: '!', Of: &gqlTypeRef{Kind: 'n', Name: "Boolean"}}
+
+type gqlExecutor struct {
+	i         *feather.Interp
+	schema    *gqlSchema
+	resolvers map[string]string
+	doc       *gqlDocument
+	varDefs   map[string]*gqlInputDef
+	vars      map[string]string // coerced, in Tcl form
+	errors    []gqlError
+}
+
+func (x *gqlExecutor) addError(msg string, sel *gqlSelection, path []any) {
+	e := gqlError{Message: msg, Path: slices.Clone(path)}
+	if sel != nil {
+		e.Locations = []gqlLocation{{sel.Line, sel.Col}}
+	}
+	x.errors = append(x.errors, e)
+}
+
+// gqlExecute runs a query against the endpoint's schema and returns the
+// JSON response. With readOnly, mutations are refused.
+func gqlExecute(i *feather.Interp, query, operation string, vars map[string]string, readOnly bool) string {
+	gqlMu.RLock()
+	x := &gqlExecutor{i: i, resolvers: make(map[string]string, len(gqlResolvers))}
+	if gqlEndpoint != nil {
+		x.schema = gqlEndpoint.Schema
+	}
+	for k, v := range gqlResolvers {
+		x.resolvers[k] = v
+	}
+	gqlMu.RUnlock()
+
+	data, err := x.run(query, operation, vars, readOnly)
+	var resp gqlObject
+	if err != nil {
+		x.errors = append(x.errors, gqlError{Message: err.Error()})
+	} else {
+		resp = append(resp, gqlEntry{"data", data})
+	}
+	if len(x.errors) > 0 {
+		resp = append(resp, gqlEntry{"errors", x.errors})
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		out, _ = json.Marshal(gqlObject{{"errors", []gqlError{{Message: err.Error()}}}})
+	}
+	return string(out)
+}
+
+// run returns the result data, or an error if the request can't be
+// executed at all
+func (x *gqlExecutor) run(query, operation string, vars map[string]string, readOnly bool) (any, error) {
+	if x.schema == nil {
+		return nil, fmt.Errorf("no schema defined")
+	}
+	doc, err := parseGraphQLDocument(query)
+	if err != nil {
+		return nil, fmt.Errorf("syntax error: %v", err)
+	}
+	x.doc = doc
+
+	var op *gqlOperation
+	for _, o := range doc.Operations {
+		if operation == "" && len(doc.Operations) > 1 {
+			return nil, fmt.Errorf("operation name required for a document with several operations")
+		}
+		if operation == "" || o.Name == operation {
+			op = o
+			break
+		}
+	}
+	if op == nil {
+		return nil, fmt.Errorf("unknown operation %q", operation)
+	}
+	root := x.schema.Query
+	switch op.Kind {
+	case "mutation":
+		if x.schema.Mutation == "" {
+			return nil, fmt.Errorf("schema does not support mutations")
+		}
+		if readOnly {
+			return nil, fmt.Errorf("mutations are not allowed in a GET request")
+		}
+		root = x.schema.Mutation
+	case "subscription":
+		return nil, fmt.Errorf("subscriptions are not supported")
+	}
+	rootType := x.schema.Types[root]
+
+	x.varDefs = make(map[string]*gqlInputDef, len(op.Vars))
+	for _, v := range op.Vars {
+		t, ok := x.schema.Types[v.Type.named()]
+		if !ok || t.Kind != "scalar" && t.Kind != "enum" && t.Kind != "input" {
+			return nil, fmt.Errorf("variable $%s: %s is not an input type", v.Name, v.Type.named())
+		}
+		x.varDefs[v.Name] = v
+	}
+	if err := x.validate(rootType, op.Selections, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+
+	// Coerce the variables first, so values from them are already in shape
+	x.vars = make(map[string]string, len(op.Vars))
+	for _, v := range op.Vars {
+		val, ok := vars[v.Name]
+		switch {
+		case ok:
+			if val, err = x.coerceVariable(v.Type, val, 0); err != nil {
+				return nil, fmt.Errorf("variable $%s: %v", v.Name, err)
+			}
+			x.vars[v.Name] = val
+		case v.Default != nil:
+			if val, ok, err = x.coerceInput(v.Type, v.Default); err != nil {
+				return nil, fmt.Errorf("variable $%s: %v", v.Name, err)
+			}
+			if ok {
+				x.vars[v.Name] = val
+			}
+		case v.Type.Kind == '!':
+			return nil, fmt.Errorf("variable $%s of type %s was not provided", v.Name, v.Type)
+		}
+	}
+
+	data, ok := x.selectionSet(rootType, "", op.Selections, nil)
+	if !ok {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// validate checks that the selections exist on t and have the arguments
+// and subselections they need
+func (x *gqlExecutor) validate(t *gqlType, sels []*gqlSelection, spreading map[string]bool) error {
+	at := func(sel *gqlSelection, format string, args ...any) error {
+		return fmt.Errorf("%d:%d: %s", sel.Line, sel.Col, fmt.Sprintf(format, args...))
+	}
+	for _, sel := range sels {
+		switch {
+		case sel.Fragment != "":
+			f, ok := x.doc.Fragments[sel.Fragment]
+			if !ok {
+				return at(sel, "unknown fragment %q", sel.Fragment)
+			}
+			if spreading[sel.Fragment] {
+				return at(sel, "fragment %q spreads itself", sel.Fragment)
+			}
+			cond, ok := x.schema.Types[f.On]
+			if !ok || cond.Kind != "object" && cond.Kind != "interface" && cond.Kind != "union" {
+				return at(sel, "fragment %q is on unknown type %q", sel.Fragment, f.On)
+			}
+			spreading[sel.Fragment] = true
+			if err := x.validate(cond, f.Selections, spreading); err != nil {
+				return err
+			}
+			delete(spreading, sel.Fragment)
+
+		case sel.Inline:
+			cond := t
+			if sel.On != "" {
+				var ok bool
+				cond, ok = x.schema.Types[sel.On]
+				if !ok || cond.Kind != "object" && cond.Kind != "interface" && cond.Kind != "union" {
+					return at(sel, "inline fragment is on unknown type %q", sel.On)
+				}
+			}
+			if err := x.validate(cond, sel.Selections, spreading); err != nil {
+				return err
+			}
+
+		case sel.Name == "__typename":
+			if len(sel.Selections) > 0 {
+				return at(sel, "field \"__typename\" must not have a selection")
+			}
+
+		default:
+			f, ok := t.fields[sel.Name]
+			if !ok {
+				return at(sel, "cannot query field %q on type %q", sel.Name, t.Name)
+			}
+			for _, a := range sel.Args {
+				if !slices.ContainsFunc(f.Args, func(d *gqlInputDef) bool { return d.Name == a.Name }) {
+					return at(sel, "unknown argument %q on field %s.%s", a.Name, t.Name, f.Name)
+				}
+			}
+			for _, d := range f.Args {
+				given := slices.ContainsFunc(sel.Args, func(a gqlNamedValue) bool { return a.Name == d.Name })
+				if d.Type.Kind == '!' && d.Default == nil && !given {
+					return at(sel, "argument %q of type %s is required on field %s.%s", d.Name, d.Type, t.Name, f.Name)
+				}
+			}
+			ft := x.schema.Types[f.Type.named()]
+			leaf := ft.Kind == "scalar" || ft.Kind == "enum"
+			if leaf && len(sel.Selections) > 0 {
+				return at(sel, "field %q must not have a selection since type %q has no subfields", sel.Name, ft.Name)
+			}
+			if !leaf && len(sel.Selections) == 0 {
+				return at(sel, "field %q of type %q must have a selection of subfields", sel.Name, ft.Name)
+			}
+			if err := x.validate(ft, sel.Selections, spreading); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// included evaluates the @skip and @include directives
+func (x *gqlExecutor) included(dirs []gqlDirective, sel *gqlSelection) bool {
+	for _, d := range dirs {
+		if d.Name != "skip" && d.Name != "include" {
+			continue
+		}
+		cond := ""
+		for _, a := range d.Args {
+			if a.Name == "if" {
+				v, _, err := x.coerceInput(gqlBooleanNonNull, a.Value)
+				if err != nil {
+					x.addError(fmt.Sprintf("@%s: %v", d.Name, err), sel, nil)
+					return false
+				}
+				cond = v
+			}
+		}
+		if d.Name == "skip" && cond == "true" || d.Name == "include" && cond != "true" {
+			return false
+		}
+	}
+	return true
+}
+
+type gqlFieldGroup struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// collectFields groups the fields selected on the object type t by their
+// response key, expanding fragments
+func (x *gqlExecutor) collectFields(t *gqlType, sels []*gqlSelection, groups []*gqlFieldGroup, visited map[string]bool) []*gqlFieldGroup {
+	for _, sel := range sels {
+		if !x.included(sel.Directives, sel) {
+			continue
+		}
+		switch {
+		case sel.Fragment != "":
+			if visited[sel.Fragment] {
+				continue
+			}
+			visited[sel.Fragment] = true
+			if f := x.doc.Fragments[sel.Fragment]; x.schema.applies(f.On, t) {
+				groups = x.collectFields(t, f.Selections, groups, visited)
+			}
+		case sel.Inline:
+			if sel.On == "" || x.schema.applies(sel.On, t) {
+				groups = x.collectFields(t, sel.Selections, groups, visited)
+			}
+		default:
+			k := slices.IndexFunc(groups, func(g *gqlFieldGroup) bool { return g.key == sel.key() })
+			if k < 0 {
+				groups = append(groups, &gqlFieldGroup{key: sel.key()})
+				k = len(groups) - 1
+			}
+			groups[k].fields = append(groups[k].fields, sel)
+		}
+	}
+	return groups
+}
+
+// selectionSet resolves the selections on parent, a value of object type
+// t. It returns false when a non-null field was null, making the object
+// itself null.
+func (x *gqlExecutor) selectionSet(t *gqlType, parent string, sels []*gqlSelection, path []any) (gqlObject, bool) {
+	groups := x.collectFields(t, sels, nil, make(map[string]bool))
+	obj := make(gqlObject, 0, len(groups))
+	var parentDict *feather.DictType // parsed on first use
+	for _, g := range groups {
+		sel := g.fields[0]
+		fieldPath := append(path[:len(path):len(path)], g.key)
+		if sel.Name == "__typename" {
+			obj = append(obj, gqlEntry{g.key, t.Name})
+			continue
+		}
+		def := t.fields[sel.Name]
+
+		var value string
+		null := false
+		args, err := x.coerceArgs(def.Args, sel.Args)
+		if err != nil {
+			x.addError(err.Error(), sel, fieldPath)
+			null = true
+		} else if proc := x.resolvers[t.Name+"."+def.Name]; proc != "" {
+			res, err := x.i.Eval(proc + " " + tclQuote(parent, args))
+			if err != nil {
+				x.addError(err.Error(), sel, fieldPath)
+				null = true
+			} else {
+				value = res.String()
+				null = value == "" && x.schema.emptyIsNull(def.Type)
+			}
+		} else {
+			// Without a resolver a field is the key of the same name in
+			// the parent dict
+			if parentDict == nil {
+				if parentDict, err = x.i.ParseDict(parent); err != nil {
+					parentDict = &feather.DictType{}
+				}
+			}
+			if v, ok := parentDict.Items[def.Name]; ok {
+				value = v.String()
+			} else {
+				null = true
+			}
+		}
+
+		var sub []*gqlSelection
+		for _, f := range g.fields {
+			sub = append(sub, f.Selections...)
+		}
+		v, ok := x.complete(def.Type, value, null, sub, sel, fieldPath)
+		if !ok {
+			return nil, false
+		}
+		obj = append(obj, gqlEntry{g.key, v})
+	}
+	return obj, true
+}
+
+// complete converts a resolved value to its result for type ref. It
+// returns false when the value is null but ref is non-null, so the null
+// propagates to the closest nullable parent.
+func (x *gqlExecutor) complete(ref *gqlTypeRef, value string, null bool, sels []*gqlSelection, sel *gqlSelection, path []any) (any, bool) {
+	if ref.Kind == '!' {
+		v, ok := x.completeNullable(ref.Of, value, null, sels, sel, path)
+		if ok && v == nil {
+			x.addError(fmt.Sprintf("cannot return null for non-null type %s", ref), sel, path)
+		}
+		if !ok || v == nil {
+			return nil, false
+		}
+		return v, true
+	}
+	v, ok := x.completeNullable(ref, value, null, sels, sel, path)
+	if !ok {
+		return nil, true
+	}
+	return v, true
+}
+
+func (x *gqlExecutor) completeNullable(ref *gqlTypeRef, value string, null bool, sels []*gqlSelection, sel *gqlSelection, path []any) (any, bool) {
+	if null {
+		return nil, true
+	}
+	if ref.Kind == 'l' {
+		items, err := x.i.ParseList(value)
+		if err != nil {
+			x.addError(fmt.Sprintf("expected a list: %v", err), sel, path)
+			return nil, false
+		}
+		out := make([]any, len(items))
+		for k, item := range items {
+			s := item.String()
+			v, ok := x.complete(ref.Of, s, s == "" && x.schema.emptyIsNull(ref.Of), sels, sel, append(path[:len(path):len(path)], k))
+			if !ok {
+				return nil, false
+			}
+			out[k] = v
+		}
+		return out, true
+	}
+
+	t := x.schema.Types[ref.Name]
+	switch t.Kind {
+	case "scalar":
+		v, err := gqlSerialize(t.Name, value)
+		if err != nil {
+			x.addError(err.Error(), sel, path)
+			return nil, false
+		}
+		return v, true
+
+	case "enum":
+		if !slices.Contains(t.Values, value) {
+			x.addError(fmt.Sprintf("enum %s has no value %q", t.Name, value), sel, path)
+			return nil, false
+		}
+		return value, true
+
+	case "interface", "union":
+		// The value names its concrete type in __typename, unless only
+		// one type is possible
+		possible := x.schema.possibleTypes(t)
+		name := ""
+		if d, err := x.i.ParseDict(value); err == nil {
+			if v, ok := d.Items["__typename"]; ok {
+				name = v.String()
+			}
+		}
+		if name == "" && len(possible) == 1 {
+			name = possible[0]
+		}
+		if !slices.Contains(possible, name) {
+			if name == "" {
+				x.addError(fmt.Sprintf("value of abstract type %s needs a __typename key", t.Name), sel, path)
+			} else {
+				x.addError(fmt.Sprintf("%s is not a possible type of %s", name, t.Name), sel, path)
+			}
+			return nil, false
+		}
+		t = x.schema.Types[name]
+	}
+
+	obj, ok := x.selectionSet(t, value, sels, path)
+	if !ok {
+		return nil, false
+	}
+	return obj, true
+}
+
+// gqlSerialize converts a resolved Tcl value to a scalar result
+func gqlSerialize(scalar, value string) (any, error) {
+	switch scalar {
+	case "Int":
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Int cannot represent %q", value)
+		}
+		return n, nil
+	case "Float":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("Float cannot represent %q", value)
+		}
+		return f, nil
+	case "Boolean":
+		switch strings.ToLower(value) {
+		case "1", "true", "yes", "on":
+			return true, nil
+		case "0", "false", "no", "off":
+			return false, nil
+		}
+		return nil, fmt.Errorf("Boolean cannot represent %q", value)
+	}
+	return value, nil
+}
+
+// coerceArgs returns the field arguments as a Tcl dict. Arguments that
+// are null or not given and have no default are left out.
+func (x *gqlExecutor) coerceArgs(defs []*gqlInputDef, given []gqlNamedValue) (string, error) {
+	var words []string
+	for _, d := range defs {
+		var v *gqlValue
+		for _, a := range given {
+			if a.Name == d.Name {
+				v = a.Value
+			}
+		}
+		s, ok, err := x.coerceField(d, v)
+		if err != nil {
+			return "", fmt.Errorf("argument %q: %v", d.Name, err)
+		}
+		if ok {
+			words = append(words, d.Name, s)
+		}
+	}
+	return tclQuote(words...), nil
+}
+
+// coerceField coerces the value v given for an argument or input field,
+// falling back to its default when v is missing
+func (x *gqlExecutor) coerceField(d *gqlInputDef, v *gqlValue) (string, bool, error) {
+	if v != nil && v.Kind == '$' {
+		if _, ok := x.vars[v.Str]; !ok {
+			if _, ok := x.varDefs[v.Str]; !ok {
+				return "", false, fmt.Errorf("variable $%s is not defined", v.Str)
+			}
+			v = nil
+		}
+	}
+	if v == nil {
+		if d.Default != nil {
+			return x.coerceInput(d.Type, d.Default)
+		}
+		if d.Type.Kind == '!' {
+			return "", false, fmt.Errorf("expected a value of type %s", d.Type)
+		}
+		return "", false, nil
+	}
+	return x.coerceInput(d.Type, v)
+}
+
+// coerceInput coerces a literal to input type ref, returning it in Tcl
+// form and whether it is non-null
+func (x *gqlExecutor) coerceInput(ref *gqlTypeRef, v *gqlValue) (string, bool, error) {
+	if ref.Kind == '!' {
+		s, ok, err := x.coerceInput(ref.Of, v)
+		if err == nil && !ok {
+			err = fmt.Errorf("expected a value of type %s, found null", ref)
+		}
+		return s, ok, err
+	}
+	switch v.Kind {
+	case '$':
+		if _, ok := x.varDefs[v.Str]; !ok {
+			return "", false, fmt.Errorf("variable $%s is not defined", v.Str)
+		}
+		s, ok := x.vars[v.Str]
+		return s, ok, nil
+	case '0':
+		return "", false, nil
+	}
+
+	if ref.Kind == 'l' {
+		if v.Kind != '[' {
+			// A single value is coerced to a list of one
+			s, ok, err := x.coerceInput(ref.Of, v)
+			if err != nil || !ok {
+				return "", ok, err
+			}
+			return tclQuote(s), true, nil
+		}
+		items := make([]string, 0, len(v.List))
+		for _, item := range v.List {
+			s, _, err := x.coerceInput(ref.Of, item)
+			if err != nil {
+				return "", false, err
+			}
+			items = append(items, s)
+		}
+		return tclQuote(items...), true, nil
+	}
+
+	t := x.schema.Types[ref.Name]
+	mismatch := fmt.Errorf("expected a value of type %s, found %s", t.Name, v.describe())
+	switch t.Kind {
+	case "scalar":
+		switch t.Name {
+		case "Int":
+			if v.Kind != 'i' {
+				return "", false, mismatch
+			}
+			if _, err := strconv.ParseInt(v.Str, 10, 32); err != nil {
+				return "", false, fmt.Errorf("Int cannot represent %s", v.Str)
+			}
+		case "Float":
+			if v.Kind != 'i' && v.Kind != 'f' {
+				return "", false, mismatch
+			}
+		case "String":
+			if v.Kind != 's' {
+				return "", false, mismatch
+			}
+		case "ID":
+			if v.Kind != 's' && v.Kind != 'i' {
+				return "", false, mismatch
+			}
+		case "Boolean":
+			if v.Kind != 'b' {
+				return "", false, mismatch
+			}
+		default:
+			if v.Kind == '[' || v.Kind == '{' {
+				return "", false, mismatch
+			}
+		}
+		return v.Str, true, nil
+
+	case "enum":
+		if v.Kind != 'e' || !slices.Contains(t.Values, v.Str) {
+			return "", false, mismatch
+		}
+		return v.Str, true, nil
+
+	case "input":
+		if v.Kind != '{' {
+			return "", false, mismatch
+		}
+		for _, f := range v.Fields {
+			if !slices.ContainsFunc(t.Inputs, func(d *gqlInputDef) bool { return d.Name == f.Name }) {
+				return "", false, fmt.Errorf("%s has no field %q", t.Name, f.Name)
+			}
+		}
+		var words []string
+		for _, d := range t.Inputs {
+			var fv *gqlValue
+			for _, f := range v.Fields {
+				if f.Name == d.Name {
+					fv = f.Value
+				}
+			}
+			s, ok, err := x.coerceField(d, fv)
+			if err != nil {
+				return "", false, fmt.Errorf("%s.%s: %v", t.Name, d.Name, err)
+			}
+			if ok {
+				words = append(words, d.Name, s)
+			}
+		}
+		return tclQuote(words...), true, nil
+	}
+	return "", false, fmt.Errorf("%s is not an input type", t.Name)
+}
+
+// coerceVariable checks a variable value given in Tcl form against its
+// type and normalizes it
+func (x *gqlExecutor) coerceVariable(ref *gqlTypeRef, value string, depth int) (string, error) {
+	if depth > maxJSONDepth {
+		return "", fmt.Errorf("nested too deeply")
+	}
+	if ref.Kind == '!' {
+		return x.coerceVariable(ref.Of, value, depth)
+	}
+	if ref.Kind == 'l' {
+		items, err := x.i.ParseList(value)
+		if err != nil {
+			return "", fmt.Errorf("expected a list: %v", err)
+		}
+		out := make([]string, len(items))
+		for k, item := range items {
+			if out[k], err = x.coerceVariable(ref.Of, item.String(), depth+1); err != nil {
+				return "", err
+			}
+		}
+		return tclQuote(out...), nil
+	}
+
+	t := x.schema.Types[ref.Name]
+	switch t.Kind {
+	case "scalar":
+		switch t.Name {
+		case "Int", "Float", "Boolean":
+			v, err := gqlSerialize(t.Name, value)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprint(v), nil
+		}
+		return value, nil
+
+	case "enum":
+		if !slices.Contains(t.Values, value) {
+			return "", fmt.Errorf("enum %s has no value %q", t.Name, value)
+		}
+		return value, nil
+
+	case "input":
+		d, err := x.i.ParseDict(value)
+		if err != nil {
+			return "", fmt.Errorf("expected a dict for %s: %v", t.Name, err)
+		}
+		for _, k := range d.Order {
+			if !slices.ContainsFunc(t.Inputs, func(def *gqlInputDef) bool { return def.Name == k }) {
+				return "", fmt.Errorf("%s has no field %q", t.Name, k)
+			}
+		}
+		var words []string
+		for _, def := range t.Inputs {
+			if v, ok := d.Items[def.Name]; ok {
+				s, err := x.coerceVariable(def.Type, v.String(), depth+1)
+				if err != nil {
+					return "", fmt.Errorf("%s.%s: %v", t.Name, def.Name, err)
+				}
+				words = append(words, def.Name, s)
+				continue
+			}
+			s, ok, err := x.coerceField(def, nil)
+			if err != nil {
+				return "", fmt.Errorf("%s.%s: %v", t.Name, def.Name, err)
+			}
+			if ok {
+				words = append(words, def.Name, s)
+			}
+		}
+		return tclQuote(words...), nil
+	}
+	return "", fmt.Errorf("%s is not an input type", t.Name)
+}
+
+// ---------------------------------------------------------------------------
+// HTTP endpoint
+
+// gqlTclValue renders a decoded JSON variable in Tcl form. Nulls become
+// empty strings inside lists and are left out of objects.
+func gqlTclValue(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k, val := range v {
+			if val != nil {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		words := make([]string, 0, 2*len(keys))
+		for _, k := range keys {
+			words = append(words, k, gqlTclValue(v[k]))
+		}
+		return tclQuote(words...)
+	case []any:
+		words := make([]string, len(v))
+		for k, item := range v {
+			words[k] = gqlTclValue(item)
+		}
+		return tclQuote(words...)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// serveGraphQL handles GraphQL over HTTP: GET with query parameters, or
+// POST with a JSON body or an application/graphql query
+func serveGraphQL(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query         string          `json:"query"`
+		OperationName string          `json:"operationName"`
+		Variables     json.RawMessage `json:"variables"`
+	}
+	badRequest := func(msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		out, _ := json.Marshal(gqlObject{{"errors", []gqlError{{Message: msg}}}})
+		w.Write(out)
+	}
+
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			req.Variables = json.RawMessage(v)
+		}
+	case "POST":
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxGraphQLBody+1))
+		if err != nil {
+			badRequest(err.Error())
+			return
+		}
+		if len(body) > maxGraphQLBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			badRequest("invalid JSON body: " + err.Error())
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		badRequest("missing query")
+		return
+	}
+
+	vars := ""
+	if len(req.Variables) > 0 && string(req.Variables) != "null" {
+		dec := json.NewDecoder(strings.NewReader(string(req.Variables)))
+		dec.UseNumber()
+		var v map[string]any
+		if err := dec.Decode(&v); err != nil {
+			badRequest("invalid variables: " + err.Error())
+			return
+		}
+		vars = gqlTclValue(v)
+	}
+
+	words := []string{"graphql", "execute", req.Query, "-variables", vars}
+	if req.OperationName != "" {
+		words = append(words, "-operation", req.OperationName)
+	}
+	if r.Method == "GET" {
+		words = append(words, "-readonly")
+	}
+
+	// Resolvers run like route bodies, so they can read the request and
+	// set response headers, and the query is held to max_concurrent and
+	// handler_timeout the same way
+	global := globalLimiter.Load()
+	if !global.tryAcquire() {
+		rejectOverloaded(w)
+		return
+	}
+	ctx := newRequestContext(w, r, nil)
+	var expiry *time.Timer
+	if timeout := time.Duration(handlerTimeout.Load()); timeout > 0 {
+		expiry = time.AfterFunc(timeout, func() { ctx.expire(timeout) })
+	}
+	res, err := state.EvalFor(ctx, tclQuote(words...))
+	// A timeout that fired may still be using ctx
+	reusable := expiry == nil || expiry.Stop()
+	global.release()
+
+	if err != nil {
+		state.handlerFailed(ctx, err)
+	} else {
+		ctx.mu.Lock()
+		if !ctx.Written {
+			ctx.Headers.Store("Content-Type", "application/json")
+			ctx.writeHeader()
+			io.WriteString(ctx.Writer, res.String())
+		}
+		ctx.mu.Unlock()
+	}
+
+	ctx.finishWriters()
+	if deferred := ctx.deferred; len(deferred) > 0 {
+		go runDeferred(state, r.Method, r.URL.Path, deferred)
+	}
+	if reusable && !ctx.held {
+		ctx.release()
+	}
+}
+
+func registerGraphQLCommand(interp *feather.Interp, state *ServerState) {
+	graphqlCmd := &Command{
+		Name:  "graphql",
+		Help:  "Serve a GraphQL API from Tcl resolvers",
+		Usage: "graphql schema SDL ?-path PATH? | graphql resolver TYPE.FIELD PROC | graphql execute QUERY ?-variables DICT? ?-operation NAME? ?-readonly? | graphql resolvers | graphql unmount",
+		Long: `Define a GraphQL schema in the schema definition language and serve it.
+graphql schema mounts the endpoint at PATH (default /graphql), replacing
+any earlier schema. The endpoint takes GET requests with query,
+variables and operationName parameters, and POST requests with a JSON
+body or an application/graphql query. Mutations are refused over GET.
+
+graphql resolver registers PROC for a field, called as PROC PARENT ARGS
+with the parent object's value and the field arguments as dicts (don't
+name the second parameter args, which Tcl makes variadic); an empty
+PROC removes it. Fields without a resolver take the value of the key of
+the same name in the parent dict. Resolvers return dicts for objects and
+lists for lists. Values of interfaces and unions name their type in a
+__typename key.
+
+An empty result is null, except for String, ID and custom scalar fields
+and lists, where it is the empty string or list; leave the key out of the
+parent dict to make those null. Resolver errors become GraphQL errors on
+the field. Resolvers run with the request available, like route bodies,
+and a query is subject to max_concurrent and handler_timeout as a
+route is.
+
+graphql execute runs a query directly and returns the JSON response.
+Only __typename is available for introspection, and subscriptions are
+not supported.
+
+Example:
+  graphql schema {
+    type Query { user(id: ID!): User }
+    type User { id: ID! name: String posts: [Post!]! }
+    type Post { title: String }
+  }
+  proc user {parent a} {
+    dict create id [dict get $a id] name ann posts {{title one}}
+  }
+  graphql resolver Query.user user`,
+		Subcommands: []*Command{
+			{Name: "schema", Help: "Define the schema and mount the endpoint", Usage: "graphql schema SDL ?-path PATH?"},
+			{Name: "resolver", Help: "Set the resolver proc of a field", Usage: "graphql resolver TYPE.FIELD PROC"},
+			{Name: "resolvers", Help: "List resolvers", Usage: "graphql resolvers"},
+			{Name: "execute", Help: "Run a query and return the JSON response", Usage: "graphql execute QUERY ?-variables DICT? ?-operation NAME? ?-readonly?"},
+			{Name: "unmount", Help: "Stop serving the endpoint", Usage: "graphql unmount"},
+		},
+	}
+	registry.Register(graphqlCmd)
+	interp.RegisterCommand("graphql", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"graphql subcommand ?arg ...?\"")
+		}
+		switch args[0].String() {
+		case "schema":
+			if len(args) != 2 && len(args) != 4 {
+				return feather.Error("wrong # args: should be \"graphql schema sdl ?-path path?\"")
+			}
+			path := "/graphql"
+			if len(args) == 4 {
+				if args[2].String() != "-path" {
+					return feather.Errorf("graphql schema: unknown option %q (must be -path)", args[2].String())
+				}
+				path = "/" + strings.Trim(args[3].String(), "/")
+			}
+			schema, err := parseGraphQLSchema(args[1].String())
+			if err != nil {
+				return feather.Errorf("graphql schema: %v", err)
+			}
+			gqlMu.Lock()
+			gqlEndpoint = &gqlMount{Path: path, Schema: schema}
+			gqlMu.Unlock()
+			return feather.OK("")
+
+		case "resolver":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"graphql resolver type.field proc\"")
+			}
+			field := args[1].String()
+			typ, name, ok := strings.Cut(field, ".")
+			if !ok || typ == "" || name == "" {
+				return feather.Errorf("graphql resolver: expected TYPE.FIELD, got %q", field)
+			}
+			gqlMu.Lock()
+			if proc := args[2].String(); proc != "" {
+				gqlResolvers[field] = proc
+			} else {
+				delete(gqlResolvers, field)
+			}
+			gqlMu.Unlock()
+			return feather.OK("")
+
+		case "resolvers":
+			gqlMu.RLock()
+			defer gqlMu.RUnlock()
+			fields := make([]string, 0, len(gqlResolvers))
+			for f := range gqlResolvers {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			kv := make([]any, 0, 2*len(fields))
+			for _, f := range fields {
+				kv = append(kv, f, gqlResolvers[f])
+			}
+			return feather.OK(i.DictKV(kv...))
+
+		case "execute":
+			if len(args) < 2 {
+				return feather.Error("wrong # args: should be \"graphql execute query ?-variables dict? ?-operation name? ?-readonly?\"")
+			}
+			var operation string
+			vars := make(map[string]string)
+			readOnly := false
+			for j := 2; j < len(args); j++ {
+				opt := args[j].String()
+				if opt == "-readonly" {
+					readOnly = true
+					continue
+				}
+				if j+1 >= len(args) {
+					return feather.Errorf("graphql execute: missing value for %s", opt)
+				}
+				j++
+				switch opt {
+				case "-variables":
+					d, err := i.ParseDict(args[j].String())
+					if err != nil {
+						return feather.Errorf("graphql execute: invalid variables: %v", err)
+					}
+					for _, k := range d.Order {
+						vars[k] = d.Items[k].String()
+					}
+				case "-operation":
+					operation = args[j].String()
+				default:
+					return feather.Errorf("graphql execute: unknown option %q (must be -variables, -operation, -readonly)", opt)
+				}
+			}
+			return feather.OK(i.String(gqlExecute(i, args[1].String(), operation, vars, readOnly)))
+
+		case "unmount":
+			gqlMu.Lock()
+			gqlEndpoint = nil
+			gqlMu.Unlock()
+			return feather.OK("")
+
+		default:
+			return feather.Errorf("graphql: unknown subcommand %q (must be schema, resolver, resolvers, execute, unmount)", args[0].String())
+		}
+	})
+}
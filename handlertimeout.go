@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// handlerTimeout is the default time a route handler may run, in
+// nanoseconds; 0 means no limit. Routes override it with -timeout.
+var handlerTimeout atomic.Int64
+
+func registerHandlerTimeoutConfig() {
+	registerConfigKey(&ConfigKey{
+		Name:    "handler_timeout",
+		Help:    "How long a route handler may run before the client gets 503, e.g. 10s (0s = no limit; route -timeout overrides); loops of builtins alone can't be stopped, see help route",
+		Type:    ConfigDuration,
+		Default: "0s",
+		Get:     func() string { return time.Duration(handlerTimeout.Load()).String() },
+		Set: func(value string) error {
+			d, _ := time.ParseDuration(value)
+			handlerTimeout.Store(int64(d))
+			return nil
+		},
+	})
+}
+
+// expire is called when the handler has run for longer than timeout. The
+// client gets 503 unless a response has been started, and every server
+// command the handler calls from now on fails, so it unwinds at the next
+// one. Builtins such as while and set run in the C interpreter without
+// passing through the command hooks, so they can't be interrupted, and
+// feather can't hand break and return through a Go wrapper around them.
+func (ctx *RequestContext) expire(timeout time.Duration) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.finished {
+		return
+	}
+	ctx.timedOut.Store(int64(timeout))
+	logf("handler_timeout %s %s: still running after %s\n", ctx.Request.Method, ctx.Request.URL.Path, timeout)
+	if ctx.Written {
+		return
+	}
+	// With Content-Length and a flush the client has the whole response
+	// while the handler is still unwinding
+	msg := "handler timed out\n"
+	h := ctx.Writer.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(msg)))
+	ctx.Writer.WriteHeader(http.StatusServiceUnavailable)
+	ctx.Writer.Write([]byte(msg))
+	if f, ok := ctx.Writer.(http.Flusher); ok {
+		f.Flush()
+	}
+	ctx.Status = http.StatusServiceUnavailable
+	ctx.Written = true
+}
+
+// expiredErr returns the error commands raise once the handler has timed out
+func (ctx *RequestContext) expiredErr() error {
+	if d := ctx.timedOut.Load(); d != 0 {
+		return fmt.Errorf("handler timed out after %s", time.Duration(d))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// headerPolicy is a set of response headers enforced under a path prefix
+type headerPolicy struct {
+	Prefix  string
+	Names   []string // in the order given
+	Headers map[string]string
+}
+
+var (
+	headerPolicyMu sync.RWMutex
+	headerPolicies = make(map[string]*headerPolicy) // by prefix
+)
+
+// findHeaderPolicies returns the policies matching p, shortest prefix
+// first, so more specific policies are applied last and win
+func findHeaderPolicies(p string) []*headerPolicy {
+	headerPolicyMu.RLock()
+	defer headerPolicyMu.RUnlock()
+	var found []*headerPolicy
+	for prefix, hp := range headerPolicies {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			found = append(found, hp)
+		}
+	}
+	sort.Slice(found, func(a, b int) bool { return len(found[a].Prefix) < len(found[b].Prefix) })
+	return found
+}
+
+// policyWriter applies header policies when the response headers go out,
+// after the handler has set its own, so the policy always has the last word
+type policyWriter struct {
+	http.ResponseWriter
+	policies    []*headerPolicy
+	wroteHeader bool
+}
+
+func (p *policyWriter) apply() {
+	if p.wroteHeader {
+		return
+	}
+	p.wroteHeader = true
+	h := p.Header()
+	for _, hp := range p.policies {
+		for _, name := range hp.Names {
+			if v := hp.Headers[name]; v != "" {
+				h.Set(name, v)
+			} else {
+				h.Del(name)
+			}
+		}
+	}
+}
+
+func (p *policyWriter) WriteHeader(code int) {
+	p.apply()
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *policyWriter) Write(b []byte) (int, error) {
+	p.apply()
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *policyWriter) Flush() {
+	p.apply()
+	if f, ok := p.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (p *policyWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+func registerHeadersCommand(interp *feather.Interp, state *ServerState) {
+	headersCmd := &Command{
+		Name:  "headers",
+		Help:  "Enforce response headers for every response under a path",
+		Usage: "headers SUBCOMMAND ?ARG ...?",
+		Long: `headers policy sets headers on every response whose path is PREFIX or
+below it: routes, static and asset mounts, tus and WebDAV, and error
+responses. They are applied as the response headers are sent, so they
+override whatever the handler set. An empty value removes the header.
+
+When several policies match, all are applied, longest prefix last.
+Setting a policy for a prefix again replaces it.
+
+Example:
+  headers policy / {X-Content-Type-Options nosniff X-Frame-Options DENY}
+  headers policy /account {Cache-Control no-store}
+  headers policy /embed {X-Frame-Options {}}`,
+		Subcommands: []*Command{
+			{Name: "policy", Help: "Set the headers for PREFIX", Usage: "headers policy PREFIX DICT"},
+			{Name: "remove", Help: "Remove the policy for PREFIX", Usage: "headers remove PREFIX"},
+			{Name: "policies", Help: "List policies as dicts", Usage: "headers policies"},
+		},
+	}
+	registry.Register(headersCmd)
+	interp.RegisterCommand("headers", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"headers subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "policy":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"headers policy prefix dict\"")
+			}
+			items, err := i.ParseList(args[2].String())
+			if err != nil {
+				return feather.Errorf("headers policy: %v", err)
+			}
+			if len(items)%2 != 0 {
+				return feather.Error("headers policy: missing value for header")
+			}
+			hp := &headerPolicy{
+				Prefix:  "/" + strings.Trim(args[1].String(), "/"),
+				Headers: make(map[string]string),
+			}
+			for j := 0; j < len(items); j += 2 {
+				name := http.CanonicalHeaderKey(items[j].String())
+				if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+					return feather.Errorf("headers policy: invalid header name %q", items[j].String())
+				}
+				value := items[j+1].String()
+				if strings.ContainsAny(value, "\r\n") {
+					return feather.Errorf("headers policy: invalid value for %s", name)
+				}
+				if _, ok := hp.Headers[name]; !ok {
+					hp.Names = append(hp.Names, name)
+				}
+				hp.Headers[name] = value
+			}
+			headerPolicyMu.Lock()
+			headerPolicies[hp.Prefix] = hp
+			headerPolicyMu.Unlock()
+			return feather.OK("")
+
+		case "remove":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"headers remove prefix\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			headerPolicyMu.Lock()
+			defer headerPolicyMu.Unlock()
+			if _, ok := headerPolicies[prefix]; !ok {
+				return feather.Errorf("headers remove: no policy for %q", prefix)
+			}
+			delete(headerPolicies, prefix)
+			return feather.OK("")
+
+		case "policies":
+			headerPolicyMu.RLock()
+			defer headerPolicyMu.RUnlock()
+			prefixes := make([]string, 0, len(headerPolicies))
+			for prefix := range headerPolicies {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			items := make([]*feather.Obj, 0, len(prefixes))
+			for _, prefix := range prefixes {
+				hp := headerPolicies[prefix]
+				kv := make([]any, 0, 2*len(hp.Names))
+				for _, name := range hp.Names {
+					kv = append(kv, name, hp.Headers[name])
+				}
+				items = append(items, i.DictKV("prefix", hp.Prefix, "headers", i.DictKV(kv...)))
+			}
+			return feather.OK(i.List(items...))
+
+		default:
+			return feather.Errorf("headers: unknown subcommand %q (must be policy, remove, policies)", subcmd)
+		}
+	})
+}
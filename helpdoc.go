@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// helpEndpoint turns on GET /_commands
+var helpEndpoint atomic.Bool
+
+// SetHelp sets the help text of a command, creating the entry if needed.
+// Empty arguments leave the current text.
+func (r *CommandRegistry) SetHelp(name, usage, short, long string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var c *Command
+	for _, cmd := range r.commands {
+		if cmd.Name == name {
+			c = cmd
+			break
+		}
+	}
+	if c == nil {
+		c = &Command{Name: name}
+		r.commands = append(r.commands, c)
+	}
+	if usage != "" {
+		c.Usage = usage
+	}
+	if short != "" {
+		c.Help = short
+	}
+	if long != "" {
+		c.Long = long
+	}
+}
+
+// selectLocked returns every command, or just the named one. r.mu must be
+// held.
+func (r *CommandRegistry) selectLocked(name string) ([]*Command, error) {
+	if name == "" {
+		return r.commands, nil
+	}
+	for _, cmd := range r.commands {
+		if cmd.Name == name {
+			return []*Command{cmd}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown command %q", name)
+}
+
+// JSON renders the commands (or the named one) as a JSON array
+func (r *CommandRegistry) JSON(name string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmds, err := r.selectLocked(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(cmds, "", "  ")
+	return string(data), err
+}
+
+// Markdown renders the commands (or the named one) as a Markdown reference
+func (r *CommandRegistry) Markdown(name string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmds, err := r.selectLocked(name)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if name == "" {
+		sb.WriteString("# Command Reference\n")
+	}
+	for _, c := range cmds {
+		writeCommandMarkdown(&sb, c, c.Name, 2)
+	}
+	return sb.String(), nil
+}
+
+func writeCommandMarkdown(sb *strings.Builder, c *Command, title string, level int) {
+	fmt.Fprintf(sb, "\n%s %s\n\n", strings.Repeat("#", min(level, 6)), title)
+	if c.Help != "" {
+		sb.WriteString(c.Help + "\n\n")
+	}
+	if c.Usage != "" {
+		fmt.Fprintf(sb, "```\n%s\n```\n\n", c.Usage)
+	}
+	if c.Long != "" {
+		// Long help is preformatted text with indented examples
+		fmt.Fprintf(sb, "```text\n%s\n```\n\n", strings.TrimRight(c.Long, "\n"))
+	}
+	for _, sub := range c.Subcommands {
+		writeCommandMarkdown(sb, sub, title+" "+sub.Name, level+1)
+	}
+}
+
+// serveHelp serves the command registry as JSON at /_commands
+func serveHelp(w http.ResponseWriter, r *http.Request) {
+	out, err := registry.JSON("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(out))
+}
+
+// registerHelpConfig registers the help_endpoint setting
+func registerHelpConfig() {
+	registerConfigKey(&ConfigKey{
+		Name:    "help_endpoint",
+		Help:    "Serve the command reference as JSON at GET /_commands",
+		Type:    ConfigBool,
+		Default: "0",
+		Get: func() string {
+			if helpEndpoint.Load() {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(value string) error {
+			helpEndpoint.Store(value == "1")
+			return nil
+		},
+	})
+}
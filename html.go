@@ -0,0 +1,40 @@
+package main
+
+import (
+	"html"
+
+	"github.com/feather-lang/feather"
+)
+
+func registerHTMLCommand(interp *feather.Interp, state *ServerState) {
+	htmlCmd := &Command{
+		Name:  "html",
+		Help:  "Escape text for HTML",
+		Usage: "html SUBCOMMAND STR",
+		Long: `Use html escape on any untrusted text put into HTML built outside the
+template engine, e.g. fragments streamed over SSE. It escapes < > & ' and "
+so the result is safe in element content and quoted attribute values.
+
+Example:
+  respond -to feed "data: <li>[html escape $text]</li>\n\n"
+  flush -to feed`,
+		Subcommands: []*Command{
+			{Name: "escape", Help: "Escape < > & ' and \"", Usage: "html escape STR"},
+			{Name: "unescape", Help: "Decode entities such as &lt; and &#39;", Usage: "html unescape STR"},
+		},
+	}
+	registry.Register(htmlCmd)
+	interp.RegisterCommand("html", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"html escape|unescape str\"")
+		}
+		switch args[0].String() {
+		case "escape":
+			return feather.OK(i.String(html.EscapeString(args[1].String())))
+		case "unescape":
+			return feather.OK(i.String(html.UnescapeString(args[1].String())))
+		default:
+			return feather.Errorf("html: unknown subcommand %q (must be escape, unescape)", args[0].String())
+		}
+	})
+}
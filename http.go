@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+const (
+	httpDefaultTimeout = 30 * time.Second
+	httpDefaultMax     = 10 << 20 // largest response body read by default
+	httpDefaultBackoff = 200 * time.Millisecond
+	httpStreamChunk    = 32 << 10
+)
+
+var httpMethods = map[string]string{
+	"get": "GET", "post": "POST", "put": "PUT", "patch": "PATCH",
+	"delete": "DELETE", "head": "HEAD", "options": "OPTIONS",
+}
+
+// httpIdempotent are the methods that are safe to send again
+var httpIdempotent = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "PUT": true, "DELETE": true}
+
+// httpRetryable reports whether a failed attempt is worth repeating:
+// no response at all, or a status saying the server is busy or down
+func httpRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the wait a response asks for in Retry-After, if any
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := resp.Header.Get("Retry-After")
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// httpDo sends a request, retrying up to retries times with exponential
+// backoff while the attempts fail and time is left before the deadline
+func httpDo(ctx context.Context, client *http.Client, method, url, body string, hasBody bool, header http.Header, retries int, backoff time.Duration) (*http.Response, error) {
+	delay := backoff
+	for attempt := 0; ; attempt++ {
+		var r io.Reader
+		if hasBody {
+			r = strings.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, r)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+		resp, err := client.Do(req)
+		if attempt == retries || !httpRetryable(resp, err) {
+			return resp, err
+		}
+
+		// Jitter the wait over the upper half of the delay, so clients that
+		// failed together don't retry together
+		wait := delay/2 + rand.N(delay/2+1)
+		wait = max(wait, retryAfter(resp))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, httpStreamChunk))
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func registerHTTPCommand(interp *feather.Interp, state *ServerState) {
+	httpCmd := &Command{
+		Name:  "http",
+		Help:  "Make HTTP requests to other servers",
+		Usage: "http get|post|put|patch|delete|head|options URL ?OPTIONS? | http tls HOST ?-ca FILE? ?-insecure BOOL?",
+		Long: `Send a request to URL and return a dict with the response status,
+headers and body. Header names are lower case; repeated headers are
+joined with ", ". Error statuses are returned like any other; only a
+request that gets no response at all is an error.
+
+Options:
+  -headers DICT       request headers
+  -query DICT         parameters added to the URL's query string
+  -body DATA          request body
+  -form DICT          urlencoded form body
+  -type TYPE          Content-Type of the body
+  -timeout DURATION   give up after this long, retries included (default 30s)
+  -proxy URL          proxy for this request, or direct for none
+  -max BYTES          largest response body to read (default 10MB)
+  -retries N          retry get, head, options, put and delete up to N times
+  -backoff DURATION   wait before the first retry, doubling each time (default 200ms)
+  -stream PROC        call PROC with each chunk of the body as it arrives
+
+Retries happen when there is no response or the status is 429, 502, 503
+or 504. The waits are jittered and honor Retry-After, and no retry starts
+that can't finish before the timeout. With -stream the body in the
+result is empty and -max does not apply; an error from PROC stops the
+transfer.
+
+http tls sets certificate checks for HTTPS requests to HOST: -ca
+replaces the system roots with the PEM certificates in FILE (or
+embed://), and -insecure 1 accepts any certificate HOST presents, which
+is only for development against self-signed servers. Empty -ca and
+-insecure 0 restore the defaults. The settings apply to http, proxy
+mounts, oauth2 and oidc, and are returned as a dict. Other hosts always
+get the standard verification against the system roots.
+
+Connections follow the dial_*, outbound_proxy and outbound_* pool
+settings. Within a request, the timeout is capped by the request
+deadline. The call blocks the interpreter until the response arrives,
+so keep timeouts short; for the same reason a route can't call routes
+of its own server.
+
+Example:
+  set r [http get https://api.example.com/users -headers {Accept application/json} -timeout 5s -retries 2]
+  if {[dict get $r status] == 200} {
+      respond [dict get $r body]
+  }
+  http tls dev.internal -ca certs/dev-ca.pem`,
+	}
+	for _, m := range []string{"get", "post", "put", "patch", "delete", "head", "options"} {
+		httpCmd.Subcommands = append(httpCmd.Subcommands, &Command{
+			Name:  m,
+			Help:  "Send a " + httpMethods[m] + " request",
+			Usage: "http " + m + " URL ?OPTIONS?",
+		})
+	}
+	httpCmd.Subcommands = append(httpCmd.Subcommands, &Command{
+		Name:  "tls",
+		Help:  "Set the CA bundle or skip verification for a host",
+		Usage: "http tls HOST ?-ca FILE? ?-insecure BOOL?",
+	})
+	registry.Register(httpCmd)
+
+	interp.RegisterCommand("http", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 || len(args)%2 != 0 {
+			return feather.Error("wrong # args: should be \"http method url ?-option value ...?\"")
+		}
+		sub := args[0].String()
+		if sub == "tls" {
+			return httpTLS(i, args[1:])
+		}
+		method, ok := httpMethods[sub]
+		if !ok {
+			return feather.Errorf("http: unknown subcommand %q (must be get, post, put, patch, delete, head, options, tls)", sub)
+		}
+		u, err := url.Parse(args[1].String())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return feather.Errorf("http %s: invalid URL %q", sub, args[1].String())
+		}
+
+		var (
+			body     string
+			hasBody  bool
+			ctype    string
+			proxy    string
+			stream   string
+			retries  int
+			backoff  = httpDefaultBackoff
+			timeout  = httpDefaultTimeout
+			maxBytes = int64(httpDefaultMax)
+			headers  = make(http.Header)
+		)
+		for j := 2; j < len(args); j += 2 {
+			opt, val := args[j].String(), args[j+1].String()
+			switch opt {
+			case "-headers", "-query", "-form":
+				d, err := i.ParseDict(val)
+				if err != nil {
+					return feather.Errorf("http %s: %s: %v", sub, opt, err)
+				}
+				switch opt {
+				case "-headers":
+					for _, k := range d.Order {
+						headers.Add(k, d.Items[k].String())
+					}
+				case "-query":
+					q := u.Query()
+					for _, k := range d.Order {
+						q.Add(k, d.Items[k].String())
+					}
+					u.RawQuery = q.Encode()
+				case "-form":
+					form := make(url.Values)
+					for _, k := range d.Order {
+						form.Add(k, d.Items[k].String())
+					}
+					body, hasBody = form.Encode(), true
+					if ctype == "" {
+						ctype = "application/x-www-form-urlencoded"
+					}
+				}
+			case "-body":
+				body, hasBody = val, true
+			case "-type":
+				ctype = val
+			case "-timeout", "-backoff":
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					return feather.Errorf("http %s: invalid %s %q", sub, opt[1:], val)
+				}
+				if opt == "-timeout" {
+					timeout = d
+				} else {
+					backoff = d
+				}
+			case "-proxy":
+				proxy = val
+			case "-max":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					return feather.Errorf("http %s: invalid -max %q", sub, val)
+				}
+				maxBytes = n
+			case "-retries":
+				n, err := parseNonNegativeInt(val)
+				if err != nil {
+					return feather.Errorf("http %s: invalid -retries %q", sub, val)
+				}
+				retries = n
+			case "-stream":
+				stream = val
+			default:
+				return feather.Errorf("http %s: unknown option %q (must be -headers, -query, -body, -form, -type, -timeout, -proxy, -max, -retries, -backoff, -stream)", sub, opt)
+			}
+		}
+		if retries > 0 && !httpIdempotent[method] {
+			return feather.Errorf("http %s: -retries only applies to get, head, options, put and delete", sub)
+		}
+		if ctype != "" {
+			headers.Set("Content-Type", ctype)
+		} else if hasBody && headers.Get("Content-Type") == "" {
+			headers.Set("Content-Type", "application/octet-stream")
+		}
+
+		// The timeout covers all attempts, so it is set on the context
+		// rather than the client
+		client, err := outboundClientVia(0, proxy)
+		if err != nil {
+			return feather.Errorf("http %s: %v", sub, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), state.GetRequestContext().downstreamTimeout(timeout))
+		defer cancel()
+		resp, err := httpDo(ctx, client, method, u.String(), body, hasBody, headers, retries, backoff)
+		if err != nil {
+			return feather.Errorf("http %s: %v", sub, err)
+		}
+		defer resp.Body.Close()
+
+		var data []byte
+		if stream != "" {
+			buf := make([]byte, httpStreamChunk)
+			for {
+				n, err := resp.Body.Read(buf)
+				if n > 0 {
+					if _, perr := i.Eval(stream + " " + tclQuote(string(buf[:n]))); perr != nil {
+						return feather.Errorf("http %s: %s: %v", sub, stream, perr)
+					}
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return feather.Errorf("http %s: reading response: %v", sub, err)
+				}
+			}
+		} else {
+			data, err = io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+			if err != nil {
+				return feather.Errorf("http %s: reading response: %v", sub, err)
+			}
+			if int64(len(data)) > maxBytes {
+				return feather.Errorf("http %s: response body larger than %d bytes", sub, maxBytes)
+			}
+		}
+
+		names := make([]string, 0, len(resp.Header))
+		for k := range resp.Header {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		kv := make([]any, 0, 2*len(names))
+		for _, k := range names {
+			kv = append(kv, strings.ToLower(k), strings.Join(resp.Header[k], ", "))
+		}
+		return feather.OK(i.DictKV("status", resp.StatusCode, "headers", i.DictKV(kv...), "body", i.String(string(data))))
+	})
+}
+
+// httpTLS implements http tls HOST ?-ca FILE? ?-insecure BOOL?
+func httpTLS(i *feather.Interp, args []*feather.Obj) feather.Result {
+	if len(args)%2 != 1 {
+		return feather.Error("wrong # args: should be \"http tls host ?-ca file? ?-insecure bool?\"")
+	}
+	host := args[0].String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	h := &hostTLS{}
+	if cur := getHostTLS(host); cur != nil {
+		h.caFile, h.roots, h.insecure = cur.caFile, cur.roots, cur.insecure
+	}
+	for j := 1; j < len(args); j += 2 {
+		val := args[j+1].String()
+		switch args[j].String() {
+		case "-ca":
+			h.caFile, h.roots = val, nil
+			if val == "" {
+				continue
+			}
+			data, err := readPath(val)
+			if err != nil {
+				return feather.Errorf("http tls: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return feather.Errorf("http tls: no PEM certificates in %s", val)
+			}
+			h.roots = pool
+		case "-insecure":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return feather.Errorf("http tls: expected boolean for -insecure, got %q", val)
+			}
+			h.insecure = b
+		default:
+			return feather.Errorf("http tls: unknown option %q (must be -ca, -insecure)", args[j].String())
+		}
+	}
+	if len(args) > 1 {
+		if h.caFile == "" && !h.insecure {
+			setHostTLS(host, nil)
+		} else {
+			setHostTLS(host, h)
+		}
+	}
+	insecure := "0"
+	if h.insecure {
+		insecure = "1"
+	}
+	return feather.OK(i.DictKV("ca", h.caFile, "insecure", insecure))
+}
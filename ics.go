@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// icsFeed accumulates the events of a calendar built during a request
+type icsFeed struct {
+	name   string
+	prodID string
+	events []icsEvent
+}
+
+type icsEvent struct {
+	uid         string
+	start, end  time.Time
+	allDay      bool
+	summary     string
+	description string
+	location    string
+	url         string
+	status      string
+	rrule       string
+	categories  []string
+}
+
+// parseICSTime accepts unix seconds, RFC 3339, "YYYY-MM-DD HH:MM[:SS]"
+// (UTC) or a bare date, which marks an all-day event
+func parseICSTime(s string) (time.Time, bool, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), false, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), false, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, false, nil
+		}
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid time %q", s)
+}
+
+// icsEscape escapes a TEXT value (RFC 5545 3.3.11)
+func icsEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// icsWriteLine writes a content line folded at 75 octets without splitting
+// UTF-8 sequences
+func icsWriteLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // the leading space counts
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func (e icsEvent) write(b *strings.Builder, stamp string) {
+	icsWriteLine(b, "BEGIN:VEVENT")
+	icsWriteLine(b, "UID:"+icsEscape(e.uid))
+	icsWriteLine(b, "DTSTAMP:"+stamp)
+	if e.allDay {
+		icsWriteLine(b, "DTSTART;VALUE=DATE:"+e.start.Format("20060102"))
+		if !e.end.IsZero() {
+			icsWriteLine(b, "DTEND;VALUE=DATE:"+e.end.Format("20060102"))
+		}
+	} else {
+		icsWriteLine(b, "DTSTART:"+e.start.Format("20060102T150405Z"))
+		if !e.end.IsZero() {
+			icsWriteLine(b, "DTEND:"+e.end.Format("20060102T150405Z"))
+		}
+	}
+	icsWriteLine(b, "SUMMARY:"+icsEscape(e.summary))
+	if e.description != "" {
+		icsWriteLine(b, "DESCRIPTION:"+icsEscape(e.description))
+	}
+	if e.location != "" {
+		icsWriteLine(b, "LOCATION:"+icsEscape(e.location))
+	}
+	if e.url != "" {
+		icsWriteLine(b, "URL:"+e.url)
+	}
+	if e.status != "" {
+		icsWriteLine(b, "STATUS:"+e.status)
+	}
+	if e.rrule != "" {
+		icsWriteLine(b, "RRULE:"+e.rrule)
+	}
+	if len(e.categories) > 0 {
+		cats := make([]string, len(e.categories))
+		for k, c := range e.categories {
+			cats[k] = icsEscape(c)
+		}
+		icsWriteLine(b, "CATEGORIES:"+strings.Join(cats, ","))
+	}
+	icsWriteLine(b, "END:VEVENT")
+}
+
+func (f *icsFeed) render() string {
+	var b strings.Builder
+	icsWriteLine(&b, "BEGIN:VCALENDAR")
+	icsWriteLine(&b, "VERSION:2.0")
+	icsWriteLine(&b, "PRODID:"+f.prodID)
+	icsWriteLine(&b, "CALSCALE:GREGORIAN")
+	icsWriteLine(&b, "METHOD:PUBLISH")
+	if f.name != "" {
+		icsWriteLine(&b, "X-WR-CALNAME:"+icsEscape(f.name))
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, e := range f.events {
+		e.write(&b, stamp)
+	}
+	icsWriteLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// parseICSEvent parses ics event options
+func parseICSEvent(i *feather.Interp, args []*feather.Obj) (icsEvent, error) {
+	var e icsEvent
+	if len(args)%2 != 0 {
+		return e, fmt.Errorf("missing value for %s", args[len(args)-1].String())
+	}
+	var startStr, endStr string
+	for j := 0; j < len(args); j += 2 {
+		val := args[j+1].String()
+		switch args[j].String() {
+		case "-uid":
+			e.uid = val
+		case "-start":
+			startStr = val
+		case "-end":
+			endStr = val
+		case "-summary":
+			e.summary = val
+		case "-description":
+			e.description = val
+		case "-location":
+			e.location = val
+		case "-url":
+			e.url = val
+		case "-status":
+			switch strings.ToUpper(val) {
+			case "TENTATIVE", "CONFIRMED", "CANCELLED":
+				e.status = strings.ToUpper(val)
+			default:
+				return e, fmt.Errorf("-status must be tentative, confirmed or cancelled, got %q", val)
+			}
+		case "-rrule":
+			e.rrule = val
+		case "-categories":
+			items, err := i.ParseList(val)
+			if err != nil {
+				return e, fmt.Errorf("-categories: %v", err)
+			}
+			for _, c := range items {
+				e.categories = append(e.categories, c.String())
+			}
+		default:
+			return e, fmt.Errorf("unknown option %q (must be -uid, -start, -end, -summary, -description, -location, -url, -status, -rrule, -categories)", args[j].String())
+		}
+	}
+	if startStr == "" {
+		return e, fmt.Errorf("missing -start")
+	}
+	var err error
+	e.start, e.allDay, err = parseICSTime(startStr)
+	if err != nil {
+		return e, fmt.Errorf("-start: %v", err)
+	}
+	if endStr != "" {
+		var endAllDay bool
+		e.end, endAllDay, err = parseICSTime(endStr)
+		if err != nil {
+			return e, fmt.Errorf("-end: %v", err)
+		}
+		if endAllDay != e.allDay {
+			return e, fmt.Errorf("-start and -end must both be dates or both be times")
+		}
+		if e.end.Before(e.start) {
+			return e, fmt.Errorf("-end is before -start")
+		}
+	}
+	if e.uid == "" {
+		// Stable across renders so clients update events instead of duplicating them
+		sum := sha1.Sum([]byte(startStr + "\x00" + e.summary + "\x00" + e.location))
+		e.uid = hex.EncodeToString(sum[:10]) + "@feather-httpd"
+	}
+	return e, nil
+}
+
+func registerICSCommand(interp *feather.Interp, state *ServerState) {
+	icsCmd := &Command{
+		Name:  "ics",
+		Help:  "Build and serve iCalendar (ICS) feeds",
+		Usage: "ics SUBCOMMAND ?ARG ...?",
+		Long: `Events added with ics event accumulate in a feed for the current request;
+ics respond sends it as text/calendar. Times are unix seconds, RFC 3339 or
+"YYYY-MM-DD HH:MM" in UTC; a bare YYYY-MM-DD makes an all-day event.
+Without -uid, a UID is derived from start, summary and location so
+subscribed clients update events rather than duplicating them.
+
+Example:
+  route GET /schedule.ics {
+      ics calendar -name "Team schedule"
+      foreach {start end title} [schedule] {
+          ics event -start $start -end $end -summary $title
+      }
+      ics respond -filename schedule.ics
+  }`,
+		Subcommands: []*Command{
+			{Name: "calendar", Help: "Set calendar properties", Usage: "ics calendar ?-name NAME? ?-prodid ID?"},
+			{Name: "event", Help: "Add an event", Usage: "ics event -start TIME ?-end TIME? -summary TEXT ?-description TEXT? ?-location TEXT? ?-url URL? ?-uid UID? ?-status S? ?-rrule RULE? ?-categories LIST?"},
+			{Name: "render", Help: "Get the feed as text", Usage: "ics render"},
+			{Name: "respond", Help: "Send the feed as text/calendar", Usage: "ics respond ?-filename NAME?"},
+			{Name: "clear", Help: "Drop the accumulated events", Usage: "ics clear"},
+		},
+	}
+	registry.Register(icsCmd)
+	interp.RegisterCommand("ics", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"ics subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			return feather.Errorf("ics %s: not in request context", subcmd)
+		}
+		if ctx.ics == nil {
+			ctx.ics = &icsFeed{prodID: "-//feather-httpd//ics//EN"}
+		}
+		feed := ctx.ics
+
+		switch subcmd {
+		case "calendar":
+			if len(args)%2 != 1 {
+				return feather.Error("wrong # args: should be \"ics calendar ?-name name? ?-prodid id?\"")
+			}
+			for j := 1; j < len(args); j += 2 {
+				switch args[j].String() {
+				case "-name":
+					feed.name = args[j+1].String()
+				case "-prodid":
+					feed.prodID = args[j+1].String()
+				default:
+					return feather.Errorf("ics calendar: unknown option %q (must be -name, -prodid)", args[j].String())
+				}
+			}
+			return feather.OK("")
+		case "event":
+			e, err := parseICSEvent(i, args[1:])
+			if err != nil {
+				return feather.Errorf("ics event: %v", err)
+			}
+			feed.events = append(feed.events, e)
+			return feather.OK(i.String(e.uid))
+		case "render":
+			return feather.OK(i.String(feed.render()))
+		case "respond":
+			var filename string
+			if len(args) == 3 && args[1].String() == "-filename" {
+				filename = args[2].String()
+			} else if len(args) != 1 {
+				return feather.Error("wrong # args: should be \"ics respond ?-filename name?\"")
+			}
+			ctx.Headers.Store("Content-Type", "text/calendar; charset=utf-8")
+			if filename != "" {
+				ctx.Headers.Store("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+			}
+			body := feed.render()
+			ctx.mu.Lock()
+			defer ctx.mu.Unlock()
+			ctx.writeHeader()
+			ctx.Writer.Write([]byte(body))
+			return feather.OK("")
+		case "clear":
+			feed.events = nil
+			return feather.OK("")
+		default:
+			return feather.Errorf("ics: unknown subcommand %q (must be calendar, event, render, respond, clear)", subcmd)
+		}
+	})
+}
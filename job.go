@@ -0,0 +1,453 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// job is a script run by async on a worker goroutine
+type job struct {
+	id        string
+	body      string
+	vars      map[string]string
+	channel   string // channel that started it, which main runs on
+	cancelled atomic.Bool
+	done      chan struct{} // closed once the job has finished, failed or been cancelled
+
+	mu       sync.Mutex
+	status   string // queued, running, done, error or cancelled
+	result   string
+	err      string
+	queued   time.Time
+	started  time.Time
+	finished time.Time
+}
+
+// jobManager runs jobs, at most workers at a time, in submission order
+type jobManager struct {
+	state     *ServerState // whose interpreter main bridges to
+	mu        sync.Mutex
+	jobs      map[string]*job
+	queue     []*job
+	running   int
+	workers   int
+	retention time.Duration // how long finished jobs can still be awaited
+	nextID    int
+}
+
+var jobs = &jobManager{jobs: make(map[string]*job), workers: 4, retention: 10 * time.Minute}
+
+func (m *jobManager) get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+func (m *jobManager) submit(body string, vars map[string]string, channel string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	j := &job{
+		id:      "job" + strconv.Itoa(m.nextID),
+		body:    body,
+		vars:    vars,
+		channel: channel,
+		done:    make(chan struct{}),
+		status:  "queued",
+		queued:  time.Now(),
+	}
+	m.jobs[j.id] = j
+	m.queue = append(m.queue, j)
+	m.startLocked()
+	return j
+}
+
+// startLocked starts queued jobs while workers are free
+func (m *jobManager) startLocked() {
+	for m.running < m.workers && len(m.queue) > 0 {
+		j := m.queue[0]
+		m.queue = m.queue[1:]
+		if j.cancelled.Load() {
+			continue
+		}
+		m.running++
+		go m.run(j)
+	}
+}
+
+func (m *jobManager) run(j *job) {
+	defer func() {
+		m.mu.Lock()
+		m.running--
+		m.startLocked()
+		m.mu.Unlock()
+	}()
+
+	j.mu.Lock()
+	if j.status != "queued" {
+		// Cancelled between leaving the queue and starting
+		j.mu.Unlock()
+		return
+	}
+	j.status, j.started = "running", time.Now()
+	j.mu.Unlock()
+
+	result, err := runJobScript(m.state, j)
+
+	j.mu.Lock()
+	switch {
+	case j.cancelled.Load():
+		j.status = "cancelled"
+	case err != nil:
+		j.status, j.err = "error", err.Error()
+	default:
+		j.status, j.result = "done", result
+	}
+	j.mu.Unlock()
+	m.finish(j)
+}
+
+// finish marks j finished and forgets it after the retention period
+func (m *jobManager) finish(j *job) {
+	j.mu.Lock()
+	j.finished = time.Now()
+	j.mu.Unlock()
+	close(j.done)
+
+	m.mu.Lock()
+	retention := m.retention
+	m.mu.Unlock()
+	time.AfterFunc(retention, func() {
+		m.mu.Lock()
+		delete(m.jobs, j.id)
+		m.mu.Unlock()
+	})
+}
+
+// cancel stops a queued job, or asks a running one to stop at its next
+// call of a Go command. It reports false for a job that has already
+// finished.
+func (m *jobManager) cancel(j *job) bool {
+	j.mu.Lock()
+	status := j.status
+	if status == "queued" || status == "running" {
+		j.cancelled.Store(true)
+	}
+	if status == "queued" {
+		j.status = "cancelled"
+	}
+	j.mu.Unlock()
+
+	if status == "queued" {
+		m.finish(j)
+	}
+	return status == "queued" || status == "running"
+}
+
+// runJobScript evaluates the job in a new interpreter of its own, with the
+// commands that are safe away from the interpreter loop and main, which
+// bridges back to it
+func runJobScript(state *ServerState, j *job) (string, error) {
+	interp := feather.New()
+	defer interp.Close()
+
+	// A state of its own: the job has no request or connections
+	worker := &ServerState{channel: ChannelScript}
+	registerJobInterpCommands(interp, worker, state, j.channel)
+
+	// Builtins such as set and while run in C and can't be stopped, so a
+	// cancelled job fails at its next call of one of the commands above
+	cmds := interp.Internal().Commands
+	for name, fn := range cmds {
+		cmds[name] = func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+			if j.cancelled.Load() {
+				i.SetErrorString("job cancelled")
+				return feather.ResultError
+			}
+			return callRecovered(name, fn, i, cmd, args, nil)
+		}
+	}
+
+	for k, v := range j.vars {
+		interp.SetVar(k, v)
+	}
+	res, err := interp.Eval(j.body)
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+// registerJobInterpCommands gives a job interpreter the data, storage and
+// client commands, which don't touch requests or the route table. main
+// runs on channel, so a job can't do more than the code that started it.
+func registerJobInterpCommands(interp *feather.Interp, worker, state *ServerState, channel string) {
+	for _, register := range []func(*feather.Interp, *ServerState){
+		registerJSONCommand, registerCBORCommand, registerXMLCommand,
+		registerYAMLCommand, registerTOMLCommand, registerCryptoCommand,
+		registerEncodingCommands, registerURLCommand, registerHTMLCommand,
+		registerMarkdownCommand, registerHTTPCommand, registerRedisCommand,
+		registerDBCommand, registerCacheCommand, registerKVCommand,
+		registerChanCommand, registerMetricCommand,
+	} {
+		register(interp, worker)
+	}
+	interp.RegisterCommand("puts", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"puts string\"")
+		}
+		logf("%s\n", args[0].String())
+		return feather.OK("")
+	})
+	interp.RegisterCommand("sleep", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"sleep ms\"")
+		}
+		d, err := parseTimerMS("sleep", args[0].String())
+		if err != nil {
+			return feather.Error(err.Error())
+		}
+		time.Sleep(d)
+		return feather.OK("")
+	})
+	interp.RegisterCommand("main", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"main script\"")
+		}
+		res, err := state.EvalIn(channel, args[0].String())
+		if err != nil {
+			return feather.Errorf("main: %v", err)
+		}
+		return feather.OK(i.String(res.String()))
+	})
+}
+
+// jobInfo describes a job for job status
+func jobInfo(i *feather.Interp, j *job) *feather.Obj {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	kvs := []any{"id", j.id, "status", j.status, "queued", j.queued.Format(time.RFC3339)}
+	if !j.started.IsZero() {
+		kvs = append(kvs, "started", j.started.Format(time.RFC3339))
+	}
+	if !j.finished.IsZero() {
+		kvs = append(kvs, "finished", j.finished.Format(time.RFC3339))
+	}
+	switch j.status {
+	case "done":
+		kvs = append(kvs, "result", j.result)
+	case "error":
+		kvs = append(kvs, "error", j.err)
+	}
+	return i.DictKV(kvs...)
+}
+
+func registerJobConfig() {
+	registerConfigKey(&ConfigKey{
+		Name:    "job_workers",
+		Help:    "Jobs started by async that run at the same time; the rest wait their turn",
+		Type:    ConfigInt,
+		Default: "4",
+		Get: func() string {
+			jobs.mu.Lock()
+			defer jobs.mu.Unlock()
+			return strconv.Itoa(jobs.workers)
+		},
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			if n < 1 {
+				return errors.New("must be at least 1")
+			}
+			jobs.mu.Lock()
+			jobs.workers = n
+			jobs.startLocked()
+			jobs.mu.Unlock()
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "job_retention",
+		Help:    "How long a finished job's result is kept for await and job status",
+		Type:    ConfigDuration,
+		Default: "10m",
+		Get: func() string {
+			jobs.mu.Lock()
+			defer jobs.mu.Unlock()
+			return jobs.retention.String()
+		},
+		Set: func(value string) error {
+			d, _ := time.ParseDuration(value)
+			jobs.mu.Lock()
+			jobs.retention = d
+			jobs.mu.Unlock()
+			return nil
+		},
+	})
+}
+
+func registerJobCommands(interp *feather.Interp, state *ServerState) {
+	jobs.state = state
+	registerJobConfig()
+
+	registry.Register(&Command{
+		Name:  "async",
+		Help:  "Run a script in the background and return a job handle",
+		Usage: "async ?-vars DICT? BODY",
+		Long: `Run BODY on a worker goroutine, so slow work such as sending mail,
+calling APIs or resizing images doesn't hold up the interpreter that
+serves requests. Returns a job handle for await, job status and job
+cancel.
+
+BODY runs in an interpreter of its own, created for the job. It has the
+data, storage and client commands (json, yaml, toml, xml, cbor, crypto,
+encode, decode, url, html, markdown, http, redis, db, cache, kv, chan,
+sleep and puts) but none of the main script's procs and variables; pass values
+with -vars, which sets each key as a variable. Handles from db open,
+redis connect and kv open work in jobs too. main SCRIPT runs SCRIPT
+on the main interpreter and returns its result, e.g. to call a proc or
+publish an event; it runs under the command policy (see acl) of where
+async was called. The job's result is BODY's result.
+
+Up to job_workers jobs run at once (default 4); the others queue.
+Results are kept for job_retention (default 10m) after the job ends.`,
+	})
+	registry.Register(&Command{
+		Name:  "await",
+		Help:  "Wait for a job and return its result",
+		Usage: "await HANDLE ?-timeout DURATION?",
+		Long: `Wait until the job finishes and return its result, or raise its error.
+Other requests are served while a handler waits. Without -timeout it
+waits as long as the job takes; with one, it raises an error when the
+time is up and the job keeps running.
+
+Example:
+  route POST /signup {
+      set email [request body]
+      set mail [async -vars [dict create to $email] {
+          http post https://mail.example.com/send -form [dict create to $to]
+      }]
+      respond "welcome"
+  }
+  route GET /stats {
+      set job [async {dict get [http get https://api.example.com/stats] body}]
+      respond [await $job -timeout 10s]
+  }`,
+	})
+	registry.Register(&Command{
+		Name:  "job",
+		Help:  "Inspect and cancel background jobs",
+		Usage: "job status|cancel|list ...",
+		Long: `job status returns a dict with the job's id, status (queued, running,
+done, error or cancelled), queued, started and finished times, and its
+result or error. job cancel stops a queued job at once, and reports
+whether there was anything to cancel. A running job stops the next time
+it calls one of the job commands listed under async (http, db, puts,
+main, ...); a loop of Tcl builtins alone runs to its end. job list
+returns the handles of the jobs still known.`,
+		Subcommands: []*Command{
+			{Name: "status", Help: "Describe a job", Usage: "job status HANDLE"},
+			{Name: "cancel", Help: "Cancel a queued or running job", Usage: "job cancel HANDLE"},
+			{Name: "list", Help: "List job handles", Usage: "job list"},
+		},
+	})
+
+	interp.RegisterCommand("async", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		var vars map[string]string
+		switch {
+		case len(args) == 3 && args[0].String() == "-vars":
+			d, err := i.ParseDict(args[1].String())
+			if err != nil {
+				return feather.Errorf("async: -vars: %v", err)
+			}
+			vars = make(map[string]string, len(d.Order))
+			for _, k := range d.Order {
+				vars[k] = d.Items[k].String()
+			}
+		case len(args) != 1:
+			return feather.Error("wrong # args: should be \"async ?-vars dict? body\"")
+		}
+		j := jobs.submit(args[len(args)-1].String(), vars, state.originChannel())
+		return feather.OK(j.id)
+	})
+
+	interp.RegisterCommand("await", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		var timeout time.Duration
+		switch {
+		case len(args) == 3 && args[1].String() == "-timeout":
+			d, err := time.ParseDuration(args[2].String())
+			if err != nil || d <= 0 {
+				return feather.Errorf("await: invalid timeout %q", args[2].String())
+			}
+			timeout = d
+		case len(args) != 1:
+			return feather.Error("wrong # args: should be \"await handle ?-timeout duration?\"")
+		}
+		j, ok := jobs.get(args[0].String())
+		if !ok {
+			return feather.Errorf("await: unknown job %q", args[0].String())
+		}
+		done, err := state.serveUntil(i, j.done, timeout)
+		if err != nil {
+			return feather.Errorf("await: %v", err)
+		}
+		if !done {
+			select {
+			case <-state.shutdown:
+				return feather.Error("await: server shutting down")
+			default:
+			}
+			return feather.Errorf("await: %s still running after %s", j.id, timeout)
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		switch j.status {
+		case "error":
+			return feather.Errorf("%s: %s", j.id, j.err)
+		case "cancelled":
+			return feather.Errorf("%s: cancelled", j.id)
+		}
+		return feather.OK(i.String(j.result))
+	})
+
+	interp.RegisterCommand("job", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"job subcommand ?arg ...?\"")
+		}
+		switch sub := args[0].String(); sub {
+		case "status", "cancel":
+			if len(args) != 2 {
+				return feather.Errorf("wrong # args: should be \"job %s handle\"", sub)
+			}
+			j, ok := jobs.get(args[1].String())
+			if !ok {
+				return feather.Errorf("job %s: unknown job %q", sub, args[1].String())
+			}
+			if sub == "status" {
+				return feather.OK(jobInfo(i, j))
+			}
+			return feather.OK(jobs.cancel(j))
+		case "list":
+			jobs.mu.Lock()
+			ids := make([]string, 0, len(jobs.jobs))
+			for id := range jobs.jobs {
+				ids = append(ids, id)
+			}
+			jobs.mu.Unlock()
+			sort.Slice(ids, func(a, b int) bool {
+				na, _ := strconv.Atoi(ids[a][len("job"):])
+				nb, _ := strconv.Atoi(ids[b][len("job"):])
+				return na < nb
+			})
+			return feather.OK(ids)
+		default:
+			return feather.Errorf("job: unknown subcommand %q (must be status, cancel, list)", sub)
+		}
+	})
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/feather-lang/feather"
 )
@@ -14,13 +19,113 @@ type SchemaNode struct {
 	Type     string        // "string", "number", "bool", "object", "array"
 	Name     string        // field name
 	Children []*SchemaNode // for object: fields; for array: single element describing item type
+	Proto    string        // protobuf scalar type (int32, bytes, ...) when given instead of Type
+	Number   int           // protobuf field number, 0 if none
+	key      string        // pre-encoded `"name":` prefix used by the encoder
 }
 
+// protoScalarTypes are the protobuf scalar types the schema DSL accepts,
+// with the schema type other encoders treat them as
+var protoScalarTypes = map[string]string{
+	"int32": "number", "int64": "number", "uint32": "number", "uint64": "number",
+	"sint32": "number", "sint64": "number", "fixed32": "number", "fixed64": "number",
+	"sfixed32": "number", "sfixed64": "number", "double": "number", "float": "number",
+	"bytes": "string",
+}
+
+func isSchemaType(t string) bool {
+	switch t {
+	case "string", "number", "bool", "object", "array":
+		return true
+	}
+	_, ok := protoScalarTypes[t]
+	return ok
+}
+
+// schemaScalarNode creates a node for a scalar type, mapping protobuf
+// types to their schema type
+func schemaScalarNode(typ, name string) *SchemaNode {
+	if base, ok := protoScalarTypes[typ]; ok {
+		node := newSchemaNode(base, name, nil)
+		node.Proto = typ
+		return node
+	}
+	return newSchemaNode(typ, name, nil)
+}
+
+// schemaFieldNumber reads an optional protobuf field number at pos, as in
+// "string 1 name". A number is only taken as one when a field name
+// follows it, so fields named with digits still work.
+func schemaFieldNumber(tokens []string, pos int) (int, int) {
+	if pos+1 >= len(tokens) {
+		return 0, pos
+	}
+	next := tokens[pos+1]
+	if isSchemaType(next) || next == "{" || next == "}" {
+		return 0, pos
+	}
+	n, err := strconv.Atoi(tokens[pos])
+	if err != nil || n < 1 || n > 536870911 || strings.TrimLeft(tokens[pos], "0123456789") != "" {
+		return 0, pos
+	}
+	return n, pos + 1
+}
+
+// Parsed schemas are cached by their source text, since handlers pass the
+// same literal schema on every request. The cache is bounded so that
+// schemas built dynamically can't grow it without limit; the least
+// recently used schema makes room for a new one.
+const maxCachedSchemas = 256
+
+// cachedSchema is an entry of schemaOrder
+type cachedSchema struct {
+	src   string
+	nodes []*SchemaNode
+}
+
+var (
+	schemaCacheMu sync.Mutex
+	schemaCache   = make(map[string]*list.Element)
+	schemaOrder   = list.New() // *cachedSchema, most recently used first
+)
+
 // parseSchema parses the schema DSL into a tree of SchemaNodes
 func parseSchema(schemaStr string) ([]*SchemaNode, error) {
+	schemaCacheMu.Lock()
+	if e, ok := schemaCache[schemaStr]; ok {
+		schemaOrder.MoveToFront(e)
+		schemaCacheMu.Unlock()
+		return e.Value.(*cachedSchema).nodes, nil
+	}
+	schemaCacheMu.Unlock()
+
 	tokens := tokenizeSchema(schemaStr)
 	nodes, _, err := parseSchemaTokens(tokens, 0)
-	return nodes, err
+	if err != nil {
+		return nil, err
+	}
+
+	schemaCacheMu.Lock()
+	defer schemaCacheMu.Unlock()
+	if _, ok := schemaCache[schemaStr]; !ok {
+		schemaCache[schemaStr] = schemaOrder.PushFront(&cachedSchema{src: schemaStr, nodes: nodes})
+		if schemaOrder.Len() > maxCachedSchemas {
+			oldest := schemaOrder.Back()
+			schemaOrder.Remove(oldest)
+			delete(schemaCache, oldest.Value.(*cachedSchema).src)
+		}
+	}
+	return nodes, nil
+}
+
+// newSchemaNode creates a node and pre-encodes its object key
+func newSchemaNode(typ, name string, children []*SchemaNode) *SchemaNode {
+	node := &SchemaNode{Type: typ, Name: name, Children: children}
+	if name != "" {
+		b, _ := json.Marshal(name)
+		node.key = string(b) + ":"
+	}
+	return node
 }
 
 func tokenizeSchema(s string) []string {
@@ -72,22 +177,18 @@ func parseSchemaTokens(tokens []string, pos int) ([]*SchemaNode, int, error) {
 			continue
 		}
 
-		// Expect a type
+		// Expect a type, then an optional field number
+		if !isSchemaType(token) {
+			return nil, pos, fmt.Errorf("unexpected token: %s", token)
+		}
+		number, namePos := schemaFieldNumber(tokens, pos+1)
 		switch token {
-		case "string", "number", "bool":
-			if pos+1 >= len(tokens) {
-				return nil, pos, fmt.Errorf("expected field name after %s", token)
-			}
-			node := &SchemaNode{Type: token, Name: tokens[pos+1]}
-			nodes = append(nodes, node)
-			pos += 2
-
 		case "object":
-			if pos+1 >= len(tokens) {
+			if namePos >= len(tokens) {
 				return nil, pos, fmt.Errorf("expected field name after object")
 			}
-			name := tokens[pos+1]
-			pos += 2
+			name := tokens[namePos]
+			pos = namePos + 1
 			if pos >= len(tokens) || tokens[pos] != "{" {
 				return nil, pos, fmt.Errorf("expected { after object %s", name)
 			}
@@ -97,15 +198,16 @@ func parseSchemaTokens(tokens []string, pos int) ([]*SchemaNode, int, error) {
 				return nil, newPos, err
 			}
 			pos = newPos + 1 // skip }
-			node := &SchemaNode{Type: "object", Name: name, Children: children}
+			node := newSchemaNode("object", name, children)
+			node.Number = number
 			nodes = append(nodes, node)
 
 		case "array":
-			if pos+1 >= len(tokens) {
+			if namePos >= len(tokens) {
 				return nil, pos, fmt.Errorf("expected field name after array")
 			}
-			name := tokens[pos+1]
-			pos += 2
+			name := tokens[namePos]
+			pos = namePos + 1
 			if pos >= len(tokens) {
 				return nil, pos, fmt.Errorf("expected element type after array %s", name)
 			}
@@ -123,16 +225,23 @@ func parseSchemaTokens(tokens []string, pos int) ([]*SchemaNode, int, error) {
 					return nil, newPos, err
 				}
 				pos = newPos + 1 // skip }
-				elemNode = &SchemaNode{Type: "object", Children: children}
+				elemNode = newSchemaNode("object", "", children)
 			} else {
-				elemNode = &SchemaNode{Type: elemType}
+				elemNode = schemaScalarNode(elemType, "")
 			}
 
-			node := &SchemaNode{Type: "array", Name: name, Children: []*SchemaNode{elemNode}}
+			node := newSchemaNode("array", name, []*SchemaNode{elemNode})
+			node.Number = number
 			nodes = append(nodes, node)
 
 		default:
-			return nil, pos, fmt.Errorf("unexpected token: %s", token)
+			if namePos >= len(tokens) {
+				return nil, pos, fmt.Errorf("expected field name after %s", token)
+			}
+			node := schemaScalarNode(token, tokens[namePos])
+			node.Number = number
+			nodes = append(nodes, node)
+			pos = namePos + 1
 		}
 	}
 
@@ -302,16 +411,135 @@ func registerJSONCommand(fi *feather.Interp, state *ServerState) {
 	jsonCmd := &Command{
 		Name:  "json",
 		Help:  "Encode or decode JSON with schema",
-		Usage: "json VALUE -as SCHEMA | json VALUE -from SCHEMA",
+		Usage: "json VALUE -as SCHEMA | json VALUE -from SCHEMA | json parse STR | json stringify VALUE | json validate STR -schema SCHEMA | json get STR PATH ?-default VALUE? | json stream ?-to HANDLE? VALUE ?-as SCHEMA?",
+		Long: `json parse and json stringify need no schema, for prototyping and
+payloads of unknown shape. parse turns objects into dicts (keeping key
+order), arrays into lists, numbers into ints or doubles, and true, false
+and null into those strings. stringify goes the other way: dicts become
+objects and lists arrays; other values become numbers if they look like
+JSON numbers, true/false/null literals if they are those words, and
+strings otherwise. Only values that are already dicts or lists (from
+dict create, list, json parse, ...) become objects or arrays, so a string
+with spaces stays a string.
+
+Example:
+  set user [json parse [request body]]
+  respond -type application/json [json stringify [dict create ok true id 42]]
+
+json get pulls one value out of a JSON string, decoded as by json parse.
+PATH is an RFC 6901 pointer (/items/0/id) or a simple JSONPath
+($.items[0].id, $['a key']). Everything outside the path is skipped
+without being decoded, and the rest of the document after the value is
+not read at all. A missing path is an error unless -default is given.
+
+Example:
+  set id [json get [request body] {$.items[0].id}]
+  set mode [json get [request body] /options/mode -default fast]
+
+json stream writes VALUE as one line of newline-delimited JSON
+(application/x-ndjson) and flushes it, so a held connection can send
+records as they happen instead of buffering a whole array. With -as the
+value is encoded with SCHEMA like json -as, otherwise like json stringify.
+Lines sent to a connection held with -max-rate or -max-bytes-per-sec are
+paced like respond -to.
+
+Example:
+  route GET /events {
+      connection hold -as feed
+  }
+  # whenever a record is ready
+  json stream -to feed $record -as {number id string name}
+
+json validate checks a JSON string against a JSON Schema (draft 2020-12):
+type, enum, const, minimum/maximum, multipleOf, minLength/maxLength,
+pattern, items, prefixItems, contains, minItems/maxItems, uniqueItems,
+properties, patternProperties, additionalProperties, required,
+dependentRequired, allOf/anyOf/oneOf/not, if/then/else and local $ref.
+SCHEMA is the schema's JSON text or a file or embed:// path holding it.
+The result is a list of errors, empty when the value is valid, each a dict
+with path (a JSON pointer into the value), schema_path, keyword and
+message.
+
+Example:
+  set errs [json validate [request body] -schema ./schemas/user.json]
+  if {[llength $errs] > 0} {
+      status 422
+      respond -type application/json [json stringify [dict create errors $errs]]
+      return
+  }`,
 		Subcommands: []*Command{
 			{Name: "-as", Help: "Encode TCL value to JSON using schema", Usage: "json VALUE -as SCHEMA"},
 			{Name: "-from", Help: "Decode JSON string to TCL value using schema", Usage: "json VALUE -from SCHEMA"},
+			{Name: "parse", Help: "Decode any JSON without a schema", Usage: "json parse STR"},
+			{Name: "stringify", Help: "Encode a value as JSON without a schema", Usage: "json stringify VALUE"},
+			{Name: "get", Help: "Extract one value by JSON pointer or path", Usage: "json get STR PATH ?-default VALUE?"},
+			{Name: "stream", Help: "Write one NDJSON line and flush", Usage: "json stream ?-to HANDLE? VALUE ?-as SCHEMA?"},
+			{Name: "validate", Help: "Check JSON against a JSON Schema", Usage: "json validate STR -schema SCHEMA"},
 		},
 	}
 	registry.Register(jsonCmd)
 
 	// Use low-level registration to avoid TCL quoting of JSON output
 	fi.Internal().Register("json", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) == 2 {
+			switch i.GetString(args[0]) {
+			case "parse":
+				v, err := jsonParse(i, i.GetString(args[1]))
+				if err != nil {
+					i.SetErrorString(fmt.Sprintf("json parse: %v", err))
+					return feather.ResultError
+				}
+				i.SetResult(v)
+				return feather.ResultOK
+			case "stringify":
+				enc := newJSONEncoder(i)
+				defer enc.release()
+				if err := enc.encodeAny(args[1], 0); err != nil {
+					i.SetErrorString(fmt.Sprintf("json stringify: %v", err))
+					return feather.ResultError
+				}
+				i.SetResult(i.InternString(enc.String()))
+				return feather.ResultOK
+			}
+		}
+		if len(args) >= 2 && i.GetString(args[0]) == "stream" {
+			return jsonStream(i, state, args[1:])
+		}
+		if (len(args) == 3 || len(args) == 5) && i.GetString(args[0]) == "get" {
+			if len(args) == 5 && i.GetString(args[3]) != "-default" {
+				i.SetErrorString("wrong # args: should be \"json get value path ?-default value?\"")
+				return feather.ResultError
+			}
+			path := i.GetString(args[2])
+			v, found, err := jsonGet(i, i.GetString(args[1]), path)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("json get: %v", err))
+				return feather.ResultError
+			}
+			if !found {
+				if len(args) == 5 {
+					i.SetResult(args[4])
+					return feather.ResultOK
+				}
+				i.SetErrorString(fmt.Sprintf("json get: nothing at %s", path))
+				return feather.ResultError
+			}
+			i.SetResult(v)
+			return feather.ResultOK
+		}
+		if len(args) == 4 && i.GetString(args[0]) == "validate" {
+			if i.GetString(args[2]) != "-schema" {
+				i.SetErrorString("wrong # args: should be \"json validate value -schema schema\"")
+				return feather.ResultError
+			}
+			v, err := jsonValidate(i, i.GetString(args[1]), i.GetString(args[3]))
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("json validate: %v", err))
+				return feather.ResultError
+			}
+			i.SetResult(v)
+			return feather.ResultOK
+		}
 		if len(args) < 3 {
 			i.SetErrorString("wrong # args: should be \"json value -as schema\" or \"json value -from schema\"")
 			return feather.ResultError
@@ -335,6 +563,7 @@ func registerJSONCommand(fi *feather.Interp, state *ServerState) {
 				return feather.ResultError
 			}
 			enc := newJSONEncoder(i)
+			defer enc.release()
 			if err := enc.encodeDict(dictVal, schema); err != nil {
 				i.SetErrorString(fmt.Sprintf("json: encode error: %v", err))
 				return feather.ResultError
@@ -365,20 +594,26 @@ func registerJSONCommand(fi *feather.Interp, state *ServerState) {
 	})
 }
 
-// jsonEncoder writes JSON directly to a buffer based on schema
+// jsonEncoder writes JSON directly to a pooled buffer based on schema
 type jsonEncoder struct {
 	i   *feather.InternalInterp
-	buf *strings.Builder
+	buf *bytes.Buffer
 }
 
 func newJSONEncoder(i *feather.InternalInterp) *jsonEncoder {
-	return &jsonEncoder{i: i, buf: &strings.Builder{}}
+	return &jsonEncoder{i: i, buf: getBuffer()}
 }
 
 func (e *jsonEncoder) String() string {
 	return e.buf.String()
 }
 
+// release returns the encoder's buffer to the pool
+func (e *jsonEncoder) release() {
+	putBuffer(e.buf)
+	e.buf = nil
+}
+
 func (e *jsonEncoder) encodeDict(dict map[string]feather.FeatherObj, schema []*SchemaNode) error {
 	e.buf.WriteByte('{')
 	first := true
@@ -391,9 +626,7 @@ func (e *jsonEncoder) encodeDict(dict map[string]feather.FeatherObj, schema []*S
 			e.buf.WriteByte(',')
 		}
 		first = false
-		e.buf.WriteByte('"')
-		e.buf.WriteString(node.Name)
-		e.buf.WriteString("\":")
+		e.buf.WriteString(node.key)
 		if err := e.encodeValue(val, node); err != nil {
 			return fmt.Errorf("field %s: %v", node.Name, err)
 		}
@@ -405,13 +638,13 @@ func (e *jsonEncoder) encodeDict(dict map[string]feather.FeatherObj, schema []*S
 func (e *jsonEncoder) encodeValue(val feather.FeatherObj, node *SchemaNode) error {
 	switch node.Type {
 	case "string":
-		s := e.getRawString(val)
+		s := schemaString(e.i, val)
 		b, _ := json.Marshal(s)
 		e.buf.Write(b)
 		return nil
 
 	case "number":
-		s := e.getRawString(val)
+		s := schemaString(e.i, val)
 		if _, err := strconv.ParseFloat(s, 64); err != nil {
 			return fmt.Errorf("invalid number: %s", s)
 		}
@@ -419,7 +652,7 @@ func (e *jsonEncoder) encodeValue(val feather.FeatherObj, node *SchemaNode) erro
 		return nil
 
 	case "bool":
-		s := e.getRawString(val)
+		s := schemaString(e.i, val)
 		switch s {
 		case "1", "true":
 			e.buf.WriteString("true")
@@ -460,9 +693,165 @@ func (e *jsonEncoder) encodeValue(val feather.FeatherObj, node *SchemaNode) erro
 	}
 }
 
-// getRawString extracts the raw string value, stripping Tcl braces if present
-func (e *jsonEncoder) getRawString(val feather.FeatherObj) string {
+// maxJSONDepth bounds nesting in json parse and json stringify
+const maxJSONDepth = 512
+
+// jsonParse decodes a JSON document of any shape
+func jsonParse(i *feather.InternalInterp, s string) (feather.FeatherObj, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	v, err := jsonParseValue(i, dec, 0)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return 0, fmt.Errorf("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+func jsonParseValue(i *feather.InternalInterp, dec *json.Decoder, depth int) (feather.FeatherObj, error) {
+	if depth > maxJSONDepth {
+		return 0, fmt.Errorf("nested too deeply")
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			dict := i.NewDict()
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return 0, err
+				}
+				val, err := jsonParseValue(i, dec, depth+1)
+				if err != nil {
+					return 0, err
+				}
+				dict = i.DictSet(dict, key.(string), val)
+			}
+			_, err := dec.Token() // closing brace
+			return dict, err
+		}
+		list := i.NewList()
+		for dec.More() {
+			val, err := jsonParseValue(i, dec, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			list = i.ListAppend(list, val)
+		}
+		_, err := dec.Token() // closing bracket
+		return list, err
+	case string:
+		return i.InternString(t), nil
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return i.NewInt(n), nil
+		}
+		// Integers too big for int64 keep their digits rather than lose
+		// precision as doubles
+		if !strings.ContainsAny(t.String(), ".eE") {
+			return i.InternString(t.String()), nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return i.InternString(t.String()), nil
+		}
+		return i.NewDouble(f), nil
+	case bool:
+		return i.InternString(strconv.FormatBool(t)), nil
+	default: // null
+		return i.InternString("null"), nil
+	}
+}
+
+// isJSONNumber reports whether s is a number in JSON syntax
+func isJSONNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	var n json.Number
+	return json.Unmarshal([]byte(s), &n) == nil
+}
+
+// encodeAny writes val as JSON, choosing the JSON type from the value
+func (e *jsonEncoder) encodeAny(val feather.FeatherObj, depth int) error {
+	if depth > maxJSONDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+	switch e.i.Type(val) {
+	case "dict":
+		dict, order, err := e.i.GetDict(val)
+		if err != nil {
+			return err
+		}
+		e.buf.WriteByte('{')
+		for idx, k := range order {
+			if idx > 0 {
+				e.buf.WriteByte(',')
+			}
+			b, _ := json.Marshal(k)
+			e.buf.Write(b)
+			e.buf.WriteByte(':')
+			if err := e.encodeAny(dict[k], depth+1); err != nil {
+				return fmt.Errorf("key %s: %v", k, err)
+			}
+		}
+		e.buf.WriteByte('}')
+		return nil
+	case "list":
+		list, err := e.i.GetList(val)
+		if err != nil {
+			return err
+		}
+		e.buf.WriteByte('[')
+		for idx, item := range list {
+			if idx > 0 {
+				e.buf.WriteByte(',')
+			}
+			if err := e.encodeAny(item, depth+1); err != nil {
+				return fmt.Errorf("index %d: %v", idx, err)
+			}
+		}
+		e.buf.WriteByte(']')
+		return nil
+	case "int":
+		n, err := e.i.GetInt(val)
+		if err != nil {
+			return err
+		}
+		e.buf.WriteString(strconv.FormatInt(n, 10))
+		return nil
+	case "double":
+		f, err := e.i.GetDouble(val)
+		if err != nil {
+			return err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%v can't be represented in JSON", f)
+		}
+		e.buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		return nil
+	}
 	s := e.i.GetString(val)
+	switch {
+	case s == "true" || s == "false" || s == "null" || isJSONNumber(s):
+		e.buf.WriteString(s)
+	default:
+		b, _ := json.Marshal(s)
+		e.buf.Write(b)
+	}
+	return nil
+}
+
+// schemaString extracts the raw string value of a field for the schema
+// encoders, stripping Tcl braces if present
+func schemaString(i *feather.InternalInterp, val feather.FeatherObj) string {
+	s := i.GetString(val)
 	// Strip Tcl braces that wrap strings with spaces
 	if len(s) >= 2 && s[0] == '{' && s[len(s)-1] == '}' {
 		return s[1 : len(s)-1]
@@ -501,3 +890,198 @@ func setDictValue(i *feather.InternalInterp, dict feather.FeatherObj, key string
 		return i.DictSet(dict, key, i.InternString(fmt.Sprintf("%v", v)))
 	}
 }
+
+// splitJSONPath turns a path into segments: an RFC 6901 pointer ("",
+// "/items/0/id") or a simple JSONPath ("$", "$.items[0].id",
+// "$['a key'][2]"). Array indexes are segments holding digits.
+func splitJSONPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] == '/' {
+		parts := strings.Split(path[1:], "/")
+		for k, p := range parts {
+			parts[k] = pointerUnescape(p)
+		}
+		return parts, nil
+	}
+	if path[0] != '$' {
+		return nil, fmt.Errorf("path must start with / or $")
+	}
+	var parts []string
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty name in %q", path)
+			}
+			parts = append(parts, rest[:end])
+			rest = rest[end:]
+		case '[':
+			if len(rest) > 1 && (rest[1] == '\'' || rest[1] == '"') {
+				end := strings.Index(rest[2:], string(rest[1])+"]")
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated [ in %q", path)
+				}
+				parts = append(parts, rest[2:2+end])
+				rest = rest[2+end+2:]
+				continue
+			}
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", path)
+			}
+			idx := rest[1:end]
+			if _, err := strconv.Atoi(idx); err != nil || idx[0] == '-' {
+				return nil, fmt.Errorf("bad index %q in %q", idx, path)
+			}
+			parts = append(parts, idx)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", rest[0], path)
+		}
+	}
+	return parts, nil
+}
+
+// skipJSONValue reads past the next value in dec without building it
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// jsonGet decodes only the value at path in s, skipping everything else.
+// found is false when the path doesn't exist.
+func jsonGet(i *feather.InternalInterp, s, path string) (v feather.FeatherObj, found bool, err error) {
+	parts, err := splitJSONPath(path)
+	if err != nil {
+		return 0, false, err
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	for _, part := range parts {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, false, err
+		}
+		delim, _ := tok.(json.Delim)
+		switch delim {
+		case '{':
+			for {
+				if !dec.More() {
+					return 0, false, nil
+				}
+				key, err := dec.Token()
+				if err != nil {
+					return 0, false, err
+				}
+				if key.(string) == part {
+					break
+				}
+				if err := skipJSONValue(dec); err != nil {
+					return 0, false, err
+				}
+			}
+		case '[':
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return 0, false, nil
+			}
+			for ; n > 0; n-- {
+				if !dec.More() {
+					return 0, false, nil
+				}
+				if err := skipJSONValue(dec); err != nil {
+					return 0, false, err
+				}
+			}
+			if !dec.More() {
+				return 0, false, nil
+			}
+		default:
+			return 0, false, nil // a scalar has no children
+		}
+	}
+	v, err = jsonParseValue(i, dec, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// jsonStream implements json stream: encode one value, write it as an
+// NDJSON line and flush
+func jsonStream(i *feather.InternalInterp, state *ServerState, args []feather.FeatherObj) feather.FeatherResult {
+	var conn *Connection
+	var ctx *RequestContext
+	toConn := len(args) >= 2 && i.GetString(args[0]) == "-to"
+	if toConn {
+		conn = state.GetConnection(i.GetString(args[1]))
+		args = args[2:]
+	}
+	if len(args) != 1 && (len(args) != 3 || i.GetString(args[1]) != "-as") {
+		i.SetErrorString("wrong # args: should be \"json stream ?-to handle? value ?-as schema?\"")
+		return feather.ResultError
+	}
+	if toConn {
+		if conn == nil {
+			// Connection gone, silently succeed like respond -to
+			i.SetResult(i.InternString(""))
+			return feather.ResultOK
+		}
+		ctx = conn.Ctx
+	} else if ctx = state.GetRequestContext(); ctx == nil {
+		i.SetErrorString("json stream: not in request context")
+		return feather.ResultError
+	}
+
+	enc := newJSONEncoder(i)
+	defer enc.release()
+	if len(args) == 3 {
+		schema, err := parseSchema(i.GetString(args[2]))
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("json stream: invalid schema: %v", err))
+			return feather.ResultError
+		}
+		dictVal, _, err := i.GetDict(args[0])
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("json stream: expected dict: %v", err))
+			return feather.ResultError
+		}
+		if err := enc.encodeDict(dictVal, schema); err != nil {
+			i.SetErrorString(fmt.Sprintf("json stream: encode error: %v", err))
+			return feather.ResultError
+		}
+	} else if err := enc.encodeAny(args[0], 0); err != nil {
+		i.SetErrorString(fmt.Sprintf("json stream: %v", err))
+		return feather.ResultError
+	}
+
+	if _, set := ctx.Headers.Load("Content-Type"); !set {
+		ctx.Headers.Store("Content-Type", "application/x-ndjson")
+	}
+	streamWrite(ctx, conn, []byte(enc.String()+"\n"))
+	i.SetResult(i.InternString(""))
+	return feather.ResultOK
+}
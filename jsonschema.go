@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/feather-lang/feather"
+)
+
+// jsonSchemaError is one validation failure: where in the instance, which
+// schema keyword and why
+type jsonSchemaError struct {
+	Path       string // JSON pointer into the instance, "" = root
+	SchemaPath string // JSON pointer into the schema
+	Keyword    string
+	Message    string
+}
+
+// jsonSchemaValidator checks instances against a JSON Schema (draft 2020-12
+// vocabulary: types, enum/const, numeric and string bounds, pattern,
+// object and array keywords, combinators and local $ref)
+type jsonSchemaValidator struct {
+	root   any
+	errors []jsonSchemaError
+	depth  int
+}
+
+var (
+	schemaRegexpMu sync.Mutex
+	schemaRegexps  = make(map[string]*regexp.Regexp)
+
+	parsedSchemaMu sync.Mutex
+	parsedSchemas  = make(map[string]any) // by source text
+)
+
+// decodeJSONNumbers decodes JSON keeping numbers as json.Number
+func decodeJSONNumbers(data string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// parseJSONSchema decodes a schema, caching it by its source like
+// parseSchema does for json -as schemas
+func parseJSONSchema(src string) (any, error) {
+	parsedSchemaMu.Lock()
+	s, ok := parsedSchemas[src]
+	parsedSchemaMu.Unlock()
+	if ok {
+		return s, nil
+	}
+	s, err := decodeJSONNumbers(src)
+	if err != nil {
+		return nil, err
+	}
+	switch s.(type) {
+	case map[string]any, bool:
+	default:
+		return nil, fmt.Errorf("schema must be an object or boolean")
+	}
+	parsedSchemaMu.Lock()
+	if len(parsedSchemas) < maxCachedSchemas {
+		parsedSchemas[src] = s
+	}
+	parsedSchemaMu.Unlock()
+	return s, nil
+}
+
+// validateJSONSchema returns the ways instance fails schema
+func validateJSONSchema(schema, instance any) []jsonSchemaError {
+	v := &jsonSchemaValidator{root: schema}
+	v.validate(schema, instance, "", "")
+	return v.errors
+}
+
+func (v *jsonSchemaValidator) fail(path, schemaPath, keyword, format string, args ...any) {
+	v.errors = append(v.errors, jsonSchemaError{
+		Path:       path,
+		SchemaPath: schemaPath + "/" + keyword,
+		Keyword:    keyword,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// valid reports whether instance matches schema without recording errors,
+// for anyOf, oneOf, not and contains
+func (v *jsonSchemaValidator) valid(schema, instance any, path, schemaPath string) bool {
+	saved := v.errors
+	v.errors = nil
+	v.validate(schema, instance, path, schemaPath)
+	ok := len(v.errors) == 0
+	v.errors = saved
+	return ok
+}
+
+func pointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func pointerUnescape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
+// resolveRef resolves a local reference ("#", "#/$defs/name")
+func (v *jsonSchemaValidator) resolveRef(ref string) (any, bool) {
+	if ref == "#" {
+		return v.root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	cur := v.root
+	for _, tok := range strings.Split(ref[2:], "/") {
+		tok = pointerUnescape(tok)
+		switch c := cur.(type) {
+		case map[string]any:
+			next, ok := c[tok]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []any:
+			n, err := strconv.Atoi(tok)
+			if err != nil || n < 0 || n >= len(c) {
+				return nil, false
+			}
+			cur = c[n]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func jsonTypeOf(x any) string {
+	switch t := x.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := t.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func schemaNumber(x any) (float64, bool) {
+	n, ok := x.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// jsonEqual compares two decoded JSON values, numbers by value
+func jsonEqual(a, b any) bool {
+	an, aok := schemaNumber(a)
+	bn, bok := schemaNumber(b)
+	if aok || bok {
+		return aok && bok && an == bn
+	}
+	switch at := a.(type) {
+	case []any:
+		bt, ok := b.([]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k := range at {
+			if !jsonEqual(at[k], bt[k]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bt, ok := b.(map[string]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, av := range at {
+			bv, ok := bt[k]
+			if !ok || !jsonEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func schemaRegexp(pattern string) (*regexp.Regexp, error) {
+	schemaRegexpMu.Lock()
+	defer schemaRegexpMu.Unlock()
+	if re, ok := schemaRegexps[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemaRegexps) < maxCachedSchemas {
+		schemaRegexps[pattern] = re
+	}
+	return re, nil
+}
+
+func (v *jsonSchemaValidator) validate(schema, inst any, path, sp string) {
+	if b, ok := schema.(bool); ok {
+		if !b {
+			v.fail(path, sp, "false", "no value is allowed here")
+		}
+		return
+	}
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+	if v.depth > maxJSONDepth {
+		v.fail(path, sp, "$ref", "schema nested too deeply (recursive $ref?)")
+		return
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		target, found := v.resolveRef(ref)
+		if !found {
+			v.fail(path, sp, "$ref", "can't resolve %s", ref)
+		} else {
+			v.validate(target, inst, path, sp+"/$ref")
+		}
+	}
+
+	typ := jsonTypeOf(inst)
+	if t, ok := s["type"]; ok {
+		var allowed []string
+		switch tt := t.(type) {
+		case string:
+			allowed = []string{tt}
+		case []any:
+			for _, x := range tt {
+				if name, ok := x.(string); ok {
+					allowed = append(allowed, name)
+				}
+			}
+		}
+		match := false
+		for _, a := range allowed {
+			if a == typ || (a == "number" && typ == "integer") {
+				match = true
+				break
+			}
+		}
+		if !match {
+			v.fail(path, sp, "type", "expected %s, got %s", strings.Join(allowed, " or "), typ)
+		}
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, inst) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, sp, "enum", "value is not one of the allowed values")
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, inst) {
+		v.fail(path, sp, "const", "value does not equal the required constant")
+	}
+
+	switch typ {
+	case "integer", "number":
+		v.validateNumber(s, inst, path, sp)
+	case "string":
+		v.validateString(s, inst.(string), path, sp)
+	case "array":
+		v.validateArray(s, inst.([]any), path, sp)
+	case "object":
+		v.validateObject(s, inst.(map[string]any), path, sp)
+	}
+
+	if all, ok := s["allOf"].([]any); ok {
+		for k, sub := range all {
+			v.validate(sub, inst, path, fmt.Sprintf("%s/allOf/%d", sp, k))
+		}
+	}
+	if anyOfList, ok := s["anyOf"].([]any); ok {
+		matched := false
+		for k, sub := range anyOfList {
+			if v.valid(sub, inst, path, fmt.Sprintf("%s/anyOf/%d", sp, k)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, sp, "anyOf", "value matches none of the anyOf schemas")
+		}
+	}
+	if one, ok := s["oneOf"].([]any); ok {
+		n := 0
+		for k, sub := range one {
+			if v.valid(sub, inst, path, fmt.Sprintf("%s/oneOf/%d", sp, k)) {
+				n++
+			}
+		}
+		if n != 1 {
+			v.fail(path, sp, "oneOf", "value matches %d of the oneOf schemas, expected exactly 1", n)
+		}
+	}
+	if not, ok := s["not"]; ok && v.valid(not, inst, path, sp+"/not") {
+		v.fail(path, sp, "not", "value must not match the schema")
+	}
+	if cond, ok := s["if"]; ok {
+		if v.valid(cond, inst, path, sp+"/if") {
+			if then, ok := s["then"]; ok {
+				v.validate(then, inst, path, sp+"/then")
+			}
+		} else if els, ok := s["else"]; ok {
+			v.validate(els, inst, path, sp+"/else")
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateNumber(s map[string]any, inst any, path, sp string) {
+	n, _ := schemaNumber(inst)
+	if m, ok := schemaNumber(s["minimum"]); ok && n < m {
+		v.fail(path, sp, "minimum", "%v is less than the minimum %v", n, m)
+	}
+	if m, ok := schemaNumber(s["maximum"]); ok && n > m {
+		v.fail(path, sp, "maximum", "%v is greater than the maximum %v", n, m)
+	}
+	if m, ok := schemaNumber(s["exclusiveMinimum"]); ok && n <= m {
+		v.fail(path, sp, "exclusiveMinimum", "%v must be greater than %v", n, m)
+	}
+	if m, ok := schemaNumber(s["exclusiveMaximum"]); ok && n >= m {
+		v.fail(path, sp, "exclusiveMaximum", "%v must be less than %v", n, m)
+	}
+	if m, ok := schemaNumber(s["multipleOf"]); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, sp, "multipleOf", "%v is not a multiple of %v", n, m)
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateString(s map[string]any, str, path, sp string) {
+	length := utf8.RuneCountInString(str)
+	if m, ok := schemaNumber(s["minLength"]); ok && float64(length) < m {
+		v.fail(path, sp, "minLength", "string is shorter than %v characters", m)
+	}
+	if m, ok := schemaNumber(s["maxLength"]); ok && float64(length) > m {
+		v.fail(path, sp, "maxLength", "string is longer than %v characters", m)
+	}
+	if p, ok := s["pattern"].(string); ok {
+		re, err := schemaRegexp(p)
+		if err != nil {
+			v.fail(path, sp, "pattern", "invalid pattern %q: %v", p, err)
+		} else if !re.MatchString(str) {
+			v.fail(path, sp, "pattern", "string does not match pattern %q", p)
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateArray(s map[string]any, arr []any, path, sp string) {
+	if m, ok := schemaNumber(s["minItems"]); ok && float64(len(arr)) < m {
+		v.fail(path, sp, "minItems", "array has fewer than %v items", m)
+	}
+	if m, ok := schemaNumber(s["maxItems"]); ok && float64(len(arr)) > m {
+		v.fail(path, sp, "maxItems", "array has more than %v items", m)
+	}
+	if u, ok := s["uniqueItems"].(bool); ok && u {
+	unique:
+		for a := range arr {
+			for b := a + 1; b < len(arr); b++ {
+				if jsonEqual(arr[a], arr[b]) {
+					v.fail(path, sp, "uniqueItems", "items %d and %d are equal", a, b)
+					break unique
+				}
+			}
+		}
+	}
+	start := 0
+	if prefix, ok := s["prefixItems"].([]any); ok {
+		for k := 0; k < len(prefix) && k < len(arr); k++ {
+			v.validate(prefix[k], arr[k], path+"/"+strconv.Itoa(k), fmt.Sprintf("%s/prefixItems/%d", sp, k))
+		}
+		start = len(prefix)
+	}
+	if items, ok := s["items"]; ok {
+		for k := start; k < len(arr); k++ {
+			v.validate(items, arr[k], path+"/"+strconv.Itoa(k), sp+"/items")
+		}
+	}
+	if contains, ok := s["contains"]; ok {
+		n := 0
+		for k, item := range arr {
+			if v.valid(contains, item, path+"/"+strconv.Itoa(k), sp+"/contains") {
+				n++
+			}
+		}
+		minC, maxC := 1.0, math.Inf(1)
+		if m, ok := schemaNumber(s["minContains"]); ok {
+			minC = m
+		}
+		if m, ok := schemaNumber(s["maxContains"]); ok {
+			maxC = m
+		}
+		if float64(n) < minC || float64(n) > maxC {
+			v.fail(path, sp, "contains", "%d items match the contains schema", n)
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateObject(s map[string]any, obj map[string]any, path, sp string) {
+	if m, ok := schemaNumber(s["minProperties"]); ok && float64(len(obj)) < m {
+		v.fail(path, sp, "minProperties", "object has fewer than %v properties", m)
+	}
+	if m, ok := schemaNumber(s["maxProperties"]); ok && float64(len(obj)) > m {
+		v.fail(path, sp, "maxProperties", "object has more than %v properties", m)
+	}
+	if req, ok := s["required"].([]any); ok {
+		for _, r := range req {
+			if name, ok := r.(string); ok {
+				if _, present := obj[name]; !present {
+					v.fail(path, sp, "required", "missing required property %q", name)
+				}
+			}
+		}
+	}
+	if deps, ok := s["dependentRequired"].(map[string]any); ok {
+		for name, list := range deps {
+			if _, present := obj[name]; !present {
+				continue
+			}
+			others, _ := list.([]any)
+			for _, o := range others {
+				if other, ok := o.(string); ok {
+					if _, present := obj[other]; !present {
+						v.fail(path, sp, "dependentRequired", "property %q requires %q", name, other)
+					}
+				}
+			}
+		}
+	}
+
+	// Visit properties in a stable order so errors come out the same way
+	// every time
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	props, _ := s["properties"].(map[string]any)
+	patterns, _ := s["patternProperties"].(map[string]any)
+	additional, hasAdditional := s["additionalProperties"]
+	for _, name := range names {
+		val := obj[name]
+		childPath := path + "/" + pointerEscape(name)
+		matched := false
+		if sub, ok := props[name]; ok {
+			matched = true
+			v.validate(sub, val, childPath, sp+"/properties/"+pointerEscape(name))
+		}
+		for pattern, sub := range patterns {
+			re, err := schemaRegexp(pattern)
+			if err == nil && re.MatchString(name) {
+				matched = true
+				v.validate(sub, val, childPath, sp+"/patternProperties/"+pointerEscape(pattern))
+			}
+		}
+		if !matched && hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				v.fail(childPath, sp, "additionalProperties", "property %q is not allowed", name)
+			} else {
+				v.validate(additional, val, childPath, sp+"/additionalProperties")
+			}
+		}
+		if pn, ok := s["propertyNames"]; ok {
+			v.validate(pn, name, childPath, sp+"/propertyNames")
+		}
+	}
+}
+
+// loadJSONSchema takes an inline schema (JSON text) or a file or embed://
+// path holding one
+func loadJSONSchema(src string) (any, error) {
+	text := strings.TrimSpace(src)
+	if !strings.HasPrefix(text, "{") && text != "true" && text != "false" {
+		data, err := readPath(src)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return parseJSONSchema(text)
+}
+
+// jsonValidate implements json validate: the result is a list of
+// {path P schema_path S keyword K message M} dicts, empty when valid
+func jsonValidate(i *feather.InternalInterp, value, schemaSrc string) (feather.FeatherObj, error) {
+	schema, err := loadJSONSchema(schemaSrc)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema: %v", err)
+	}
+	instance, err := decodeJSONNumbers(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid JSON: %v", err)
+	}
+	list := i.NewList()
+	for _, e := range validateJSONSchema(schema, instance) {
+		d := i.NewDict()
+		d = i.DictSet(d, "path", i.InternString(e.Path))
+		d = i.DictSet(d, "schema_path", i.InternString(e.SchemaPath))
+		d = i.DictSet(d, "keyword", i.InternString(e.Keyword))
+		d = i.DictSet(d, "message", i.InternString(e.Message))
+		list = i.ListAppend(list, d)
+	}
+	return list, nil
+}
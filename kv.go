@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+	bolt "go.etcd.io/bbolt"
+)
+
+// kvBucket holds every key of a kv store
+var kvBucket = []byte("kv")
+
+// kvHandle is a store opened by kv open
+type kvHandle struct {
+	path string
+	db   *bolt.DB
+}
+
+var (
+	kvHandlesMu sync.Mutex
+	kvHandles   = make(map[string]*kvHandle)
+	kvNextID    int
+)
+
+func getKVHandle(name string) (*kvHandle, bool) {
+	kvHandlesMu.Lock()
+	defer kvHandlesMu.Unlock()
+	h, ok := kvHandles[name]
+	return h, ok
+}
+
+// kvOpen opens FILE, or returns the handle it is already open under: bolt
+// locks the file, so a second open in the same process would only wait
+func kvOpen(file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	kvHandlesMu.Lock()
+	defer kvHandlesMu.Unlock()
+	for name, h := range kvHandles {
+		if h.path == abs {
+			return name, nil
+		}
+	}
+	db, err := bolt.Open(abs, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return "", errors.New("file is in use by another process")
+		}
+		return "", err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kvBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return "", err
+	}
+	kvNextID++
+	name := "kv" + strconv.Itoa(kvNextID)
+	kvHandles[name] = &kvHandle{path: abs, db: db}
+	return name, nil
+}
+
+func registerKVCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "kv",
+		Help:  "Store values on disk",
+		Usage: "kv open|get|set|incr|delete|scan|close ...",
+		Long: `A key-value store kept in a single file, for counters, tokens and small
+documents that must survive restarts without running a database server.
+kv open returns a handle for the other subcommands, creating FILE if
+needed; opening a file that is already open returns the same handle.
+Only one process can have the file open at a time.
+
+Every set, incr and delete is written to disk before it returns. kv incr
+treats the value as an integer, starting from 0, and returns the new
+value. kv scan returns the entries whose keys start with PREFIX as a
+dict in key order, so keys like user:42 group naturally.
+
+Example:
+  set store [kv open data.db]
+  kv set $store user:42 [json stringify {name alice}]
+  kv incr $store visits
+  dict for {key doc} [kv scan $store user: -limit 100] {
+      puts "$key $doc"
+  }`,
+		Subcommands: []*Command{
+			{Name: "open", Help: "Open a store file and return a handle", Usage: "kv open FILE"},
+			{Name: "get", Help: "Get a value, or DEFAULT when missing", Usage: "kv get HANDLE KEY ?DEFAULT?"},
+			{Name: "set", Help: "Set a value and return it", Usage: "kv set HANDLE KEY VALUE"},
+			{Name: "incr", Help: "Add to a counter and return the new value", Usage: "kv incr HANDLE KEY ?BY?"},
+			{Name: "delete", Help: "Remove a key, returning whether it was present", Usage: "kv delete HANDLE KEY"},
+			{Name: "scan", Help: "Return the entries under a key prefix", Usage: "kv scan HANDLE PREFIX ?-limit N?"},
+			{Name: "close", Help: "Close a handle", Usage: "kv close HANDLE"},
+		},
+	})
+
+	interp.RegisterCommand("kv", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 {
+			return feather.Error("wrong # args: should be \"kv subcommand ?arg ...?\"")
+		}
+		sub := args[0].String()
+		if sub == "open" {
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"kv open file\"")
+			}
+			name, err := kvOpen(args[1].String())
+			if err != nil {
+				return feather.Errorf("kv open: %v", err)
+			}
+			return feather.OK(name)
+		}
+		switch sub {
+		case "get", "set", "incr", "delete", "scan", "close":
+		default:
+			return feather.Errorf("kv: unknown subcommand %q (must be open, get, set, incr, delete, scan, close)", sub)
+		}
+		name := args[1].String()
+		h, ok := getKVHandle(name)
+		if !ok {
+			return feather.Errorf("kv %s: unknown handle %q", sub, name)
+		}
+
+		switch sub {
+		case "get":
+			if len(args) != 3 && len(args) != 4 {
+				return feather.Error("wrong # args: should be \"kv get handle key ?default?\"")
+			}
+			var val []byte
+			h.db.View(func(tx *bolt.Tx) error {
+				if v := tx.Bucket(kvBucket).Get([]byte(args[2].String())); v != nil {
+					val = bytes.Clone(v)
+				}
+				return nil
+			})
+			if val == nil {
+				if len(args) == 4 {
+					return feather.OK(args[3])
+				}
+				return feather.OK("")
+			}
+			return feather.OK(i.String(string(val)))
+		case "set":
+			if len(args) != 4 {
+				return feather.Error("wrong # args: should be \"kv set handle key value\"")
+			}
+			key := args[2].String()
+			if key == "" {
+				return feather.Error("kv set: key must not be empty")
+			}
+			err := h.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(kvBucket).Put([]byte(key), []byte(args[3].String()))
+			})
+			if err != nil {
+				return feather.Errorf("kv set: %v", err)
+			}
+			return feather.OK(args[3])
+		case "incr":
+			if len(args) != 3 && len(args) != 4 {
+				return feather.Error("wrong # args: should be \"kv incr handle key ?by?\"")
+			}
+			key := args[2].String()
+			if key == "" {
+				return feather.Error("kv incr: key must not be empty")
+			}
+			by := int64(1)
+			if len(args) == 4 {
+				var err error
+				if by, err = strconv.ParseInt(args[3].String(), 10, 64); err != nil {
+					return feather.Errorf("kv incr: expected integer but got %q", args[3].String())
+				}
+			}
+			var n int64
+			err := h.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(kvBucket)
+				if v := b.Get([]byte(key)); v != nil {
+					var err error
+					if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+						return errors.New(key + " is not an integer")
+					}
+				}
+				n += by
+				return b.Put([]byte(key), []byte(strconv.FormatInt(n, 10)))
+			})
+			if err != nil {
+				return feather.Errorf("kv incr: %v", err)
+			}
+			return feather.OK(n)
+		case "delete":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"kv delete handle key\"")
+			}
+			var found bool
+			err := h.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(kvBucket)
+				key := []byte(args[2].String())
+				found = b.Get(key) != nil
+				return b.Delete(key)
+			})
+			if err != nil {
+				return feather.Errorf("kv delete: %v", err)
+			}
+			return feather.OK(found)
+		case "scan":
+			if len(args) != 3 && len(args) != 5 {
+				return feather.Error("wrong # args: should be \"kv scan handle prefix ?-limit n?\"")
+			}
+			limit := 0
+			if len(args) == 5 {
+				if opt := args[3].String(); opt != "-limit" {
+					return feather.Errorf("kv scan: unknown option %q (must be -limit)", opt)
+				}
+				var err error
+				if limit, err = parseNonNegativeInt(args[4].String()); err != nil {
+					return feather.Errorf("kv scan: -limit: %v", err)
+				}
+			}
+			prefix := []byte(args[2].String())
+			var kvs []any
+			h.db.View(func(tx *bolt.Tx) error {
+				c := tx.Bucket(kvBucket).Cursor()
+				for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+					if limit > 0 && len(kvs) == 2*limit {
+						break
+					}
+					kvs = append(kvs, string(k), string(v))
+				}
+				return nil
+			})
+			return feather.OK(i.DictKV(kvs...))
+		default: // close
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"kv close handle\"")
+			}
+			kvHandlesMu.Lock()
+			delete(kvHandles, name)
+			kvHandlesMu.Unlock()
+			if err := h.db.Close(); err != nil {
+				return feather.Errorf("kv close: %v", err)
+			}
+			return feather.OK("")
+		}
+	})
+}
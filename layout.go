@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"text/template/parse"
+
+	"github.com/feather-lang/feather"
+)
+
+// isEmptyTree reports whether a template body has only whitespace
+func isEmptyTree(root *parse.ListNode) bool {
+	if root == nil {
+		return true
+	}
+	for _, n := range root.Nodes {
+		t, ok := n.(*parse.TextNode)
+		if !ok || strings.TrimSpace(string(t.Text)) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// templateSlots returns the names a template invokes with {{template}}
+// or {{block}}, which a page rendered into it as a layout can define
+func templateSlots(root parse.Node) []string {
+	seen := make(map[string]bool)
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.TemplateNode:
+			seen[n.Name] = true
+		case *parse.IfNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(root)
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitLayoutOption removes a leading -layout NAME from render arguments
+func splitLayoutOption(args []*feather.Obj) (string, []*feather.Obj) {
+	if len(args) >= 2 && args[0].String() == "-layout" {
+		return args[1].String(), args[2:]
+	}
+	return "", args
+}
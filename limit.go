@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// concurrencyLimiter is a counting semaphore that fails fast instead of
+// queueing, so overload turns into 503s rather than an ever-growing backlog
+// of requests waiting for the interpreter.
+type concurrencyLimiter struct {
+	slots chan struct{}
+}
+
+// newConcurrencyLimiter returns a limiter allowing n concurrent holders, or
+// nil (unlimited) when n is zero
+func newConcurrencyLimiter(n int) *concurrencyLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &concurrencyLimiter{slots: make(chan struct{}, n)}
+}
+
+// tryAcquire takes a slot if one is free. A nil limiter always succeeds.
+func (l *concurrencyLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// globalLimiter bounds concurrent route evaluations across the server. It is
+// swapped as a whole when max_concurrent changes; requests already holding a
+// slot release it on the limiter they acquired from.
+var (
+	globalLimiter atomic.Pointer[concurrencyLimiter]
+	maxConcurrent atomic.Int64
+)
+
+// registerLimitConfig registers the global concurrency limit setting
+func registerLimitConfig() {
+	registerConfigKey(&ConfigKey{
+		Name:    "max_concurrent",
+		Help:    "Maximum concurrently executing route handlers (0 = unlimited)",
+		Type:    ConfigInt,
+		Default: "0",
+		Get:     func() string { return strconv.FormatInt(maxConcurrent.Load(), 10) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			maxConcurrent.Store(int64(n))
+			globalLimiter.Store(newConcurrencyLimiter(n))
+			return nil
+		},
+	})
+}
+
+// rejectOverloaded responds 503 and asks the client to retry shortly
+func rejectOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "server busy", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// defaultLogKeep is how many rotated files are kept when -keep isn't given
+const defaultLogKeep = 7
+
+// logOutputSpec is where a log goes, as given by -output, -rotate and -keep
+type logOutputSpec struct {
+	output string // stdout, syslog or a file path
+	rotate string // a size such as 100mb, hourly, daily or "" for never
+	keep   int
+}
+
+func defaultLogOutputSpec() logOutputSpec {
+	return logOutputSpec{output: "stdout", keep: defaultLogKeep}
+}
+
+// option applies the -output, -rotate or -keep option and reports whether
+// name was one of them
+func (s *logOutputSpec) option(name, value string) (bool, error) {
+	switch name {
+	case "-output":
+		s.output = value
+	case "-rotate":
+		if value != "hourly" && value != "daily" {
+			if _, err := parseByteSize(value); err != nil {
+				return true, fmt.Errorf("-rotate: expected a size, hourly or daily, got %q", value)
+			}
+		}
+		s.rotate = value
+	case "-keep":
+		n, err := parseNonNegativeInt(value)
+		if err != nil {
+			return true, fmt.Errorf("-keep: %v", err)
+		}
+		s.keep = n
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// logOutput is an open log destination: stdout, syslog (which journald
+// also reads) or a file, rotated if the spec says so
+type logOutput struct {
+	logOutputSpec
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func openLogOutput(spec logOutputSpec) (*logOutput, error) {
+	o := &logOutput{logOutputSpec: spec}
+	if spec.rotate != "" && !o.isFile() {
+		return nil, fmt.Errorf("-rotate needs a file -output")
+	}
+	switch spec.output {
+	case "stdout":
+		o.w = os.Stdout
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, filepath.Base(os.Args[0]))
+		if err != nil {
+			return nil, err
+		}
+		o.w = w
+	default:
+		f := &rotatingFile{path: spec.output, keep: spec.keep}
+		switch spec.rotate {
+		case "":
+		case "hourly":
+			f.period = "2006-01-02T15"
+		case "daily":
+			f.period = "2006-01-02"
+		default:
+			f.maxSize, _ = parseByteSize(spec.rotate)
+		}
+		if err := f.open(); err != nil {
+			return nil, err
+		}
+		o.w = f
+	}
+	return o, nil
+}
+
+func (o *logOutput) isFile() bool {
+	return o.output != "stdout" && o.output != "syslog"
+}
+
+// write writes one line. A failing log must not fail what is being
+// logged, so errors are dropped.
+func (o *logOutput) write(line []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.w.Write(line)
+}
+
+func (o *logOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if c, ok := o.w.(io.Closer); ok && o.w != os.Stdout {
+		c.Close()
+	}
+	o.w = io.Discard
+}
+
+// dict describes o for log config and accesslog
+func (o *logOutput) dict(i *feather.Interp, kv ...any) *feather.Obj {
+	kv = append(kv, "output", o.output)
+	if o.rotate != "" {
+		kv = append(kv, "rotate", o.rotate, "keep", o.keep)
+	}
+	return i.DictKV(kv...)
+}
+
+// rotatingFile appends to path, moving it aside to path.1 once it reaches
+// maxSize or the period it was written in is over. Older files shift to
+// path.2 and so on; only keep of them are kept.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64  // 0 for no size limit
+	period  string // time layout that changes when a new file is due, "" for none
+	keep    int
+	file    *os.File
+	size    int64
+	stamp   string // the file's period, formatted with period
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	// A file left from an earlier period is rotated on the first write
+	if f.period != "" {
+		t := time.Now()
+		if f.size > 0 {
+			t = info.ModTime()
+		}
+		f.stamp = t.Format(f.period)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	due := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	if f.period != "" && time.Now().Format(f.period) != f.stamp {
+		due = f.size > 0
+		f.stamp = time.Now().Format(f.period)
+	}
+	if due || f.file == nil {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. f.mu must be
+// held.
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+		os.Remove(f.path + "." + strconv.Itoa(f.keep))
+		for n := f.keep - 1; n >= 1; n-- {
+			os.Rename(f.path+"."+strconv.Itoa(n), f.path+"."+strconv.Itoa(n+1))
+		}
+		if f.keep > 0 {
+			os.Rename(f.path, f.path+".1")
+		} else {
+			os.Remove(f.path)
+		}
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// serverLog is where the server's own messages and puts go, nil for stdout
+var serverLog atomic.Pointer[logOutput]
+
+// logf writes a server message: errors from background scripts, handler
+// timeouts, panics, puts output and the like. Lines written to a file are
+// prefixed with the time; stdout and syslog collectors add their own.
+func logf(format string, args ...any) {
+	o := serverLog.Load()
+	if o == nil {
+		fmt.Printf(format, args...)
+		return
+	}
+	if o.isFile() {
+		o.write(fmt.Appendf([]byte(time.Now().Format(time.RFC3339)+" "), format, args...))
+		return
+	}
+	o.write(fmt.Appendf(nil, format, args...))
+}
+
+func registerLogCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "log",
+		Help:  "Configure where server messages go",
+		Usage: "log config ?-output FILE|stdout|syslog? ?-rotate SIZE|hourly|daily? ?-keep N?",
+		Long: `Server messages are puts output, errors from timers, jobs, cron and
+deferred scripts, handler timeouts, panics and the like. They go to
+stdout unless log config sends them elsewhere:
+
+  -output   stdout (default), syslog, which journald also collects, or a
+            file to append to, created if needed; file lines start with
+            the time
+  -rotate   move the file aside once it reaches a size such as 100mb, or
+            every hour or day (hourly, daily). The current file is always
+            FILE; older ones are FILE.1, FILE.2, ..., newest first
+  -keep     rotated files to keep, oldest removed first (default 7)
+
+Options not given take their defaults. With no options, log config
+returns the configuration as a dict. accesslog takes the same options.
+
+Example:
+  log config -output /var/log/app/server.log -rotate 100mb -keep 7`,
+		Subcommands: []*Command{
+			{Name: "config", Help: "Set or show where server messages go", Usage: "log config ?-output FILE|stdout|syslog? ?-rotate SIZE|hourly|daily? ?-keep N?"},
+		},
+	})
+
+	interp.RegisterCommand("log", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"log subcommand ?arg ...?\"")
+		}
+		if args[0].String() != "config" {
+			return feather.Errorf("log: unknown subcommand %q (must be config)", args[0].String())
+		}
+		opts := args[1:]
+		if len(opts) == 0 {
+			if o := serverLog.Load(); o != nil {
+				return feather.OK(o.dict(i))
+			}
+			return feather.OK(i.DictKV("output", "stdout"))
+		}
+		if len(opts)%2 != 0 {
+			return feather.Error("wrong # args: should be \"log config ?-output file|stdout|syslog? ?-rotate size|hourly|daily? ?-keep n?\"")
+		}
+		spec := defaultLogOutputSpec()
+		for k := 0; k < len(opts); k += 2 {
+			ok, err := spec.option(opts[k].String(), opts[k+1].String())
+			if err != nil {
+				return feather.Errorf("log config: %v", err)
+			}
+			if !ok {
+				return feather.Errorf("log config: unknown option %q (must be -output, -rotate, -keep)", opts[k].String())
+			}
+		}
+		var o *logOutput
+		if spec.output != "stdout" || spec.rotate != "" {
+			var err error
+			if o, err = openLogOutput(spec); err != nil {
+				return feather.Errorf("log config: %v", err)
+			}
+		}
+		if old := serverLog.Swap(o); old != nil {
+			old.close()
+		}
+		return feather.OK("")
+	})
+}
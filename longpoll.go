@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// connWaitDefault is how long connection wait parks without -timeout
+const connWaitDefault = 30 * time.Second
+
+// connectionWait parks the calling script until conn is notified, a
+// message is published to topic (if given), the client goes away or
+// timeout passes, and describes which as a dict. Other scripts keep
+// running meanwhile; see serveUntil.
+func connectionWait(i *feather.Interp, state *ServerState, conn *Connection, topic string, timeout time.Duration) (*feather.Obj, error) {
+	var published chan string
+	if topic != "" {
+		published = make(chan string, 1)
+		id := state.pubsub.subscribe(&pubsubSub{topic: topic, waiter: published})
+		defer state.pubsub.unsubscribe(id)
+	}
+
+	// The goroutine only records what happened; objects are made on the
+	// interpreter goroutine
+	var event, data string
+	wake := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case data = <-conn.notify:
+			event = "notify"
+		case data = <-published:
+			event = "message"
+		case <-conn.Done:
+			event = "closed"
+		case <-conn.Ctx.Request.Context().Done():
+			event = "closed"
+		case <-stop:
+			return
+		}
+		close(wake)
+	}()
+
+	woken, err := state.serveUntil(i, wake, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !woken {
+		return i.DictKV("event", "timeout"), nil
+	}
+	switch event {
+	case "notify":
+		return i.DictKV("event", event, "data", data), nil
+	case "message":
+		return i.DictKV("event", event, "topic", topic, "data", data), nil
+	}
+	return i.DictKV("event", event), nil
+}
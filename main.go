@@ -6,11 +6,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/feather-lang/feather"
 )
@@ -19,14 +21,29 @@ import (
 var DefaultConfig string
 
 func main() {
-	scriptFile := flag.String("f", "feather-httpd.tcl", "TCL script file to load")
+	if len(os.Args) > 1 && os.Args[1] == "new" {
+		if err := runNew(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "new: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	scriptFile := flag.String("f", "feather-httpd.tcl", "TCL script file to load (embed://PATH for a bundled one)")
 	noRepl := flag.Bool("no-repl", false, "Disable interactive REPL")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "Grace period for in-flight requests on shutdown")
+	useMmap := flag.Bool("mmap", false, "Memory-map medium files when sendfile is unavailable")
+	notebookDir := flag.String("notebooks", "notebooks", "Directory for web REPL notebooks")
 	flag.Parse()
 
+	mmapEnabled.Store(*useMmap)
+
 	interp := feather.New()
 	defer interp.Close()
 
 	state := NewServerState()
+	state.drainTimeout = *drainTimeout
+	state.notebooks = newNotebookStore(*notebookDir)
 	registerCommands(interp, state)
 
 	// Handle SIGINT for graceful shutdown
@@ -35,13 +52,29 @@ func main() {
 	go func() {
 		<-sigCh
 		fmt.Println("\nShutting down...")
-		close(state.shutdown)
-		if state.server != nil {
-			state.server.Close()
+		state.CloseAllConnections(state.Eval)
+		state.Drain(state.drainTimeout, false)
+	}()
+
+	// Handle SIGUSR2 for zero-downtime restart
+	restartCh := make(chan os.Signal, 1)
+	signal.Notify(restartCh, syscall.SIGUSR2)
+	go func() {
+		for range restartCh {
+			if err := state.Restart(); err != nil {
+				fmt.Fprintf(os.Stderr, "Restart error: %v\n", err)
+			}
 		}
 	}()
 
-	script, err := os.ReadFile(*scriptFile)
+	// A bundled binary runs its own script unless told otherwise
+	if bundleFS != nil && !flagGiven("f") {
+		if _, err := fs.Stat(bundleFS, "feather-httpd.tcl"); err == nil {
+			*scriptFile = embedScheme + "feather-httpd.tcl"
+		}
+	}
+
+	script, err := readPath(*scriptFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", *scriptFile, err)
 		os.Exit(1)
@@ -53,6 +86,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	// Only a script that ran to the end may take over from the parent
+	signalReady()
 
 	if *noRepl {
 		// No REPL - just run the interpreter loop for HTTP requests
@@ -74,6 +109,7 @@ func runTelnetRepl(state *ServerState) {
 		return
 	}
 	fmt.Println("REPL listening on 127.0.0.1:8081")
+	state.replListener = listener
 
 	// Close listener on shutdown
 	go func() {
@@ -117,7 +153,7 @@ func runRepl(state *ServerState, r io.Reader, w io.Writer) {
 			continue
 		}
 
-		result, err := state.EvalWithOutput(input, w)
+		result, err := state.EvalWithOutput(ChannelTelnet, input, w)
 		if err != nil {
 			fmt.Fprintf(w, "error: %v\n", err)
 		} else if result.String() != "" {
@@ -164,3 +200,14 @@ func isComplete(input string) bool {
 	}
 	return braces == 0 && brackets == 0 && !inQuote
 }
+
+// flagGiven reports whether the named flag was set on the command line
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
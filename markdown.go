@@ -0,0 +1,630 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// markdownRenderer converts the common subset of CommonMark plus GFM
+// tables and strikethrough to HTML: ATX and setext headings, paragraphs,
+// block quotes, nested lists, fenced and indented code, rules, tables,
+// emphasis, code spans, links (inline and reference), images, autolinks
+// and hard breaks. With sanitize, raw HTML is escaped instead of passed
+// through. Links with script URLs are always dropped.
+type markdownRenderer struct {
+	sanitize bool
+	refs     map[string][2]string // lowercased label -> url, title
+}
+
+var (
+	mdFenceRe     = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+	mdHeadingRe   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRuleRe      = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdSetextRe    = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdListRe      = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+	mdRefDefRe    = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:[ \t]*<?([^\s>]+)>?(?:[ \t]+["'(](.*)["')])?[ \t]*$`)
+	mdTableSepRe  = regexp.MustCompile(`^ *\|? *:?-+:? *(\| *:?-+:? *)*\|? *$`)
+	mdHTMLBlockRe = regexp.MustCompile(`^ {0,3}<(/?[a-zA-Z][a-zA-Z0-9-]*|!--)`)
+
+	mdStrongRe = regexp.MustCompile(`\*\*([^\s*](?:[^*]*[^\s*])?)\*\*|__([^\s_](?:[^_]*[^\s_])?)__`)
+	mdEmRe     = regexp.MustCompile(`\*([^\s*](?:[^*]*[^\s*])?)\*|(^|[^\w])_([^\s_](?:[^_]*[^\s_])?)_([^\w]|$)`)
+	mdStrikeRe = regexp.MustCompile(`~~([^\s~](?:[^~]*[^\s~])?)~~`)
+	mdTagRe    = regexp.MustCompile(`^</?[a-zA-Z][a-zA-Z0-9-]*(?:\s+[a-zA-Z_:][-a-zA-Z0-9_:.]*(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*\s*/?>|^<!--[\s\S]*?-->`)
+	mdStripRe  = regexp.MustCompile(`<[^>]*>`)
+	mdBreakRe  = regexp.MustCompile(` {2,}\n`)
+	mdAutoRe   = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*|[^\s<>@]+@[^\s<>@]+\.[^\s<>@]+)>`)
+)
+
+// renderMarkdown converts markdown source to HTML
+func renderMarkdown(src string, sanitize bool) string {
+	r := &markdownRenderer{sanitize: sanitize, refs: make(map[string][2]string)}
+	src = strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\t", "    ")
+	lines := r.collectRefs(strings.Split(src, "\n"))
+	var b strings.Builder
+	r.blocks(&b, lines)
+	return b.String()
+}
+
+// collectRefs removes link reference definitions, outside code, and
+// records them for use by reference links
+func (r *markdownRenderer) collectRefs(lines []string) []string {
+	out := lines[:0:0]
+	inFence := ""
+	for _, line := range lines {
+		if m := mdFenceRe.FindStringSubmatch(line); m != nil {
+			if inFence == "" {
+				inFence = m[1][:1]
+			} else if strings.HasPrefix(m[1], inFence) {
+				inFence = ""
+			}
+		}
+		if inFence == "" {
+			if m := mdRefDefRe.FindStringSubmatch(line); m != nil {
+				label := strings.ToLower(strings.TrimSpace(m[1]))
+				if _, ok := r.refs[label]; !ok {
+					r.refs[label] = [2]string{m[2], m[3]}
+				}
+				continue
+			}
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// indentOf counts leading spaces
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// startsBlock reports whether line interrupts a paragraph
+func startsBlock(line string) bool {
+	return mdFenceRe.MatchString(line) || mdHeadingRe.MatchString(line) || mdRuleRe.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), ">") || mdListRe.MatchString(line) && !isBlank(mdListRe.ReplaceAllString(line, ""))
+}
+
+func (r *markdownRenderer) blocks(b *strings.Builder, lines []string) {
+	for k := 0; k < len(lines); {
+		line := lines[k]
+		switch {
+		case isBlank(line):
+			k++
+
+		case mdFenceRe.MatchString(line):
+			m := mdFenceRe.FindStringSubmatch(line)
+			fence, indent := m[1], indentOf(line)
+			var code []string
+			k++
+			for ; k < len(lines); k++ {
+				if f := mdFenceRe.FindStringSubmatch(lines[k]); f != nil && f[2] == "" &&
+					f[1][0] == fence[0] && len(f[1]) >= len(fence) {
+					k++
+					break
+				}
+				code = append(code, strings.TrimPrefix(lines[k], strings.Repeat(" ", min(indent, indentOf(lines[k])))))
+			}
+			b.WriteString("<pre><code")
+			if lang := html.UnescapeString(m[2]); lang != "" {
+				fmt.Fprintf(b, ` class="language-%s"`, html.EscapeString(lang))
+			}
+			b.WriteString(">")
+			for _, c := range code {
+				b.WriteString(html.EscapeString(c))
+				b.WriteString("\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case indentOf(line) >= 4:
+			var code []string
+			for ; k < len(lines) && (indentOf(lines[k]) >= 4 || isBlank(lines[k])); k++ {
+				code = append(code, strings.TrimPrefix(lines[k], "    "))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>")
+			for _, c := range code {
+				b.WriteString(html.EscapeString(c))
+				b.WriteString("\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case mdHeadingRe.MatchString(line):
+			m := mdHeadingRe.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), r.inline(m[2]), len(m[1]))
+			k++
+
+		case mdRuleRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			k++
+
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			var quoted []string
+			for ; k < len(lines) && !isBlank(lines[k]); k++ {
+				l := strings.TrimLeft(lines[k], " ")
+				if strings.HasPrefix(l, ">") {
+					l = strings.TrimPrefix(strings.TrimPrefix(l, ">"), " ")
+				} else if startsBlock(lines[k]) {
+					break
+				}
+				quoted = append(quoted, l)
+			}
+			b.WriteString("<blockquote>\n")
+			r.blocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case mdListRe.MatchString(line):
+			k = r.list(b, lines, k)
+
+		case mdHTMLBlockRe.MatchString(line):
+			var block []string
+			for ; k < len(lines) && !isBlank(lines[k]); k++ {
+				block = append(block, lines[k])
+			}
+			raw := strings.Join(block, "\n")
+			if r.sanitize {
+				b.WriteString("<p>" + html.EscapeString(raw) + "</p>\n")
+			} else {
+				b.WriteString(raw + "\n")
+			}
+
+		case k+1 < len(lines) && strings.Contains(line, "|") && mdTableSepRe.MatchString(lines[k+1]) && strings.Contains(lines[k+1], "-"):
+			k = r.table(b, lines, k)
+
+		default:
+			para := []string{line}
+			k++
+			for ; k < len(lines) && !isBlank(lines[k]); k++ {
+				if m := mdSetextRe.FindStringSubmatch(lines[k]); m != nil {
+					level := 1
+					if m[1][0] == '-' {
+						level = 2
+					}
+					fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, r.inline(strings.TrimSpace(strings.Join(para, "\n"))), level)
+					para = nil
+					k++
+					break
+				}
+				if startsBlock(lines[k]) {
+					break
+				}
+				para = append(para, lines[k])
+			}
+			if para != nil {
+				b.WriteString("<p>" + r.inline(strings.TrimSpace(strings.Join(para, "\n"))) + "</p>\n")
+			}
+		}
+	}
+}
+
+// list renders the list starting at lines[k] and returns the index after it
+func (r *markdownRenderer) list(b *strings.Builder, lines []string, k int) int {
+	m := mdListRe.FindStringSubmatch(lines[k])
+	marker := m[2]
+	ordered := marker[0] >= '0' && marker[0] <= '9'
+	delim := marker[len(marker)-1:]
+	base := len(m[1])
+	sameList := func(line string) (content int, ok bool) {
+		m := mdListRe.FindStringSubmatch(line)
+		if m == nil || len(m[1]) != base {
+			return 0, false
+		}
+		isOrdered := m[2][0] >= '0' && m[2][0] <= '9'
+		if isOrdered != ordered || m[2][len(m[2])-1:] != delim {
+			return 0, false
+		}
+		return len(m[0]), true
+	}
+
+	var items [][]string
+	loose := false
+	for k < len(lines) {
+		content, ok := sameList(lines[k])
+		if !ok {
+			break
+		}
+		if content-base > 5 { // a code block right after the marker
+			content = base + len(m[2]) + 1
+		}
+		item := []string{lines[k][min(content, len(lines[k])):]}
+		k++
+		for k < len(lines) {
+			line := lines[k]
+			if isBlank(line) {
+				// The item continues if indented content follows
+				next := k + 1
+				for next < len(lines) && isBlank(lines[next]) {
+					next++
+				}
+				if next < len(lines) && indentOf(lines[next]) >= content {
+					item = append(item, "")
+					k++
+					continue
+				}
+				if next < len(lines) {
+					if _, ok := sameList(lines[next]); ok {
+						loose = true
+					}
+				}
+				break
+			}
+			if indentOf(line) >= content {
+				item = append(item, line[content:])
+			} else if _, ok := sameList(line); ok {
+				break
+			} else if startsBlock(line) || (len(item) > 0 && isBlank(item[len(item)-1])) {
+				break
+			} else {
+				item = append(item, strings.TrimLeft(line, " ")) // lazy continuation
+			}
+			k++
+		}
+		for len(item) > 0 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+		}
+		for _, l := range item {
+			if isBlank(l) {
+				loose = true
+			}
+		}
+		items = append(items, item)
+		for k < len(lines) && isBlank(lines[k]) {
+			next := k + 1
+			for next < len(lines) && isBlank(lines[next]) {
+				next++
+			}
+			if next < len(lines) {
+				if _, ok := sameList(lines[next]); ok {
+					loose = true
+					k = next
+					continue
+				}
+			}
+			break
+		}
+	}
+
+	if ordered {
+		start, _ := strconv.Atoi(strings.TrimRight(marker, ".)"))
+		if start != 1 {
+			fmt.Fprintf(b, "<ol start=\"%d\">\n", start)
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		var inner strings.Builder
+		r.blocks(&inner, item)
+		s := inner.String()
+		if !loose {
+			// Tight lists don't wrap paragraphs
+			s = strings.ReplaceAll(strings.ReplaceAll(s, "<p>", ""), "</p>\n", "\n")
+		}
+		b.WriteString("<li>" + strings.TrimSuffix(s, "\n") + "</li>\n")
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return k
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cur strings.Builder
+	for k := 0; k < len(line); k++ {
+		if line[k] == '\\' && k+1 < len(line) && line[k+1] == '|' {
+			cur.WriteByte('|')
+			k++
+			continue
+		}
+		if line[k] == '|' {
+			cells = append(cells, strings.TrimSpace(cur.String()))
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(line[k])
+	}
+	return append(cells, strings.TrimSpace(cur.String()))
+}
+
+// table renders a GFM table starting at lines[k]
+func (r *markdownRenderer) table(b *strings.Builder, lines []string, k int) int {
+	header := splitTableRow(lines[k])
+	var align []string
+	for _, c := range splitTableRow(lines[k+1]) {
+		switch {
+		case strings.HasPrefix(c, ":") && strings.HasSuffix(c, ":"):
+			align = append(align, "center")
+		case strings.HasSuffix(c, ":"):
+			align = append(align, "right")
+		case strings.HasPrefix(c, ":"):
+			align = append(align, "left")
+		default:
+			align = append(align, "")
+		}
+	}
+	row := func(tag string, cells []string) {
+		b.WriteString("<tr>")
+		for j := range header {
+			var cell string
+			if j < len(cells) {
+				cell = cells[j]
+			}
+			if j < len(align) && align[j] != "" {
+				fmt.Fprintf(b, `<%s style="text-align:%s">`, tag, align[j])
+			} else {
+				b.WriteString("<" + tag + ">")
+			}
+			b.WriteString(r.inline(cell) + "</" + tag + ">")
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("<table>\n<thead>\n")
+	row("th", header)
+	b.WriteString("</thead>\n")
+	k += 2
+	if k < len(lines) && !isBlank(lines[k]) && strings.Contains(lines[k], "|") {
+		b.WriteString("<tbody>\n")
+		for ; k < len(lines) && !isBlank(lines[k]) && strings.Contains(lines[k], "|"); k++ {
+			row("td", splitTableRow(lines[k]))
+		}
+		b.WriteString("</tbody>\n")
+	}
+	b.WriteString("</table>\n")
+	return k
+}
+
+// safeURL drops URLs that would run script when followed
+func safeURL(u string, image bool) string {
+	scheme, _, ok := strings.Cut(strings.ToLower(strings.TrimSpace(u)), ":")
+	if ok && !strings.ContainsAny(scheme, "/?#") {
+		switch scheme {
+		case "javascript", "vbscript", "file":
+			return ""
+		case "data":
+			if !image || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(u)), "data:image/") {
+				return ""
+			}
+		}
+	}
+	return u
+}
+
+// linkTarget parses "(url "title")" at s[0] and returns url, title and
+// the length consumed
+func linkTarget(s string) (string, string, int, bool) {
+	if !strings.HasPrefix(s, "(") {
+		return "", "", 0, false
+	}
+	depth := 0
+	for k := 0; k < len(s); k++ {
+		switch s[k] {
+		case '\\':
+			k++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				inner := strings.TrimSpace(s[1:k])
+				url, title := inner, ""
+				if sp := strings.IndexAny(inner, " \t\n"); sp >= 0 {
+					rest := strings.TrimSpace(inner[sp:])
+					if len(rest) >= 2 && strings.ContainsRune(`"'(`, rune(rest[0])) {
+						url, title = inner[:sp], rest[1:len(rest)-1]
+					}
+				}
+				url = strings.TrimSuffix(strings.TrimPrefix(url, "<"), ">")
+				return url, title, k + 1, true
+			}
+		}
+	}
+	return "", "", 0, false
+}
+
+// closingBracket finds the ] matching the [ at s[0]
+func closingBracket(s string) int {
+	depth := 0
+	for k := 0; k < len(s); k++ {
+		switch s[k] {
+		case '\\':
+			k++
+		case '`':
+			if end := strings.IndexByte(s[k+1:], '`'); end >= 0 {
+				k += end + 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return k
+			}
+		}
+	}
+	return -1
+}
+
+// inline renders inline markdown. Code spans, links, autolinks, raw HTML
+// and escapes are replaced by placeholders first so emphasis rules never
+// see inside them.
+func (r *markdownRenderer) inline(s string) string {
+	var tokens []string
+	hold := func(h string) string {
+		tokens = append(tokens, h)
+		return "\x00" + strconv.Itoa(len(tokens)-1) + "\x00"
+	}
+	link := func(text, url, title string, image bool) string {
+		url = safeURL(url, image)
+		if url == "" && !image {
+			return r.inline(text)
+		}
+		titleAttr := ""
+		if title != "" {
+			titleAttr = ` title="` + html.EscapeString(title) + `"`
+		}
+		if image {
+			alt := html.EscapeString(html.UnescapeString(mdStripRe.ReplaceAllString(r.inline(text), "")))
+			return fmt.Sprintf(`<img src="%s" alt="%s"%s>`, html.EscapeString(url), alt, titleAttr)
+		}
+		return fmt.Sprintf(`<a href="%s"%s>%s</a>`, html.EscapeString(url), titleAttr, r.inline(text))
+	}
+
+	var out strings.Builder
+	for k := 0; k < len(s); k++ {
+		c := s[k]
+		switch {
+		case c == '\\' && k+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!|<>~\"'", s[k+1]) >= 0:
+			out.WriteString(hold(html.EscapeString(s[k+1 : k+2])))
+			k++
+			continue
+		case c == '\\' && k+1 < len(s) && s[k+1] == '\n':
+			out.WriteString(hold("<br>\n"))
+			k++
+			continue
+		case c == '`':
+			n := len(s[k:]) - len(strings.TrimLeft(s[k:], "`"))
+			ticks := s[k : k+n]
+			if end := strings.Index(s[k+n:], ticks); end >= 0 {
+				code := strings.ReplaceAll(s[k+n:k+n+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				out.WriteString(hold("<code>" + html.EscapeString(code) + "</code>"))
+				k += n + end + n - 1
+				continue
+			}
+			out.WriteString(ticks)
+			k += n - 1
+			continue
+		case c == '<':
+			if m := mdAutoRe.FindStringSubmatch(s[k:]); m != nil {
+				href := m[1]
+				if !strings.Contains(href, ":") || strings.Contains(href, "@") && !strings.Contains(href, "://") && !strings.HasPrefix(strings.ToLower(href), "mailto:") {
+					href = "mailto:" + href
+				}
+				out.WriteString(hold(fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(safeURL(href, false)), html.EscapeString(m[1]))))
+				k += len(m[0]) - 1
+				continue
+			}
+			if m := mdTagRe.FindString(s[k:]); m != "" && !r.sanitize {
+				out.WriteString(hold(m))
+				k += len(m) - 1
+				continue
+			}
+		case c == '[' || c == '!' && k+1 < len(s) && s[k+1] == '[':
+			image := c == '!'
+			start := k
+			if image {
+				start++
+			}
+			end := closingBracket(s[start:])
+			if end < 0 {
+				break
+			}
+			text := s[start+1 : start+end]
+			rest := s[start+end+1:]
+			if url, title, n, ok := linkTarget(rest); ok {
+				out.WriteString(hold(link(text, url, title, image)))
+				k = start + end + n
+				continue
+			}
+			label := text
+			n := 0
+			if strings.HasPrefix(rest, "[") {
+				if e := strings.IndexByte(rest, ']'); e >= 0 {
+					if e > 1 {
+						label = rest[1:e]
+					}
+					n = e + 1
+				}
+			}
+			if ref, ok := r.refs[strings.ToLower(strings.TrimSpace(label))]; ok {
+				out.WriteString(hold(link(text, ref[0], ref[1], image)))
+				k = start + end + n
+				continue
+			}
+		}
+		out.WriteByte(c)
+	}
+
+	text := html.EscapeString(out.String())
+	text = mdStrongRe.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = mdEmRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mdEmRe.FindStringSubmatch(m)
+		if sub[1] != "" {
+			return "<em>" + sub[1] + "</em>"
+		}
+		return sub[2] + "<em>" + sub[3] + "</em>" + sub[4]
+	})
+	text = mdStrikeRe.ReplaceAllString(text, "<del>$1</del>")
+	text = mdBreakRe.ReplaceAllString(text, "<br>\n")
+
+	// Tokens are fully rendered, so a single pass restores them
+	for j := range tokens {
+		text = strings.Replace(text, "\x00"+strconv.Itoa(j)+"\x00", tokens[j], 1)
+	}
+	return text
+}
+
+// markdownTemplateFunc renders markdown for {{markdown .body}}. Template
+// data is usually user content, so raw HTML is always escaped.
+func markdownTemplateFunc(src string) template.HTML {
+	return template.HTML(renderMarkdown(src, true))
+}
+
+func registerMarkdownCommand(interp *feather.Interp, state *ServerState) {
+	markdownCmd := &Command{
+		Name:  "markdown",
+		Help:  "Render markdown to HTML",
+		Usage: "markdown render TEXT ?-sanitize?",
+		Long: `Supports CommonMark headings, paragraphs, emphasis, code, block quotes,
+lists, links, images, rules and hard breaks, plus GFM tables and
+~~strikethrough~~. Raw HTML in the source is passed through unless
+-sanitize is given, in which case it is escaped; use -sanitize for
+anything users can write. javascript: and similar links are always
+dropped.
+
+In templates, {{markdown .body}} renders with -sanitize.`,
+		Subcommands: []*Command{
+			{Name: "render", Help: "Convert markdown to HTML", Usage: "markdown render TEXT ?-sanitize?"},
+		},
+	}
+	registry.Register(markdownCmd)
+	interp.RegisterCommand("markdown", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"markdown render text ?-sanitize?\"")
+		}
+		switch args[0].String() {
+		case "render":
+			sanitize := false
+			if len(args) == 3 && args[2].String() == "-sanitize" {
+				sanitize = true
+			} else if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"markdown render text ?-sanitize?\"")
+			}
+			return feather.OK(i.String(renderMarkdown(args[1].String(), sanitize)))
+		default:
+			return feather.Errorf("markdown: unknown subcommand %q (must be render)", args[0].String())
+		}
+	})
+}
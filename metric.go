@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// defaultMetricBuckets are the histogram bucket bounds used unless
+// -buckets is given, the same as the Prometheus client libraries'
+var defaultMetricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// scriptMetric is a metric published by the metric command
+type scriptMetric struct {
+	kind   string    // counter, gauge or histogram
+	value  float64   // counter and gauge
+	bounds []float64 // histogram upper bounds, ascending
+	counts []uint64  // per bucket, the last one is +Inf
+	count  uint64
+	sum    float64
+}
+
+var (
+	scriptMetricsMu sync.Mutex
+	scriptMetrics   = make(map[string]*scriptMetric)
+)
+
+// getScriptMetric returns the metric called name, creating it as kind.
+// scriptMetricsMu must be held.
+func getScriptMetric(kind, name string) (*scriptMetric, error) {
+	m, ok := scriptMetrics[name]
+	if !ok {
+		if !metricNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		m = &scriptMetric{kind: kind}
+		scriptMetrics[name] = m
+	} else if m.kind != kind {
+		return nil, fmt.Errorf("%s is a %s", name, m.kind)
+	}
+	return m, nil
+}
+
+func (m *scriptMetric) observe(v float64) {
+	m.counts[sort.SearchFloat64s(m.bounds, v)]++
+	m.count++
+	m.sum += v
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeScriptMetrics renders the metrics scripts published, by name
+func writeScriptMetrics(w io.Writer) {
+	scriptMetricsMu.Lock()
+	defer scriptMetricsMu.Unlock()
+	names := make([]string, 0, len(scriptMetrics))
+	for name := range scriptMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := scriptMetrics[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(m.value))
+			continue
+		}
+		var cum uint64
+		for i, b := range m.bounds {
+			cum += m.counts[i]
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatMetricValue(b), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, m.count)
+		fmt.Fprintf(w, "%s_sum %s\n", name, formatMetricValue(m.sum))
+		fmt.Fprintf(w, "%s_count %d\n", name, m.count)
+	}
+}
+
+// parseMetricValue parses a metric value, which must be a finite number
+func parseMetricValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("expected number, got %q", s)
+	}
+	return v, nil
+}
+
+// parseMetricBuckets parses a -buckets list of ascending bounds
+func parseMetricBuckets(i *feather.Interp, obj *feather.Obj) ([]float64, error) {
+	items, err := i.ParseList(obj.String())
+	if err != nil {
+		return nil, fmt.Errorf("-buckets: %v", err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("-buckets: expected at least one bound")
+	}
+	bounds := make([]float64, len(items))
+	for k, item := range items {
+		if bounds[k], err = parseMetricValue(item.String()); err != nil {
+			return nil, fmt.Errorf("-buckets: %v", err)
+		}
+		if k > 0 && bounds[k] <= bounds[k-1] {
+			return nil, fmt.Errorf("-buckets: bounds must be ascending")
+		}
+	}
+	return bounds, nil
+}
+
+func registerMetricCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "metric",
+		Help:  "Publish application metrics at /_metrics",
+		Usage: "metric counter|gauge|histogram NAME ...",
+		Long: `Business metrics from scripts, served with the server's own in the
+Prometheus text format at /_metrics. A metric is created on first use
+and keeps its type; NAME must be a valid Prometheus metric name, such
+as orders_total. Handlers, jobs and timers all update the same metrics.
+
+metric counter incr adds N (default 1) and returns the new total;
+counters only go up. metric gauge set records the current value of
+something that goes up and down. metric histogram observe counts V into
+buckets; -buckets gives their upper bounds when the histogram is
+created, otherwise 0.005 to 10, which suits durations in seconds.
+
+Example:
+  route POST /orders {
+      set total [json get [request body] /total]
+      metric counter orders_total incr
+      metric histogram order_value_dollars observe $total -buckets {10 50 100 500}
+      respond ok
+  }
+  every 10000 {
+      metric gauge pending_signups set [dict size [kv scan $store signup:]]
+  }`,
+		Subcommands: []*Command{
+			{Name: "counter", Help: "Add to a counter", Usage: "metric counter NAME incr ?N?"},
+			{Name: "gauge", Help: "Set a gauge", Usage: "metric gauge NAME set VALUE"},
+			{Name: "histogram", Help: "Count a value into a histogram", Usage: "metric histogram NAME observe VALUE ?-buckets LIST?"},
+		},
+	})
+
+	interp.RegisterCommand("metric", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 3 {
+			return feather.Error("wrong # args: should be \"metric counter|gauge|histogram name op ?arg ...?\"")
+		}
+		kind, name, op := args[0].String(), args[1].String(), args[2].String()
+		switch kind {
+		case "counter":
+			if op != "incr" {
+				return feather.Errorf("metric counter: unknown operation %q (must be incr)", op)
+			}
+			n := 1.0
+			switch len(args) {
+			case 3:
+			case 4:
+				var err error
+				if n, err = parseMetricValue(args[3].String()); err != nil {
+					return feather.Errorf("metric counter: %v", err)
+				}
+				if n < 0 {
+					return feather.Error("metric counter: counters can't go down")
+				}
+			default:
+				return feather.Error("wrong # args: should be \"metric counter name incr ?n?\"")
+			}
+			scriptMetricsMu.Lock()
+			defer scriptMetricsMu.Unlock()
+			m, err := getScriptMetric(kind, name)
+			if err != nil {
+				return feather.Errorf("metric counter: %v", err)
+			}
+			m.value += n
+			return feather.OK(formatMetricValue(m.value))
+		case "gauge":
+			if op != "set" {
+				return feather.Errorf("metric gauge: unknown operation %q (must be set)", op)
+			}
+			if len(args) != 4 {
+				return feather.Error("wrong # args: should be \"metric gauge name set value\"")
+			}
+			v, err := parseMetricValue(args[3].String())
+			if err != nil {
+				return feather.Errorf("metric gauge: %v", err)
+			}
+			scriptMetricsMu.Lock()
+			defer scriptMetricsMu.Unlock()
+			m, err := getScriptMetric(kind, name)
+			if err != nil {
+				return feather.Errorf("metric gauge: %v", err)
+			}
+			m.value = v
+			return feather.OK("")
+		case "histogram":
+			if op != "observe" {
+				return feather.Errorf("metric histogram: unknown operation %q (must be observe)", op)
+			}
+			bounds := defaultMetricBuckets
+			switch {
+			case len(args) == 6 && args[4].String() == "-buckets":
+				var err error
+				if bounds, err = parseMetricBuckets(i, args[5]); err != nil {
+					return feather.Errorf("metric histogram: %v", err)
+				}
+			case len(args) != 4:
+				return feather.Error("wrong # args: should be \"metric histogram name observe value ?-buckets list?\"")
+			}
+			v, err := parseMetricValue(args[3].String())
+			if err != nil {
+				return feather.Errorf("metric histogram: %v", err)
+			}
+			scriptMetricsMu.Lock()
+			defer scriptMetricsMu.Unlock()
+			m, err := getScriptMetric(kind, name)
+			if err != nil {
+				return feather.Errorf("metric histogram: %v", err)
+			}
+			if m.bounds == nil {
+				m.bounds, m.counts = bounds, make([]uint64, len(bounds)+1)
+			}
+			m.observe(v)
+			return feather.OK("")
+		default:
+			return feather.Errorf("metric: unknown type %q (must be counter, gauge, histogram)", kind)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// serveMetrics writes runtime and server metrics in the Prometheus text format
+func serveMetrics(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(state, w)
+}
+
+func writeMetrics(state *ServerState, w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	writeMetric(w, "feather_go_alloc_bytes", "gauge", "Bytes of allocated heap objects", ms.HeapAlloc)
+	writeMetric(w, "feather_go_alloc_bytes_total", "counter", "Cumulative bytes allocated for heap objects", ms.TotalAlloc)
+	writeMetric(w, "feather_go_mallocs_total", "counter", "Cumulative count of heap objects allocated", ms.Mallocs)
+	writeMetric(w, "feather_go_frees_total", "counter", "Cumulative count of heap objects freed", ms.Frees)
+	writeMetric(w, "feather_go_gc_cycles_total", "counter", "Completed GC cycles", uint64(ms.NumGC))
+	writeMetric(w, "feather_go_gc_pause_seconds_total", "counter", "Cumulative GC stop-the-world pause time", float64(ms.PauseTotalNs)/1e9)
+	writeMetric(w, "feather_go_goroutines", "gauge", "Number of goroutines", runtime.NumGoroutine())
+
+	writeMetric(w, "feather_buffer_pool_gets_total", "counter", "Buffers taken from the pool", poolStats.gets.Load())
+	writeMetric(w, "feather_buffer_pool_allocs_total", "counter", "Buffer pool misses that allocated a new buffer", poolStats.allocs.Load())
+	writeMetric(w, "feather_buffer_pool_puts_total", "counter", "Buffers returned to the pool", poolStats.puts.Load())
+	writeMetric(w, "feather_buffer_pool_discarded_total", "counter", "Oversized buffers dropped instead of pooled", poolStats.discarded.Load())
+
+	writeMetric(w, "feather_files_sendfile_total", "counter", "Files served via the kernel sendfile path", fileStats.sendfile.Load())
+	writeMetric(w, "feather_files_mmap_total", "counter", "Files served from a memory mapping", fileStats.mmap.Load())
+	writeMetric(w, "feather_files_copied_total", "counter", "Files served by copying through userspace", fileStats.copied.Load())
+
+	cs := state.conns.Stats()
+	writeMetric(w, "feather_client_connections_open", "gauge", "Open client connections", cs.Open)
+	writeMetric(w, "feather_client_connections_active", "gauge", "Client connections serving a request", cs.Active)
+	writeMetric(w, "feather_client_connections_idle", "gauge", "Idle keep-alive client connections", cs.Idle)
+	writeMetric(w, "feather_client_connections_hijacked_total", "counter", "Client connections hijacked from the server", cs.Hijacked)
+	writeMetric(w, "feather_connections_held", "gauge", "Currently held streaming connections", len(state.ListConnections()))
+
+	interpStats.queueWait.write(w, "feather_interp_queue_wait_seconds", "Time scripts waited for the interpreter before running")
+	writeMetric(w, "feather_interp_queue_waiting", "gauge", "Scripts waiting for the interpreter", interpStats.waiting.Load())
+	writeMetric(w, "feather_interp_evals_total", "counter", "Scripts evaluated by the interpreter", interpStats.evals.Load())
+	writeMetric(w, "feather_interp_eval_seconds_total", "counter", "Time the interpreter spent evaluating scripts", float64(interpStats.evalNs.Load())/1e9)
+
+	writeScriptMetrics(w)
+}
+
+// queueWaitBuckets are the histogram bucket bounds, in seconds, for the
+// interpreter queue wait
+var queueWaitBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// histogram counts durations into fixed buckets
+type histogram struct {
+	bounds []float64       // upper bounds in seconds, ascending
+	counts []atomic.Uint64 // per bucket, the last one is +Inf
+	count  atomic.Uint64
+	sumNs  atomic.Int64
+	maxNs  atomic.Int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sumNs.Add(int64(d))
+	for {
+		max := h.maxNs.Load()
+		if int64(d) <= max || h.maxNs.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// quantile estimates the q quantile (0..1) as the upper bound of the bucket
+// it falls in, capped at the maximum
+func (h *histogram) quantile(q float64) time.Duration {
+	total := h.count.Load()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i := range h.bounds {
+		if seen += h.counts[i].Load(); seen >= rank {
+			return min(time.Duration(h.bounds[i]*float64(time.Second)), time.Duration(h.maxNs.Load()))
+		}
+	}
+	return time.Duration(h.maxNs.Load())
+}
+
+// write renders the histogram in the Prometheus text format
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, cum)
+	}
+	cum += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cum)
+	fmt.Fprintf(w, "%s_sum %g\n", name, float64(h.sumNs.Load())/1e9)
+	fmt.Fprintf(w, "%s_count %d\n", name, cum)
+}
+
+func registerStatsCommand(interp *feather.Interp, state *ServerState) {
+	statsCmd := &Command{
+		Name:  "stats",
+		Help:  "Show server statistics",
+		Usage: "stats SUBCOMMAND",
+		Subcommands: []*Command{
+			{Name: "connections", Help: "Client connection counts as a dict", Usage: "stats connections"},
+			{Name: "interp", Help: "Interpreter queue wait and eval time as a dict", Usage: "stats interp"},
+		},
+		Long: `stats interp shows whether the interpreter itself is the bottleneck.
+Every script (route bodies, middleware, REPL input) runs on a single
+interpreter goroutine and waits its turn; wait_p50_ms, wait_p90_ms and
+wait_p99_ms (bucket upper bounds), wait_max_ms and waiting describe that
+queue. busy_ratio is the share of time since startup spent evaluating.
+When waits grow while busy_ratio approaches 1, requests are queueing
+for the interpreter rather than spending time in their own handlers.
+The full histogram is feather_interp_queue_wait_seconds in /_metrics.`,
+	}
+	registry.Register(statsCmd)
+	interp.RegisterCommand("stats", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"stats subcommand\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "connections":
+			cs := state.conns.Stats()
+			return feather.OK(i.DictKV(
+				"open", cs.Open,
+				"active", cs.Active,
+				"idle", cs.Idle,
+				"hijacked", int64(cs.Hijacked),
+				"held", len(state.ListConnections()),
+			))
+		case "interp":
+			h := interpStats.queueWait
+			ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+			evals := interpStats.evals.Load()
+			var avg float64
+			if n := h.count.Load(); n > 0 {
+				avg = ms(time.Duration(h.sumNs.Load() / int64(n)))
+			}
+			uptime := time.Since(interpStats.since)
+			return feather.OK(i.DictKV(
+				"evals", int64(evals),
+				"waiting", interpStats.waiting.Load(),
+				"wait_avg_ms", avg,
+				"wait_p50_ms", ms(h.quantile(0.5)),
+				"wait_p90_ms", ms(h.quantile(0.9)),
+				"wait_p99_ms", ms(h.quantile(0.99)),
+				"wait_max_ms", ms(time.Duration(h.maxNs.Load())),
+				"eval_total_ms", ms(time.Duration(interpStats.evalNs.Load())),
+				"busy_ratio", float64(interpStats.evalNs.Load())/float64(uptime),
+			))
+		default:
+			return feather.Errorf("stats: unknown subcommand %q (must be connections, interp)", subcmd)
+		}
+	})
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// Middleware is a step run for every matched route, configured with use.
+// Built-in middlewares (gzip, minify) wrap the response writer; any other name is
+// a proc called before the route body.
+type Middleware struct {
+	Name   string
+	Except []string // path patterns to skip
+	Only   []string // when set, path patterns to apply to
+	When   string   // script that must be true to apply
+	Unless string   // script that must be false to apply
+	Level  int      // gzip compression level
+}
+
+// builtinMiddlewares are implemented in Go rather than as procs
+var builtinMiddlewares = map[string]bool{"gzip": true, "minify": true}
+
+// String renders the middleware back into use command arguments
+func (m *Middleware) String() string {
+	parts := []string{tclQuote(m.Name)}
+	if m.Name == "gzip" && m.Level != gzip.DefaultCompression {
+		parts = append(parts, "-level", strconv.Itoa(m.Level))
+	}
+	if len(m.Except) > 0 {
+		parts = append(parts, "-except", tclQuote(tclQuote(m.Except...)))
+	}
+	if len(m.Only) > 0 {
+		parts = append(parts, "-only", tclQuote(tclQuote(m.Only...)))
+	}
+	if m.When != "" {
+		parts = append(parts, "-when", tclQuote(m.When))
+	}
+	if m.Unless != "" {
+		parts = append(parts, "-unless", tclQuote(m.Unless))
+	}
+	return strings.Join(parts, " ")
+}
+
+// applies decides whether the middleware runs for a request; eval runs the
+// -when and -unless predicates
+func (m *Middleware) applies(path string, eval func(string) (string, error)) (bool, error) {
+	for _, p := range m.Except {
+		if globMatch(p, path) {
+			return false, nil
+		}
+	}
+	if len(m.Only) > 0 {
+		matched := false
+		for _, p := range m.Only {
+			if globMatch(p, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	if m.When != "" {
+		out, err := eval(m.When)
+		if err != nil || !tclTrue(out) {
+			return false, err
+		}
+	}
+	if m.Unless != "" {
+		out, err := eval(m.Unless)
+		if err != nil || tclTrue(out) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// globMatch matches like Tcl's string match for * and ?; * also matches /
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for k := 0; k <= len(s); k++ {
+				if globMatch(pattern, s[k:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+var (
+	middlewareMu sync.RWMutex
+	middlewares  []*Middleware
+)
+
+func currentMiddlewares() []*Middleware {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	return middlewares
+}
+
+// runMiddlewares wraps the response writer and calls proc middlewares for
+// a matched request. It returns whether the route body should still run:
+// a proc middleware that responds short-circuits it. ctx.finishWriters
+// must be called once the request is done.
+func runMiddlewares(ctx *RequestContext, eval func(string) (string, error)) (proceed bool, err error) {
+	for _, m := range currentMiddlewares() {
+		ok, err := m.applies(ctx.Request.URL.Path, eval)
+		if err != nil {
+			return false, fmt.Errorf("use %s: %v", m.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		switch m.Name {
+		case "gzip":
+			if gw := newGzipWriter(ctx.Writer, ctx.Request, m.Level); gw != nil {
+				ctx.wrapWriter(gw, gw.close)
+			}
+		case "minify":
+			if mw := newMinifyWriter(ctx.Writer, ctx.Request); mw != nil {
+				ctx.wrapWriter(mw, mw.close)
+			}
+		default:
+			if _, err := eval(tclQuote(m.Name)); err != nil {
+				return false, fmt.Errorf("use %s: %v", m.Name, err)
+			}
+			ctx.mu.Lock()
+			written := ctx.Written
+			ctx.mu.Unlock()
+			if written {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// gzipWriter compresses a response unless it turns out not to have a body
+// or is already encoded
+type gzipWriter struct {
+	http.ResponseWriter
+	level       int
+	gz          *gzip.Writer
+	wroteHeader bool
+	passthrough bool
+}
+
+// newGzipWriter returns nil when the request can't take a gzip response
+func newGzipWriter(w http.ResponseWriter, r *http.Request, level int) *gzipWriter {
+	if r.Method == "HEAD" || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+		return nil
+	}
+	return &gzipWriter{ResponseWriter: w, level: level}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(enc) == "gzip" || strings.TrimSpace(enc) == "*" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" || code == http.StatusPartialContent {
+		g.passthrough = true
+	} else {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.passthrough {
+		return g.ResponseWriter.Write(b)
+	}
+	if g.gz == nil {
+		gz, err := gzip.NewWriterLevel(g.ResponseWriter, g.level)
+		if err != nil {
+			return 0, err
+		}
+		g.gz = gz
+	}
+	return g.gz.Write(b)
+}
+
+// Flush pushes compressed data out, so streamed responses keep streaming
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+func parseMiddleware(i *feather.Interp, args []*feather.Obj) (*Middleware, error) {
+	m := &Middleware{Name: args[0].String(), Level: gzip.DefaultCompression}
+	for j := 1; j < len(args); j++ {
+		opt := args[j].String()
+		j++
+		if j >= len(args) {
+			return nil, fmt.Errorf("%s: missing value", opt)
+		}
+		val := args[j].String()
+		switch opt {
+		case "-except", "-only":
+			items, err := i.ParseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", opt, err)
+			}
+			patterns := make([]string, len(items))
+			for k, it := range items {
+				patterns[k] = it.String()
+			}
+			if opt == "-except" {
+				m.Except = patterns
+			} else {
+				m.Only = patterns
+			}
+		case "-when":
+			m.When = val
+		case "-unless":
+			m.Unless = val
+		case "-level":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < gzip.HuffmanOnly || n > gzip.BestCompression {
+				return nil, fmt.Errorf("-level expects -2 to 9, got %q", val)
+			}
+			if m.Name != "gzip" {
+				return nil, fmt.Errorf("-level only applies to gzip")
+			}
+			m.Level = n
+		default:
+			return nil, fmt.Errorf("unknown option %q (must be -except, -only, -when, -unless, -level)", opt)
+		}
+	}
+	return m, nil
+}
+
+func registerUseCommand(interp *feather.Interp, state *ServerState) {
+	useCmd := &Command{
+		Name:  "use",
+		Help:  "Add middleware that runs for every route",
+		Usage: "use ?NAME ?-except PATTERNS? ?-only PATTERNS? ?-when SCRIPT? ?-unless SCRIPT? ?-level N??",
+		Long: `Add a middleware, or with no arguments list them. NAME is gzip (compress
+responses for clients that accept it), minify (strip comments and collapse
+whitespace in HTML responses; add it after gzip) or the name of a proc
+called before each route body; a proc that responds stops the route body from running.
+Middlewares run in the order they were added. Using a name again replaces
+its options.
+
+Options:
+  -except PATTERNS  Skip paths matching any glob, e.g. {/events/* /download/*}
+  -only PATTERNS    Apply only to paths matching a glob
+  -when SCRIPT      Apply only when SCRIPT returns true
+  -unless SCRIPT    Skip when SCRIPT returns true
+  -level N          gzip compression level, 1 (fast) to 9 (small)
+
+Example:
+  use gzip -except {/events/* *.zip *.gz}
+  use minify
+  use requireLogin -only {/admin/*}`,
+	}
+	registry.Register(useCmd)
+	interp.RegisterCommand("use", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) == 0 {
+			items := make([]*feather.Obj, 0)
+			for _, m := range currentMiddlewares() {
+				items = append(items, i.String(m.String()))
+			}
+			return feather.OK(i.List(items...))
+		}
+		m, err := parseMiddleware(i, args)
+		if err != nil {
+			return feather.Errorf("use %s: %v", args[0].String(), err)
+		}
+
+		middlewareMu.Lock()
+		defer middlewareMu.Unlock()
+		// Copy on write: requests iterate the old slice without the lock
+		next := make([]*Middleware, 0, len(middlewares)+1)
+		replaced := false
+		for _, old := range middlewares {
+			if old.Name == m.Name {
+				next = append(next, m)
+				replaced = true
+			} else {
+				next = append(next, old)
+			}
+		}
+		if !replaced {
+			next = append(next, m)
+		}
+		middlewares = next
+		return feather.OK("")
+	})
+
+	unuseCmd := &Command{
+		Name:  "unuse",
+		Help:  "Remove a middleware",
+		Usage: "unuse NAME",
+	}
+	registry.Register(unuseCmd)
+	interp.RegisterCommand("unuse", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"unuse name\"")
+		}
+		name := args[0].String()
+		middlewareMu.Lock()
+		defer middlewareMu.Unlock()
+		next := make([]*Middleware, 0, len(middlewares))
+		for _, m := range middlewares {
+			if m.Name != name {
+				next = append(next, m)
+			}
+		}
+		middlewares = next
+		return feather.OK("")
+	})
+}
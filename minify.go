@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// minifyMaxBuffer bounds how much of an HTML response is buffered for
+// minification; larger responses are passed through unchanged
+const minifyMaxBuffer = 4 << 20
+
+var (
+	// Whitespace-sensitive elements are copied verbatim
+	htmlRawRe = regexp.MustCompile(`(?is)<(pre|textarea|script|style)\b.*?</(pre|textarea|script|style)\s*>`)
+	// Comments, but not conditional comments (<!--[if ...]>)
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--([^\[].*?)?-->`)
+	htmlSpaceRe   = regexp.MustCompile(`[ \t\r\n\f]+`)
+	htmlGapRe     = regexp.MustCompile(`>\s*\n\s*<`)
+)
+
+// minifyHTML strips comments and collapses whitespace outside pre,
+// textarea, script and style. It is conservative: runs of whitespace
+// become one space (or a newline between tags), never nothing, so inline
+// layout doesn't change.
+func minifyHTML(src []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	text := func(b []byte) {
+		b = htmlCommentRe.ReplaceAll(b, nil)
+		b = htmlGapRe.ReplaceAll(b, []byte(">\n<"))
+		b = htmlSpaceRe.ReplaceAllFunc(b, func(ws []byte) []byte {
+			if bytes.IndexByte(ws, '\n') >= 0 {
+				return []byte("\n")
+			}
+			return []byte(" ")
+		})
+		out.Write(b)
+	}
+	last := 0
+	for _, loc := range htmlRawRe.FindAllIndex(src, -1) {
+		text(src[last:loc[0]])
+		out.Write(src[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	text(src[last:])
+	return bytes.TrimSpace(out.Bytes())
+}
+
+// minifyWriter buffers an HTML response and writes it minified when the
+// request finishes. Other content types, encoded, streamed or very large
+// responses pass through untouched.
+type minifyWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	passthrough bool
+	buf         bytes.Buffer
+}
+
+// newMinifyWriter returns nil when the request can't have a minified body
+func newMinifyWriter(w http.ResponseWriter, r *http.Request) *minifyWriter {
+	if r.Method == "HEAD" || r.Header.Get("Range") != "" {
+		return nil
+	}
+	return &minifyWriter{ResponseWriter: w}
+}
+
+func (m *minifyWriter) WriteHeader(code int) {
+	if m.wroteHeader {
+		return
+	}
+	m.wroteHeader = true
+	m.status = code
+	h := m.Header()
+	ct := h.Get("Content-Type")
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || !strings.HasPrefix(ct, "text/html") {
+		m.passthrough = true
+		m.ResponseWriter.WriteHeader(code)
+		return
+	}
+	// The length changes, so it's set again when the body is written
+	h.Del("Content-Length")
+}
+
+func (m *minifyWriter) Write(b []byte) (int, error) {
+	if !m.wroteHeader {
+		if m.Header().Get("Content-Type") == "" {
+			m.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		m.WriteHeader(http.StatusOK)
+	}
+	if m.passthrough {
+		return m.ResponseWriter.Write(b)
+	}
+	if m.buf.Len()+len(b) > minifyMaxBuffer {
+		m.spill()
+		return m.ResponseWriter.Write(b)
+	}
+	return m.buf.Write(b)
+}
+
+// spill gives up on minifying and sends what was buffered as is
+func (m *minifyWriter) spill() {
+	m.passthrough = true
+	m.ResponseWriter.WriteHeader(m.status)
+	m.ResponseWriter.Write(m.buf.Bytes())
+	m.buf.Reset()
+}
+
+// Flush means the handler is streaming, so stop buffering
+func (m *minifyWriter) Flush() {
+	if m.wroteHeader && !m.passthrough {
+		m.spill()
+	}
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (m *minifyWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+func (m *minifyWriter) close() {
+	if !m.wroteHeader || m.passthrough {
+		return
+	}
+	m.ResponseWriter.WriteHeader(m.status)
+	m.ResponseWriter.Write(minifyHTML(m.buf.Bytes()))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// starters holds the project layouts written by feather-httpd new. Each
+// subdirectory is one -template; lib.sh is shared test support. __APP__ is
+// replaced with the project name.
+//
+//go:embed all:starters
+var starters embed.FS
+
+var projectNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// runNew implements feather-httpd new NAME ?-template api|site|sse?
+func runNew(args []string) error {
+	fset := flag.NewFlagSet("new", flag.ContinueOnError)
+	kind := fset.String("template", "site", "Project template: api, site or sse")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "usage: feather-httpd new NAME ?-template api|site|sse?")
+		fset.PrintDefaults()
+	}
+	// Allow the name before or after the flags
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if name == "" && fset.NArg() > 0 {
+		name = fset.Arg(0)
+	} else if fset.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fset.Arg(0))
+	}
+	if name == "" {
+		fset.Usage()
+		return fmt.Errorf("missing project name")
+	}
+	if !projectNameRE.MatchString(filepath.Base(name)) {
+		return fmt.Errorf("invalid project name %q", name)
+	}
+	if _, err := fs.Stat(starters, path.Join("starters", *kind)); err != nil {
+		return fmt.Errorf("unknown template %q (must be api, site, sse)", *kind)
+	}
+	if _, err := os.Stat(name); err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+
+	app := filepath.Base(name)
+	write := func(rel string, data []byte) error {
+		dst := filepath.Join(name, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		mode := os.FileMode(0o644)
+		if strings.HasSuffix(rel, ".sh") {
+			mode = 0o755
+		}
+		return os.WriteFile(dst, []byte(strings.ReplaceAll(string(data), "__APP__", app)), mode)
+	}
+
+	root := path.Join("starters", *kind)
+	err := fs.WalkDir(starters, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := starters.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return write(strings.TrimPrefix(p, root+"/"), data)
+	})
+	if err != nil {
+		return err
+	}
+	lib, err := starters.ReadFile("starters/lib.sh")
+	if err != nil {
+		return err
+	}
+	if err := write("tests/lib.sh", lib); err != nil {
+		return err
+	}
+	if err := write(".gitignore", []byte("tests/server.log\n")); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s (%s template)\n\n", name, *kind)
+	fmt.Printf("  cd %s\n  feather-httpd              # serve on :8080\n  ./tests/smoke.sh           # run the smoke tests\n", name)
+	return nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notebook is a named list of TCL cells with their last outputs, used for
+// operational runbooks that can be re-executed cell by cell
+type Notebook struct {
+	Name  string          `json:"name"`
+	Cells []*NotebookCell `json:"cells"`
+}
+
+// NotebookCell holds one cell's source and the outcome of its last run
+type NotebookCell struct {
+	Source string `json:"source"`
+	Output string `json:"output,omitempty"` // puts output
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	RanAt  int64  `json:"ran_at,omitempty"` // unix seconds
+}
+
+var notebookNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// notebookStore keeps notebooks as JSON files in a directory
+type notebookStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newNotebookStore(dir string) *notebookStore {
+	return &notebookStore{dir: dir}
+}
+
+func (s *notebookStore) path(name string) (string, error) {
+	if !notebookNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid notebook name %q", name)
+	}
+	return filepath.Join(s.dir, name+".json"), nil
+}
+
+func (s *notebookStore) List() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), ".json"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *notebookStore) Load(name string) (*Notebook, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return &Notebook{Name: name, Cells: []*NotebookCell{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nb Notebook
+	if err := json.Unmarshal(data, &nb); err != nil {
+		return nil, fmt.Errorf("notebook %s: %v", name, err)
+	}
+	nb.Name = name
+	return &nb, nil
+}
+
+// Save writes the notebook atomically so a crash never leaves half a file
+func (s *notebookStore) Save(nb *Notebook) error {
+	p, err := s.path(nb.Name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(nb, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *notebookStore) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.Remove(p)
+}
+
+// runCell evaluates a cell and records its output, result and error
+func runCell(state *ServerState, cell *NotebookCell) {
+	var out bytes.Buffer
+	result, err := state.EvalWithOutput(ChannelWeb, cell.Source, &out)
+	cell.Output = strings.TrimSuffix(out.String(), "\n")
+	cell.Result = ""
+	cell.Error = ""
+	if err != nil {
+		cell.Error = err.Error()
+	} else {
+		cell.Result = result.String()
+	}
+	cell.RanAt = time.Now().Unix()
+}
+
+// handleNotebooks serves the notebook page and its JSON API:
+//
+//	GET    /_repl/notebooks                        notebook editor page
+//	GET    /_repl/notebooks/api                    list of notebook names
+//	GET    /_repl/notebooks/api/NAME               notebook as JSON
+//	PUT    /_repl/notebooks/api/NAME               save notebook
+//	DELETE /_repl/notebooks/api/NAME               delete notebook
+//	POST   /_repl/notebooks/api/NAME/run?cell=N    run cell N (all cells if omitted)
+func handleNotebooks(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/_repl/notebooks")
+	if rest == "" || rest == "/" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(notebookHTML))
+		return
+	}
+
+	rest = strings.TrimPrefix(rest, "/api")
+	rest = strings.Trim(rest, "/")
+	store := state.notebooks
+
+	if rest == "" {
+		names, err := store.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, names)
+		return
+	}
+
+	name, action, _ := strings.Cut(rest, "/")
+	switch {
+	case action == "" && r.Method == "GET":
+		nb, err := store.Load(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, nb)
+
+	case action == "" && r.Method == "PUT":
+		var nb Notebook
+		if err := json.NewDecoder(r.Body).Decode(&nb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		nb.Name = name
+		if err := store.Save(&nb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, &nb)
+
+	case action == "" && r.Method == "DELETE":
+		if err := store.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "run" && r.Method == "POST":
+		nb, err := store.Load(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c := r.URL.Query().Get("cell"); c != "" {
+			idx, err := strconv.Atoi(c)
+			if err != nil || idx < 0 || idx >= len(nb.Cells) {
+				http.Error(w, fmt.Sprintf("invalid cell %q", c), http.StatusBadRequest)
+				return
+			}
+			runCell(state, nb.Cells[idx])
+		} else {
+			// Run all cells, stopping at the first error like a runbook would
+			for _, cell := range nb.Cells {
+				runCell(state, cell)
+				if cell.Error != "" {
+					break
+				}
+			}
+		}
+		if err := store.Save(nb); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, nb)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+const notebookHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>feather notebooks</title>
+    <style>
+        * { box-sizing: border-box; }
+        body {
+            font-family: ui-monospace, monospace;
+            margin: 0; padding: 1rem;
+            background: #1e1e1e; color: #d4d4d4;
+        }
+        h1 { margin: 0 0 1rem 0; font-size: 1.2rem; color: #569cd6; }
+        a { color: #569cd6; }
+        #bar { display: flex; gap: 0.5rem; margin-bottom: 1rem; align-items: center; }
+        .cell { background: #252526; border-radius: 4px; padding: 0.5rem; margin-bottom: 0.75rem; }
+        .cell textarea {
+            width: 100%; min-height: 4rem;
+            font-family: inherit; font-size: inherit;
+            background: #3c3c3c; color: #d4d4d4;
+            border: 1px solid #555; border-radius: 4px; padding: 0.5rem;
+            resize: vertical;
+        }
+        .cell .tools { display: flex; gap: 0.5rem; margin-top: 0.25rem; }
+        .out { white-space: pre-wrap; margin-top: 0.5rem; }
+        .output-line { color: #d4d4d4; }
+        .result-line { color: #4ec9b0; }
+        .error-line { color: #f14c4c; }
+        input, select {
+            font-family: inherit; padding: 0.4rem;
+            background: #3c3c3c; color: #d4d4d4; border: 1px solid #555; border-radius: 4px;
+        }
+        button {
+            padding: 0.4rem 0.8rem;
+            background: #0e639c; border: none; border-radius: 4px;
+            color: white; cursor: pointer;
+        }
+        button:hover { background: #1177bb; }
+    </style>
+</head>
+<body>
+    <h1>feather notebooks <a href="/_repl">(REPL)</a></h1>
+    <div id="bar">
+        <select id="names" onchange="openNotebook(this.value)"></select>
+        <input id="newname" placeholder="new notebook name">
+        <button onclick="openNotebook(document.getElementById('newname').value)">New</button>
+        <button onclick="save()">Save</button>
+        <button onclick="runAll()">Run all</button>
+        <button onclick="addCell()">Add cell</button>
+    </div>
+    <div id="cells"></div>
+    <script>
+        let nb = null;
+        const api = '/_repl/notebooks/api';
+
+        async function refreshNames(selected) {
+            const names = await (await fetch(api)).json();
+            const sel = document.getElementById('names');
+            sel.innerHTML = '<option value="">-- open --</option>';
+            for (const n of names) {
+                const opt = document.createElement('option');
+                opt.value = n; opt.textContent = n; opt.selected = n === selected;
+                sel.appendChild(opt);
+            }
+        }
+
+        async function openNotebook(name) {
+            if (!name) return;
+            const res = await fetch(api + '/' + encodeURIComponent(name));
+            if (!res.ok) { alert(await res.text()); return; }
+            nb = await res.json();
+            render();
+        }
+
+        function render() {
+            const root = document.getElementById('cells');
+            root.innerHTML = '';
+            nb.cells.forEach((cell, idx) => {
+                const div = document.createElement('div');
+                div.className = 'cell';
+                const ta = document.createElement('textarea');
+                ta.value = cell.source;
+                ta.oninput = () => { cell.source = ta.value; };
+                const tools = document.createElement('div');
+                tools.className = 'tools';
+                const run = document.createElement('button');
+                run.textContent = 'Run [' + idx + ']';
+                run.onclick = () => runCell(idx);
+                const del = document.createElement('button');
+                del.textContent = 'Delete';
+                del.onclick = () => { nb.cells.splice(idx, 1); render(); };
+                tools.append(run, del);
+                const out = document.createElement('div');
+                out.className = 'out';
+                for (const [text, cls] of [[cell.output, 'output-line'], [cell.result, 'result-line'], [cell.error && 'error: ' + cell.error, 'error-line']]) {
+                    if (!text) continue;
+                    const line = document.createElement('div');
+                    line.className = cls; line.textContent = text;
+                    out.appendChild(line);
+                }
+                div.append(ta, tools, out);
+                root.appendChild(div);
+            });
+        }
+
+        function addCell() {
+            if (!nb) return;
+            nb.cells.push({source: ''});
+            render();
+        }
+
+        async function save() {
+            if (!nb) return;
+            const res = await fetch(api + '/' + encodeURIComponent(nb.name), {method: 'PUT', body: JSON.stringify(nb)});
+            if (!res.ok) { alert(await res.text()); return; }
+            nb = await res.json();
+            refreshNames(nb.name);
+        }
+
+        async function run(query) {
+            await save();
+            const res = await fetch(api + '/' + encodeURIComponent(nb.name) + '/run' + query, {method: 'POST'});
+            if (!res.ok) { alert(await res.text()); return; }
+            nb = await res.json();
+            render();
+        }
+
+        const runCell = (idx) => run('?cell=' + idx);
+        const runAll = () => run('');
+
+        refreshNames();
+    </script>
+</body>
+</html>`
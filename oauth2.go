@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// OAuth2Provider holds the client configuration for one authorization server
+type OAuth2Provider struct {
+	Name         string
+	AuthURL      string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	AuthStyle    string // "body" or "header": how client credentials are sent
+}
+
+// oauth2Presets fill in endpoints for well-known providers
+var oauth2Presets = map[string]OAuth2Provider{
+	"github": {
+		AuthURL:  "https://github.com/login/oauth/authorize",
+		TokenURL: "https://github.com/login/oauth/access_token",
+	},
+	"google": {
+		AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL: "https://oauth2.googleapis.com/token",
+		Scopes:   []string{"openid", "email", "profile"},
+	},
+	"gitlab": {
+		AuthURL:  "https://gitlab.com/oauth/authorize",
+		TokenURL: "https://gitlab.com/oauth/token",
+	},
+}
+
+// oauth2Timeout bounds token requests when the route has no tighter deadline
+const oauth2Timeout = 10 * time.Second
+
+var (
+	oauth2Mu        sync.RWMutex
+	oauth2Providers = make(map[string]*OAuth2Provider)
+)
+
+func parseOAuth2Provider(i *feather.Interp, name string, args []*feather.Obj) (*OAuth2Provider, error) {
+	p := &OAuth2Provider{AuthStyle: "body"}
+	if preset, ok := oauth2Presets[name]; ok {
+		*p = preset
+		p.AuthStyle = "body"
+	}
+	p.Name = name
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("missing value for %s", args[len(args)-1].String())
+	}
+	for j := 0; j < len(args); j += 2 {
+		val := args[j+1].String()
+		switch args[j].String() {
+		case "-authurl":
+			p.AuthURL = val
+		case "-tokenurl":
+			p.TokenURL = val
+		case "-clientid":
+			p.ClientID = val
+		case "-secret":
+			p.ClientSecret = val
+		case "-redirect":
+			p.RedirectURL = val
+		case "-scopes":
+			items, err := i.ParseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("-scopes: %v", err)
+			}
+			p.Scopes = p.Scopes[:0:0]
+			for _, s := range items {
+				p.Scopes = append(p.Scopes, s.String())
+			}
+		case "-authstyle":
+			if val != "body" && val != "header" {
+				return nil, fmt.Errorf("-authstyle must be body or header, got %q", val)
+			}
+			p.AuthStyle = val
+		default:
+			return nil, fmt.Errorf("unknown option %q (must be -authurl, -tokenurl, -clientid, -secret, -redirect, -scopes, -authstyle)", args[j].String())
+		}
+	}
+	switch {
+	case p.AuthURL == "" || p.TokenURL == "":
+		return nil, fmt.Errorf("-authurl and -tokenurl are required for provider %q", name)
+	case p.ClientID == "":
+		return nil, fmt.Errorf("missing -clientid")
+	}
+	return p, nil
+}
+
+func findOAuth2Provider(name string) (*OAuth2Provider, error) {
+	oauth2Mu.RLock()
+	defer oauth2Mu.RUnlock()
+	p, ok := oauth2Providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", name)
+	}
+	return p, nil
+}
+
+// authCodeURL builds the URL to send the user to
+func (p *OAuth2Provider) authCodeURL(state string, scopes []string, extra url.Values) string {
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+	}
+	if p.RedirectURL != "" {
+		v.Set("redirect_uri", p.RedirectURL)
+	}
+	if len(scopes) > 0 {
+		v.Set("scope", strings.Join(scopes, " "))
+	}
+	if state != "" {
+		v.Set("state", state)
+	}
+	for k, vals := range extra {
+		v[k] = vals
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// token posts a token request and returns the decoded response
+func (p *OAuth2Provider) token(form url.Values, timeout time.Duration) (map[string]any, error) {
+	if p.AuthStyle == "body" {
+		form.Set("client_id", p.ClientID)
+		if p.ClientSecret != "" {
+			form.Set("client_secret", p.ClientSecret)
+		}
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// GitHub answers urlencoded unless JSON is asked for
+	req.Header.Set("Accept", "application/json")
+	if p.AuthStyle == "header" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	client := outboundClient(timeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]any)
+	if err := json.Unmarshal(body, &result); err != nil {
+		// Fall back to the form encoding used by some older servers
+		values, perr := url.ParseQuery(string(body))
+		if perr != nil || len(values) == 0 {
+			return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+		}
+		for k := range values {
+			result[k] = values.Get(k)
+		}
+	}
+	if e, ok := result["error"]; ok {
+		msg := fmt.Sprint(e)
+		if desc, ok := result["error_description"]; ok {
+			msg += ": " + fmt.Sprint(desc)
+		}
+		return nil, fmt.Errorf("%s", msg)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if _, ok := result["access_token"]; !ok {
+		return nil, fmt.Errorf("token response has no access_token")
+	}
+	return result, nil
+}
+
+// tokenDict converts a token response to a dict, adding expires_at when
+// the server gave expires_in
+func tokenDict(i *feather.Interp, tok map[string]any) *feather.Obj {
+	keys := make([]string, 0, len(tok))
+	for k := range tok {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]any, 0, 2*len(keys)+2)
+	for _, k := range keys {
+		switch v := tok[k].(type) {
+		case string, bool:
+			kvs = append(kvs, k, v)
+		case float64:
+			kvs = append(kvs, k, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			b, _ := json.Marshal(v)
+			kvs = append(kvs, k, string(b))
+		}
+	}
+	if secs, ok := tok["expires_in"].(float64); ok {
+		kvs = append(kvs, "expires_at", time.Now().Add(time.Duration(secs)*time.Second).Unix())
+	}
+	return i.DictKV(kvs...)
+}
+
+func registerOAuth2Command(interp *feather.Interp, state *ServerState) {
+	oauth2Cmd := &Command{
+		Name:  "oauth2",
+		Help:  "OAuth2 authorization code flow helpers",
+		Usage: "oauth2 SUBCOMMAND ?ARG ...?",
+		Long: `Configure providers once, then build the authorization URL, exchange the
+callback code for tokens and refresh them. The github, google and gitlab
+providers have their endpoints preset. Token results are dicts with
+access_token, token_type, refresh_token, expires_in, expires_at, ...
+
+Example:
+  oauth2 provider github -clientid $id -secret $secret \
+      -redirect https://example.com/auth/callback -scopes {read:user}
+  route GET /login {
+      set state [oauth2 state]
+      session set oauth_state $state
+      status 302
+      header Location [oauth2 authurl github -state $state]
+      respond ""
+  }
+  route GET /auth/callback {
+      if {[query state] ne [session get oauth_state]} { status 400; respond "bad state"; return }
+      set tok [oauth2 exchange github [query code]]
+      session set token [dict get $tok access_token]
+      ...
+  }`,
+		Subcommands: []*Command{
+			{Name: "provider", Help: "Configure a provider", Usage: "oauth2 provider NAME ?-authurl URL? ?-tokenurl URL? -clientid ID ?-secret SECRET? ?-redirect URL? ?-scopes LIST? ?-authstyle body|header?"},
+			{Name: "providers", Help: "List configured providers", Usage: "oauth2 providers"},
+			{Name: "state", Help: "Generate a random state value", Usage: "oauth2 state"},
+			{Name: "authurl", Help: "Build the authorization URL", Usage: "oauth2 authurl NAME ?-state STATE? ?-scopes LIST? ?-param NAME VALUE ...?"},
+			{Name: "exchange", Help: "Exchange an authorization code for tokens", Usage: "oauth2 exchange NAME CODE ?-verifier V?"},
+			{Name: "refresh", Help: "Get new tokens with a refresh token", Usage: "oauth2 refresh NAME REFRESH_TOKEN"},
+		},
+	}
+	registry.Register(oauth2Cmd)
+	interp.RegisterCommand("oauth2", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"oauth2 subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "provider":
+			if len(args) < 2 {
+				return feather.Error("wrong # args: should be \"oauth2 provider name ?option value ...?\"")
+			}
+			p, err := parseOAuth2Provider(i, args[1].String(), args[2:])
+			if err != nil {
+				return feather.Errorf("oauth2 provider: %v", err)
+			}
+			oauth2Mu.Lock()
+			oauth2Providers[p.Name] = p
+			oauth2Mu.Unlock()
+			return feather.OK("")
+
+		case "providers":
+			oauth2Mu.RLock()
+			names := make([]string, 0, len(oauth2Providers))
+			for name := range oauth2Providers {
+				names = append(names, name)
+			}
+			oauth2Mu.RUnlock()
+			sort.Strings(names)
+			return feather.OK(i.ListFrom(names))
+
+		case "state":
+			b := make([]byte, 24)
+			rand.Read(b)
+			return feather.OK(base64.RawURLEncoding.EncodeToString(b))
+
+		case "authurl":
+			if len(args) < 2 {
+				return feather.Error("wrong # args: should be \"oauth2 authurl name ?option value ...?\"")
+			}
+			p, err := findOAuth2Provider(args[1].String())
+			if err != nil {
+				return feather.Errorf("oauth2 authurl: %v", err)
+			}
+			var state string
+			scopes := p.Scopes
+			extra := url.Values{}
+			for j := 2; j < len(args); j++ {
+				switch opt := args[j].String(); opt {
+				case "-state", "-scopes":
+					if j+1 >= len(args) {
+						return feather.Errorf("oauth2 authurl %s: missing value", opt)
+					}
+					j++
+					if opt == "-state" {
+						state = args[j].String()
+						continue
+					}
+					items, err := i.ParseList(args[j].String())
+					if err != nil {
+						return feather.Errorf("oauth2 authurl -scopes: %v", err)
+					}
+					scopes = nil
+					for _, s := range items {
+						scopes = append(scopes, s.String())
+					}
+				case "-param":
+					if j+2 >= len(args) {
+						return feather.Error("oauth2 authurl -param: expected name and value")
+					}
+					extra.Add(args[j+1].String(), args[j+2].String())
+					j += 2
+				default:
+					return feather.Errorf("oauth2 authurl: unknown option %q (must be -state, -scopes, -param)", opt)
+				}
+			}
+			return feather.OK(i.String(p.authCodeURL(state, scopes, extra)))
+
+		case "exchange", "refresh":
+			if subcmd == "exchange" && len(args) != 3 && len(args) != 5 {
+				return feather.Error("wrong # args: should be \"oauth2 exchange name code ?-verifier v?\"")
+			}
+			if subcmd == "refresh" && len(args) != 3 {
+				return feather.Error("wrong # args: should be \"oauth2 refresh name refresh_token\"")
+			}
+			p, err := findOAuth2Provider(args[1].String())
+			if err != nil {
+				return feather.Errorf("oauth2 %s: %v", subcmd, err)
+			}
+			form := url.Values{}
+			if subcmd == "exchange" {
+				form.Set("grant_type", "authorization_code")
+				form.Set("code", args[2].String())
+				if p.RedirectURL != "" {
+					form.Set("redirect_uri", p.RedirectURL)
+				}
+				if len(args) == 5 {
+					if args[3].String() != "-verifier" {
+						return feather.Errorf("oauth2 exchange: unknown option %q (must be -verifier)", args[3].String())
+					}
+					form.Set("code_verifier", args[4].String())
+				}
+			} else {
+				form.Set("grant_type", "refresh_token")
+				form.Set("refresh_token", args[2].String())
+			}
+			tok, err := p.token(form, state.GetRequestContext().downstreamTimeout(oauth2Timeout))
+			if err != nil {
+				return feather.Errorf("oauth2 %s: %v", subcmd, err)
+			}
+			return feather.OK(tokenDict(i, tok))
+
+		default:
+			return feather.Errorf("oauth2: unknown subcommand %q (must be provider, providers, state, authurl, exchange, refresh)", subcmd)
+		}
+	})
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+const (
+	oidcFetchTimeout  = 10 * time.Second
+	oidcJWKSMaxAge    = time.Hour        // refetch keys at least this often
+	oidcRefetchMinGap = 30 * time.Second // limit refetches on unknown key IDs
+	oidcDefaultLeeway = time.Minute      // clock skew allowed on exp, nbf, iat
+)
+
+// oidcProvider holds the discovery data and signing keys of one issuer
+type oidcProvider struct {
+	issuer   string
+	audience string // expected aud, usually the client ID
+	leeway   time.Duration
+	jwksURI  string
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // by kid
+	fetched     time.Time
+	lastAttempt time.Time
+}
+
+var (
+	oidcMu        sync.RWMutex
+	oidcProviders = make(map[string]*oidcProvider) // by issuer
+)
+
+func oidcGetJSON(url string, timeout time.Duration, v any) error {
+	client := outboundClient(timeout)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	return nil
+}
+
+// discover fetches the issuer's discovery document and keys
+func (p *oidcProvider) discover(timeout time.Duration) error {
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	if err := oidcGetJSON(url, timeout, &doc); err != nil {
+		return err
+	}
+	if doc.Issuer != p.issuer {
+		return fmt.Errorf("discovery issuer %q does not match %q", doc.Issuer, p.issuer)
+	}
+	if doc.JWKSURI == "" {
+		return fmt.Errorf("discovery document has no jwks_uri")
+	}
+	p.jwksURI = doc.JWKSURI
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetchKeysLocked(timeout)
+}
+
+func (p *oidcProvider) fetchKeysLocked(timeout time.Duration) error {
+	p.lastAttempt = time.Now()
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := oidcGetJSON(p.jwksURI, timeout, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue // skip key types we can't use rather than failing all
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS at %s has no usable signing keys", p.jwksURI)
+	}
+	p.keys = keys
+	p.fetched = time.Now()
+	return nil
+}
+
+// key returns the signing key for kid, refetching the JWKS when the keys
+// are stale or the kid is unknown (the issuer rotated its keys)
+func (p *oidcProvider) key(kid string, timeout time.Duration) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k, ok := p.keys[kid]
+	stale := time.Since(p.fetched) > oidcJWKSMaxAge
+	if (!ok || stale) && time.Since(p.lastAttempt) > oidcRefetchMinGap {
+		if err := p.fetchKeysLocked(timeout); err != nil && !ok {
+			return nil, fmt.Errorf("fetching keys: %v", err)
+		}
+		k, ok = p.keys[kid]
+	}
+	if !ok {
+		// A token without kid is fine when the issuer has a single key
+		if kid == "" && len(p.keys) == 1 {
+			for _, only := range p.keys {
+				return only, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+// jwk is a JSON Web Key as found in a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifyJWTSignature checks a JWS signature for the algorithms OIDC
+// providers use. Symmetric and "none" algorithms are rejected.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	}
+
+	switch alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match alg %s", alg)
+		}
+		h.Write(signed)
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hashID, h.Sum(nil), sig, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, hashID, h.Sum(nil), sig)
+	case "ES256", "ES384", "ES512":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match alg %s", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match alg %s", alg)
+		}
+		if !ed25519.Verify(pub, signed, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+}
+
+// verify checks an ID token's signature and standard claims and returns
+// its claims
+func (p *oidcProvider) verify(token, audience, nonce string, timeout time.Duration) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	b64 := base64.RawURLEncoding
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || len(header.Alg) < 3 {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	key, err := p.key(header.Kid, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.UseNumber()
+	var claims map[string]any
+	if err := dec.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.issuer {
+		return nil, fmt.Errorf("issuer %q does not match %q", iss, p.issuer)
+	}
+	// Without an audience any token the issuer minted for another client
+	// would pass, so one is always required
+	if audience == "" {
+		audience = p.audience
+	}
+	if audience == "" {
+		return nil, fmt.Errorf("no audience: give -audience to oidc configure or oidc verify")
+	}
+	auds := claimStrings(claims["aud"])
+	found := false
+	for _, a := range auds {
+		found = found || a == audience
+	}
+	if !found {
+		return nil, fmt.Errorf("audience %q not in token", audience)
+	}
+	if azp, ok := claims["azp"].(string); ok && len(auds) > 1 && azp != audience {
+		return nil, fmt.Errorf("authorized party %q does not match %q", azp, audience)
+	}
+
+	now := time.Now()
+	exp, ok := claimTime(claims["exp"])
+	if !ok {
+		return nil, fmt.Errorf("token has no exp")
+	}
+	if now.After(exp.Add(p.leeway)) {
+		return nil, fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(p.leeway).Before(nbf) {
+		return nil, fmt.Errorf("token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	if iat, ok := claimTime(claims["iat"]); ok && now.Add(p.leeway).Before(iat) {
+		return nil, fmt.Errorf("token issued in the future")
+	}
+	if nonce != "" {
+		if n, _ := claims["nonce"].(string); n != nonce {
+			return nil, fmt.Errorf("nonce does not match")
+		}
+	}
+	return claims, nil
+}
+
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func claimTime(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func registerOIDCCommand(fi *feather.Interp, state *ServerState) {
+	oidcCmd := &Command{
+		Name:  "oidc",
+		Help:  "Validate OpenID Connect ID tokens",
+		Usage: "oidc SUBCOMMAND ?ARG ...?",
+		Long: `oidc configure fetches the issuer's discovery document and JWKS. Keys are
+refetched hourly and when a token names an unknown key ID, so issuer key
+rotation is picked up without a restart.
+
+oidc verify checks the signature (RS*, PS*, ES*, EdDSA), issuer, audience,
+expiry, not-before and optional nonce, and returns the claims as a dict.
+The issuer is taken from the token's iss claim and must be configured.
+The audience, usually your client ID, comes from verify -audience or
+else configure -audience; verify fails when neither is given.
+
+Example:
+  oidc configure https://accounts.google.com -audience $clientId
+  set claims [oidc verify [dict get $tok id_token] -nonce [session get nonce]]
+  session set user [dict get $claims email]`,
+		Subcommands: []*Command{
+			{Name: "configure", Help: "Add an issuer", Usage: "oidc configure ISSUER ?-audience CLIENT_ID? ?-leeway DURATION?"},
+			{Name: "verify", Help: "Verify an ID token and return its claims", Usage: "oidc verify TOKEN ?-audience AUD? ?-nonce NONCE?"},
+			{Name: "refresh", Help: "Refetch an issuer's keys now", Usage: "oidc refresh ISSUER"},
+			{Name: "issuers", Help: "List configured issuers", Usage: "oidc issuers"},
+		},
+	}
+	registry.Register(oidcCmd)
+
+	// Use low-level registration so claim values are set without Tcl quoting
+	fi.Internal().Register("oidc", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) < 1 {
+			i.SetErrorString("wrong # args: should be \"oidc subcommand ?arg ...?\"")
+			return feather.ResultError
+		}
+		strArgs := make([]string, len(args))
+		for j, a := range args {
+			strArgs[j] = i.GetString(a)
+		}
+		subcmd := strArgs[0]
+		fail := func(format string, a ...any) feather.FeatherResult {
+			i.SetErrorString(fmt.Sprintf("oidc %s: ", subcmd) + fmt.Sprintf(format, a...))
+			return feather.ResultError
+		}
+		timeout := state.GetRequestContext().downstreamTimeout(oidcFetchTimeout)
+
+		switch subcmd {
+		case "configure":
+			if len(strArgs) < 2 || len(strArgs)%2 != 0 {
+				i.SetErrorString("wrong # args: should be \"oidc configure issuer ?-audience client_id? ?-leeway duration?\"")
+				return feather.ResultError
+			}
+			p := &oidcProvider{issuer: strArgs[1], leeway: oidcDefaultLeeway}
+			for j := 2; j < len(strArgs); j += 2 {
+				switch strArgs[j] {
+				case "-audience":
+					p.audience = strArgs[j+1]
+				case "-leeway":
+					d, err := time.ParseDuration(strArgs[j+1])
+					if err != nil || d < 0 {
+						return fail("-leeway expects a duration, got %q", strArgs[j+1])
+					}
+					p.leeway = d
+				default:
+					return fail("unknown option %q (must be -audience, -leeway)", strArgs[j])
+				}
+			}
+			if err := p.discover(timeout); err != nil {
+				return fail("%v", err)
+			}
+			oidcMu.Lock()
+			oidcProviders[p.issuer] = p
+			oidcMu.Unlock()
+			i.SetResultString("")
+			return feather.ResultOK
+
+		case "verify":
+			if len(strArgs) < 2 || len(strArgs)%2 != 0 {
+				i.SetErrorString("wrong # args: should be \"oidc verify token ?-audience aud? ?-nonce nonce?\"")
+				return feather.ResultError
+			}
+			var audience, nonce string
+			for j := 2; j < len(strArgs); j += 2 {
+				switch strArgs[j] {
+				case "-audience":
+					audience = strArgs[j+1]
+				case "-nonce":
+					nonce = strArgs[j+1]
+				default:
+					return fail("unknown option %q (must be -audience, -nonce)", strArgs[j])
+				}
+			}
+			// Peek at the issuer to pick the provider; the claim is checked
+			// again once the signature is verified
+			token := strArgs[1]
+			parts := strings.Split(token, ".")
+			if len(parts) != 3 {
+				return fail("malformed token")
+			}
+			payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil {
+				return fail("malformed token payload")
+			}
+			var peek struct {
+				Iss string `json:"iss"`
+			}
+			json.Unmarshal(payload, &peek)
+			oidcMu.RLock()
+			p, ok := oidcProviders[peek.Iss]
+			oidcMu.RUnlock()
+			if !ok {
+				return fail("issuer %q is not configured", peek.Iss)
+			}
+			claims, err := p.verify(token, audience, nonce, timeout)
+			if err != nil {
+				return fail("%v", err)
+			}
+			dict := i.NewDict()
+			for k, v := range claims {
+				dict = setDictValue(i, dict, k, v)
+			}
+			i.SetResult(dict)
+			return feather.ResultOK
+
+		case "refresh":
+			if len(strArgs) != 2 {
+				i.SetErrorString("wrong # args: should be \"oidc refresh issuer\"")
+				return feather.ResultError
+			}
+			oidcMu.RLock()
+			p, ok := oidcProviders[strArgs[1]]
+			oidcMu.RUnlock()
+			if !ok {
+				return fail("issuer %q is not configured", strArgs[1])
+			}
+			p.mu.Lock()
+			err := p.fetchKeysLocked(timeout)
+			p.mu.Unlock()
+			if err != nil {
+				return fail("%v", err)
+			}
+			i.SetResultString("")
+			return feather.ResultOK
+
+		case "issuers":
+			oidcMu.RLock()
+			list := i.NewList()
+			names := make([]string, 0, len(oidcProviders))
+			for name := range oidcProviders {
+				names = append(names, name)
+			}
+			oidcMu.RUnlock()
+			sort.Strings(names)
+			for _, name := range names {
+				list = i.ListAppend(list, i.InternString(name))
+			}
+			i.SetResult(list)
+			return feather.ResultOK
+
+		default:
+			i.SetErrorString(fmt.Sprintf("oidc: unknown subcommand %q (must be configure, verify, refresh, issuers)", subcmd))
+			return feather.ResultError
+		}
+	})
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// docsMount serves API docs at Prefix and the generated spec at
+// Prefix/openapi.json
+type docsMount struct {
+	Prefix   string
+	Renderer string // "swagger" or "redoc"
+	Title    string
+	Version  string
+	SpecURL  string // spec the page loads; the generated one by default
+	CDN      string // base URL of the renderer's script and styles
+	Assets   string // directory served at Prefix/assets instead of a CDN
+}
+
+var (
+	docsMu     sync.RWMutex
+	docsMounts = make(map[string]*docsMount) // by prefix
+)
+
+// Default script locations, pinned to exact releases so the page doesn't
+// pick up new code unannounced; -assets and -cdn serve a local copy instead
+const (
+	swaggerCDN = "https://unpkg.com/swagger-ui-dist@5.17.14"
+	redocCDN   = "https://cdn.redoc.ly/redoc/v2.1.5/bundles"
+)
+
+// docsAssetsPath is where a mount with -assets serves the renderer's files
+const docsAssetsPath = "/assets/"
+
+// findDocsMount returns the docs mount serving p: the page itself, its
+// openapi.json or, with -assets, the renderer's files
+func findDocsMount(p string) *docsMount {
+	docsMu.RLock()
+	defer docsMu.RUnlock()
+	if m, ok := docsMounts[p]; ok {
+		return m
+	}
+	if prefix, ok := strings.CutSuffix(p, "/openapi.json"); ok {
+		if prefix == "" {
+			prefix = "/"
+		}
+		return docsMounts[prefix]
+	}
+	if prefix, _, ok := strings.Cut(p, docsAssetsPath); ok {
+		if prefix == "" {
+			prefix = "/"
+		}
+		if m := docsMounts[prefix]; m != nil && m.Assets != "" {
+			return m
+		}
+	}
+	return nil
+}
+
+// openapiPath turns a route pattern into an OpenAPI path template:
+// /users/:id -> /users/{id}
+func openapiPath(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	for k, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[k] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// routeSummary is the route's leading # comment, if its body starts with one
+func routeSummary(body string) string {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return strings.TrimSpace(strings.TrimLeft(line, "#"))
+		}
+		return ""
+	}
+	return ""
+}
+
+// openapiSpec builds an OpenAPI 3.1 document from the current routes
+func openapiSpec(state *ServerState, title, version string) ([]byte, error) {
+	paths := make(map[string]map[string]any)
+	for _, route := range state.GetRoutes() {
+		p := openapiPath(route.Pattern)
+		if paths[p] == nil {
+			paths[p] = make(map[string]any)
+		}
+		method := strings.ToLower(route.Method)
+		opID := method + strings.NewReplacer("/", "_", ":", "", "-", "_", ".", "_").Replace(route.Pattern)
+		op := map[string]any{
+			"operationId": strings.TrimSuffix(opID, "_"),
+			"responses": map[string]any{
+				"default": map[string]any{"description": "Response"},
+			},
+		}
+		if s := routeSummary(route.Body); s != "" {
+			op["summary"] = s
+		}
+		if len(route.Params) > 0 {
+			params := make([]any, 0, len(route.Params))
+			for _, name := range route.Params {
+				params = append(params, map[string]any{
+					"name":     name,
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]any{"type": "string"},
+				})
+			}
+			op["parameters"] = params
+		}
+		if route.Options.Auth != nil {
+			op["responses"].(map[string]any)["401"] = map[string]any{"description": "Authentication required"}
+		}
+		paths[p][method] = op
+	}
+	if title == "" {
+		title = "API"
+	}
+	if version == "" {
+		version = "1.0.0"
+	}
+	return json.MarshalIndent(map[string]any{
+		"openapi": "3.1.0",
+		"info":    map[string]any{"title": title, "version": version},
+		"paths":   paths,
+	}, "", "  ")
+}
+
+var docsPageTemplate = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+{{if eq .Renderer "redoc"}}<script src="{{.CDN}}/redoc.standalone.js"></script>
+{{else}}<link rel="stylesheet" href="{{.CDN}}/swagger-ui.css">
+<script src="{{.CDN}}/swagger-ui-bundle.js"></script>
+{{end}}<style>body { margin: 0; }</style>
+</head>
+<body>
+{{if eq .Renderer "redoc"}}<redoc spec-url="{{.SpecURL}}"></redoc>
+{{else}}<div id="swagger-ui"></div>
+<script>
+window.ui = SwaggerUIBundle({ url: {{.SpecURL}}, dom_id: "#swagger-ui", deepLinking: true });
+</script>
+{{end}}</body>
+</html>
+`))
+
+func serveDocs(state *ServerState, m *docsMount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/openapi.json") {
+		spec, err := openapiSpec(state, m.Title, m.Version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(spec)
+		return
+	}
+	if base := strings.TrimSuffix(m.Prefix, "/") + docsAssetsPath; m.Assets != "" && strings.HasPrefix(r.URL.Path, base) {
+		rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, base))
+		name := joinPath(m.Assets, rel)
+		file, err := openPath(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		serveFSFile(w, r, name, file, stat)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	docsPageTemplate.Execute(w, m)
+}
+
+func registerOpenAPICommand(interp *feather.Interp, state *ServerState) {
+	openapiCmd := &Command{
+		Name:  "openapi",
+		Help:  "Generate an OpenAPI spec from routes and serve API docs",
+		Usage: "openapi SUBCOMMAND ?ARG ...?",
+		Long: `openapi spec returns an OpenAPI 3.1 document describing the current
+routes: their paths (with :params as path parameters) and methods. A route
+whose body starts with a # comment uses it as the operation summary.
+
+openapi ui PATH serves an interactive docs page at PATH and the spec,
+generated fresh on every request, at PATH/openapi.json.
+
+Options:
+  -renderer swagger|redoc  Page to serve (default swagger, i.e. Swagger UI)
+  -title TITLE             Spec and page title (default API)
+  -version VERSION         Spec info.version (default 1.0.0)
+  -spec URL                Load this spec instead of the generated one
+  -assets DIR              Serve the renderer's files from DIR (may be
+                           embed://) at PATH/assets
+  -cdn URL                 Where the renderer's files live otherwise
+
+Without -assets or -cdn the page loads Swagger UI 5.17.14 from unpkg.com
+or Redoc 2.1.5 from cdn.redoc.ly, which needs internet access and trusts
+those hosts. For offline use, or to run only code you have checked, copy
+swagger-ui.css and swagger-ui-bundle.js from the swagger-ui-dist package,
+or redoc.standalone.js, into a directory (or a bundle, see help bundle)
+and give it as -assets.
+
+Example:
+  route GET /users/:id {
+      # Fetch one user
+      respond [json [get_user [param id]] -as {number id string name}]
+  }
+  openapi ui /docs -title "Users API" -version 2.0.0
+  openapi ui /reference -renderer redoc -assets embed://vendor/redoc`,
+		Subcommands: []*Command{
+			{Name: "spec", Help: "Return the OpenAPI document for the current routes", Usage: "openapi spec ?-title TITLE? ?-version VERSION?"},
+			{Name: "ui", Help: "Serve interactive API docs", Usage: "openapi ui PATH ?-renderer swagger|redoc? ?-title TITLE? ?-version VERSION? ?-spec URL? ?-assets DIR? ?-cdn URL?"},
+			{Name: "unmount", Help: "Stop serving docs at a path", Usage: "openapi unmount PATH"},
+			{Name: "mounts", Help: "List docs mounts", Usage: "openapi mounts"},
+		},
+	}
+	registry.Register(openapiCmd)
+	interp.RegisterCommand("openapi", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"openapi subcommand ?arg ...?\"")
+		}
+		switch args[0].String() {
+		case "spec":
+			var title, version string
+			if len(args)%2 != 1 {
+				return feather.Error("wrong # args: should be \"openapi spec ?-title title? ?-version version?\"")
+			}
+			for j := 1; j < len(args); j += 2 {
+				switch args[j].String() {
+				case "-title":
+					title = args[j+1].String()
+				case "-version":
+					version = args[j+1].String()
+				default:
+					return feather.Errorf("openapi spec: unknown option %q (must be -title, -version)", args[j].String())
+				}
+			}
+			spec, err := openapiSpec(state, title, version)
+			if err != nil {
+				return feather.Errorf("openapi spec: %v", err)
+			}
+			return feather.OK(i.String(string(spec)))
+
+		case "ui":
+			if len(args) < 2 || len(args)%2 != 0 {
+				return feather.Error("wrong # args: should be \"openapi ui path ?-renderer swagger|redoc? ?-title title? ?-version version? ?-spec url? ?-assets dir? ?-cdn url?\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			m := &docsMount{Prefix: prefix, Renderer: "swagger", Title: "API"}
+			for j := 2; j < len(args); j += 2 {
+				val := args[j+1].String()
+				switch args[j].String() {
+				case "-renderer":
+					if val != "swagger" && val != "redoc" {
+						return feather.Errorf("openapi ui: unknown renderer %q (must be swagger, redoc)", val)
+					}
+					m.Renderer = val
+				case "-title":
+					m.Title = val
+				case "-version":
+					m.Version = val
+				case "-spec":
+					m.SpecURL = val
+				case "-cdn":
+					m.CDN = strings.TrimSuffix(val, "/")
+				case "-assets":
+					m.Assets = val
+				default:
+					return feather.Errorf("openapi ui: unknown option %q (must be -renderer, -title, -version, -spec, -assets, -cdn)", args[j].String())
+				}
+			}
+			if m.Assets != "" {
+				if m.CDN != "" {
+					return feather.Error("openapi ui: -assets and -cdn can't be used together")
+				}
+				stat, err := statPath(m.Assets)
+				if err != nil {
+					return feather.Errorf("openapi ui: %v", err)
+				}
+				if !stat.IsDir() {
+					return feather.Errorf("openapi ui: %s is not a directory", m.Assets)
+				}
+				m.CDN = strings.TrimSuffix(prefix, "/") + strings.TrimSuffix(docsAssetsPath, "/")
+			}
+			if m.SpecURL == "" {
+				m.SpecURL = strings.TrimSuffix(prefix, "/") + "/openapi.json"
+			}
+			if m.CDN == "" {
+				m.CDN = swaggerCDN
+				if m.Renderer == "redoc" {
+					m.CDN = redocCDN
+				}
+			}
+			docsMu.Lock()
+			docsMounts[prefix] = m
+			docsMu.Unlock()
+			return feather.OK("")
+
+		case "unmount":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"openapi unmount path\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			docsMu.Lock()
+			defer docsMu.Unlock()
+			if _, ok := docsMounts[prefix]; !ok {
+				return feather.Errorf("openapi unmount: no docs at %s", prefix)
+			}
+			delete(docsMounts, prefix)
+			return feather.OK("")
+
+		case "mounts":
+			docsMu.RLock()
+			defer docsMu.RUnlock()
+			prefixes := make([]string, 0, len(docsMounts))
+			for p := range docsMounts {
+				prefixes = append(prefixes, p)
+			}
+			sort.Strings(prefixes)
+			items := make([]*feather.Obj, 0, len(prefixes))
+			for _, p := range prefixes {
+				m := docsMounts[p]
+				items = append(items, i.DictKV("prefix", m.Prefix, "renderer", m.Renderer,
+					"title", m.Title, "version", m.Version, "spec", m.SpecURL, "cdn", m.CDN, "assets", m.Assets))
+			}
+			return feather.OK(i.List(items...))
+
+		default:
+			return feather.Errorf("openapi: unknown subcommand %q (must be spec, ui, unmount, mounts)", args[0].String())
+		}
+	})
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// outboundSettings control how connections to other servers are made by
+// the http client, proxy, oauth2, oidc and redis features. The proxy
+// settings apply to HTTP requests only.
+type outboundSettings struct {
+	prefer        string        // auto, ipv4, ipv6, ipv4only or ipv6only
+	source        net.IP        // local address to bind, nil = any
+	resolver      string        // DNS server host:port, "" = system resolver
+	fallbackDelay time.Duration // happy eyeballs delay; negative disables
+	proxy         string        // proxy URL, "direct" for none, "" = environment
+	noProxy       string        // hosts that bypass proxy, as in NO_PROXY
+
+	// Connection pool of the HTTP transports
+	maxIdle         int
+	maxIdlePerHost  int
+	maxConnsPerHost int // 0 = unlimited
+	idleTimeout     time.Duration
+}
+
+// pool returns the settings that need new transports when they change
+func (s outboundSettings) pool() [4]int64 {
+	return [4]int64{int64(s.maxIdle), int64(s.maxIdlePerHost), int64(s.maxConnsPerHost), int64(s.idleTimeout)}
+}
+
+// hostTLS overrides certificate checks for connections to one host.
+// Requests to the host go through copies of the shared transports whose
+// TLS config carries the overrides; other hosts keep the standard checks.
+type hostTLS struct {
+	caFile   string
+	roots    *x509.CertPool // replaces the system roots when set
+	insecure bool           // skip verification, for development only
+
+	mu         sync.Mutex
+	transports map[*http.Transport]*http.Transport // by the transport they copy
+}
+
+// transport returns the copy of base used for requests to the host
+func (h *hostTLS) transport(base *http.Transport) *http.Transport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.transports[base]; ok {
+		return t
+	}
+	t := base.Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: h.roots, InsecureSkipVerify: h.insecure}
+	if h.transports == nil {
+		h.transports = make(map[*http.Transport]*http.Transport)
+	}
+	h.transports[base] = t
+	return t
+}
+
+// closeTransports drops the copies and their pooled connections
+func (h *hostTLS) closeTransports() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.transports {
+		t.CloseIdleConnections()
+	}
+	h.transports = nil
+}
+
+// hostTLSTransport sends HTTPS requests for hosts with http tls settings
+// through the host's copy of base, and everything else through base
+type hostTLSTransport struct {
+	base *http.Transport
+}
+
+func (t hostTLSTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == "https" {
+		if h := getHostTLS(r.URL.Hostname()); h != nil {
+			return h.transport(t.base).RoundTrip(r)
+		}
+	}
+	return t.base.RoundTrip(r)
+}
+
+var (
+	outboundMu sync.RWMutex
+	outbound   = outboundSettings{
+		prefer:         "auto",
+		noProxy:        envNoProxy(),
+		maxIdle:        100,
+		maxIdlePerHost: http.DefaultMaxIdleConnsPerHost,
+		idleTimeout:    90 * time.Second,
+	}
+
+	// outboundTransport is shared so connections are pooled across calls.
+	// It is replaced when the pool settings change; guarded by outboundMu.
+	outboundTransport = newOutboundTransport(outboundProxy, outbound)
+
+	// hostTLSSettings are looked up on every request, by host name
+	hostTLSMu       sync.RWMutex
+	hostTLSSettings = make(map[string]*hostTLS)
+
+	// proxyTransports serve requests given an explicit proxy, by proxy URL
+	proxyTransportsMu sync.Mutex
+	proxyTransports   = make(map[string]*http.Transport)
+)
+
+func envNoProxy() string {
+	if v := os.Getenv("NO_PROXY"); v != "" {
+		return v
+	}
+	return os.Getenv("no_proxy")
+}
+
+func newOutboundTransport(proxy func(*http.Request) (*url.URL, error), s outboundSettings) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = outboundDial
+	t.Proxy = proxy
+	t.MaxIdleConns = s.maxIdle
+	t.MaxIdleConnsPerHost = s.maxIdlePerHost
+	t.MaxConnsPerHost = s.maxConnsPerHost
+	t.IdleConnTimeout = s.idleTimeout
+	return t
+}
+
+// setHostTLS changes the TLS settings for host; nil removes them
+func setHostTLS(host string, h *hostTLS) {
+	hostTLSMu.Lock()
+	old := hostTLSSettings[strings.ToLower(host)]
+	if h == nil {
+		delete(hostTLSSettings, strings.ToLower(host))
+	} else {
+		hostTLSSettings[strings.ToLower(host)] = h
+	}
+	hostTLSMu.Unlock()
+	// Pooled connections were verified under the old settings
+	if old != nil {
+		old.closeTransports()
+	}
+}
+
+func getHostTLS(host string) *hostTLS {
+	hostTLSMu.RLock()
+	defer hostTLSMu.RUnlock()
+	return hostTLSSettings[strings.ToLower(host)]
+}
+
+// parseProxyURL validates a proxy given to config or a -proxy option
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %q: scheme must be http, https, socks5 or socks5h", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q: missing host", s)
+	}
+	return u, nil
+}
+
+// proxyFunc returns the proxy selector for a proxy setting, honoring
+// noProxy. Requests to localhost never go through a proxy.
+func proxyFunc(proxy, noProxy string) func(*http.Request) (*url.URL, error) {
+	switch proxy {
+	case "direct":
+		return nil
+	case "":
+		cfg := httpproxy.FromEnvironment()
+		cfg.NoProxy = noProxy
+		fn := cfg.ProxyFunc()
+		return func(r *http.Request) (*url.URL, error) { return fn(r.URL) }
+	}
+	fn := (&httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy, NoProxy: noProxy}).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) { return fn(r.URL) }
+}
+
+// outboundProxy picks the proxy for a request from the current settings
+func outboundProxy(r *http.Request) (*url.URL, error) {
+	s := currentOutbound()
+	fn := proxyFunc(s.proxy, s.noProxy)
+	if fn == nil {
+		return nil, nil
+	}
+	return fn(r)
+}
+
+func currentOutbound() outboundSettings {
+	outboundMu.RLock()
+	defer outboundMu.RUnlock()
+	return outbound
+}
+
+func currentTransport() *http.Transport {
+	outboundMu.RLock()
+	defer outboundMu.RUnlock()
+	return outboundTransport
+}
+
+// updateOutbound changes the settings and drops pooled connections that
+// were made under the old ones. A change to the pool settings replaces
+// the transports.
+func updateOutbound(fn func(*outboundSettings)) {
+	outboundMu.Lock()
+	old := outboundTransport
+	pool := outbound.pool()
+	fn(&outbound)
+	rebuild := outbound.pool() != pool
+	if rebuild {
+		outboundTransport = newOutboundTransport(outboundProxy, outbound)
+	}
+	outboundMu.Unlock()
+	old.CloseIdleConnections()
+	if rebuild {
+		hostTLSMu.RLock()
+		for _, h := range hostTLSSettings {
+			h.closeTransports()
+		}
+		hostTLSMu.RUnlock()
+	}
+	proxyTransportsMu.Lock()
+	for proxy, t := range proxyTransports {
+		t.CloseIdleConnections()
+		if rebuild {
+			delete(proxyTransports, proxy)
+		}
+	}
+	proxyTransportsMu.Unlock()
+}
+
+func (s outboundSettings) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, FallbackDelay: s.fallbackDelay}
+	if s.source != nil {
+		d.LocalAddr = &net.TCPAddr{IP: s.source}
+	}
+	if s.resolver != "" {
+		resolver := s.resolver
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var rd net.Dialer
+				return rd.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	return d
+}
+
+// outboundDial dials addr following the outbound settings. With a
+// preferred family it tries that family first and falls back to the
+// other; the only variants never fall back.
+func outboundDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := currentOutbound()
+	d := s.dialer()
+	if network != "tcp" {
+		return d.DialContext(ctx, network, addr)
+	}
+	switch s.prefer {
+	case "ipv4only":
+		return d.DialContext(ctx, "tcp4", addr)
+	case "ipv6only":
+		return d.DialContext(ctx, "tcp6", addr)
+	case "ipv4", "ipv6":
+		first, second := "tcp4", "tcp6"
+		if s.prefer == "ipv6" {
+			first, second = second, first
+		}
+		conn, err := d.DialContext(ctx, first, addr)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		if conn, err2 := d.DialContext(ctx, second, addr); err2 == nil {
+			return conn, nil
+		}
+		return nil, err
+	default:
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// outboundDialTimeout is outboundDial bounded by timeout
+func outboundDialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return outboundDial(ctx, network, addr)
+}
+
+// outboundClient returns an HTTP client using the outbound settings
+func outboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: hostTLSTransport{currentTransport()}}
+}
+
+// outboundClientVia is outboundClient with an explicit proxy URL, or
+// "direct" for none, overriding the outbound_proxy setting. NO_PROXY
+// still applies.
+func outboundClientVia(timeout time.Duration, proxy string) (*http.Client, error) {
+	if proxy == "" {
+		return outboundClient(timeout), nil
+	}
+	if proxy != "direct" {
+		if _, err := parseProxyURL(proxy); err != nil {
+			return nil, err
+		}
+	}
+	proxyTransportsMu.Lock()
+	defer proxyTransportsMu.Unlock()
+	t, ok := proxyTransports[proxy]
+	if !ok {
+		t = newOutboundTransport(func(r *http.Request) (*url.URL, error) {
+			fn := proxyFunc(proxy, currentOutbound().noProxy)
+			if fn == nil {
+				return nil, nil
+			}
+			return fn(r)
+		}, currentOutbound())
+		proxyTransports[proxy] = t
+	}
+	return &http.Client{Timeout: timeout, Transport: hostTLSTransport{t}}, nil
+}
+
+func registerOutboundConfig() {
+	registerConfigKey(&ConfigKey{
+		Name:    "dial_prefer",
+		Help:    "Address family for outbound connections: auto (happy eyeballs), ipv4, ipv6, ipv4only or ipv6only",
+		Type:    ConfigEnum,
+		Default: "auto",
+		Choices: []string{"auto", "ipv4", "ipv6", "ipv4only", "ipv6only"},
+		Get:     func() string { return currentOutbound().prefer },
+		Set: func(value string) error {
+			updateOutbound(func(s *outboundSettings) { s.prefer = value })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name: "dial_source",
+		Help: "Local IP address outbound connections are made from (empty = any)",
+		Type: ConfigString,
+		Get: func() string {
+			if ip := currentOutbound().source; ip != nil {
+				return ip.String()
+			}
+			return ""
+		},
+		Set: func(value string) error {
+			var ip net.IP
+			if value != "" {
+				if ip = net.ParseIP(value); ip == nil {
+					return fmt.Errorf("invalid IP address %q", value)
+				}
+			}
+			updateOutbound(func(s *outboundSettings) { s.source = ip })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name: "dial_resolver",
+		Help: "DNS server for outbound connections as HOST:PORT (empty = system resolver)",
+		Type: ConfigString,
+		Get:  func() string { return currentOutbound().resolver },
+		Set: func(value string) error {
+			if value != "" {
+				// A bare address uses the standard DNS port
+				if host := strings.Trim(value, "[]"); net.ParseIP(host) != nil || !strings.Contains(value, ":") {
+					value = net.JoinHostPort(host, "53")
+				}
+				if _, _, err := net.SplitHostPort(value); err != nil {
+					return err
+				}
+			}
+			updateOutbound(func(s *outboundSettings) { s.resolver = value })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name: "outbound_proxy",
+		Help: "Proxy for outbound HTTP requests: http://, https:// or socks5:// URL, direct, or empty for HTTP_PROXY/HTTPS_PROXY",
+		Type: ConfigString,
+		Get:  func() string { return currentOutbound().proxy },
+		Set: func(value string) error {
+			if value != "" && value != "direct" {
+				if _, err := parseProxyURL(value); err != nil {
+					return err
+				}
+			}
+			updateOutbound(func(s *outboundSettings) { s.proxy = value })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "outbound_no_proxy",
+		Help:    "Comma-separated hosts, domains and CIDRs that bypass the proxy (defaults to NO_PROXY)",
+		Type:    ConfigString,
+		Default: envNoProxy(),
+		Get:     func() string { return currentOutbound().noProxy },
+		Set: func(value string) error {
+			updateOutbound(func(s *outboundSettings) { s.noProxy = value })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "dial_fallback_delay",
+		Help:    "Happy eyeballs delay before trying the other address family, e.g. 300ms (0s = default, negative disables)",
+		Type:    ConfigDuration,
+		Default: "0s",
+		Get:     func() string { return currentOutbound().fallbackDelay.String() },
+		Set: func(value string) error {
+			d, _ := time.ParseDuration(value)
+			updateOutbound(func(s *outboundSettings) { s.fallbackDelay = d })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "outbound_max_idle",
+		Help:    "Idle HTTP connections kept for reuse across all hosts (0 = no limit)",
+		Type:    ConfigInt,
+		Default: "100",
+		Get:     func() string { return strconv.Itoa(currentOutbound().maxIdle) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			updateOutbound(func(s *outboundSettings) { s.maxIdle = n })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "outbound_max_idle_per_host",
+		Help:    "Idle HTTP connections kept for reuse per host",
+		Type:    ConfigInt,
+		Default: strconv.Itoa(http.DefaultMaxIdleConnsPerHost),
+		Get:     func() string { return strconv.Itoa(currentOutbound().maxIdlePerHost) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			updateOutbound(func(s *outboundSettings) { s.maxIdlePerHost = n })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "outbound_max_conns_per_host",
+		Help:    "HTTP connections open at once per host, further requests wait (0 = no limit)",
+		Type:    ConfigInt,
+		Default: "0",
+		Get:     func() string { return strconv.Itoa(currentOutbound().maxConnsPerHost) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			updateOutbound(func(s *outboundSettings) { s.maxConnsPerHost = n })
+			return nil
+		},
+	})
+	registerConfigKey(&ConfigKey{
+		Name:    "outbound_idle_timeout",
+		Help:    "How long an idle HTTP connection is kept before closing (0s = forever)",
+		Type:    ConfigDuration,
+		Default: "90s",
+		Get:     func() string { return currentOutbound().idleTimeout.String() },
+		Set: func(value string) error {
+			d, _ := time.ParseDuration(value)
+			if d < 0 {
+				return fmt.Errorf("expected non-negative duration, got %q", value)
+			}
+			updateOutbound(func(s *outboundSettings) { s.idleTimeout = d })
+			return nil
+		},
+	})
+}
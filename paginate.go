@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// PageSpec holds the paginate options
+type PageSpec struct {
+	Total      int
+	Per        int // default page size
+	Max        int // largest page size a client may ask for
+	PageParam  string
+	LimitParam string
+}
+
+// Page is the clamped page a request asked for
+type Page struct {
+	Number int
+	Limit  int
+	Offset int
+	Pages  int
+}
+
+// resolve reads page and limit from the query and clamps them to the
+// available range; bad values fall back to the defaults
+func (s PageSpec) resolve(ctx *RequestContext) Page {
+	q := ctx.Request.URL.Query()
+	p := Page{Number: 1, Limit: s.Per}
+	if n, err := strconv.Atoi(q.Get(s.LimitParam)); err == nil && n > 0 {
+		p.Limit = min(n, s.Max)
+	}
+	p.Pages = max(1, (s.Total+p.Limit-1)/p.Limit)
+	if n, err := strconv.Atoi(q.Get(s.PageParam)); err == nil && n > 0 {
+		p.Number = min(n, p.Pages)
+	}
+	p.Offset = (p.Number - 1) * p.Limit
+	return p
+}
+
+// links renders the RFC 8288 Link header value for a page
+func (s PageSpec) links(ctx *RequestContext, p Page) string {
+	pageURL := func(n int) string {
+		q := ctx.Request.URL.Query()
+		q.Set(s.PageParam, strconv.Itoa(n))
+		if q.Has(s.LimitParam) {
+			q.Set(s.LimitParam, strconv.Itoa(p.Limit))
+		}
+		return ctx.Request.URL.Path + "?" + q.Encode()
+	}
+	rels := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(1))}
+	if p.Number > 1 {
+		rels = append(rels, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(p.Number-1)))
+	}
+	if p.Number < p.Pages {
+		rels = append(rels, fmt.Sprintf(`<%s>; rel="next"`, pageURL(p.Number+1)))
+	}
+	rels = append(rels, fmt.Sprintf(`<%s>; rel="last"`, pageURL(p.Pages)))
+	return strings.Join(rels, ", ")
+}
+
+func registerPaginateCommand(interp *feather.Interp, state *ServerState) {
+	paginateCmd := &Command{
+		Name:  "paginate",
+		Help:  "Resolve page and limit query parameters for list endpoints",
+		Usage: "paginate -total N ?-per N? ?-max N? ?-pageparam NAME? ?-limitparam NAME? ?-nolinks?",
+		Long: `Read page and limit from the query string, clamp them to valid values,
+set Link (first, prev, next, last) and X-Total-Count response headers,
+and return a dict with page, limit, offset, pages and total.
+
+Options:
+  -total N          Number of items in the full list (required)
+  -per N            Default page size (default 20)
+  -max N            Largest limit a client may request (default 100)
+  -pageparam NAME   Query parameter for the page number (default page)
+  -limitparam NAME  Query parameter for the page size (default limit)
+  -nolinks          Don't set the response headers
+
+Example:
+  set p [paginate -total [db count users] -per 25]
+  respond [json stringify [db users [dict get $p offset] [dict get $p limit]]]`,
+	}
+	registry.Register(paginateCmd)
+	interp.RegisterCommand("paginate", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			return feather.Error("paginate: not in request context")
+		}
+		spec := PageSpec{Total: -1, Per: 20, Max: 100, PageParam: "page", LimitParam: "limit"}
+		links := true
+		for j := 0; j < len(args); j++ {
+			opt := args[j].String()
+			if opt == "-nolinks" {
+				links = false
+				continue
+			}
+			j++
+			if j >= len(args) {
+				return feather.Errorf("paginate %s: missing value", opt)
+			}
+			val := args[j].String()
+			switch opt {
+			case "-total", "-per", "-max":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 || (n == 0 && opt != "-total") {
+					return feather.Errorf("paginate: %s expects a positive integer, got %q", opt, val)
+				}
+				switch opt {
+				case "-total":
+					spec.Total = n
+				case "-per":
+					spec.Per = n
+				case "-max":
+					spec.Max = n
+				}
+			case "-pageparam":
+				spec.PageParam = val
+			case "-limitparam":
+				spec.LimitParam = val
+			default:
+				return feather.Errorf("paginate: unknown option %q (must be -total, -per, -max, -pageparam, -limitparam, -nolinks)", opt)
+			}
+		}
+		if spec.Total < 0 {
+			return feather.Error("paginate: missing -total")
+		}
+		spec.Per = min(spec.Per, spec.Max)
+
+		p := spec.resolve(ctx)
+		if links {
+			ctx.Headers.Store("Link", spec.links(ctx, p))
+			ctx.Headers.Store("X-Total-Count", strconv.Itoa(spec.Total))
+		}
+		return feather.OK(i.DictKV("page", p.Number, "limit", p.Limit, "offset", p.Offset,
+			"pages", p.Pages, "total", spec.Total))
+	})
+}
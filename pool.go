@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBufferSize keeps a single huge response from pinning memory in
+// the pool forever; larger buffers are dropped and left to the GC.
+const maxPooledBufferSize = 64 << 10
+
+// bufferPoolStats counts pool traffic so the win is visible in /_metrics
+type bufferPoolStats struct {
+	gets      atomic.Uint64
+	allocs    atomic.Uint64 // gets that had to allocate a new buffer
+	puts      atomic.Uint64
+	discarded atomic.Uint64 // buffers dropped for being oversized
+}
+
+var poolStats bufferPoolStats
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		poolStats.allocs.Add(1)
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	poolStats.gets.Add(1)
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns a buffer to the pool. The buffer must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		poolStats.discarded.Add(1)
+		return
+	}
+	poolStats.puts.Add(1)
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+
+	"github.com/feather-lang/feather"
+)
+
+// pprofServing is the debug pprof setting
+type pprofServing struct {
+	auth     *AuthSpec    // nil = no authentication
+	listener string       // address of the separate listener, "" to serve under /_debug/pprof/
+	server   *http.Server // the separate listener's server
+	ln       net.Listener
+}
+
+// pprofState is the current pprof setting, nil while it is off
+var pprofState atomic.Pointer[pprofServing]
+
+// isLoopbackAddr reports whether the listen address addr only accepts
+// connections from this machine. A missing host means every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// pprofMux serves the net/http/pprof handlers at /debug/pprof/
+var pprofMux = func() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}()
+
+// serve checks the request's credentials, then serves it from pprofMux
+func (p *pprofServing) serve(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	if p.auth != nil {
+		ctx := &RequestContext{Writer: w, Request: r, Status: 200}
+		ok, err := p.auth.authenticate(ctx, state.routeEval(ctx))
+		if err != nil {
+			logf("debug pprof auth: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+	pprofMux.ServeHTTP(w, r)
+}
+
+// servePprof serves /_debug/pprof/ on the main listener by handing the
+// pprof handlers the paths they expect
+func servePprof(state *ServerState, p *pprofServing, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/_debug/pprof")
+	if rest == "" {
+		http.Redirect(w, r, "/_debug/pprof/", http.StatusMovedPermanently)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/debug/pprof" + rest
+	p.serve(state, w, r2)
+}
+
+// startPprof turns pprof on with p, replacing the previous setting
+func startPprof(state *ServerState, p *pprofServing) error {
+	if p.listener != "" {
+		// Replacing on the same address has to give it up before binding again
+		if old := pprofState.Load(); old != nil && old.listener == p.listener {
+			stopPprof(pprofState.Swap(nil))
+		}
+		ln, err := net.Listen("tcp", p.listener)
+		if err != nil {
+			return err
+		}
+		p.ln = ln
+		p.server = &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p.serve(state, w, r)
+			}),
+		}
+		server := p.server
+		go server.Serve(ln)
+		go func() {
+			<-state.shutdown
+			server.Close()
+		}()
+	}
+	stopPprof(pprofState.Swap(p))
+	return nil
+}
+
+// stopPprof closes the separate listener of a setting that was replaced
+// or turned off. The listener is closed itself too, as Serve may not have
+// taken it yet.
+func stopPprof(p *pprofServing) {
+	if p != nil && p.server != nil {
+		p.server.Close()
+		p.ln.Close()
+	}
+}
+
+// debugPprofCommand implements debug pprof
+func debugPprofCommand(i *feather.Interp, state *ServerState, args []*feather.Obj) feather.Result {
+	if len(args) == 0 {
+		p := pprofState.Load()
+		if p == nil {
+			return feather.OK(i.DictKV("enabled", false))
+		}
+		auth := ""
+		if p.auth != nil {
+			auth = p.auth.String()
+		}
+		return feather.OK(i.DictKV("enabled", true, "listener", p.listener, "auth", auth))
+	}
+	switch args[0].String() {
+	case "on":
+		p := &pprofServing{}
+		for j := 1; j < len(args); j += 2 {
+			opt := args[j].String()
+			if j+1 >= len(args) {
+				return feather.Errorf("debug pprof on: %s: missing value", opt)
+			}
+			switch opt {
+			case "-auth":
+				specArgs, err := i.ParseList(args[j+1].String())
+				if err != nil {
+					return feather.Errorf("debug pprof on: -auth: %v", err)
+				}
+				strArgs := make([]string, len(specArgs))
+				for k, a := range specArgs {
+					strArgs[k] = a.String()
+				}
+				if p.auth, err = parseAuthSpec(strArgs); err != nil {
+					return feather.Errorf("debug pprof on: -auth: %v", err)
+				}
+			case "-listener":
+				p.listener = args[j+1].String()
+			default:
+				return feather.Errorf("debug pprof on: unknown option %q (must be -auth, -listener)", opt)
+			}
+		}
+		// Profiles and the command line give away a lot about the server
+		if p.auth == nil && !isLoopbackAddr(p.listener) {
+			return feather.Error("debug pprof on: -auth is required unless -listener is a loopback address")
+		}
+		if err := startPprof(state, p); err != nil {
+			return feather.Errorf("debug pprof on: %v", err)
+		}
+		return feather.OK("")
+	case "off":
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"debug pprof off\"")
+		}
+		stopPprof(pprofState.Swap(nil))
+		return feather.OK("")
+	default:
+		return feather.Errorf("debug pprof: expected on or off, got %q", args[0].String())
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/feather-lang/feather"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoKind is the protobuf type of a scalar node: its Proto type, or
+// string, bool and double for plain schema types
+func protoKind(node *SchemaNode) string {
+	if node.Proto != "" {
+		return node.Proto
+	}
+	if node.Type == "number" {
+		return "double"
+	}
+	return node.Type
+}
+
+func protoWireType(kind string) int {
+	switch kind {
+	case "string", "bytes":
+		return wireBytes
+	case "fixed64", "sfixed64", "double":
+		return wireFixed64
+	case "fixed32", "sfixed32", "float":
+		return wireFixed32
+	}
+	return wireVarint
+}
+
+// protoEncoder writes protobuf messages based on schema
+type protoEncoder struct {
+	i *feather.InternalInterp
+}
+
+func appendProtoTag(b []byte, number, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(number)<<3|uint64(wire))
+}
+
+// message appends the fields of dict present in schema
+func (e *protoEncoder) message(b []byte, dict map[string]feather.FeatherObj, schema []*SchemaNode, depth int) ([]byte, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("nested too deeply")
+	}
+	for _, node := range schema {
+		val, ok := dict[node.Name]
+		if !ok {
+			continue
+		}
+		if node.Number == 0 {
+			return nil, fmt.Errorf("field %s: no field number", node.Name)
+		}
+		var err error
+		b, err = e.field(b, val, node, depth)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", node.Name, err)
+		}
+	}
+	return b, nil
+}
+
+func (e *protoEncoder) field(b []byte, val feather.FeatherObj, node *SchemaNode, depth int) ([]byte, error) {
+	switch node.Type {
+	case "object":
+		dict, _, err := e.i.GetDict(val)
+		if err != nil {
+			return nil, fmt.Errorf("expected dict for object: %v", err)
+		}
+		return e.embedded(b, node.Number, dict, node.Children, depth)
+
+	case "array":
+		list, err := e.i.GetList(val)
+		if err != nil {
+			return nil, fmt.Errorf("expected list for array: %v", err)
+		}
+		elem := node.Children[0]
+		if elem.Type == "object" {
+			for idx, item := range list {
+				dict, _, err := e.i.GetDict(item)
+				if err != nil {
+					return nil, fmt.Errorf("index %d: expected dict for object: %v", idx, err)
+				}
+				if b, err = e.embedded(b, node.Number, dict, elem.Children, depth); err != nil {
+					return nil, fmt.Errorf("index %d: %v", idx, err)
+				}
+			}
+			return b, nil
+		}
+		kind := protoKind(elem)
+		if protoWireType(kind) == wireBytes {
+			for idx, item := range list {
+				b = appendProtoTag(b, node.Number, wireBytes)
+				if b, err = e.scalar(b, item, kind); err != nil {
+					return nil, fmt.Errorf("index %d: %v", idx, err)
+				}
+			}
+			return b, nil
+		}
+		// Numeric and bool repeated fields are packed, as in proto3
+		if len(list) == 0 {
+			return b, nil
+		}
+		var packed []byte
+		for idx, item := range list {
+			if packed, err = e.scalar(packed, item, kind); err != nil {
+				return nil, fmt.Errorf("index %d: %v", idx, err)
+			}
+		}
+		b = appendProtoTag(b, node.Number, wireBytes)
+		b = binary.AppendUvarint(b, uint64(len(packed)))
+		return append(b, packed...), nil
+	}
+
+	kind := protoKind(node)
+	b = appendProtoTag(b, node.Number, protoWireType(kind))
+	return e.scalar(b, val, kind)
+}
+
+func (e *protoEncoder) embedded(b []byte, number int, dict map[string]feather.FeatherObj, schema []*SchemaNode, depth int) ([]byte, error) {
+	msg, err := e.message(nil, dict, schema, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	b = appendProtoTag(b, number, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	return append(b, msg...), nil
+}
+
+// scalar appends a value without its tag
+func (e *protoEncoder) scalar(b []byte, val feather.FeatherObj, kind string) ([]byte, error) {
+	s := schemaString(e.i, val)
+	switch kind {
+	case "string", "bytes":
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		return append(b, s...), nil
+	case "bool":
+		switch s {
+		case "1", "true":
+			return append(b, 1), nil
+		case "0", "false":
+			return append(b, 0), nil
+		}
+		return nil, fmt.Errorf("invalid bool: %s", s)
+	case "double", "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", s)
+		}
+		if kind == "float" {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), nil
+	case "uint32", "uint64", "fixed32", "fixed64":
+		bits := 64
+		if kind == "uint32" || kind == "fixed32" {
+			bits = 32
+		}
+		n, err := strconv.ParseUint(s, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", kind, s)
+		}
+		switch kind {
+		case "fixed32":
+			return binary.LittleEndian.AppendUint32(b, uint32(n)), nil
+		case "fixed64":
+			return binary.LittleEndian.AppendUint64(b, n), nil
+		}
+		return binary.AppendUvarint(b, n), nil
+	}
+	// Signed integers
+	bits := 64
+	if kind == "int32" || kind == "sint32" || kind == "sfixed32" {
+		bits = 32
+	}
+	n, err := strconv.ParseInt(s, 10, bits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", kind, s)
+	}
+	switch kind {
+	case "sint32", "sint64":
+		return binary.AppendUvarint(b, uint64(n<<1)^uint64(n>>63)), nil
+	case "sfixed32":
+		return binary.LittleEndian.AppendUint32(b, uint32(int32(n))), nil
+	case "sfixed64":
+		return binary.LittleEndian.AppendUint64(b, uint64(n)), nil
+	}
+	return binary.AppendUvarint(b, uint64(n)), nil // int32, int64
+}
+
+// protoField is one field read off the wire
+type protoField struct {
+	number int
+	wire   int
+	varint uint64 // varint, fixed32 and fixed64 values
+	data   []byte // length-delimited values
+}
+
+// readProtoFields splits a message into its fields
+func readProtoFields(msg []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad field key")
+		}
+		msg = msg[n:]
+		f := protoField{number: int(key >> 3), wire: int(key & 7)}
+		if f.number == 0 {
+			return nil, fmt.Errorf("invalid field number 0")
+		}
+		switch f.wire {
+		case wireVarint:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, fmt.Errorf("field %d: bad varint", f.number)
+			}
+			f.varint, msg = v, msg[n:]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return nil, fmt.Errorf("field %d: truncated", f.number)
+			}
+			f.varint, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case wireFixed32:
+			if len(msg) < 4 {
+				return nil, fmt.Errorf("field %d: truncated", f.number)
+			}
+			f.varint, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return nil, fmt.Errorf("field %d: truncated", f.number)
+			}
+			f.data, msg = msg[n:n+int(l)], msg[n+int(l):]
+		default:
+			return nil, fmt.Errorf("field %d: unsupported wire type %d", f.number, f.wire)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// decodeProtoScalar converts a varint or fixed value of the given kind
+func decodeProtoScalar(i *feather.InternalInterp, v uint64, kind string) feather.FeatherObj {
+	switch kind {
+	case "bool":
+		if v != 0 {
+			return i.InternString("1")
+		}
+		return i.InternString("0")
+	case "double":
+		return i.NewDouble(math.Float64frombits(v))
+	case "float":
+		return i.NewDouble(float64(math.Float32frombits(uint32(v))))
+	case "int32", "sfixed32":
+		return i.NewInt(int64(int32(v)))
+	case "sint32", "sint64":
+		return i.NewInt(int64(v>>1) ^ -int64(v&1))
+	case "uint32", "fixed32":
+		return i.NewInt(int64(uint32(v)))
+	case "uint64", "fixed64":
+		if v > math.MaxInt64 {
+			return i.InternString(strconv.FormatUint(v, 10))
+		}
+		return i.NewInt(int64(v))
+	}
+	return i.NewInt(int64(v)) // int64, sfixed64
+}
+
+// decodeProtoMessage builds a dict from msg in schema order. Fields not
+// in the schema are skipped.
+func decodeProtoMessage(i *feather.InternalInterp, msg []byte, schema []*SchemaNode, depth int) (feather.FeatherObj, error) {
+	if depth > maxJSONDepth {
+		return 0, fmt.Errorf("nested too deeply")
+	}
+	fields, err := readProtoFields(msg)
+	if err != nil {
+		return 0, err
+	}
+	values := make(map[*SchemaNode][]feather.FeatherObj)
+	byNumber := make(map[int]*SchemaNode, len(schema))
+	for _, node := range schema {
+		if node.Number != 0 {
+			byNumber[node.Number] = node
+		}
+	}
+	for _, f := range fields {
+		node, ok := byNumber[f.number]
+		if !ok {
+			continue
+		}
+		elem := node
+		if node.Type == "array" {
+			elem = node.Children[0]
+		}
+		var vals []feather.FeatherObj
+		switch {
+		case elem.Type == "object":
+			if f.wire != wireBytes {
+				return 0, fmt.Errorf("field %s: expected a message, got wire type %d", node.Name, f.wire)
+			}
+			v, err := decodeProtoMessage(i, f.data, elem.Children, depth+1)
+			if err != nil {
+				return 0, fmt.Errorf("field %s: %v", node.Name, err)
+			}
+			vals = append(vals, v)
+		case protoWireType(protoKind(elem)) == wireBytes:
+			if f.wire != wireBytes {
+				return 0, fmt.Errorf("field %s: expected %s, got wire type %d", node.Name, protoKind(elem), f.wire)
+			}
+			vals = append(vals, i.InternString(string(f.data)))
+		case f.wire == wireBytes && node.Type == "array":
+			// Packed repeated scalars
+			kind := protoKind(elem)
+			data := f.data
+			for len(data) > 0 {
+				var v uint64
+				switch protoWireType(kind) {
+				case wireVarint:
+					x, n := binary.Uvarint(data)
+					if n <= 0 {
+						return 0, fmt.Errorf("field %s: bad packed varint", node.Name)
+					}
+					v, data = x, data[n:]
+				case wireFixed64:
+					if len(data) < 8 {
+						return 0, fmt.Errorf("field %s: truncated", node.Name)
+					}
+					v, data = binary.LittleEndian.Uint64(data), data[8:]
+				case wireFixed32:
+					if len(data) < 4 {
+						return 0, fmt.Errorf("field %s: truncated", node.Name)
+					}
+					v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+				}
+				vals = append(vals, decodeProtoScalar(i, v, kind))
+			}
+		default:
+			kind := protoKind(elem)
+			if f.wire != protoWireType(kind) {
+				return 0, fmt.Errorf("field %s: expected %s, got wire type %d", node.Name, kind, f.wire)
+			}
+			vals = append(vals, decodeProtoScalar(i, f.varint, kind))
+		}
+		if node.Type == "array" {
+			values[node] = append(values[node], vals...)
+		} else {
+			values[node] = vals // last one wins
+		}
+	}
+
+	dict := i.NewDict()
+	for _, node := range schema {
+		vals, ok := values[node]
+		if !ok {
+			continue
+		}
+		if node.Type == "array" {
+			list := i.NewList()
+			for _, v := range vals {
+				list = i.ListAppend(list, v)
+			}
+			dict = i.DictSet(dict, node.Name, list)
+		} else {
+			dict = i.DictSet(dict, node.Name, vals[len(vals)-1])
+		}
+	}
+	return dict, nil
+}
+
+func registerProtoCommand(fi *feather.Interp, state *ServerState) {
+	protoCmd := &Command{
+		Name:  "proto",
+		Help:  "Encode or decode protobuf messages with schema",
+		Usage: "proto encode DICT SCHEMA | proto decode DATA SCHEMA",
+		Long: `proto speaks the protobuf wire format without generated code. The
+schema is the json schema DSL with a field number after each type:
+
+  string 1 name
+  int64 2 id
+  array 3 tags string
+  object 4 address { string 1 city }
+  array 5 items object { uint32 1 qty }
+
+Besides string, number (double) and bool, fields can use the protobuf
+scalar types int32, int64, uint32, uint64, sint32, sint64, fixed32,
+fixed64, sfixed32, sfixed64, double, float and bytes. Other encoders treat
+these as number, or string for bytes.
+
+encode returns the message bytes; repeated numeric fields are packed, as
+in proto3. decode reads message bytes such as [request body] into a dict,
+accepting packed and unpacked repeated fields and skipping fields not in
+the schema. Bools decode as 1 or 0.
+
+Example:
+  set schema {int64 1 id string 2 name}
+  respond -type application/x-protobuf [proto encode [dict create id 7 name ann] $schema]`,
+		Subcommands: []*Command{
+			{Name: "encode", Help: "Encode a dict as a protobuf message", Usage: "proto encode DICT SCHEMA"},
+			{Name: "decode", Help: "Decode a protobuf message into a dict", Usage: "proto decode DATA SCHEMA"},
+		},
+	}
+	registry.Register(protoCmd)
+
+	// Low-level registration, like json, so the bytes aren't list-quoted
+	fi.Internal().Register("proto", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) != 3 {
+			i.SetErrorString("wrong # args: should be \"proto encode dict schema\" or \"proto decode data schema\"")
+			return feather.ResultError
+		}
+		sub := i.GetString(args[0])
+		if sub != "encode" && sub != "decode" {
+			i.SetErrorString(fmt.Sprintf("proto: unknown subcommand %q (must be encode, decode)", sub))
+			return feather.ResultError
+		}
+		schema, err := parseSchema(i.GetString(args[2]))
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("proto %s: invalid schema: %v", sub, err))
+			return feather.ResultError
+		}
+
+		if sub == "encode" {
+			dict, _, err := i.GetDict(args[1])
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("proto encode: expected dict: %v", err))
+				return feather.ResultError
+			}
+			msg, err := (&protoEncoder{i: i}).message(nil, dict, schema, 0)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("proto encode: %v", err))
+				return feather.ResultError
+			}
+			i.SetResult(i.InternString(string(msg)))
+			return feather.ResultOK
+		}
+
+		dict, err := decodeProtoMessage(i, []byte(i.GetString(args[1])), schema, 0)
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("proto decode: %v", err))
+			return feather.ResultError
+		}
+		i.SetResult(dict)
+		return feather.ResultOK
+	})
+}
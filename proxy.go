@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// proxyMount forwards requests under a path prefix to an upstream server
+type proxyMount struct {
+	Prefix         string
+	Target         *url.URL
+	KeepPrefix     bool            // forward the full path instead of the part after Prefix
+	HTTP10         bool            // talk HTTP/1.0 to the upstream
+	BufferRequests bool            // send request bodies with Content-Length instead of chunked
+	MaxBody        int64           // largest buffered request body
+	DecodeRequests bool            // decompress gzip/deflate request bodies
+	Compression    string          // pass, identity or gzip
+	StripHeaders   []string        // request headers not forwarded
+	Timeout        time.Duration   // wait for response headers, 0 = none
+	Breaker        *circuitBreaker // nil = no circuit breaking
+	Fallback       string          // proc answering while the breaker is open
+	Transform      *bodyTransform  // rewrites responses, nil = none
+	proxy          *httputil.ReverseProxy
+}
+
+var (
+	proxyMu     sync.RWMutex
+	proxyMounts = make(map[string]*proxyMount) // by prefix
+)
+
+// findProxyMount returns the mount with the longest prefix matching p
+func findProxyMount(p string) *proxyMount {
+	proxyMu.RLock()
+	defer proxyMu.RUnlock()
+	var best *proxyMount
+	for prefix, m := range proxyMounts {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			if best == nil || len(prefix) > len(best.Prefix) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// newReverseProxy builds the reverse proxy for m. Hop-by-hop headers are
+// always stripped, in both directions.
+func (m *proxyMount) newReverseProxy() {
+	var transport http.RoundTripper
+	if m.HTTP10 {
+		transport = &http10Transport{timeout: m.Timeout}
+	} else {
+		t := newOutboundTransport(outboundProxy, currentOutbound())
+		t.ResponseHeaderTimeout = m.Timeout
+		transport = hostTLSTransport{t}
+	}
+	m.proxy = &httputil.ReverseProxy{
+		Transport:     transport,
+		FlushInterval: -1, // stream responses as they arrive
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(m.Target)
+			pr.SetXForwarded()
+			for _, h := range m.StripHeaders {
+				pr.Out.Header.Del(h)
+			}
+			switch m.Compression {
+			case "identity":
+				pr.Out.Header.Set("Accept-Encoding", "identity")
+			case "gzip":
+				// Compression is ours to add, so only take gzip from the
+				// upstream when the client can use it as is
+				if acceptsGzip(pr.In) {
+					pr.Out.Header.Set("Accept-Encoding", "gzip")
+				} else {
+					pr.Out.Header.Set("Accept-Encoding", "identity")
+				}
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if m.Breaker != nil {
+				m.Breaker.record(breakerTicketFrom(resp.Request.Context()), resp.StatusCode < 500)
+			}
+			if m.Compression == "pass" || resp.Header.Get("Content-Encoding") != "gzip" {
+				return nil
+			}
+			// The upstream sent gzip anyway; decode it for the client
+			if m.Compression == "identity" || !acceptsGzip(resp.Request) {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					return err
+				}
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{gz, resp.Body}
+				resp.Header.Del("Content-Encoding")
+				resp.Header.Del("Content-Length")
+				resp.ContentLength = -1
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if m.Breaker != nil {
+				if t := breakerTicketFrom(r.Context()); errors.Is(err, context.Canceled) {
+					m.Breaker.abandon(t)
+				} else {
+					m.Breaker.record(t, false)
+				}
+			}
+			logf("proxy %s: %s %s: %v\n", m.Prefix, r.Method, r.URL.Path, err)
+			status := http.StatusBadGateway
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				status = http.StatusGatewayTimeout
+			}
+			http.Error(w, http.StatusText(status), status)
+		},
+	}
+}
+
+// prepareBody decodes and buffers the request body as configured. It
+// reports false after writing an error response.
+func (m *proxyMount) prepareBody(w http.ResponseWriter, r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	decode := false
+	if m.DecodeRequests {
+		switch enc := strings.ToLower(r.Header.Get("Content-Encoding")); enc {
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip request body", http.StatusBadRequest)
+				return false
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{gz, r.Body}
+			decode = true
+		case "deflate":
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{flate.NewReader(r.Body), r.Body}
+			decode = true
+		}
+		if decode {
+			r.Header.Del("Content-Encoding")
+		}
+	}
+	// A decoded body has a new length, and HTTP/1.0 has no chunked encoding
+	if !decode && (r.ContentLength >= 0 || (!m.BufferRequests && !m.HTTP10)) {
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "error reading request body", http.StatusBadRequest)
+		return false
+	}
+	if int64(len(body)) > m.MaxBody {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Content-Length")
+	return true
+}
+
+// serveProxy forwards a request to the mount's upstream
+func serveProxy(state *ServerState, m *proxyMount, w http.ResponseWriter, r *http.Request) {
+	if m.Breaker != nil {
+		t, wait := m.Breaker.allow()
+		if t == nil {
+			m.unavailable(state, w, r, wait)
+			return
+		}
+		r = r.WithContext(withBreakerTicket(r.Context(), t))
+	}
+	if !m.prepareBody(w, r) {
+		if m.Breaker != nil {
+			m.Breaker.abandon(breakerTicketFrom(r.Context()))
+		}
+		return
+	}
+	if !m.KeepPrefix {
+		r = r.Clone(r.Context())
+		r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, m.Prefix), "/")
+		r.URL.RawPath = ""
+	}
+	if m.Compression == "gzip" {
+		if gw := newGzipWriter(w, r, gzip.DefaultCompression); gw != nil {
+			defer gw.close()
+			w = gw
+		}
+	}
+	if m.Transform != nil {
+		tw := &transformWriter{ResponseWriter: w, t: m.Transform}
+		defer tw.close()
+		w = tw
+	}
+	m.proxy.ServeHTTP(w, r)
+}
+
+// unavailable answers a request refused by the circuit breaker, with the
+// fallback proc if there is one
+func (m *proxyMount) unavailable(state *ServerState, w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	if m.Fallback == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	ctx := &RequestContext{Writer: w, Request: r, Status: 200}
+	_, err := state.EvalFor(ctx, m.Fallback)
+	ctx.mu.Lock()
+	if err != nil {
+		logf("proxy %s: fallback %s: %v\n", m.Prefix, m.Fallback, err)
+		if !ctx.Written {
+			http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+			ctx.Written = true
+		}
+	}
+	ctx.writeHeader()
+	ctx.mu.Unlock()
+	ctx.finishWriters()
+}
+
+// http10Transport sends each request as HTTP/1.0 on a new connection, for
+// upstreams that can't handle HTTP/1.1. Request bodies must have a known
+// length (prepareBody buffers them). It dials directly, without the
+// outbound proxy.
+type http10Transport struct {
+	timeout time.Duration
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		if req.URL.Scheme == "https" {
+			host = net.JoinHostPort(req.URL.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	conn, err := outboundDial(req.Context(), "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		cfg := &tls.Config{ServerName: req.URL.Hostname()}
+		if h := getHostTLS(req.URL.Hostname()); h != nil {
+			cfg.RootCAs, cfg.InsecureSkipVerify = h.roots, h.insecure
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(req.Context()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+	if t.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(t.timeout))
+	}
+
+	bw := bufio.NewWriter(conn)
+	fmt.Fprintf(bw, "%s %s HTTP/1.0\r\n", req.Method, req.URL.RequestURI())
+	hostHeader := req.Host
+	if hostHeader == "" {
+		hostHeader = req.URL.Host
+	}
+	fmt.Fprintf(bw, "Host: %s\r\n", hostHeader)
+	h := req.Header.Clone()
+	h.Del("Connection")
+	h.Del("Transfer-Encoding")
+	if req.Body != nil && req.ContentLength > 0 {
+		h.Set("Content-Length", fmt.Sprint(req.ContentLength))
+	}
+	h.Write(bw)
+	bw.WriteString("\r\n")
+	if req.Body != nil {
+		io.Copy(bw, req.Body)
+		req.Body.Close()
+	}
+	if err := bw.Flush(); err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	// Headers are in; the body may take as long as it takes
+	conn.SetDeadline(time.Time{})
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: conn, stop: stop}
+	return resp, nil
+}
+
+// connBody closes the connection along with the response body
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+	stop func() bool
+}
+
+func (b *connBody) Close() error {
+	b.stop()
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+func registerProxyCommand(interp *feather.Interp, state *ServerState) {
+	proxyCmd := &Command{
+		Name:  "proxy",
+		Help:  "Forward requests under a URL prefix to another server",
+		Usage: "proxy PREFIX URL ?OPTIONS?",
+		Long: `Mount a reverse proxy at PREFIX: requests under it are forwarded to URL
+with the path after PREFIX appended (all of it with -keep-prefix 1), and
+the response is streamed back. X-Forwarded-For, -Host and -Proto are set;
+hop-by-hop headers (Connection, Keep-Alive, TE, ...) are always dropped.
+An unreachable upstream gives 502, one that doesn't answer within -timeout
+gives 504.
+
+Options for legacy upstreams:
+  -http10 BOOL           Speak HTTP/1.0, one connection per request
+  -buffer-requests BOOL  Send request bodies with Content-Length instead
+                         of chunked (always on with -http10)
+  -max-body SIZE         Largest buffered request body (default 10MB);
+                         larger ones get 413
+  -decode-requests BOOL  Decompress gzip and deflate request bodies
+  -compression MODE      pass (default) leaves encodings alone; identity
+                         asks the upstream for plain responses and decodes
+                         gzip ones; gzip also compresses plain responses for
+                         clients that accept it
+  -strip-headers LIST    Request headers not to forward
+  -timeout DURATION      Wait for response headers (default 30s, 0 = none)
+
+-transform OPTIONS rewrites responses as they stream back; it takes the
+options of the transform command as a list (see help transform). Encoded
+responses pass through unchanged, so use it with -compression identity or
+gzip.
+
+Circuit breaking, so a failing upstream fails fast instead of tying up
+connections: with -breaker RATIO, once at least -breaker-min requests
+(default 5) in a -breaker-window (default 30s) have failed at that ratio
+(connection errors, timeouts and 5xx responses), requests are refused for
+-breaker-cooldown (default 30s). Then a single probe request is let
+through; if it succeeds the breaker closes, otherwise it opens again.
+Refused requests get 503 with Retry-After, or are answered by the
+-fallback proc, which runs like a route body.
+
+Example:
+  proxy /api http://127.0.0.1:9000
+  proxy /legacy http://10.0.0.5:8080 -http10 1 -decode-requests 1 \
+      -compression gzip -strip-headers {Cookie}
+  proxy /search http://10.0.0.7:9200 -timeout 2s -breaker 0.5 -fallback cachedResults
+  proxy unmount /api
+
+proxy fcgi fronts a FastCGI application server (php-fpm and the like) on a
+unix socket path or host:port. Requests under -prefix (default /) for a
+script under -root (default the current directory) with the -ext
+extension (default .php) are run by it, with anything after the script
+name as PATH_INFO; directory requests run the -index script (default
+index.php). With -front 1, requests that match neither a script nor a file
+go to the root -index script, as front-controller frameworks expect.
+Everything else (static files, routes) is served as usual. Request and
+response bodies are streamed; chunked request bodies are buffered up to
+-max-body (default 10MB) because FastCGI needs CONTENT_LENGTH.
+
+Example:
+  proxy fcgi /run/php/php-fpm.sock -root /var/www/app -front 1
+  static /assets /var/www/app/assets`,
+		Subcommands: []*Command{
+			{Name: "unmount", Help: "Stop proxying PREFIX", Usage: "proxy unmount PREFIX"},
+			{Name: "mounts", Help: "List mounts as dicts", Usage: "proxy mounts"},
+			{Name: "fcgi", Help: "Run scripts through a FastCGI server such as php-fpm", Usage: "proxy fcgi SOCKET ?-root DIR? ?-index FILE? ?-prefix PREFIX? ?-ext EXT? ?-front BOOL? ?-max-body SIZE? ?-timeout DURATION?"},
+			{Name: "breaker", Help: "Circuit breaker state and counts, optionally closing it", Usage: "proxy breaker PREFIX ?-reset?"},
+		},
+	}
+	registry.Register(proxyCmd)
+	interp.RegisterCommand("proxy", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"proxy prefix url ?options?\"")
+		}
+		switch args[0].String() {
+		case "unmount":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"proxy unmount prefix\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			proxyMu.Lock()
+			_, found := proxyMounts[prefix]
+			delete(proxyMounts, prefix)
+			proxyMu.Unlock()
+			fcgiMu.Lock()
+			if _, ok := fcgiMounts[prefix]; ok {
+				found = true
+				delete(fcgiMounts, prefix)
+			}
+			fcgiMu.Unlock()
+			if !found {
+				return feather.Errorf("proxy unmount: no mount at %q", prefix)
+			}
+			return feather.OK("")
+		case "fcgi":
+			return proxyFcgi(i, args[1:])
+		case "breaker":
+			if len(args) != 2 && !(len(args) == 3 && args[2].String() == "-reset") {
+				return feather.Error("wrong # args: should be \"proxy breaker prefix ?-reset?\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			proxyMu.RLock()
+			m := proxyMounts[prefix]
+			proxyMu.RUnlock()
+			if m == nil {
+				return feather.Errorf("proxy breaker: no mount at %q", prefix)
+			}
+			if m.Breaker == nil {
+				return feather.Errorf("proxy breaker: %s has no circuit breaker (see -breaker)", prefix)
+			}
+			if len(args) == 3 {
+				m.Breaker.reset()
+			}
+			return feather.OK(i.DictKV(m.Breaker.stats()...))
+		case "mounts":
+			proxyMu.RLock()
+			defer proxyMu.RUnlock()
+			prefixes := make([]string, 0, len(proxyMounts))
+			for prefix := range proxyMounts {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			items := make([]*feather.Obj, 0, len(prefixes))
+			for _, prefix := range prefixes {
+				m := proxyMounts[prefix]
+				items = append(items, i.DictKV("prefix", m.Prefix, "url", m.Target.String(),
+					"keep_prefix", m.KeepPrefix, "http10", m.HTTP10, "buffer_requests", m.BufferRequests,
+					"max_body", int(m.MaxBody), "decode_requests", m.DecodeRequests,
+					"compression", m.Compression, "strip_headers", strings.Join(m.StripHeaders, " "),
+					"timeout", m.Timeout.String(), "fallback", m.Fallback, "breaker", m.Breaker != nil,
+					"transform", m.Transform != nil))
+			}
+			fcgiMu.RLock()
+			defer fcgiMu.RUnlock()
+			prefixes = prefixes[:0]
+			for prefix := range fcgiMounts {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			for _, prefix := range prefixes {
+				m := fcgiMounts[prefix]
+				items = append(items, i.DictKV("prefix", m.Prefix, "fcgi", m.Socket, "root", m.Root,
+					"index", m.Index, "ext", m.Ext, "front", m.Front, "max_body", int(m.MaxBody),
+					"timeout", m.Timeout.String()))
+			}
+			return feather.OK(i.List(items...))
+		}
+
+		if !strings.HasPrefix(args[0].String(), "/") {
+			return feather.Errorf("proxy: unknown subcommand %q (must be a /PREFIX, fcgi, unmount, mounts, breaker)", args[0].String())
+		}
+		if len(args) < 2 || len(args)%2 != 0 {
+			return feather.Error("wrong # args: should be \"proxy prefix url ?options?\"")
+		}
+		target, err := url.Parse(args[1].String())
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return feather.Errorf("proxy: invalid upstream URL %q (must be http:// or https://)", args[1].String())
+		}
+		m := &proxyMount{
+			Prefix:      "/" + strings.Trim(args[0].String(), "/"),
+			Target:      target,
+			MaxBody:     10 << 20,
+			Compression: "pass",
+			Timeout:     30 * time.Second,
+		}
+		var breakerRatio float64
+		breakerMin, breakerWindow, breakerCooldown := 5, 30*time.Second, 30*time.Second
+		for j := 2; j < len(args); j += 2 {
+			val := args[j+1].String()
+			switch args[j].String() {
+			case "-keep-prefix":
+				m.KeepPrefix = tclTrue(val)
+			case "-http10":
+				m.HTTP10 = tclTrue(val)
+			case "-buffer-requests":
+				m.BufferRequests = tclTrue(val)
+			case "-max-body":
+				n, err := parseByteSize(val)
+				if err != nil {
+					return feather.Errorf("proxy: -max-body: %v", err)
+				}
+				m.MaxBody = n
+			case "-decode-requests":
+				m.DecodeRequests = tclTrue(val)
+			case "-compression":
+				if val != "pass" && val != "identity" && val != "gzip" {
+					return feather.Errorf("proxy: invalid -compression %q (must be pass, identity, gzip)", val)
+				}
+				m.Compression = val
+			case "-strip-headers":
+				items, err := i.ParseList(val)
+				if err != nil {
+					return feather.Errorf("proxy: -strip-headers: %v", err)
+				}
+				for _, item := range items {
+					m.StripHeaders = append(m.StripHeaders, http.CanonicalHeaderKey(item.String()))
+				}
+			case "-timeout":
+				d, err := time.ParseDuration(val)
+				if err != nil || d < 0 {
+					return feather.Errorf("proxy: invalid -timeout %q", val)
+				}
+				m.Timeout = d
+			case "-breaker":
+				ratio, err := strconv.ParseFloat(val, 64)
+				if err != nil || ratio < 0 || ratio > 1 {
+					return feather.Errorf("proxy: invalid -breaker %q (must be a failure ratio from 0 to 1)", val)
+				}
+				breakerRatio = ratio
+			case "-breaker-min":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					return feather.Errorf("proxy: invalid -breaker-min %q", val)
+				}
+				breakerMin = n
+			case "-breaker-window", "-breaker-cooldown":
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					return feather.Errorf("proxy: invalid %s %q", args[j].String(), val)
+				}
+				if args[j].String() == "-breaker-window" {
+					breakerWindow = d
+				} else {
+					breakerCooldown = d
+				}
+			case "-fallback":
+				m.Fallback = val
+			case "-transform":
+				t, err := parseMountTransform(i, val)
+				if err != nil {
+					return feather.Errorf("proxy: %v", err)
+				}
+				m.Transform = t
+			default:
+				return feather.Errorf("proxy: unknown option %q (must be -keep-prefix, -http10, -buffer-requests, -max-body, -decode-requests, -compression, -strip-headers, -timeout, -breaker, -breaker-min, -breaker-window, -breaker-cooldown, -fallback, -transform)", args[j].String())
+			}
+		}
+		if m.Prefix == "/" {
+			return feather.Error("proxy: PREFIX can't be / (routes would be unreachable)")
+		}
+		if breakerRatio > 0 {
+			m.Breaker = newCircuitBreaker(breakerRatio, breakerMin, breakerWindow, breakerCooldown)
+		} else if m.Fallback != "" {
+			return feather.Error("proxy: -fallback needs -breaker")
+		}
+		m.newReverseProxy()
+
+		proxyMu.Lock()
+		proxyMounts[m.Prefix] = m
+		proxyMu.Unlock()
+		return feather.OK("")
+	})
+}
+
+// proxyFcgi handles proxy fcgi SOCKET ?options?
+func proxyFcgi(i *feather.Interp, args []*feather.Obj) feather.Result {
+	if len(args) < 1 || len(args)%2 != 1 {
+		return feather.Error("wrong # args: should be \"proxy fcgi socket ?-root dir? ?-index file? ?-prefix prefix? ?-ext ext? ?-front bool? ?-max-body size? ?-timeout duration?\"")
+	}
+	m := &fcgiMount{
+		Prefix:  "/",
+		Socket:  args[0].String(),
+		Root:    ".",
+		Index:   "index.php",
+		Ext:     ".php",
+		MaxBody: 10 << 20,
+		Timeout: 60 * time.Second,
+	}
+	for j := 1; j < len(args); j += 2 {
+		val := args[j+1].String()
+		switch args[j].String() {
+		case "-root":
+			m.Root = val
+		case "-index":
+			if strings.ContainsAny(val, `/\`) {
+				return feather.Errorf("proxy fcgi: -index must be a file name, got %q", val)
+			}
+			m.Index = val
+		case "-prefix":
+			m.Prefix = "/" + strings.Trim(val, "/")
+		case "-ext":
+			if !strings.HasPrefix(val, ".") || strings.Contains(val, "/") {
+				return feather.Errorf("proxy fcgi: invalid -ext %q (e.g. .php)", val)
+			}
+			m.Ext = val
+		case "-front":
+			m.Front = tclTrue(val)
+		case "-max-body":
+			n, err := parseByteSize(val)
+			if err != nil {
+				return feather.Errorf("proxy fcgi: -max-body: %v", err)
+			}
+			m.MaxBody = n
+		case "-timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return feather.Errorf("proxy fcgi: invalid -timeout %q", val)
+			}
+			m.Timeout = d
+		default:
+			return feather.Errorf("proxy fcgi: unknown option %q (must be -root, -index, -prefix, -ext, -front, -max-body, -timeout)", args[j].String())
+		}
+	}
+	root, err := filepath.Abs(m.Root)
+	if err != nil {
+		return feather.Errorf("proxy fcgi: %v", err)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return feather.Errorf("proxy fcgi: %s is not a directory", m.Root)
+	}
+	m.Root = root
+
+	fcgiMu.Lock()
+	fcgiMounts[m.Prefix] = m
+	fcgiMu.Unlock()
+	return feather.OK("")
+}
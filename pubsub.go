@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// pubsubSub is one subscription: messages go to a held connection or to
+// a proc
+type pubsubSub struct {
+	id      string
+	topic   string
+	conn    *Connection
+	proc    string
+	channel string      // channel that subscribed proc, which it runs on
+	sse     bool        // frame messages to conn as server-sent events
+	waiter  chan string // set for connection wait -topic; gets the first message
+}
+
+// pubsubBroker keeps the subscriptions by topic, in subscription order
+type pubsubBroker struct {
+	mu     sync.Mutex
+	topics map[string][]*pubsubSub
+	byID   map[string]*pubsubSub
+	nextID int
+}
+
+func newPubsubBroker() *pubsubBroker {
+	return &pubsubBroker{topics: make(map[string][]*pubsubSub), byID: make(map[string]*pubsubSub)}
+}
+
+func (b *pubsubBroker) subscribe(sub *pubsubSub) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	sub.id = "sub" + strconv.Itoa(b.nextID)
+	b.topics[sub.topic] = append(b.topics[sub.topic], sub)
+	b.byID[sub.id] = sub
+	return sub.id
+}
+
+func (b *pubsubBroker) unsubscribe(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub, ok := b.byID[id]
+	if ok {
+		b.removeLocked(sub)
+	}
+	return ok
+}
+
+func (b *pubsubBroker) removeLocked(sub *pubsubSub) {
+	delete(b.byID, sub.id)
+	subs := b.topics[sub.topic]
+	for j, s := range subs {
+		if s == sub {
+			subs = append(subs[:j:j], subs[j+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(b.topics, sub.topic)
+	} else {
+		b.topics[sub.topic] = subs
+	}
+}
+
+// dropConnection removes the subscriptions of a connection being closed
+func (b *pubsubBroker) dropConnection(conn *Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.byID {
+		if sub.conn == conn {
+			b.removeLocked(sub)
+		}
+	}
+}
+
+// publish delivers msg to the subscribers of topic and returns how many
+// it reached. Proc subscribers are queued to run on the interpreter loop
+// after the publisher's script, in order, each on its subscriber's
+// channel and outside any request, using evalIn. Their errors are
+// logged, not returned, so one broken subscriber doesn't stop the others.
+func (b *pubsubBroker) publish(topic, msg string, evalIn func(channel, script string) (*feather.Obj, error)) int {
+	b.mu.Lock()
+	subs := append([]*pubsubSub(nil), b.topics[topic]...)
+	b.mu.Unlock()
+
+	n := 0
+	var procs []*pubsubSub
+	defer func() {
+		if len(procs) == 0 {
+			return
+		}
+		go func() {
+			for _, sub := range procs {
+				if _, err := evalIn(sub.channel, sub.proc+" "+tclQuote(topic, msg)); err != nil {
+					logf("pubsub %s: %s: %v\n", topic, sub.proc, err)
+				}
+			}
+		}()
+	}()
+	for _, sub := range subs {
+		if sub.waiter != nil {
+			select {
+			case sub.waiter <- msg:
+				n++
+			default:
+			}
+			continue
+		}
+		if sub.proc != "" {
+			procs = append(procs, sub)
+			n++
+			continue
+		}
+		select {
+		case <-sub.conn.Done:
+			continue
+		default:
+		}
+		if sub.sse {
+			var buf bytes.Buffer
+			writeSSE(&buf, topic, msg)
+			sub.conn.send(buf.Bytes())
+		} else {
+			sub.conn.send([]byte(msg))
+		}
+		n++
+	}
+	return n
+}
+
+// counts returns the number of subscribers of each topic
+func (b *pubsubBroker) counts() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := make(map[string]int, len(b.topics))
+	for t, subs := range b.topics {
+		m[t] = len(subs)
+	}
+	return m
+}
+
+func registerPubsubCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "pubsub",
+		Help:  "Publish events to subscribed connections and procs",
+		Usage: "pubsub publish|subscribe|unsubscribe|topics ...",
+		Long: `pubsub publish sends MSG to everything subscribed to TOPIC and returns
+how many subscribers it reached. A route, a background job or the REPL
+can publish; subscribers don't need to know who did.
+
+pubsub subscribe adds a subscriber and returns its id for pubsub
+unsubscribe. With -to HANDLE the message is written to that held
+connection and flushed; without -to or -proc, the connection held by
+the current request is used. -sse frames each message as a server-sent
+event named after the topic, otherwise it is written as is. With -proc
+PROC, PROC is called with the topic and the message instead. It runs
+once the publishing script is done, not inside it, with no request of
+its own and under the command policy (see acl) of where it subscribed.
+
+A connection's subscriptions end when it closes. pubsub topics returns
+a dict of each topic and its number of subscribers.
+
+Example:
+  route GET /events {
+      header Content-Type text/event-stream
+      connection hold
+      pubsub subscribe orders -sse
+  }
+  route POST /orders {
+      set id [save_order [request body]]
+      pubsub publish orders $id
+      respond $id
+  }`,
+		Subcommands: []*Command{
+			{Name: "publish", Help: "Send a message to a topic's subscribers", Usage: "pubsub publish TOPIC MSG"},
+			{Name: "subscribe", Help: "Subscribe a connection or proc to a topic", Usage: "pubsub subscribe TOPIC ?-to HANDLE | -proc PROC? ?-sse?"},
+			{Name: "unsubscribe", Help: "Remove a subscription", Usage: "pubsub unsubscribe ID"},
+			{Name: "topics", Help: "Return the subscriber count of each topic", Usage: "pubsub topics"},
+		},
+	})
+
+	interp.RegisterCommand("pubsub", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"pubsub subcommand ?arg ...?\"")
+		}
+		switch sub := args[0].String(); sub {
+		case "publish":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"pubsub publish topic msg\"")
+			}
+			return feather.OK(state.pubsub.publish(args[1].String(), args[2].String(), state.EvalIn))
+		case "subscribe":
+			if len(args) < 2 {
+				return feather.Error("wrong # args: should be \"pubsub subscribe topic ?-to handle | -proc proc? ?-sse?\"")
+			}
+			s := &pubsubSub{topic: args[1].String()}
+			var handle string
+			for j := 2; j < len(args); j++ {
+				switch opt := args[j].String(); opt {
+				case "-sse":
+					s.sse = true
+				case "-to", "-proc":
+					if j+1 >= len(args) {
+						return feather.Errorf("pubsub subscribe %s: missing value", opt)
+					}
+					j++
+					if opt == "-to" {
+						handle = args[j].String()
+					} else {
+						s.proc, s.channel = args[j].String(), state.originChannel()
+					}
+				default:
+					return feather.Errorf("pubsub subscribe: unknown option %q (must be -to, -proc, -sse)", opt)
+				}
+			}
+			switch {
+			case handle != "" && s.proc != "":
+				return feather.Error("pubsub subscribe: -to and -proc can't be combined")
+			case handle != "":
+				if s.conn = state.GetConnection(handle); s.conn == nil {
+					return feather.Errorf("pubsub subscribe: unknown connection %q", handle)
+				}
+			case s.proc == "":
+				ctx := state.GetRequestContext()
+				if ctx != nil {
+					s.conn = state.findConnectionByContext(ctx)
+				}
+				if s.conn == nil {
+					return feather.Error("pubsub subscribe: no held connection; hold one first or give -to or -proc")
+				}
+			}
+			return feather.OK(state.pubsub.subscribe(s))
+		case "unsubscribe":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"pubsub unsubscribe id\"")
+			}
+			return feather.OK(state.pubsub.unsubscribe(args[1].String()))
+		case "topics":
+			counts := state.pubsub.counts()
+			topics := make([]string, 0, len(counts))
+			for t := range counts {
+				topics = append(topics, t)
+			}
+			sort.Strings(topics)
+			kvs := make([]any, 0, 2*len(topics))
+			for _, t := range topics {
+				kvs = append(kvs, t, counts[t])
+			}
+			return feather.OK(i.DictKV(kvs...))
+		default:
+			return feather.Errorf("pubsub: unknown subcommand %q (must be publish, subscribe, unsubscribe, topics)", sub)
+		}
+	})
+}
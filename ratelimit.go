@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// RateLimitSpec describes a token bucket limit as given to the ratelimit
+// command or the route -ratelimit option
+type RateLimitSpec struct {
+	Per     string  // "ip" or "global"
+	Rate    string  // as written, e.g. "10/s"
+	PerSec  float64 // tokens added per second
+	Burst   int     // bucket capacity
+	KeyExpr string  // optional script computing the bucket key
+}
+
+// parseRateLimitSpec parses -per, -rate, -burst and -key options
+func parseRateLimitSpec(args []string) (*RateLimitSpec, error) {
+	spec := &RateLimitSpec{Per: "ip"}
+	for j := 0; j < len(args); j++ {
+		opt := args[j]
+		j++
+		if j >= len(args) {
+			return nil, fmt.Errorf("%s: missing value", opt)
+		}
+		val := args[j]
+		switch opt {
+		case "-per":
+			if val != "ip" && val != "global" {
+				return nil, fmt.Errorf("-per must be ip or global, got %q", val)
+			}
+			spec.Per = val
+		case "-rate":
+			perSec, err := parseRate(val)
+			if err != nil {
+				return nil, err
+			}
+			spec.Rate = val
+			spec.PerSec = perSec
+		case "-burst":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("-burst expects positive integer, got %q", val)
+			}
+			spec.Burst = n
+		case "-key":
+			spec.KeyExpr = val
+		default:
+			return nil, fmt.Errorf("unknown option %q (must be -per, -rate, -burst, -key)", opt)
+		}
+	}
+	if spec.PerSec == 0 {
+		return nil, fmt.Errorf("missing -rate")
+	}
+	if spec.Burst == 0 {
+		spec.Burst = int(math.Max(1, math.Ceil(spec.PerSec)))
+	}
+	return spec, nil
+}
+
+// parseRate parses "N/s", "N/m", "N/h", "N/d" or "N/DURATION" into tokens per second
+func parseRate(s string) (float64, error) {
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q (expected N/s, N/m, N/h or N/DURATION)", s)
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	var window time.Duration
+	switch per {
+	case "s":
+		window = time.Second
+	case "m":
+		window = time.Minute
+	case "h":
+		window = time.Hour
+	case "d":
+		window = 24 * time.Hour
+	default:
+		window, err = time.ParseDuration(per)
+		if err != nil || window <= 0 {
+			return 0, fmt.Errorf("invalid rate %q", s)
+		}
+	}
+	return n / window.Seconds(), nil
+}
+
+// String renders the spec back into command options
+func (s *RateLimitSpec) String() string {
+	str := fmt.Sprintf("-per %s -rate %s -burst %d", s.Per, s.Rate, s.Burst)
+	if s.KeyExpr != "" {
+		str += fmt.Sprintf(" -key {%s}", s.KeyExpr)
+	}
+	return str
+}
+
+// tokenBucket holds the state for one key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets for every key of one spec
+type rateLimiter struct {
+	spec    *RateLimitSpec
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(spec *RateLimitSpec) *rateLimiter {
+	return &rateLimiter{spec: spec, buckets: make(map[string]*tokenBucket)}
+}
+
+// rateDecision is the outcome of taking a token
+type rateDecision struct {
+	allowed   bool
+	limit     int
+	remaining int
+	reset     time.Duration // until the bucket is full again
+	retry     time.Duration // until the next token, when denied
+}
+
+// maxIdleBuckets triggers a sweep of full (idle) buckets, so one-off
+// clients don't accumulate forever
+const maxIdleBuckets = 10000
+
+// take removes a token from the bucket for key if one is available
+func (l *rateLimiter) take(key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(l.spec.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweepLocked(now)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.spec.PerSec)
+	b.last = now
+
+	d := rateDecision{limit: l.spec.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retry = time.Duration((1 - b.tokens) / l.spec.PerSec * float64(time.Second))
+	}
+	d.remaining = int(b.tokens)
+	d.reset = time.Duration((burst - b.tokens) / l.spec.PerSec * float64(time.Second))
+	return d
+}
+
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	burst := float64(l.spec.Burst)
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.spec.PerSec >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the remote address of the request without the port
+func clientIP(ctx *RequestContext) string {
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		return ctx.Request.RemoteAddr
+	}
+	return host
+}
+
+// bucketKey picks the bucket for a request; eval is used for -key
+func (l *rateLimiter) bucketKey(ctx *RequestContext, eval func(string) (string, error)) (string, error) {
+	if l.spec.KeyExpr != "" {
+		return eval(l.spec.KeyExpr)
+	}
+	if l.spec.Per == "global" {
+		return "", nil
+	}
+	return clientIP(ctx), nil
+}
+
+// apply queues the RateLimit-* headers on the response and, when the
+// request is denied, sends a 429. ctx.mu must not be held.
+func (d rateDecision) apply(ctx *RequestContext) {
+	ctx.Headers.Store("RateLimit-Limit", strconv.Itoa(d.limit))
+	ctx.Headers.Store("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	ctx.Headers.Store("RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.reset.Seconds()))))
+	if d.allowed {
+		return
+	}
+	ctx.Headers.Store("Retry-After", strconv.Itoa(int(math.Ceil(d.retry.Seconds()))))
+	ctx.Headers.Store("Content-Type", "text/plain; charset=utf-8")
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.Written {
+		return
+	}
+	ctx.Status = 429
+	ctx.writeHeader()
+	ctx.Writer.Write([]byte("rate limit exceeded\n"))
+}
+
+var (
+	filterLimitersMu sync.Mutex
+	filterLimiters   = make(map[string]*rateLimiter) // by spec string
+)
+
+func registerRateLimitCommand(fi *feather.Interp, state *ServerState) {
+	rateLimitCmd := &Command{
+		Name:  "ratelimit",
+		Help:  "Limit request rate with token buckets",
+		Usage: "ratelimit -rate N/UNIT ?-burst N? ?-per ip|global? ?-key SCRIPT?",
+		Long: `Take a token from the bucket for the current client. Called at the
+top of a route body it acts as a filter: when the bucket is empty it
+responds 429 with Retry-After and stops the handler. The same options can
+be given per route with route -ratelimit {...}.
+
+Every checked response carries RateLimit-Limit, RateLimit-Remaining and
+RateLimit-Reset headers.
+
+Options:
+  -rate N/UNIT  Refill rate, e.g. 10/s, 100/m, 5/30s
+  -burst N      Bucket size (default: one second of rate)
+  -per ip       One bucket per client IP (default)
+  -per global   One bucket shared by all clients
+  -key SCRIPT   Script whose result is the bucket key, e.g. {request header X-Api-Key}`,
+	}
+	registry.Register(rateLimitCmd)
+
+	// Use low-level registration so a denied request can stop the handler
+	// with a return code, like a filter
+	fi.Internal().Register("ratelimit", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			i.SetErrorString("ratelimit: not in request context")
+			return feather.ResultError
+		}
+		strArgs := make([]string, len(args))
+		for j, a := range args {
+			strArgs[j] = i.GetString(a)
+		}
+		spec, err := parseRateLimitSpec(strArgs)
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("ratelimit: %v", err))
+			return feather.ResultError
+		}
+
+		filterLimitersMu.Lock()
+		limiter, ok := filterLimiters[spec.String()]
+		if !ok {
+			limiter = newRateLimiter(spec)
+			filterLimiters[spec.String()] = limiter
+		}
+		filterLimitersMu.Unlock()
+
+		key, err := limiter.bucketKey(ctx, i.Eval)
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("ratelimit -key: %v", err))
+			return feather.ResultError
+		}
+		d := limiter.take(key)
+		d.apply(ctx)
+		if !d.allowed {
+			i.SetResultString("0")
+			return feather.ResultReturn
+		}
+		i.SetResultString(strconv.Itoa(d.remaining))
+		return feather.ResultOK
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/feather-lang/feather"
+)
+
+// logPanic reports a recovered panic with the stack of the goroutine that
+// raised it
+func logPanic(where string, v any) {
+	logf("panic in %s: %v\n%s", where, v, debug.Stack())
+}
+
+// callRecovered runs a Go command, turning a panic into a Tcl error. The
+// interpreter calls commands from C, which a panic can't unwind through,
+// so without this one bad call would take the whole process down.
+// onPanic, if set, is called after the stack is logged.
+func callRecovered(name string, fn feather.InternalCommandFunc, i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj, onPanic func()) (res feather.FeatherResult) {
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic(name, v)
+			if onPanic != nil {
+				onPanic()
+			}
+			i.SetErrorString(fmt.Sprintf("%s: internal error: %v", name, v))
+			res = feather.ResultError
+		}
+	}()
+	return fn(i, cmd, args)
+}
+
+// recoverHandler answers 500 instead of dropping the connection when
+// serving a request panics outside the interpreter
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logPanic(r.Method+" "+r.URL.Path, v)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlerFailed answers a request whose handler raised err. If the script
+// defines a proc named onerror, it is called with the message in the
+// request's context and can respond as it likes; otherwise, or if it
+// doesn't respond, the client gets 500 with the message, or a generic
+// page when a Go command panicked, so internals aren't shown.
+func (s *ServerState) handlerFailed(ctx *RequestContext, err error) {
+	if ctx.Written {
+		return
+	}
+	if res, e := s.EvalIn(ChannelRoute, "info procs onerror"); e == nil && res.String() != "" {
+		if _, e := s.EvalFor(ctx, "onerror "+tclQuote(err.Error())); e != nil {
+			logf("onerror %s %s: %v\n", ctx.Request.Method, ctx.Request.URL.Path, e)
+		}
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.Written {
+		return
+	}
+	msg := err.Error()
+	if ctx.panicked {
+		msg = "internal server error"
+	}
+	http.Error(ctx.Writer, msg, http.StatusInternalServerError)
+	ctx.Status = http.StatusInternalServerError
+	ctx.Written = true
+}
+
+// errEvalPanic is returned for a script whose evaluation panicked outside
+// any command
+var errEvalPanic = errors.New("internal error")
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// errRedisNil is returned by redisClient.Do for a nil bulk reply
+var errRedisNil = errors.New("redis: nil")
+
+// redisClient is a minimal RESP client over a single connection. Commands
+// are serialized; the connection is re-dialed after any I/O error.
+type redisClient struct {
+	addr    string
+	timeout time.Duration
+
+	// set from a redis:// URL; sent on every new connection
+	useTLS   bool
+	user     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisClient(addr string) *redisClient {
+	return &redisClient{addr: addr, timeout: 5 * time.Second}
+}
+
+// newRedisClientURL makes a client from redis://[[user]:password@]host[:port][/db],
+// or rediss:// for TLS
+func newRedisClientURL(raw string) (*redisClient, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("scheme must be redis or rediss, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	c := newRedisClient(net.JoinHostPort(u.Hostname(), port))
+	c.useTLS = u.Scheme == "rediss"
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			// redis://secret@host is a password with no user
+			c.user, c.password = "", c.user
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+		c.db = n
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply: string for simple and bulk
+// strings, int64 for integers, []any for arrays. Error replies are returned
+// as errors.
+func (c *redisClient) Do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	reply, err := c.roundTrip(args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) && err != errRedisNil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// dial connects and, for a client made from a URL, authenticates and
+// selects the database. Called with c.mu held.
+func (c *redisClient) dial() error {
+	conn, err := outboundDialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return err
+	}
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		cfg := &tls.Config{ServerName: host}
+		if h := getHostTLS(host); h != nil {
+			cfg.RootCAs, cfg.InsecureSkipVerify = h.roots, h.insecure
+		}
+		conn = tls.Client(conn, cfg)
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var setup [][]string
+	switch {
+	case c.user != "":
+		setup = append(setup, []string{"AUTH", c.user, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("redis %s: %w", strings.ToLower(args[0]), err)
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string) (any, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRESP(c.rd)
+}
+
+// Close drops the connection
+func (c *redisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func readRESP(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", body)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for j := range items {
+			item, err := readRESP(rd)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items[j] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+var (
+	redisHandlesMu sync.Mutex
+	redisHandles   = make(map[string]*redisClient)
+	redisNextID    int
+)
+
+func getRedisHandle(name string) (*redisClient, bool) {
+	redisHandlesMu.Lock()
+	defer redisHandlesMu.Unlock()
+	c, ok := redisHandles[name]
+	return c, ok
+}
+
+// redisReplyObj converts a reply from Do: integers stay integers, arrays
+// become lists and nil becomes the empty string
+func redisReplyObj(i *feather.Interp, reply any) *feather.Obj {
+	switch v := reply.(type) {
+	case int64:
+		return i.Int(v)
+	case string:
+		return i.String(v)
+	case []any:
+		items := make([]*feather.Obj, len(v))
+		for j, item := range v {
+			items[j] = redisReplyObj(i, item)
+		}
+		return i.List(items...)
+	}
+	return i.String("")
+}
+
+func registerRedisCommand(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "redis",
+		Help:  "Talk to a redis server",
+		Usage: "redis connect|cmd|get|set|incr|expire|publish|close ...",
+		Long: `Connect to redis and send it commands. redis connect returns a handle
+for the other subcommands; the URL is redis://[[USER]:PASSWORD@]HOST[:PORT][/DB],
+or rediss:// for TLS (certificate checks follow http tls). The password
+and database are sent again whenever the connection is re-established.
+
+redis cmd sends any command as is and returns the reply: integers as
+integers, arrays as lists, a nil reply as the empty string. An error
+reply from the server is an error. get, set, incr, expire and publish
+are shorthands for the commands scripts use most.
+
+Each handle has one connection and commands on it run one at a time.
+A call blocks the interpreter until the reply arrives, so keep -timeout
+short (default 5s).
+
+Example:
+  set cache [redis connect redis://:$::redisPassword@localhost:6379/1]
+  redis set $cache greeting hello -ttl 10m
+  redis get $cache greeting
+  redis cmd $cache HSET user:1 name alice
+  redis cmd $cache HGETALL user:1
+  redis publish $cache events "user:1 updated"`,
+		Subcommands: []*Command{
+			{Name: "connect", Help: "Open a handle to a redis server", Usage: "redis connect URL ?-timeout DURATION?"},
+			{Name: "cmd", Help: "Send a command and return its reply", Usage: "redis cmd HANDLE COMMAND ?ARG ...?"},
+			{Name: "get", Help: "Get a key, or DEFAULT when it is missing", Usage: "redis get HANDLE KEY ?DEFAULT?"},
+			{Name: "set", Help: "Set a key, optionally expiring", Usage: "redis set HANDLE KEY VALUE ?-ttl DURATION?"},
+			{Name: "incr", Help: "Add to a counter and return the new value", Usage: "redis incr HANDLE KEY ?BY?"},
+			{Name: "expire", Help: "Set a key's time to live", Usage: "redis expire HANDLE KEY DURATION"},
+			{Name: "publish", Help: "Publish a message and return the number of receivers", Usage: "redis publish HANDLE CHANNEL MESSAGE"},
+			{Name: "close", Help: "Close a handle", Usage: "redis close HANDLE"},
+		},
+	})
+
+	interp.RegisterCommand("redis", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 2 {
+			return feather.Error("wrong # args: should be \"redis subcommand ?arg ...?\"")
+		}
+		sub := args[0].String()
+		if sub == "connect" {
+			return redisConnect(i, args[1:])
+		}
+		name := args[1].String()
+		c, ok := getRedisHandle(name)
+		if !ok {
+			switch sub {
+			case "cmd", "get", "set", "incr", "expire", "publish", "close":
+				return feather.Errorf("redis %s: unknown handle %q", sub, name)
+			}
+			return feather.Errorf("redis: unknown subcommand %q (must be connect, cmd, get, set, incr, expire, publish, close)", sub)
+		}
+		rest := make([]string, len(args)-2)
+		for j, a := range args[2:] {
+			rest[j] = a.String()
+		}
+
+		var req []string
+		switch sub {
+		case "cmd":
+			if len(rest) == 0 {
+				return feather.Error("wrong # args: should be \"redis cmd handle command ?arg ...?\"")
+			}
+			req = rest
+		case "get":
+			if len(rest) != 1 && len(rest) != 2 {
+				return feather.Error("wrong # args: should be \"redis get handle key ?default?\"")
+			}
+			reply, err := c.Do("GET", rest[0])
+			if err == errRedisNil {
+				if len(rest) == 2 {
+					return feather.OK(rest[1])
+				}
+				return feather.OK("")
+			}
+			if err != nil {
+				return feather.Errorf("redis get: %v", err)
+			}
+			return feather.OK(redisReplyObj(i, reply))
+		case "set":
+			if len(rest) != 2 && len(rest) != 4 {
+				return feather.Error("wrong # args: should be \"redis set handle key value ?-ttl duration?\"")
+			}
+			req = []string{"SET", rest[0], rest[1]}
+			if len(rest) == 4 {
+				if rest[2] != "-ttl" {
+					return feather.Errorf("redis set: unknown option %q (must be -ttl)", rest[2])
+				}
+				d, err := time.ParseDuration(rest[3])
+				if err != nil || d < time.Millisecond {
+					return feather.Errorf("redis set: invalid ttl %q", rest[3])
+				}
+				req = append(req, "PX", strconv.FormatInt(d.Milliseconds(), 10))
+			}
+		case "incr":
+			if len(rest) != 1 && len(rest) != 2 {
+				return feather.Error("wrong # args: should be \"redis incr handle key ?by?\"")
+			}
+			req = []string{"INCR", rest[0]}
+			if len(rest) == 2 {
+				if _, err := strconv.ParseInt(rest[1], 10, 64); err != nil {
+					return feather.Errorf("redis incr: expected integer but got %q", rest[1])
+				}
+				req = []string{"INCRBY", rest[0], rest[1]}
+			}
+		case "expire":
+			if len(rest) != 2 {
+				return feather.Error("wrong # args: should be \"redis expire handle key duration\"")
+			}
+			d, err := time.ParseDuration(rest[1])
+			if err != nil || d < time.Millisecond {
+				return feather.Errorf("redis expire: invalid duration %q", rest[1])
+			}
+			req = []string{"PEXPIRE", rest[0], strconv.FormatInt(d.Milliseconds(), 10)}
+		case "publish":
+			if len(rest) != 2 {
+				return feather.Error("wrong # args: should be \"redis publish handle channel message\"")
+			}
+			req = []string{"PUBLISH", rest[0], rest[1]}
+		case "close":
+			if len(rest) != 0 {
+				return feather.Error("wrong # args: should be \"redis close handle\"")
+			}
+			redisHandlesMu.Lock()
+			delete(redisHandles, name)
+			redisHandlesMu.Unlock()
+			c.Close()
+			return feather.OK("")
+		default:
+			return feather.Errorf("redis: unknown subcommand %q (must be connect, cmd, get, set, incr, expire, publish, close)", sub)
+		}
+
+		reply, err := c.Do(req...)
+		if err != nil && err != errRedisNil {
+			return feather.Errorf("redis %s: %v", sub, err)
+		}
+		return feather.OK(redisReplyObj(i, reply))
+	})
+}
+
+func redisConnect(i *feather.Interp, args []*feather.Obj) feather.Result {
+	if len(args) != 1 && len(args) != 3 {
+		return feather.Error("wrong # args: should be \"redis connect url ?-timeout duration?\"")
+	}
+	c, err := newRedisClientURL(args[0].String())
+	if err != nil {
+		return feather.Errorf("redis connect: %v", err)
+	}
+	if len(args) == 3 {
+		if opt := args[1].String(); opt != "-timeout" {
+			return feather.Errorf("redis connect: unknown option %q (must be -timeout)", opt)
+		}
+		d, err := time.ParseDuration(args[2].String())
+		if err != nil || d <= 0 {
+			return feather.Errorf("redis connect: invalid timeout %q", args[2].String())
+		}
+		c.timeout = d
+	}
+	// connect now so a wrong address or password shows up here
+	if _, err := c.Do("PING"); err != nil {
+		return feather.Errorf("redis connect: %v", err)
+	}
+
+	redisHandlesMu.Lock()
+	redisNextID++
+	name := "redis" + strconv.Itoa(redisNextID)
+	redisHandles[name] = c
+	redisHandlesMu.Unlock()
+	return feather.OK(name)
+}
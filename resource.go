@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// resourceAction is one of the RESTful actions the resource command binds
+type resourceAction struct {
+	name    string
+	methods []string
+	member  bool // on /base/:id rather than /base
+}
+
+var resourceActions = []resourceAction{
+	{name: "index", methods: []string{"GET"}},
+	{name: "create", methods: []string{"POST"}},
+	{name: "show", methods: []string{"GET"}, member: true},
+	{name: "update", methods: []string{"PUT", "PATCH"}, member: true},
+	{name: "delete", methods: []string{"DELETE"}, member: true},
+}
+
+// resourceMethods are answered on both paths, with 405 when not handled
+var resourceMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+func registerResourceCommand(interp *feather.Interp, state *ServerState) {
+	resourceCmd := &Command{
+		Name:  "resource",
+		Help:  "Define RESTful routes bound to procs",
+		Usage: "resource PATH ?-handlers LIST? ?-namespace NS? ?-id NAME?",
+		Long: `Register the RESTful routes for PATH, each calling a proc in a
+namespace named after the last path segment:
+
+  index   GET    PATH        NS::index
+  create  POST   PATH        NS::create
+  show    GET    PATH/:id    NS::show ID
+  update  PUT    PATH/:id    NS::update ID   (PATCH too)
+  delete  DELETE PATH/:id    NS::delete ID
+
+Only the actions in -handlers (default: all five) are bound; the other
+methods on both paths answer 405 with an Allow header. Returns the list
+of routes defined.
+
+Example:
+  namespace eval users {
+      proc index {} { respond [json stringify ...] }
+      proc show {id} { ... }
+  }
+  resource /users -handlers {index show}`,
+	}
+	registry.Register(resourceCmd)
+	interp.RegisterCommand("resource", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 || len(args)%2 != 1 {
+			return feather.Error("wrong # args: should be \"resource path ?-handlers list? ?-namespace ns? ?-id name?\"")
+		}
+		base := "/" + strings.Trim(args[0].String(), "/")
+		ns := path.Base(base)
+		idParam := "id"
+		handlers := make(map[string]bool)
+		for _, a := range resourceActions {
+			handlers[a.name] = true
+		}
+
+		for j := 1; j < len(args); j += 2 {
+			val := args[j+1]
+			switch args[j].String() {
+			case "-handlers":
+				names, err := i.ParseList(val.String())
+				if err != nil {
+					return feather.Errorf("resource -handlers: %v", err)
+				}
+				handlers = make(map[string]bool)
+				for _, n := range names {
+					if !validResourceAction(n.String()) {
+						return feather.Errorf("resource -handlers: unknown action %q (must be index, show, create, update, delete)", n.String())
+					}
+					handlers[n.String()] = true
+				}
+			case "-namespace":
+				ns = strings.TrimPrefix(val.String(), "::")
+			case "-id":
+				idParam = val.String()
+			default:
+				return feather.Errorf("resource: unknown option %q (must be -handlers, -namespace, -id)", args[j].String())
+			}
+		}
+		if base == "/" && ns == "/" {
+			return feather.Error("resource: path must not be /, or give -namespace")
+		}
+
+		collection, member := base, base+"/:"+idParam
+		bodies := make(map[string]string) // "METHOD path" -> body
+		allowed := map[string][]string{collection: nil, member: nil}
+		for _, a := range resourceActions {
+			if !handlers[a.name] {
+				continue
+			}
+			p, body := collection, tclQuote(ns+"::"+a.name)
+			if a.member {
+				p, body = member, body+" [param "+tclQuote(idParam)+"]"
+			}
+			for _, m := range a.methods {
+				bodies[m+" "+p] = body
+				allowed[p] = append(allowed[p], m)
+			}
+		}
+
+		var defined []*feather.Obj
+		for _, p := range []string{collection, member} {
+			notAllowed := fmt.Sprintf("status 405; header Allow %s; respond \"method not allowed\\n\"",
+				tclQuote(strings.Join(allowed[p], ", ")))
+			for _, m := range resourceMethods {
+				body, ok := bodies[m+" "+p]
+				if !ok {
+					body = notAllowed
+				}
+				state.AddRoute(m, p, body, RouteOptions{})
+				defined = append(defined, i.List(i.String(m), i.String(p)))
+			}
+		}
+		return feather.OK(i.List(defined...))
+	})
+}
+
+func validResourceAction(name string) bool {
+	for _, a := range resourceActions {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Environment variables used to hand the listening socket to a restarted
+// process. The child finds the listener on fd 3 and reports readiness by
+// writing a byte to the pipe on fd 4 once its startup script has run. The
+// pipe closing without that byte means the child died first.
+const (
+	envListenFD   = "FEATHER_LISTEN_FD"
+	envListenAddr = "FEATHER_LISTEN_ADDR"
+	envReadyFD    = "FEATHER_READY_FD"
+)
+
+// restartReadyTimeout bounds how long the old process waits for its
+// replacement to start listening before giving up on the restart.
+const restartReadyTimeout = 30 * time.Second
+
+// inheritedListener returns the listener passed down by a parent process
+// for addr, or nil if there is none. It can only be claimed once.
+func inheritedListener(addr string) (net.Listener, error) {
+	if os.Getenv(envListenAddr) != addr {
+		return nil, nil
+	}
+	fd, err := strconv.Atoi(os.Getenv(envListenFD))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", envListenFD, err)
+	}
+	os.Unsetenv(envListenAddr)
+	os.Unsetenv(envListenFD)
+
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// signalReady tells the parent process, if any, that this process is
+// serving requests and the parent can start draining.
+func signalReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// Restart starts a new copy of this process that inherits the listening
+// socket. Once the child reports ready, held connections are closed and
+// this process drains and exits; until then both processes accept
+// requests, so none are dropped. If the child fails to come up, this
+// process keeps serving and reopens its REPL.
+func (s *ServerState) Restart() error {
+	if s.listener == nil {
+		return fmt.Errorf("not listening")
+	}
+	tcp, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("listener does not support handover")
+	}
+	lnFile, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyW.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyR.Close()
+		return err
+	}
+
+	// The REPL port isn't handed over, so release it for the child and
+	// take it back if the child doesn't come up
+	hadRepl := s.replListener != nil
+	if hadRepl {
+		s.replListener.Close()
+	}
+	reopenRepl := func() {
+		if hadRepl {
+			go runTelnetRepl(s)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	cmd.Env = append(os.Environ(),
+		envListenFD+"=3",
+		envListenAddr+"="+s.server.Addr,
+		envReadyFD+"=4",
+	)
+	if err := cmd.Start(); err != nil {
+		readyR.Close()
+		reopenRepl()
+		return err
+	}
+	logf("Restarting: started pid %d\n", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	go func() {
+		defer readyR.Close()
+		ready := make(chan bool, 1)
+		go func() {
+			// A child that exits before listening closes the pipe
+			// without writing, so only the byte counts as ready
+			var b [1]byte
+			n, err := readyR.Read(b[:])
+			ready <- n == 1 && err == nil
+		}()
+
+		select {
+		case ok := <-ready:
+			if !ok {
+				logf("Restart failed: new process closed the ready pipe without becoming ready\n")
+				cmd.Process.Kill()
+				<-exited
+				reopenRepl()
+				return
+			}
+		case err := <-exited:
+			logf("Restart failed: new process exited: %v\n", err)
+			reopenRepl()
+			return
+		case <-time.After(restartReadyTimeout):
+			logf("Restart failed: new process not ready after %s\n", restartReadyTimeout)
+			cmd.Process.Kill()
+			<-exited
+			reopenRepl()
+			return
+		}
+
+		logf("New process ready, draining...\n")
+		s.CloseAllConnections(s.Eval)
+		s.Drain(s.drainTimeout, false)
+	}()
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// routeHistoryDepth is how many previous versions are kept per route
+var routeHistoryDepth atomic.Int64
+
+// routeVersion is a replaced or removed route definition
+type routeVersion struct {
+	route   Route
+	removed bool // the route was absent in the version that followed
+	when    time.Time
+}
+
+func routeKey(method, pattern string) string {
+	return method + " " + pattern
+}
+
+// sameRoute reports whether two definitions are identical
+func sameRoute(a, b Route) bool {
+	return a.Body == b.Body && a.Options.args() == b.Options.args()
+}
+
+// recordRouteLocked saves old as the newest previous version of its
+// route. s.mu must be held.
+func (s *ServerState) recordRouteLocked(old Route, removed bool) {
+	depth := int(routeHistoryDepth.Load())
+	if depth == 0 {
+		return
+	}
+	if s.history == nil {
+		s.history = make(map[string][]routeVersion)
+	}
+	key := routeKey(old.Method, old.Pattern)
+	versions := append(s.history[key], routeVersion{route: old, removed: removed, when: time.Now()})
+	if len(versions) > depth {
+		versions = versions[len(versions)-depth:]
+	}
+	s.history[key] = versions
+}
+
+// recordSwapLocked records the versions replaced or removed when the
+// route table changes from old to new in one step. s.mu must be held.
+func (s *ServerState) recordSwapLocked(old, new []Route) {
+	next := make(map[string]Route, len(new))
+	for _, r := range new {
+		next[routeKey(r.Method, r.Pattern)] = r
+	}
+	for _, r := range old {
+		n, ok := next[routeKey(r.Method, r.Pattern)]
+		if !ok {
+			s.recordRouteLocked(r, true)
+		} else if !sameRoute(r, n) {
+			s.recordRouteLocked(r, false)
+		}
+	}
+}
+
+// RouteHistory returns the previous versions of a route, newest first
+func (s *ServerState) RouteHistory(method, pattern string) []routeVersion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := s.history[routeKey(method, pattern)]
+	out := make([]routeVersion, len(versions))
+	for k, v := range versions {
+		out[len(versions)-1-k] = v
+	}
+	return out
+}
+
+// RollbackRoute makes the version n steps back (n < 0) the live route.
+// The version being replaced is recorded, so a rollback can itself be
+// rolled back with -1.
+func (s *ServerState) RollbackRoute(method, pattern string, n int) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.staged != nil {
+		return Route{}, fmt.Errorf("can't roll back during a routes transaction")
+	}
+	if n >= 0 {
+		return Route{}, fmt.Errorf("version must be negative, e.g. -1 for the previous one, got %d", n)
+	}
+	key := routeKey(method, pattern)
+	versions := s.history[key]
+	if -n > len(versions) {
+		return Route{}, fmt.Errorf("only %d previous versions of %s %s", len(versions), method, pattern)
+	}
+	target := versions[len(versions)+n].route
+
+	current := -1
+	for k, r := range s.routes {
+		if r.Method == method && r.Pattern == pattern {
+			current = k
+			break
+		}
+	}
+	// Drop the restored version so history doesn't grow with duplicates,
+	// then record what it replaces
+	s.history[key] = append(versions[:len(versions)+n:len(versions)+n], versions[len(versions)+n+1:]...)
+	if current >= 0 {
+		s.recordRouteLocked(s.routes[current], false)
+		s.routes[current] = target
+	} else {
+		s.routes = append(s.routes, target)
+	}
+	s.publishRoutesLocked()
+	return target, nil
+}
+
+func registerRouteHistoryConfig() {
+	routeHistoryDepth.Store(10)
+	registerConfigKey(&ConfigKey{
+		Name:    "route_history",
+		Help:    "Previous versions kept per route for route history and route rollback (0 = none)",
+		Type:    ConfigInt,
+		Default: "10",
+		Get:     func() string { return strconv.FormatInt(routeHistoryDepth.Load(), 10) },
+		Set: func(value string) error {
+			n, _ := strconv.Atoi(value)
+			routeHistoryDepth.Store(int64(n))
+			return nil
+		},
+	})
+}
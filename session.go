@@ -0,0 +1,630 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// sessionStore persists session data by ID. Implementations must be safe
+// for concurrent use.
+type sessionStore interface {
+	Load(id string) (map[string]string, bool, error)
+	Save(id string, data map[string]string, ttl time.Duration) error
+	Delete(id string) error
+	Name() string
+}
+
+// memorySessionStore keeps sessions in process memory
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	data    map[string]string
+	expires time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession)}
+}
+
+func (m *memorySessionStore) Name() string { return "memory" }
+
+func (m *memorySessionStore) Load(id string) (map[string]string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(s.expires) {
+		delete(m.sessions, id)
+		return nil, false, nil
+	}
+	return copySessionData(s.data), true, nil
+}
+
+func (m *memorySessionStore) Save(id string, data map[string]string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if _, ok := m.sessions[id]; !ok && len(m.sessions)%1024 == 1023 {
+		for k, s := range m.sessions {
+			if now.After(s.expires) {
+				delete(m.sessions, k)
+			}
+		}
+	}
+	m.sessions[id] = memorySession{data: copySessionData(data), expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// fileSessionStore keeps one JSON file per session in a directory
+type fileSessionStore struct {
+	dir string
+}
+
+type fileSession struct {
+	Expires time.Time         `json:"expires"`
+	Data    map[string]string `json:"data"`
+}
+
+func (f *fileSessionStore) Name() string { return "file" }
+
+func (f *fileSessionStore) path(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+func (f *fileSessionStore) Load(id string) (map[string]string, bool, error) {
+	b, err := os.ReadFile(f.path(id))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var s fileSession
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, false, err
+	}
+	if time.Now().After(s.Expires) {
+		os.Remove(f.path(id))
+		return nil, false, nil
+	}
+	return s.Data, true, nil
+}
+
+func (f *fileSessionStore) Save(id string, data map[string]string, ttl time.Duration) error {
+	b, err := json.Marshal(fileSession{Expires: time.Now().Add(ttl), Data: data})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+	tmp := f.path(id) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(id))
+}
+
+func (f *fileSessionStore) Delete(id string) error {
+	err := os.Remove(f.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// redisSessionStore keeps sessions as JSON strings with a redis expiry
+type redisSessionStore struct {
+	client *redisClient
+	prefix string
+}
+
+func (r *redisSessionStore) Name() string { return "redis" }
+
+func (r *redisSessionStore) Load(id string) (map[string]string, bool, error) {
+	reply, err := r.client.Do("GET", r.prefix+id)
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var data map[string]string
+	if err := json.Unmarshal([]byte(reply.(string)), &data); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (r *redisSessionStore) Save(id string, data map[string]string, ttl time.Duration) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	ms := max(ttl.Milliseconds(), 1)
+	_, err = r.client.Do("SET", r.prefix+id, string(b), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (r *redisSessionStore) Delete(id string) error {
+	_, err := r.client.Do("DEL", r.prefix+id)
+	return err
+}
+
+func copySessionData(data map[string]string) map[string]string {
+	c := make(map[string]string, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+	return c
+}
+
+// sessionManager ties a store to the signed session cookie
+type sessionManager struct {
+	mu     sync.RWMutex
+	store  sessionStore
+	ttl    time.Duration
+	cookie string
+	secret []byte
+}
+
+func newSessionManager() *sessionManager {
+	// A random secret means sessions don't survive a restart; scripts that
+	// need that must configure -secret
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &sessionManager{
+		store:  newMemorySessionStore(),
+		ttl:    24 * time.Hour,
+		cookie: "feather_session",
+		secret: secret,
+	}
+}
+
+// Session keys used by session csrf and session flash
+const (
+	sessionCSRFKey  = "_csrf"
+	sessionFlashKey = "_flash"
+)
+
+// requestSession is the session state cached on a request context
+type requestSession struct {
+	id     string
+	data   map[string]string
+	loaded bool
+
+	flashes []flashMessage // taken from the session by this request
+	taken   bool
+}
+
+// flashMessage is one message queued for the next page a client sees
+type flashMessage struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+func (m *sessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session ID from a cookie value if its signature is valid
+func (m *sessionManager) verify(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(m.sign(id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+// load returns the session for a request, reading the cookie and store on
+// first use. Only the interpreter goroutine touches ctx.session.
+func (m *sessionManager) load(ctx *RequestContext) (*requestSession, error) {
+	if ctx.session != nil && ctx.session.loaded {
+		return ctx.session, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sess := &requestSession{loaded: true}
+	if c, err := ctx.Request.Cookie(m.cookie); err == nil {
+		if id, ok := m.verify(c.Value); ok {
+			data, found, err := m.store.Load(id)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				sess.id = id
+				sess.data = data
+			}
+		}
+	}
+	ctx.session = sess
+	return sess, nil
+}
+
+// save writes the session to the store, creating it and setting the cookie
+// if this request started it
+func (m *sessionManager) save(ctx *RequestContext, sess *requestSession) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if sess.id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		sess.id = hex.EncodeToString(b)
+		m.setCookie(ctx, m.sign(sess.id), int(m.ttl.Seconds()))
+	}
+	return m.store.Save(sess.id, sess.data, m.ttl)
+}
+
+func (m *sessionManager) destroy(ctx *RequestContext, sess *requestSession) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if sess.id == "" {
+		return nil
+	}
+	err := m.store.Delete(sess.id)
+	m.setCookie(ctx, "", -1)
+	sess.id = ""
+	sess.data = nil
+	return err
+}
+
+// csrfToken returns the session's CSRF token, starting the session and
+// the token if there are none yet
+func (m *sessionManager) csrfToken(ctx *RequestContext) (string, error) {
+	sess, err := m.load(ctx)
+	if err != nil {
+		return "", err
+	}
+	if tok := sess.data[sessionCSRFKey]; tok != "" {
+		return tok, nil
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	tok := base64.RawURLEncoding.EncodeToString(b)
+	if sess.data == nil {
+		sess.data = make(map[string]string)
+	}
+	sess.data[sessionCSRFKey] = tok
+	return tok, m.save(ctx, sess)
+}
+
+// checkCSRF reports whether token matches the session's CSRF token. A
+// request without a session never matches.
+func (m *sessionManager) checkCSRF(ctx *RequestContext, token string) (bool, error) {
+	sess, err := m.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	want := sess.data[sessionCSRFKey]
+	return want != "" && hmac.Equal([]byte(want), []byte(token)), nil
+}
+
+// addFlash queues a message for the next page rendered for this client
+func (m *sessionManager) addFlash(ctx *RequestContext, category, message string) error {
+	sess, err := m.load(ctx)
+	if err != nil {
+		return err
+	}
+	var queued []flashMessage
+	json.Unmarshal([]byte(sess.data[sessionFlashKey]), &queued)
+	data, _ := json.Marshal(append(queued, flashMessage{Category: category, Message: message}))
+	if sess.data == nil {
+		sess.data = make(map[string]string)
+	}
+	sess.data[sessionFlashKey] = string(data)
+	return m.save(ctx, sess)
+}
+
+// takeFlashes removes the queued messages from the session. Later calls
+// in the same request return the same messages.
+func (m *sessionManager) takeFlashes(ctx *RequestContext) ([]flashMessage, error) {
+	sess, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sess.taken {
+		return sess.flashes, nil
+	}
+	sess.taken = true
+	data, ok := sess.data[sessionFlashKey]
+	if !ok {
+		return nil, nil
+	}
+	json.Unmarshal([]byte(data), &sess.flashes)
+	delete(sess.data, sessionFlashKey)
+	return sess.flashes, m.save(ctx, sess)
+}
+
+// setCookie adds a Set-Cookie header; it is dropped if the response has
+// already started
+func (m *sessionManager) setCookie(ctx *RequestContext, value string, maxAge int) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.Written {
+		return
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     m.cookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   ctx.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// configure applies session configure options
+func (m *sessionManager) configure(args []string) error {
+	if len(args)%2 != 0 {
+		return fmt.Errorf("missing value for %s", args[len(args)-1])
+	}
+	storeName, dir, addr := "", "sessions", "127.0.0.1:6379"
+	ttl, cookie, secret := m.ttl, m.cookie, m.secret
+	for j := 0; j < len(args); j += 2 {
+		opt, val := args[j], args[j+1]
+		switch opt {
+		case "-store":
+			if val != "memory" && val != "file" && val != "redis" {
+				return fmt.Errorf("-store must be memory, file or redis, got %q", val)
+			}
+			storeName = val
+		case "-dir":
+			dir = val
+		case "-addr":
+			addr = val
+		case "-ttl":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("-ttl expects positive duration, got %q", val)
+			}
+			ttl = d
+		case "-cookie":
+			if val == "" {
+				return fmt.Errorf("-cookie must not be empty")
+			}
+			cookie = val
+		case "-secret":
+			if len(val) < 16 {
+				return fmt.Errorf("-secret must be at least 16 bytes")
+			}
+			secret = []byte(val)
+		default:
+			return fmt.Errorf("unknown option %q (must be -store, -dir, -addr, -ttl, -cookie, -secret)", opt)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch storeName {
+	case "memory":
+		m.store = newMemorySessionStore()
+	case "file":
+		m.store = &fileSessionStore{dir: dir}
+	case "redis":
+		m.store = &redisSessionStore{client: newRedisClient(addr), prefix: "session:"}
+	}
+	m.ttl, m.cookie, m.secret = ttl, cookie, secret
+	return nil
+}
+
+func (m *sessionManager) describe(i *feather.Interp) *feather.Obj {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return i.DictKV("store", m.store.Name(), "ttl", m.ttl.String(), "cookie", m.cookie)
+}
+
+func registerSessionCommand(interp *feather.Interp, state *ServerState) {
+	sessionCmd := &Command{
+		Name:  "session",
+		Help:  "Per-client session data",
+		Usage: "session SUBCOMMAND ?ARG ...?",
+		Long: `Sessions are identified by an HMAC-signed cookie and stored in memory
+(the default), as files, or in redis. A session is created the first time
+a route calls session set. Without -secret a random key is used, so
+sessions are lost on restart.
+
+session csrf returns a random token tied to the session, for hidden form
+fields and X-CSRF-Token headers; templates get it as {{.ctx.csrf}}.
+session csrf verify checks a token, by default the X-CSRF-Token header or
+else the csrf_token field of the submitted form.
+
+session flash queues a message (category info unless given) for the next
+page the client sees. session flashes returns the queued messages as a
+list of dicts with category and message and clears them; every template
+render does the same into {{.ctx.flash}}.
+
+Example:
+  session configure -store file -dir /var/lib/app/sessions -ttl 12h -secret $key
+  route POST /login {
+      session set user [query user]
+      session flash "Signed in" success
+      redirect /
+  }
+  route POST /settings {
+      if {![session csrf verify]} { status 403; respond "bad token"; return }
+      ...
+  }`,
+		Subcommands: []*Command{
+			{Name: "get", Help: "Get a session value", Usage: "session get KEY ?DEFAULT?"},
+			{Name: "set", Help: "Set a session value", Usage: "session set KEY VALUE"},
+			{Name: "unset", Help: "Remove a session value", Usage: "session unset KEY"},
+			{Name: "exists", Help: "Check whether a key is set", Usage: "session exists KEY"},
+			{Name: "id", Help: "Get the session ID, empty if none", Usage: "session id"},
+			{Name: "destroy", Help: "Delete the session and its cookie", Usage: "session destroy"},
+			{Name: "csrf", Help: "Get the CSRF token, or verify one", Usage: "session csrf ?verify ?TOKEN??"},
+			{Name: "flash", Help: "Queue a message for the next page", Usage: "session flash MESSAGE ?CATEGORY?"},
+			{Name: "flashes", Help: "Take the queued messages", Usage: "session flashes"},
+			{Name: "configure", Help: "Set store and cookie options", Usage: "session configure ?-store memory|file|redis? ?-dir DIR? ?-addr HOST:PORT? ?-ttl DURATION? ?-cookie NAME? ?-secret KEY?"},
+		},
+	}
+	registry.Register(sessionCmd)
+	interp.RegisterCommand("session", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"session subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		m := state.sessions
+
+		if subcmd == "configure" {
+			if len(args) == 1 {
+				return feather.OK(m.describe(i))
+			}
+			opts := make([]string, len(args)-1)
+			for j, a := range args[1:] {
+				opts[j] = a.String()
+			}
+			if err := m.configure(opts); err != nil {
+				return feather.Errorf("session configure: %v", err)
+			}
+			return feather.OK("")
+		}
+
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			return feather.Error("session: not in request context")
+		}
+		sess, err := m.load(ctx)
+		if err != nil {
+			return feather.Errorf("session %s: %v", subcmd, err)
+		}
+
+		switch subcmd {
+		case "get":
+			if len(args) != 2 && len(args) != 3 {
+				return feather.Error("wrong # args: should be \"session get key ?default?\"")
+			}
+			if v, ok := sess.data[args[1].String()]; ok {
+				return feather.OK(i.String(v))
+			}
+			if len(args) == 3 {
+				return feather.OK(args[2])
+			}
+			return feather.OK("")
+		case "exists":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"session exists key\"")
+			}
+			_, ok := sess.data[args[1].String()]
+			return feather.OK(ok)
+		case "set":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"session set key value\"")
+			}
+			if sess.data == nil {
+				sess.data = make(map[string]string)
+			}
+			sess.data[args[1].String()] = args[2].String()
+			if err := m.save(ctx, sess); err != nil {
+				return feather.Errorf("session set: %v", err)
+			}
+			return feather.OK(args[2])
+		case "unset":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"session unset key\"")
+			}
+			if _, ok := sess.data[args[1].String()]; !ok {
+				return feather.OK("")
+			}
+			delete(sess.data, args[1].String())
+			if err := m.save(ctx, sess); err != nil {
+				return feather.Errorf("session unset: %v", err)
+			}
+			return feather.OK("")
+		case "id":
+			return feather.OK(i.String(sess.id))
+		case "destroy":
+			if err := m.destroy(ctx, sess); err != nil {
+				return feather.Errorf("session destroy: %v", err)
+			}
+			return feather.OK("")
+		case "csrf":
+			if len(args) == 1 {
+				tok, err := m.csrfToken(ctx)
+				if err != nil {
+					return feather.Errorf("session csrf: %v", err)
+				}
+				return feather.OK(i.String(tok))
+			}
+			if args[1].String() != "verify" || len(args) > 3 {
+				return feather.Error("wrong # args: should be \"session csrf ?verify ?token??\"")
+			}
+			var token string
+			if len(args) == 3 {
+				token = args[2].String()
+			} else if token = ctx.Request.Header.Get("X-CSRF-Token"); token == "" {
+				fields, err := formFields(ctx)
+				if err != nil {
+					return feather.Errorf("session csrf verify: %v", err)
+				}
+				token = fields["csrf_token"]
+			}
+			ok, err := m.checkCSRF(ctx, token)
+			if err != nil {
+				return feather.Errorf("session csrf verify: %v", err)
+			}
+			return feather.OK(ok)
+		case "flash":
+			if len(args) != 2 && len(args) != 3 {
+				return feather.Error("wrong # args: should be \"session flash message ?category?\"")
+			}
+			category := "info"
+			if len(args) == 3 {
+				category = args[2].String()
+			}
+			if err := m.addFlash(ctx, category, args[1].String()); err != nil {
+				return feather.Errorf("session flash: %v", err)
+			}
+			return feather.OK("")
+		case "flashes":
+			if len(args) != 1 {
+				return feather.Error("wrong # args: should be \"session flashes\"")
+			}
+			flashes, err := m.takeFlashes(ctx)
+			if err != nil {
+				return feather.Errorf("session flashes: %v", err)
+			}
+			items := make([]*feather.Obj, len(flashes))
+			for k, f := range flashes {
+				items[k] = i.DictKV("category", f.Category, "message", f.Message)
+			}
+			return feather.OK(i.List(items...))
+		default:
+			return feather.Errorf("session: unknown subcommand %q (must be get, set, unset, exists, id, destroy, csrf, flash, flashes, configure)", subcmd)
+		}
+	})
+}
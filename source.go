@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// sourceFetchTimeout bounds fetching a remote script
+const sourceFetchTimeout = 30 * time.Second
+
+// sourceMaxSize bounds the size of a remote script
+const sourceMaxSize = 8 << 20
+
+func isRemoteSource(p string) bool {
+	return strings.HasPrefix(p, "https://") || strings.HasPrefix(p, "http://")
+}
+
+// fetchSource downloads a remote script
+func fetchSource(url string) ([]byte, error) {
+	resp, err := outboundClient(sourceFetchTimeout).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, sourceMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > sourceMaxSize {
+		return nil, fmt.Errorf("GET %s: script larger than %d bytes", url, sourceMaxSize)
+	}
+	return data, nil
+}
+
+// checkSourceHash reports an error unless data hashes to want (hex sha256).
+// An empty want accepts anything.
+func checkSourceHash(data []byte, want string) error {
+	if want == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("sha256 mismatch: got %s, want %s", got, want)
+	}
+	return nil
+}
+
+// loadRemoteSource fetches url, using the cache directory when given. A
+// cached copy that matches the pinned hash is used without fetching; without
+// a pin the cache is only a fallback for when the fetch fails.
+func loadRemoteSource(url, hash, cacheDir string) ([]byte, error) {
+	var cached string
+	if cacheDir != "" {
+		key := sha256.Sum256([]byte(url))
+		cached = filepath.Join(cacheDir, hex.EncodeToString(key[:16])+".tcl")
+		if hash != "" {
+			if data, err := os.ReadFile(cached); err == nil && checkSourceHash(data, hash) == nil {
+				return data, nil
+			}
+		}
+	}
+
+	data, err := fetchSource(url)
+	if err == nil {
+		err = checkSourceHash(data, hash)
+	}
+	if err != nil {
+		if cached != "" && hash == "" {
+			if data, cacheErr := os.ReadFile(cached); cacheErr == nil {
+				logf("source %s: %v (using cached copy)\n", url, err)
+				return data, nil
+			}
+		}
+		return nil, err
+	}
+
+	if cached != "" {
+		if err := os.MkdirAll(cacheDir, 0o755); err == nil {
+			if os.WriteFile(cached+".tmp", data, 0o644) == nil {
+				os.Rename(cached+".tmp", cached)
+			}
+		}
+	}
+	return data, nil
+}
+
+func registerSourceCommand(interp *feather.Interp, state *ServerState) {
+	sourceCmd := &Command{
+		Name:  "source",
+		Help:  "Evaluate a script from a file or URL",
+		Usage: "source PATH|URL ?-sha256 HASH? ?-cache DIR?",
+		Long: `Evaluate the script at PATH (a file or embed:// path) or at an http(s) URL.
+The result is the result of the script's last command.
+
+-sha256 pins the script's content: if it doesn't hash to HASH (hex), it is
+not evaluated and source fails. Plain http:// URLs require a pin.
+
+-cache keeps a copy of remote scripts in DIR. With a pin, a matching cached
+copy is used without fetching, so restarts don't depend on the remote
+server. Without one, the script is fetched every time and the cached copy
+is only used when the fetch fails.
+
+Remote scripts are fetched through the outbound settings (see config).
+Fetching blocks the interpreter, so source remote scripts at startup.
+
+Example:
+  source https://tools.example.com/lib/auth.tcl \
+      -sha256 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 \
+      -cache ./.cache/source`,
+	}
+	registry.Register(sourceCmd)
+	interp.RegisterCommand("source", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 || len(args)%2 != 1 {
+			return feather.Error("wrong # args: should be \"source path ?-sha256 hash? ?-cache dir?\"")
+		}
+		target := args[0].String()
+		var hash, cacheDir string
+		for j := 1; j < len(args); j += 2 {
+			val := args[j+1].String()
+			switch args[j].String() {
+			case "-sha256":
+				hash = strings.ToLower(val)
+				if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+					return feather.Errorf("source: invalid -sha256 %q (expected 64 hex digits)", val)
+				}
+			case "-cache":
+				cacheDir = val
+			default:
+				return feather.Errorf("source: unknown option %q (must be -sha256, -cache)", args[j].String())
+			}
+		}
+
+		var script []byte
+		var err error
+		if isRemoteSource(target) {
+			if strings.HasPrefix(target, "http://") && hash == "" {
+				return feather.Errorf("source: %s: plain http needs -sha256", target)
+			}
+			script, err = loadRemoteSource(target, hash, cacheDir)
+		} else {
+			script, err = readPath(target)
+			if err == nil {
+				err = checkSourceHash(script, hash)
+			}
+		}
+		if err != nil {
+			return feather.Errorf("source: %s: %v", target, err)
+		}
+
+		res, err := i.Eval(string(script))
+		if err != nil {
+			return feather.Error(err.Error())
+		}
+		return feather.OK(res)
+	})
+}
@@ -0,0 +1,40 @@
+# __APP__: a JSON API
+
+set notes [dict create]
+set nextID 1
+
+route GET /api/notes {
+    header Content-Type application/json
+    set items {}
+    dict for {id text} $::notes {
+        lappend items [json [dict create id $id text $text] -as {number id string text}]
+    }
+    respond "\[[join $items ,]\]"
+}
+
+route POST /api/notes {
+    global notes nextID
+    form bind note {text {string required}}
+    set id $nextID
+    incr nextID
+    dict set notes $id [dict get $note text]
+    header Content-Type application/json
+    status 201
+    respond [json [dict create id $id text [dict get $note text]] -as {number id string text}]
+}
+
+route GET /api/notes/:id {
+    header Content-Type application/json
+    if {![dict exists $::notes [param id]]} {
+        status 404
+        respond {{"error": "not found"}}
+        return
+    }
+    respond [json [dict create id [param id] text [dict get $::notes [param id]]] -as {number id string text}]
+}
+
+route GET /health {
+    respond ok
+}
+
+listen 8080
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Smoke tests: start the app, check its routes, stop it.
+# Run from the project directory: ./tests/smoke.sh
+. "$(dirname "$0")/lib.sh"
+
+check GET  /health          200 "ok"
+check GET  /api/notes       200 "[]"
+check POST /api/notes       201 '"text":"hello"' -d text=hello
+check GET  /api/notes/1     200 '"id":1'
+check GET  /api/notes/99    404 "not found"
+
+finish
@@ -0,0 +1,46 @@
+# Helpers for the smoke tests. Sourcing this starts the app in the
+# background on port 8080; finish stops it and sets the exit status.
+#
+# FEATHER_HTTPD selects the binary (default: feather-httpd on PATH).
+
+cd "$(dirname "$0")/.." || exit 1
+
+BASE=${BASE:-http://localhost:8080}
+BIN=${FEATHER_HTTPD:-feather-httpd}
+FAILED=0
+PASSED=0
+
+"$BIN" -f feather-httpd.tcl -no-repl >tests/server.log 2>&1 &
+SERVER=$!
+trap 'kill $SERVER 2>/dev/null' EXIT
+
+# Wait for the server to accept connections
+for _ in 1 2 3 4 5 6 7 8 9 10; do
+    curl -s -o /dev/null "$BASE/" && break
+    sleep 0.3
+done
+
+# check METHOD PATH STATUS ?SUBSTRING? ?CURL ARGS...?
+check() {
+    method=$1 path=$2 want=$3 expect=${4:-}
+    [ $# -ge 4 ] && shift 4 || shift $#
+    body=$(curl -s -X "$method" -w '\n%{http_code}' "$@" "$BASE$path")
+    got=$(printf '%s\n' "$body" | tail -n 1)
+    body=$(printf '%s\n' "$body" | sed '$d')
+    if [ "$got" != "$want" ]; then
+        echo "FAIL $method $path: status $got, want $want"
+        FAILED=$((FAILED + 1))
+    elif [ -n "$expect" ] && ! printf '%s' "$body" | grep -qF -- "$expect"; then
+        echo "FAIL $method $path: body doesn't contain $expect"
+        FAILED=$((FAILED + 1))
+    else
+        echo "ok   $method $path"
+        PASSED=$((PASSED + 1))
+    fi
+}
+
+finish() {
+    echo "$PASSED passed, $FAILED failed"
+    [ "$FAILED" -eq 0 ]
+    exit $?
+}
@@ -0,0 +1,19 @@
+# __APP__: a small server-rendered site
+
+template loaddir templates
+template globals set site "__APP__"
+static /assets ./public -cache 1h
+
+route GET / {
+    template respond home -layout layout title Home
+}
+
+route GET /about {
+    template respond about -layout layout title About
+}
+
+route GET /health {
+    respond ok
+}
+
+listen 8080
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Smoke tests: start the app, check its routes, stop it.
+# Run from the project directory: ./tests/smoke.sh
+. "$(dirname "$0")/lib.sh"
+
+check GET /        200 "Welcome to __APP__"
+check GET /about   200 "About"
+check GET /health  200 "ok"
+check GET /assets/style.css 200 "font-family"
+check GET /missing 404
+
+finish
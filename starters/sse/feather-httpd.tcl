@@ -0,0 +1,45 @@
+# __APP__: live updates with server-sent events
+
+template loaddir templates
+
+set clients {}
+
+proc broadcast {event data} {
+    foreach c $::clients {
+        respond -to $c "event: $event\ndata: $data\n\n"
+        flush -to $c
+    }
+}
+
+proc dropClient {c} {
+    set i [lsearch -exact $::clients $c]
+    if {$i >= 0} {
+        set ::clients [lreplace $::clients $i $i]
+    }
+}
+
+route GET / {
+    template respond index
+}
+
+route GET /events {
+    header Content-Type text/event-stream
+    header Cache-Control no-cache
+    respond ": connected\n\n"
+    flush
+    set c [connection hold]
+    connection onclose $c dropClient
+    lappend ::clients $c
+}
+
+route POST /publish {
+    form bind msg {text {string required}}
+    broadcast message [dict get $msg text]
+    respond sent
+}
+
+route GET /health {
+    respond ok
+}
+
+listen 8080
@@ -0,0 +1,10 @@
+#!/bin/sh
+# Smoke tests: start the app, check its routes, stop it.
+# Run from the project directory: ./tests/smoke.sh
+. "$(dirname "$0")/lib.sh"
+
+check GET  /        200 "EventSource"
+check GET  /health  200 "ok"
+check POST /publish 200 "sent" -d text=hello
+
+finish
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/feather-lang/feather"
@@ -18,26 +23,280 @@ type Route struct {
 	Pattern string
 	Params  []string // parameter names extracted from pattern
 	Body    string   // TCL script to execute
+	Options RouteOptions
+	limiter *concurrencyLimiter // per-route concurrency limit, nil if unlimited
+	rate    *rateLimiter        // per-route rate limit, nil if none
+}
+
+// RouteOptions holds the optional per-route settings given as leading
+// -flags to the route command
+type RouteOptions struct {
+	MaxConcurrent int            // 0 = unlimited
+	RateLimit     *RateLimitSpec // nil = no rate limit
+	Auth          *AuthSpec      // nil = no authentication
+	ActiveFrom    time.Time      // route matches from this time on; zero = always
+	ActiveUntil   time.Time      // route stops matching at this time; zero = never
+	Timeout       time.Duration  // how long the handler may run; zero = handler_timeout
+}
+
+// args renders the options back into route command flags
+func (o RouteOptions) args() string {
+	var parts []string
+	if o.MaxConcurrent > 0 {
+		parts = append(parts, fmt.Sprintf("-maxconcurrent %d", o.MaxConcurrent))
+	}
+	if o.RateLimit != nil {
+		parts = append(parts, fmt.Sprintf("-ratelimit {%s}", o.RateLimit))
+	}
+	if o.Auth != nil {
+		parts = append(parts, fmt.Sprintf("-auth {%s}", o.Auth))
+	}
+	if !o.ActiveFrom.IsZero() {
+		parts = append(parts, "-active-from "+o.ActiveFrom.Format(time.RFC3339))
+	}
+	if !o.ActiveUntil.IsZero() {
+		parts = append(parts, "-active-until "+o.ActiveUntil.Format(time.RFC3339))
+	}
+	if o.Timeout > 0 {
+		parts = append(parts, "-timeout "+o.Timeout.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// activeAt reports whether the route's activation window includes t
+func (o RouteOptions) activeAt(t time.Time) bool {
+	if !o.ActiveFrom.IsZero() && t.Before(o.ActiveFrom) {
+		return false
+	}
+	return o.ActiveUntil.IsZero() || t.Before(o.ActiveUntil)
+}
+
+// parseActiveTime parses a route activation time: RFC 3339 with or
+// without seconds, or a date (midnight UTC)
+func parseActiveTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (expected e.g. 2025-01-01T00:00Z or 2025-01-01)", s)
 }
 
 type RequestContext struct {
-	mu      sync.Mutex
-	Writer  http.ResponseWriter
-	Request *http.Request
-	Params  map[string]string
-	Status  int
-	Headers sync.Map // string -> string
-	Written bool
+	mu       sync.Mutex
+	Writer   http.ResponseWriter
+	Request  *http.Request
+	Params   map[string]string
+	Status   int
+	Headers  sync.Map // string -> string
+	Written  bool
+	session  *requestSession // loaded on first use by the session command
+	capture  *requestCapture // non-nil when this request is being debug captured
+	panicked bool            // a Go command panicked while handling the request
+	held     bool            // a connection was held, which may outlive the handler
+	authUser string          // set by auth basic once the user is authenticated
+	body     []byte          // request body once read, see readBody
+	bodyRead bool
+	ics      *icsFeed // calendar built by the ics command
+	boundary string   // multipart/x-mixed-replace boundary, see stream multipart
+	tmpdir   string   // created by request tmpdir, removed when the request ends
+	closers  []func() // run when the request ends, see wrapWriter and tempDir
+	finished bool     // the handler has returned; the writer must not be used
+	deferred []string // scripts to run once the response is done, see defer
+	// deadline bounds the request and everything it calls downstream; zero
+	// means none. Set by request deadline.
+	deadline time.Time
+	// timedOut is the handler timeout once it has passed; see expire
+	timedOut atomic.Int64
+}
+
+// requestContexts recycles the contexts of route requests
+var requestContexts = sync.Pool{New: func() any { return new(RequestContext) }}
+
+// newRequestContext returns a context for a route request, from the pool
+func newRequestContext(w http.ResponseWriter, r *http.Request, params map[string]string) *RequestContext {
+	ctx := requestContexts.Get().(*RequestContext)
+	ctx.Writer, ctx.Request, ctx.Params, ctx.Status = w, r, params, 200
+	return ctx
+}
+
+// release clears ctx and returns it to the pool. Only call it once nothing
+// can refer to ctx anymore: the handler has returned, no connection was
+// held for it and no handler timeout is pending.
+func (ctx *RequestContext) release() {
+	*ctx = RequestContext{}
+	requestContexts.Put(ctx)
+}
+
+// writeHeader sends the status code and queued headers unless they have
+// already been sent. ctx.mu must be held.
+func (ctx *RequestContext) writeHeader() {
+	if ctx.Written {
+		return
+	}
+	ctx.copyHeaders()
+	if ctx.Status != 0 {
+		ctx.Writer.WriteHeader(ctx.Status)
+	}
+	ctx.Written = true
+}
+
+// copyHeaders sets the queued headers on the response writer without
+// sending them. ctx.mu must be held.
+func (ctx *RequestContext) copyHeaders() {
+	ctx.Headers.Range(func(k, v any) bool {
+		ctx.Writer.Header().Set(k.(string), v.(string))
+		return true
+	})
+}
+
+// wrapWriter replaces the response writer with w, which wraps the
+// current one. close is called when the request finishes, innermost
+// wrapper first, so buffered output reaches the client in order.
+func (ctx *RequestContext) wrapWriter(w http.ResponseWriter, close func()) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.Writer = w
+	ctx.closers = append(ctx.closers, close)
+}
+
+// finishWriters marks the request finished and closes the wrappers
+// installed with wrapWriter
+func (ctx *RequestContext) finishWriters() {
+	ctx.mu.Lock()
+	closers := ctx.closers
+	ctx.closers = nil
+	ctx.finished = true
+	ctx.mu.Unlock()
+	for k := len(closers) - 1; k >= 0; k-- {
+		closers[k]()
+	}
+}
+
+// tempDir returns the request's temporary directory, creating it on first
+// use. It is removed with everything in it when the request ends, after
+// any held connection is closed.
+func (ctx *RequestContext) tempDir() (string, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.tmpdir != "" {
+		return ctx.tmpdir, nil
+	}
+	dir, err := os.MkdirTemp("", "feather-request-")
+	if err != nil {
+		return "", err
+	}
+	ctx.tmpdir = dir
+	ctx.closers = append(ctx.closers, func() { os.RemoveAll(dir) })
+	return dir, nil
+}
+
+// setDeadline sets the request deadline. A deadline can only be moved
+// earlier, so nested code can't extend the budget its caller gave it.
+func (ctx *RequestContext) setDeadline(t time.Time) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.deadline.IsZero() || t.Before(ctx.deadline) {
+		ctx.deadline = t
+	}
+}
+
+// getDeadline returns the request deadline, if any. A deadline on the
+// underlying request's context counts too.
+func (ctx *RequestContext) getDeadline() (time.Time, bool) {
+	ctx.mu.Lock()
+	deadline := ctx.deadline
+	ctx.mu.Unlock()
+	if d, ok := ctx.Request.Context().Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// remaining returns the time left before the deadline, never negative
+func (ctx *RequestContext) remaining() (time.Duration, bool) {
+	deadline, ok := ctx.getDeadline()
+	if !ok {
+		return 0, false
+	}
+	return max(time.Until(deadline), 0), true
+}
+
+// downstreamTimeout caps a timeout for outbound work (http client, database,
+// proxy calls) by the remaining request budget. A zero timeout means none
+// was configured. ctx may be nil outside a request.
+func (ctx *RequestContext) downstreamTimeout(timeout time.Duration) time.Duration {
+	if ctx == nil {
+		return timeout
+	}
+	left, ok := ctx.remaining()
+	if !ok {
+		return timeout
+	}
+	// An exhausted budget must still fail fast rather than mean "no timeout"
+	left = max(left, time.Millisecond)
+	if timeout == 0 || left < timeout {
+		return left
+	}
+	return timeout
 }
 
 // Connection represents a held HTTP connection for streaming
 type Connection struct {
-	ID        string
-	Name      string // optional user-provided name
-	Ctx       *RequestContext
-	Opened    time.Time
-	Done      chan struct{} // closed when connection should end
-	OnClose   string        // Feather proc to call when connection closes
+	ID      string
+	Name    string // optional user-provided name
+	Ctx     *RequestContext
+	Opened  time.Time
+	Done    chan struct{} // closed when connection should end
+	OnClose string        // Feather proc to call when connection closes
+	shaper  *connShaper   // paces writes when hold gave -max-rate or -max-bytes-per-sec
+	notify  chan string   // connection notify messages for connection wait
+
+	// UnixNano times of the last write of any kind and of the last one
+	// made by the script, for hold -keepalive and -idle-timeout
+	lastWrite  atomic.Int64
+	lastActive atomic.Int64
+}
+
+// touch records a write made by the script
+func (c *Connection) touch() {
+	now := time.Now().UnixNano()
+	c.lastWrite.Store(now)
+	c.lastActive.Store(now)
+}
+
+// send writes body to the held connection for the script
+func (c *Connection) send(body []byte) {
+	c.touch()
+	c.write(body)
+}
+
+// write writes body to the held connection and flushes it, paced when the
+// connection was held with a rate
+func (c *Connection) write(body []byte) {
+	c.lastWrite.Store(time.Now().UnixNano())
+	if c.shaper != nil {
+		c.shaper.send(body)
+		return
+	}
+	c.Ctx.mu.Lock()
+	defer c.Ctx.mu.Unlock()
+	if c.Ctx.finished {
+		return
+	}
+	c.Ctx.writeHeader()
+	c.Ctx.Writer.Write(body)
+	if f, ok := c.Ctx.Writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handle is the name scripts know the connection by
+func (c *Connection) handle() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ID
 }
 
 type EvalContext struct {
@@ -47,9 +306,22 @@ type EvalContext struct {
 // EvalRequest represents a request to evaluate code on the interpreter
 type EvalRequest struct {
 	Script   string
+	Channel  string          // where the script came from, for command policies
+	Ctx      *RequestContext // request the script runs for; nil outside requests
 	Response chan EvalResponse
+	Queued   time.Time // when EvalIn was called, for the queue wait histogram
 }
 
+// interpStats shows whether the single interpreter goroutine is the
+// bottleneck: time spent waiting for it versus time spent in it
+var interpStats = struct {
+	queueWait *histogram
+	waiting   atomic.Int64  // EvalIn callers not yet picked up
+	evals     atomic.Uint64 // scripts evaluated
+	evalNs    atomic.Int64  // total time spent evaluating
+	since     time.Time
+}{queueWait: newHistogram(queueWaitBuckets), since: time.Now()}
+
 // EvalResponse contains the result of an eval request
 type EvalResponse struct {
 	Result *feather.Obj
@@ -57,24 +329,52 @@ type EvalResponse struct {
 }
 
 type ServerState struct {
-	mu              sync.RWMutex
-	routes          []Route
-	server          *http.Server
-	shutdown        chan struct{}
-	reqCtx          *RequestContext    // current request context (per-request)
-	evalCtx         *EvalContext       // current eval context (for web REPL)
-	templates       *template.Template
-	templateSources sync.Map           // string -> string, raw template content
-	connections     sync.Map           // string -> *Connection, by ID or name
-	evalChan        chan EvalRequest   // channel for serializing interpreter access
+	mu               sync.RWMutex
+	routes           []Route                   // route table; writers hold mu and call publishRoutesLocked
+	liveRoutes       atomic.Pointer[[]Route]   // immutable copy of routes that requests read
+	staged           *[]Route                  // route table being built by routes transaction, nil outside one
+	history          map[string][]routeVersion // previous route versions by "METHOD PATTERN", oldest first
+	server           *http.Server
+	listener         net.Listener
+	replListener     net.Listener
+	conns            *connTracker
+	notebooks        *notebookStore
+	replSessions     sync.Map // string -> *replSession
+	acl              *commandACL
+	sessions         *sessionManager
+	pubsub           *pubsubBroker
+	groups           *connGroups
+	debug            *debugCapture
+	channel          string // channel of the script being evaluated; interpreter goroutine only
+	parked           int    // scripts parked in serveUntil; interpreter goroutine only
+	shutdown         chan struct{}
+	reqCtx           *RequestContext // request of the script being evaluated; interpreter goroutine only
+	evalCtx          *EvalContext    // current eval context (for web REPL)
+	templates        *template.Template
+	templateSources  sync.Map         // string -> string, raw template content
+	templateCache    sync.Map         // string -> *template.Template, by name or name+"\x00"+layout
+	connections      sync.Map         // string -> *Connection, by ID or name
+	evalChan         chan EvalRequest // channel for serializing interpreter access
+	drainTimeout     time.Duration    // default grace period for in-flight requests on shutdown
+	shutdownConnProc string           // proc run per held connection before shutdown closes it
+	shutdownOnce     sync.Once
 }
 
 func NewServerState() *ServerState {
 	return &ServerState{
-		routes:    make([]Route, 0),
-		shutdown:  make(chan struct{}),
-		templates: template.New(""),
-		evalChan:  make(chan EvalRequest),
+		routes:       make([]Route, 0),
+		shutdown:     make(chan struct{}),
+		templates:    template.New("").Funcs(templateFuncs),
+		evalChan:     make(chan EvalRequest),
+		conns:        newConnTracker(),
+		notebooks:    newNotebookStore("notebooks"),
+		acl:          newCommandACL(),
+		sessions:     newSessionManager(),
+		pubsub:       newPubsubBroker(),
+		groups:       newConnGroups(),
+		debug:        newDebugCapture(),
+		channel:      ChannelScript,
+		drainTimeout: 30 * time.Second,
 	}
 }
 
@@ -86,23 +386,143 @@ func (s *ServerState) RunInterpreter(interp *feather.Interp) {
 		case <-s.shutdown:
 			return
 		case req := <-s.evalChan:
-			result, err := interp.Eval(req.Script)
-			req.Response <- EvalResponse{Result: result, Error: err}
+			s.runEval(interp, req)
+		}
+	}
+}
+
+func (s *ServerState) runEval(interp *feather.Interp, req EvalRequest) {
+	start := time.Now()
+	interpStats.waiting.Add(-1)
+	interpStats.queueWait.observe(start.Sub(req.Queued))
+	s.channel = req.Channel
+	s.SetRequestContext(req.Ctx)
+	result, err := s.evalRecovered(interp, req.Script)
+	s.channel = ChannelScript
+	s.SetRequestContext(nil)
+	interpStats.evals.Add(1)
+	interpStats.evalNs.Add(int64(time.Since(start)))
+	req.Response <- EvalResponse{Result: result, Error: err}
+}
+
+// evalRecovered evaluates script, returning an error instead of
+// panicking so the interpreter loop keeps running
+func (s *ServerState) evalRecovered(interp *feather.Interp, script string) (result *feather.Obj, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic("eval", v)
+			result, err = nil, errEvalPanic
+		}
+	}()
+	return interp.Eval(script)
+}
+
+// maxParked bounds how many scripts can be parked in serveUntil at once.
+// Each one nests an evaluation inside the last, so without a limit a burst
+// of sleeping handlers grows the stack without end.
+const maxParked = 64
+
+var errTooManyParked = fmt.Errorf("too many scripts waiting at once (at most %d)", maxParked)
+
+// serveUntil parks the script being evaluated, as Tcl's vwait does: it
+// keeps evaluating the scripts sent to the interpreter until wake is
+// closed, timeout passes (zero for none) or the server shuts down, and
+// reports whether wake was closed. Parked scripts nest, so they resume
+// innermost first: one whose wake came early still waits for every
+// script parked after it. Past maxParked it fails with errTooManyParked.
+// Interpreter goroutine only.
+func (s *ServerState) serveUntil(interp *feather.Interp, wake <-chan struct{}, timeout time.Duration) (bool, error) {
+	if s.parked >= maxParked {
+		return false, errTooManyParked
+	}
+	s.parked++
+	defer func() { s.parked-- }()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	// The scripts run meanwhile belong to other requests
+	ctx, channel := s.GetRequestContext(), s.channel
+	defer func() {
+		s.SetRequestContext(ctx)
+		s.channel = channel
+	}()
+	for {
+		select {
+		case <-wake:
+			return true, nil
+		case <-expired:
+			return false, nil
+		case <-s.shutdown:
+			return false, nil
+		case req := <-s.evalChan:
+			s.runEval(interp, req)
 		}
 	}
 }
 
 // Eval sends a script to the interpreter and waits for the result.
+// The script runs unrestricted, as the startup script does.
 // This is safe to call from any goroutine.
 func (s *ServerState) Eval(script string) (*feather.Obj, error) {
+	return s.EvalIn(ChannelScript, script)
+}
+
+// EvalIn evaluates a script on behalf of the given channel, subject to the
+// channel's command policy. This is safe to call from any goroutine.
+func (s *ServerState) EvalIn(channel, script string) (*feather.Obj, error) {
+	return s.evalFor(channel, nil, script)
+}
+
+// EvalFor evaluates a script on the route channel for the request ctx:
+// respond, status, header and the other request commands act on ctx, no
+// matter how many requests are in flight. This is safe to call from any
+// goroutine.
+func (s *ServerState) EvalFor(ctx *RequestContext, script string) (*feather.Obj, error) {
+	return s.evalFor(ChannelRoute, ctx, script)
+}
+
+func (s *ServerState) evalFor(channel string, ctx *RequestContext, script string) (*feather.Obj, error) {
 	resp := make(chan EvalResponse, 1)
-	s.evalChan <- EvalRequest{Script: script, Response: resp}
+	interpStats.waiting.Add(1)
+	s.evalChan <- EvalRequest{Script: script, Channel: channel, Ctx: ctx, Response: resp, Queued: time.Now()}
 	r := <-resp
 	return r.Result, r.Error
 }
 
+// routeEval returns a function that evaluates route-level scripts (rate
+// limit keys, auth checks, middleware) for ctx and returns their result as
+// a string
+func (s *ServerState) routeEval(ctx *RequestContext) func(string) (string, error) {
+	return func(script string) (string, error) {
+		res, err := s.EvalFor(ctx, script)
+		if err != nil {
+			return "", err
+		}
+		return res.String(), nil
+	}
+}
+
+// currentChannel returns the channel of the script being evaluated. It must
+// only be called from the interpreter goroutine (i.e. from a command).
+func (s *ServerState) currentChannel() string {
+	return s.channel
+}
+
+// originChannel returns the channel that scripts scheduled by the current
+// one (timers, cron entries, jobs) must run on later, so they stay subject
+// to its command policy. The startup script has no channel of its own.
+func (s *ServerState) originChannel() string {
+	if s.channel == "" {
+		return ChannelScript
+	}
+	return s.channel
+}
+
 // EvalWithOutput evaluates a script with output directed to the given writer.
-func (s *ServerState) EvalWithOutput(script string, w io.Writer) (*feather.Obj, error) {
+func (s *ServerState) EvalWithOutput(channel, script string, w io.Writer) (*feather.Obj, error) {
 	ctx := &EvalContext{
 		Output: func(msg string) {
 			fmt.Fprintln(w, msg)
@@ -110,7 +530,7 @@ func (s *ServerState) EvalWithOutput(script string, w io.Writer) (*feather.Obj,
 	}
 	s.SetEvalContext(ctx)
 	defer s.SetEvalContext(nil)
-	return s.Eval(script)
+	return s.EvalIn(channel, script)
 }
 
 func (s *ServerState) LoadTemplate(name, content string) error {
@@ -118,6 +538,7 @@ func (s *ServerState) LoadTemplate(name, content string) error {
 	defer s.mu.Unlock()
 
 	s.templateSources.Store(name, content)
+	s.templateCache.Clear()
 	_, err := s.templates.New(name).Parse(content)
 	return err
 }
@@ -128,7 +549,7 @@ func (s *ServerState) ReparseTemplates() error {
 	defer s.mu.Unlock()
 
 	// Create fresh template set
-	newTemplates := template.New("")
+	newTemplates := template.New("").Funcs(templateFuncs)
 
 	// Reparse all sources
 	var parseErr error
@@ -148,32 +569,90 @@ func (s *ServerState) ReparseTemplates() error {
 	}
 
 	s.templates = newTemplates
+	s.templateCache.Clear()
 	return nil
 }
 
-func (s *ServerState) GetTemplate(name string) *template.Template {
-	srcVal, ok := s.templateSources.Load(name)
-	if !ok {
-		return nil
+// cachedTemplate returns the template built for key, or calls build and
+// keeps the result until the templates are next reparsed. Executing an
+// html/template is safe from many goroutines, so requests share it.
+func (s *ServerState) cachedTemplate(key string, build func(clone *template.Template) (*template.Template, error)) (*template.Template, error) {
+	if tmpl, ok := s.templateCache.Load(key); ok {
+		return tmpl.(*template.Template), nil
 	}
-	src := srcVal.(string)
 
 	// Clone base templates while holding lock to prevent concurrent modification
 	s.mu.Lock()
-	clone, err := s.templates.Clone()
+	base := s.templates
+	clone, err := base.Clone()
 	s.mu.Unlock()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	// Parse outside of lock - clone is our own copy
-	tmpl, err := clone.New(name).Parse(src)
+	tmpl, err := build(clone)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't keep a template built from a set that was replaced meanwhile
+	s.mu.Lock()
+	if s.templates == base {
+		s.templateCache.Store(key, tmpl)
+	}
+	s.mu.Unlock()
+	return tmpl, nil
+}
+
+func (s *ServerState) GetTemplate(name string) *template.Template {
+	srcVal, ok := s.templateSources.Load(name)
+	if !ok {
+		return nil
+	}
+	src := srcVal.(string)
+
+	tmpl, err := s.cachedTemplate(name, func(clone *template.Template) (*template.Template, error) {
+		return clone.New(name).Parse(src)
+	})
 	if err != nil {
 		return nil
 	}
 	return tmpl
 }
 
+// GetTemplateWithLayout returns layout with the template name rendered as
+// its "content" block. The page is parsed after the layout, so blocks it
+// defines (e.g. {{define "title"}}) override the layout's defaults.
+func (s *ServerState) GetTemplateWithLayout(name, layout string) (*template.Template, error) {
+	src, ok := s.templateSources.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q", name)
+	}
+	layoutSrc, ok := s.templateSources.Load(layout)
+	if !ok {
+		return nil, fmt.Errorf("unknown layout %q", layout)
+	}
+	return s.cachedTemplate(name+"\x00"+layout, func(clone *template.Template) (*template.Template, error) {
+		// Blocks share one namespace, so another page's {{define "title"}} may
+		// have replaced a default; parsing the layout again restores them
+		if _, err := clone.New(layout).Parse(layoutSrc.(string)); err != nil {
+			return nil, err
+		}
+		page, err := clone.New(name).Parse(src.(string))
+		if err != nil {
+			return nil, err
+		}
+		// A page made only of defines fills the blocks itself
+		if page.Tree != nil && !isEmptyTree(page.Tree.Root) {
+			if _, err := clone.AddParseTree("content", page.Tree); err != nil {
+				return nil, err
+			}
+		}
+		return clone.Lookup(layout), nil
+	})
+}
+
 func (s *ServerState) ListTemplates() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -194,7 +673,7 @@ func (s *ServerState) GetTemplateSource(name string) string {
 	return ""
 }
 
-func (s *ServerState) AddRoute(method, pattern, body string) {
+func (s *ServerState) AddRoute(method, pattern, body string, opts RouteOptions) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -204,34 +683,97 @@ func (s *ServerState) AddRoute(method, pattern, body string) {
 		Pattern: pattern,
 		Params:  params,
 		Body:    body,
+		Options: opts,
+		limiter: newConcurrencyLimiter(opts.MaxConcurrent),
+	}
+	if opts.RateLimit != nil {
+		newRoute.rate = newRateLimiter(opts.RateLimit)
+	}
+
+	// Inside a transaction, changes go to the staged table
+	table := &s.routes
+	if s.staged != nil {
+		table = s.staged
 	}
 
 	// Check for existing route with same method and pattern
-	for i, r := range s.routes {
+	for i, r := range *table {
 		if r.Method == method && r.Pattern == pattern {
-			s.routes[i] = newRoute
+			// Transactions record history when they commit
+			if s.staged == nil && !sameRoute(r, newRoute) {
+				s.recordRouteLocked(r, false)
+			}
+			(*table)[i] = newRoute
+			if s.staged == nil {
+				s.publishRoutesLocked()
+			}
 			return
 		}
 	}
 
-	s.routes = append(s.routes, newRoute)
+	*table = append(*table, newRoute)
+	if s.staged == nil {
+		s.publishRoutesLocked()
+	}
+}
+
+// publishRoutesLocked makes the current route table the one requests see.
+// The table is copied, so the snapshot never changes once published and
+// requests read it without locking. s.mu must be held.
+func (s *ServerState) publishRoutesLocked() {
+	live := append([]Route(nil), s.routes...)
+	s.liveRoutes.Store(&live)
 }
 
+// GetRoutes returns the live route table. It is shared and must not be
+// modified.
 func (s *ServerState) GetRoutes() []Route {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return append([]Route{}, s.routes...)
+	if live := s.liveRoutes.Load(); live != nil {
+		return *live
+	}
+	return nil
 }
 
-func (s *ServerState) SetRequestContext(ctx *RequestContext) {
+// BeginRoutes starts staging route changes. With replace the staged table
+// starts empty, otherwise as a copy of the live one.
+func (s *ServerState) BeginRoutes(replace bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.staged != nil {
+		return fmt.Errorf("a routes transaction is already in progress")
+	}
+	staged := []Route{}
+	if !replace {
+		staged = append(staged, s.routes...)
+	}
+	s.staged = &staged
+	return nil
+}
+
+// EndRoutes finishes a transaction, swapping in the staged table when
+// commit is true and discarding it otherwise
+func (s *ServerState) EndRoutes(commit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.staged != nil && commit {
+		s.recordSwapLocked(s.routes, *s.staged)
+		s.routes = *s.staged
+		s.publishRoutesLocked()
+	}
+	s.staged = nil
+}
+
+// SetRequestContext binds the request the script being evaluated acts on.
+// runEval does so for each eval from the context it was sent with (see
+// EvalFor), so scripts never see another request's context. Interpreter
+// goroutine only.
+func (s *ServerState) SetRequestContext(ctx *RequestContext) {
 	s.reqCtx = ctx
 }
 
+// GetRequestContext returns the request of the script being evaluated, or
+// nil outside a request. Interpreter goroutine only (i.e. from a command).
 func (s *ServerState) GetRequestContext() *RequestContext {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
 	return s.reqCtx
 }
 
@@ -249,13 +791,11 @@ func (s *ServerState) GetEvalContext() *EvalContext {
 
 // HoldConnection creates a held connection from the current request context
 func (s *ServerState) HoldConnection(name string) (*Connection, error) {
-	s.mu.Lock()
-	reqCtx := s.reqCtx
-	s.mu.Unlock()
-
+	reqCtx := s.GetRequestContext()
 	if reqCtx == nil {
 		return nil, fmt.Errorf("not in request context")
 	}
+	reqCtx.held = true
 
 	// Generate unique ID
 	id := generateID()
@@ -266,7 +806,9 @@ func (s *ServerState) HoldConnection(name string) (*Connection, error) {
 		Ctx:    reqCtx,
 		Opened: time.Now(),
 		Done:   make(chan struct{}),
+		notify: make(chan string, 1),
 	}
+	conn.touch()
 
 	// Store by ID
 	s.connections.Store(id, conn)
@@ -308,10 +850,73 @@ func (s *ServerState) CloseConnection(handle string) error {
 	if conn.Name != "" {
 		s.connections.Delete(conn.Name)
 	}
+	s.pubsub.dropConnection(conn)
+	s.groups.drop(conn)
 
 	return nil
 }
 
+// CloseAllConnections runs the on_shutdown_connection proc and the OnClose
+// proc of every held connection and then closes it, so streaming handlers
+// return before the server is drained. The shutdown proc can still write to
+// the connection, e.g. to tell an SSE client where to reconnect. eval must be
+// able to reach the interpreter from the calling goroutine.
+func (s *ServerState) CloseAllConnections(eval func(string) (*feather.Obj, error)) {
+	seen := make(map[string]bool)
+	var conns []*Connection
+	s.connections.Range(func(key, value any) bool {
+		conn := value.(*Connection)
+		if !seen[conn.ID] {
+			seen[conn.ID] = true
+			conns = append(conns, conn)
+		}
+		return true
+	})
+
+	for _, conn := range conns {
+		handle := conn.Name
+		if handle == "" {
+			handle = conn.ID
+		}
+		if s.shutdownConnProc != "" {
+			if _, err := eval(fmt.Sprintf("%s %s", s.shutdownConnProc, handle)); err != nil {
+				logf("on_shutdown_connection %s: %v\n", handle, err)
+			}
+		}
+		if conn.OnClose != "" {
+			if _, err := eval(fmt.Sprintf("%s %s", conn.OnClose, handle)); err != nil {
+				logf("onclose %s: %v\n", handle, err)
+			}
+		}
+		s.CloseConnection(conn.ID)
+	}
+}
+
+// Drain stops accepting new requests and waits up to timeout for in-flight
+// ones to finish. With force, or once the timeout expires, remaining
+// connections are closed outright. Drain closes s.shutdown when done, which
+// stops the interpreter loop, so it must not run on the interpreter goroutine.
+func (s *ServerState) Drain(timeout time.Duration, force bool) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		defer close(s.shutdown)
+		if s.server == nil {
+			return
+		}
+		if force {
+			err = s.server.Close()
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err = s.server.Shutdown(ctx); err == context.DeadlineExceeded {
+			logf("Drain timeout after %s, closing remaining connections\n", timeout)
+			err = s.server.Close()
+		}
+	})
+	return err
+}
+
 // ListConnections returns all connection handles
 func (s *ServerState) ListConnections() []string {
 	seen := make(map[string]bool)
@@ -351,6 +956,18 @@ func generateID() string {
 	return "conn-" + hex.EncodeToString(b)
 }
 
+// checkRouteBody does the per-route work that can be done once when a route
+// is defined rather than on every request. feather has no compiled-script
+// API, so bodies are still evaluated from source; until it grows one, this
+// is limited to rejecting bodies with syntax errors at definition time
+// instead of failing every request that reaches them.
+func checkRouteBody(body string) error {
+	if err := checkScriptSyntax(body); err != nil {
+		return fmt.Errorf("body has syntax error: %v", err)
+	}
+	return nil
+}
+
 func extractParams(pattern string) []string {
 	var params []string
 	parts := splitPath(pattern)
@@ -381,7 +998,7 @@ func splitPath(path string) []string {
 	return parts
 }
 
-func matchRoute(route Route, method, path string) (bool, map[string]string) {
+func matchRoute(route *Route, method, path string) (bool, map[string]string) {
 	if route.Method != method {
 		return false, nil
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"testing"
+)
+
+// benchTemplateState loads a page, a layout and a few other templates,
+// as a small site would have
+func benchTemplateState(b *testing.B) *ServerState {
+	s := &ServerState{templates: template.New("").Funcs(templateFuncs)}
+	sources := map[string]string{
+		"layout": `<!doctype html><html><head><title>{{block "title" .}}Site{{end}}</title></head>` +
+			`<body><nav>{{range .nav}}<a href="{{.}}">{{.}}</a>{{end}}</nav>{{template "content" .}}</body></html>`,
+		"page": `{{define "title"}}{{.title}}{{end}}<h1>{{.title}}</h1>` +
+			`<ul>{{range .items}}<li>{{.}}</li>{{end}}</ul>{{if .user}}<p>Hello {{.user}}</p>{{end}}`,
+		"header": `<header>{{.title}}</header>`,
+		"footer": `<footer>{{range .nav}}<a href="{{.}}">{{.}}</a>{{end}}</footer>`,
+		"card":   `<div class="card"><h2>{{.title}}</h2>{{range .items}}<p>{{.}}</p>{{end}}</div>`,
+	}
+	for name, src := range sources {
+		if err := s.LoadTemplate(name, src); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+var benchTemplateData = map[string]any{
+	"title": "Orders",
+	"nav":   []string{"/", "/orders", "/account"},
+	"items": []string{"one", "two", "three", "four"},
+	"user":  "ada",
+}
+
+// BenchmarkTemplateRender compares rendering through cachedTemplate with
+// cloning the set and parsing the page for every render, as before
+func BenchmarkTemplateRender(b *testing.B) {
+	b.Run("plain/clone+parse", func(b *testing.B) {
+		s := benchTemplateState(b)
+		src := s.GetTemplateSource("page")
+		b.ReportAllocs()
+		for b.Loop() {
+			s.mu.Lock()
+			clone, err := s.templates.Clone()
+			s.mu.Unlock()
+			if err != nil {
+				b.Fatal(err)
+			}
+			tmpl, err := clone.New("page").Parse(src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := tmpl.Execute(io.Discard, benchTemplateData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("plain/cached", func(b *testing.B) {
+		s := benchTemplateState(b)
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := s.GetTemplate("page").Execute(io.Discard, benchTemplateData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("layout/clone+parse", func(b *testing.B) {
+		s := benchTemplateState(b)
+		src, layoutSrc := s.GetTemplateSource("page"), s.GetTemplateSource("layout")
+		b.ReportAllocs()
+		for b.Loop() {
+			s.mu.Lock()
+			clone, err := s.templates.Clone()
+			s.mu.Unlock()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := clone.New("layout").Parse(layoutSrc); err != nil {
+				b.Fatal(err)
+			}
+			page, err := clone.New("page").Parse(src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := clone.AddParseTree("content", page.Tree); err != nil {
+				b.Fatal(err)
+			}
+			if err := clone.Lookup("layout").Execute(io.Discard, benchTemplateData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("layout/cached", func(b *testing.B) {
+		s := benchTemplateState(b)
+		b.ReportAllocs()
+		for b.Loop() {
+			tmpl, err := s.GetTemplateWithLayout("page", "layout")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := tmpl.Execute(io.Discard, benchTemplateData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
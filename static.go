@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// staticMount serves a directory of files under a path prefix
+type staticMount struct {
+	Prefix    string
+	Dir       string
+	Index     string         // file served for directory requests, "" = none
+	Cache     time.Duration  // Cache-Control max-age, 0 = no header
+	Listing   bool           // list directories without an index file
+	Template  string         // template rendering listings, "" = built-in
+	Transform *bodyTransform // rewrites served files, nil = none
+}
+
+// staticListing is the built-in directory listing page
+var staticListing = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.path}}</title>
+<style>body{font-family:sans-serif;margin:2em}td{padding:2px 1em 2px 0}td.size{text-align:right}</style></head>
+<body>
+<h1>Index of {{.path}}</h1>
+<table>
+{{if .parent}}<tr><td><a href="{{.parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .entries}}<tr><td><a href="{{.href}}">{{.name}}{{if .dir}}/{{end}}</a></td><td class="size">{{if not .dir}}{{.size_human}}{{end}}</td><td>{{.modified}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// humanSize formats a byte count as e.g. 1.5K, 20M
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d", n)
+	}
+	f := float64(n)
+	u := -1
+	for f >= 1024 && u < len(units)-1 {
+		f /= 1024
+		u++
+	}
+	if f < 10 {
+		return fmt.Sprintf("%.1f%c", f, units[u])
+	}
+	return fmt.Sprintf("%.0f%c", f, units[u])
+}
+
+// serveListing renders the entries of dir, directories first, skipping
+// dot files
+func serveListing(state *ServerState, m *staticMount, w http.ResponseWriter, r *http.Request, dir string) {
+	dirents, err := readDirPath(dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sort.SliceStable(dirents, func(a, b int) bool {
+		if dirents[a].IsDir() != dirents[b].IsDir() {
+			return dirents[a].IsDir()
+		}
+		return dirents[a].Name() < dirents[b].Name()
+	})
+	entries := make([]any, 0, len(dirents))
+	for _, d := range dirents {
+		if strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		// "./" keeps names like "a:b" from parsing as a URL scheme
+		modified := ""
+		if !info.ModTime().IsZero() {
+			modified = info.ModTime().UTC().Format("2006-01-02 15:04")
+		}
+		href := "./" + (&url.URL{Path: d.Name()}).EscapedPath()
+		if d.IsDir() {
+			href += "/"
+		}
+		entries = append(entries, map[string]any{
+			"name":       d.Name(),
+			"href":       href,
+			"dir":        d.IsDir(),
+			"size":       info.Size(),
+			"size_human": humanSize(info.Size()),
+			"modified":   modified,
+			"mtime":      info.ModTime().Unix(),
+		})
+	}
+	data := map[string]any{
+		"path":    r.URL.Path,
+		"prefix":  m.Prefix,
+		"entries": entries,
+	}
+	if r.URL.Path != m.Prefix+"/" {
+		data["parent"] = "../"
+	}
+
+	tmpl := staticListing
+	if m.Template != "" {
+		if tmpl = state.GetTemplate(m.Template); tmpl == nil {
+			http.Error(w, fmt.Sprintf("listing template %q not found or invalid", m.Template), http.StatusInternalServerError)
+			return
+		}
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := tmpl.Execute(buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+}
+
+var (
+	staticMu     sync.RWMutex
+	staticMounts = make(map[string]*staticMount) // by prefix
+)
+
+// findStaticMount returns the mount with the longest prefix matching p
+func findStaticMount(p string) *staticMount {
+	staticMu.RLock()
+	defer staticMu.RUnlock()
+	var best *staticMount
+	for prefix, m := range staticMounts {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			if best == nil || len(prefix) > len(best.Prefix) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// serveStatic serves a GET or HEAD request from a static mount. Paths are
+// cleaned before they touch the file system, so ".." can't escape the
+// directory, and dot files (.git, .env, ...) are never served. Anything
+// that isn't a regular file, or a directory with an index file or listing,
+// is a 404. It reports false for other methods so routes can handle them.
+func serveStatic(state *ServerState, m *staticMount, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, m.Prefix))
+	for _, seg := range strings.Split(rel, "/") {
+		if strings.HasPrefix(seg, ".") {
+			http.NotFound(w, r)
+			return true
+		}
+	}
+	name := joinPath(m.Dir, rel)
+	stat, err := statPath(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	if stat.IsDir() {
+		if m.Index == "" && !m.Listing {
+			http.NotFound(w, r)
+			return true
+		}
+		// Redirect to the trailing slash so relative links in the index
+		// resolve against the directory
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return true
+		}
+		index := ""
+		if m.Index != "" {
+			index = joinPath(name, m.Index)
+		}
+		if fi, err := statPath(index); index == "" || err != nil || !fi.Mode().IsRegular() {
+			if !m.Listing {
+				http.NotFound(w, r)
+				return true
+			}
+			serveListing(state, m, w, r, name)
+			return true
+		}
+		name = index
+	}
+	file, err := openPath(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer file.Close()
+	stat, err = file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return true
+	}
+	if m.Cache > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(m.Cache.Seconds())))
+	}
+	if m.Transform != nil {
+		tw := &transformWriter{ResponseWriter: w, t: m.Transform}
+		defer tw.close()
+		w = tw
+	}
+	serveFSFile(w, r, name, file, stat)
+	return true
+}
+
+func registerStaticCommand(interp *feather.Interp, state *ServerState) {
+	staticCmd := &Command{
+		Name:  "static",
+		Help:  "Serve a directory of files under a URL prefix",
+		Usage: "static PREFIX DIR ?-index FILE? ?-cache DURATION? ?-listing BOOL? ?-template NAME? ?-transform OPTIONS?",
+		Long: `Mount DIR at PREFIX. GET and HEAD requests under PREFIX are served from
+the directory with range and conditional request support; missing files get
+a 404. Other methods still go to routes.
+
+Requests can't escape DIR with "..", and dot files are never served. DIR
+may be an embed:// path in a bundled binary (see help bundle).
+Directory requests serve the -index file (default index.html; -index {}
+turns it off). -cache sets Cache-Control: public, max-age for every file.
+
+With -listing 1, directories without an index file get an HTML listing of
+their files with sizes and modification times. -template renders it with
+your own template instead; it gets .path, .parent and .entries, each entry
+with .name, .href, .dir, .size, .size_human, .modified and .mtime.
+
+-transform rewrites the files as they are served; it takes the options of
+the transform command as a list (see help transform).
+
+Example:
+  static /assets ./public -cache 1h
+  static unmount /assets`,
+		Subcommands: []*Command{
+			{Name: "unmount", Help: "Stop serving PREFIX", Usage: "static unmount PREFIX"},
+			{Name: "mounts", Help: "List mounts as dicts", Usage: "static mounts"},
+		},
+	}
+	registry.Register(staticCmd)
+	interp.RegisterCommand("static", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"static prefix dir ?-index file? ?-cache duration?\"")
+		}
+		switch args[0].String() {
+		case "unmount":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"static unmount prefix\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			staticMu.Lock()
+			defer staticMu.Unlock()
+			if _, ok := staticMounts[prefix]; !ok {
+				return feather.Errorf("static unmount: no mount at %q", prefix)
+			}
+			delete(staticMounts, prefix)
+			return feather.OK("")
+		case "mounts":
+			staticMu.RLock()
+			defer staticMu.RUnlock()
+			prefixes := make([]string, 0, len(staticMounts))
+			for prefix := range staticMounts {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			items := make([]*feather.Obj, 0, len(prefixes))
+			for _, prefix := range prefixes {
+				m := staticMounts[prefix]
+				items = append(items, i.DictKV("prefix", m.Prefix, "dir", m.Dir, "index", m.Index, "cache", m.Cache.String(), "listing", m.Listing, "template", m.Template, "transform", m.Transform != nil))
+			}
+			return feather.OK(i.List(items...))
+		}
+
+		if !strings.HasPrefix(args[0].String(), "/") {
+			return feather.Errorf("static: unknown subcommand %q (must be a /PREFIX, unmount, mounts)", args[0].String())
+		}
+		if len(args) < 2 || len(args)%2 != 0 {
+			return feather.Error("wrong # args: should be \"static prefix dir ?-index file? ?-cache duration? ?-listing bool? ?-template name? ?-transform options?\"")
+		}
+		m := &staticMount{
+			Prefix: "/" + strings.Trim(args[0].String(), "/"),
+			Dir:    args[1].String(),
+			Index:  "index.html",
+		}
+		for j := 2; j < len(args); j += 2 {
+			val := args[j+1].String()
+			switch args[j].String() {
+			case "-index":
+				if strings.ContainsAny(val, `/\`) {
+					return feather.Errorf("static: -index must be a file name, got %q", val)
+				}
+				m.Index = val
+			case "-cache":
+				d, err := time.ParseDuration(val)
+				if err != nil || d < 0 {
+					return feather.Errorf("static: invalid -cache duration %q", val)
+				}
+				m.Cache = d
+			case "-listing":
+				m.Listing = tclTrue(val)
+			case "-template":
+				m.Template = val
+			case "-transform":
+				t, err := parseMountTransform(i, val)
+				if err != nil {
+					return feather.Errorf("static: %v", err)
+				}
+				m.Transform = t
+			default:
+				return feather.Errorf("static: unknown option %q (must be -index, -cache, -listing, -template, -transform)", args[j].String())
+			}
+		}
+		if m.Prefix == "/" {
+			return feather.Error("static: PREFIX can't be / (routes would be unreachable)")
+		}
+		stat, err := statPath(m.Dir)
+		if err != nil {
+			return feather.Errorf("static: %v", err)
+		}
+		if !stat.IsDir() {
+			return feather.Errorf("static: %s is not a directory", m.Dir)
+		}
+
+		staticMu.Lock()
+		staticMounts[m.Prefix] = m
+		staticMu.Unlock()
+		return feather.OK("")
+	})
+}
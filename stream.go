@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// streamTarget resolves an optional leading -to HANDLE to the request
+// context to write to. conn is nil when writing to the current request.
+func streamTarget(state *ServerState, args []*feather.Obj) (ctx *RequestContext, conn *Connection, rest []*feather.Obj, err error) {
+	if len(args) >= 2 && args[0].String() == "-to" {
+		conn = state.GetConnection(args[1].String())
+		if conn == nil {
+			return nil, nil, nil, nil
+		}
+		return conn.Ctx, conn, args[2:], nil
+	}
+	ctx = state.GetRequestContext()
+	if ctx == nil {
+		return nil, nil, nil, fmt.Errorf("not in request context")
+	}
+	return ctx, nil, args, nil
+}
+
+// streamWrite writes data and flushes it, through the connection's shaper
+// if it has one
+func streamWrite(ctx *RequestContext, conn *Connection, data []byte) {
+	if conn != nil && conn.shaper != nil {
+		conn.shaper.send(data)
+		return
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.writeHeader()
+	ctx.Writer.Write(data)
+	if f, ok := ctx.Writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// validBoundary reports whether b is a usable multipart boundary (RFC 2046)
+func validBoundary(b string) bool {
+	if b == "" || len(b) > 70 {
+		return false
+	}
+	for _, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("'()+_,-./:=?", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func registerStreamCommand(interp *feather.Interp, state *ServerState) {
+	streamCmd := &Command{
+		Name:  "stream",
+		Help:  "Stream replacing content (multipart/x-mixed-replace)",
+		Usage: "stream SUBCOMMAND ?ARG ...?",
+		Long: `stream multipart starts a multipart/x-mixed-replace response. Every part
+sent afterwards replaces the previous one in the browser, which is how
+MJPEG cameras and live dashboard images work: point an <img> at the route.
+
+Example:
+  route GET /camera {
+      stream multipart
+      connection hold -as camera -max-rate 10/s
+  }
+  # whenever a frame is ready
+  stream part -to camera -type image/jpeg -base64 $frame
+
+Parts sent to a connection held with -max-rate or -max-bytes-per-sec are
+paced like respond -to.`,
+		Subcommands: []*Command{
+			{Name: "multipart", Help: "Start a multipart/x-mixed-replace response", Usage: "stream multipart ?-boundary BOUNDARY?"},
+			{Name: "part", Help: "Send one part", Usage: "stream part ?-to HANDLE? ?-type CONTENT-TYPE? ?-base64? DATA"},
+			{Name: "end", Help: "Send the closing boundary", Usage: "stream end ?-to HANDLE?"},
+		},
+	}
+	registry.Register(streamCmd)
+	interp.RegisterCommand("stream", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"stream subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "multipart":
+			ctx := state.GetRequestContext()
+			if ctx == nil {
+				return feather.Error("stream multipart: not in request context")
+			}
+			boundary := "frame"
+			switch {
+			case len(args) == 3 && args[1].String() == "-boundary":
+				boundary = args[2].String()
+			case len(args) != 1:
+				return feather.Error("wrong # args: should be \"stream multipart ?-boundary boundary?\"")
+			}
+			if !validBoundary(boundary) {
+				return feather.Errorf("stream multipart: invalid boundary %q", boundary)
+			}
+			ctx.mu.Lock()
+			defer ctx.mu.Unlock()
+			if ctx.Written {
+				return feather.Error("stream multipart: response headers already sent")
+			}
+			ctx.boundary = boundary
+			ctx.Headers.Store("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+			ctx.Headers.Store("Cache-Control", "no-cache, no-store")
+			ctx.writeHeader()
+			if f, ok := ctx.Writer.(http.Flusher); ok {
+				f.Flush()
+			}
+			return feather.OK("")
+
+		case "part":
+			ctx, conn, rest, err := streamTarget(state, args[1:])
+			if err != nil {
+				return feather.Errorf("stream part: %v", err)
+			}
+			if ctx == nil {
+				// Connection gone, silently succeed like respond -to
+				return feather.OK("")
+			}
+			contentType := "application/octet-stream"
+			binary := false
+			j := 0
+		options:
+			for ; j < len(rest)-1; j++ {
+				switch rest[j].String() {
+				case "-type":
+					j++
+					contentType = rest[j].String()
+				case "-base64":
+					binary = true
+				default:
+					break options
+				}
+			}
+			if len(rest)-j != 1 {
+				return feather.Error("wrong # args: should be \"stream part ?-to handle? ?-type content-type? ?-base64? data\"")
+			}
+			data := []byte(rest[j].String())
+			if binary {
+				decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[j].String()))
+				if err != nil {
+					return feather.Errorf("stream part: invalid base64: %v", err)
+				}
+				data = decoded
+			}
+			ctx.mu.Lock()
+			boundary := ctx.boundary
+			ctx.mu.Unlock()
+			if boundary == "" {
+				return feather.Error("stream part: not a multipart stream (call stream multipart first)")
+			}
+			buf := getBuffer()
+			defer putBuffer(buf)
+			fmt.Fprintf(buf, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", boundary, contentType, len(data))
+			buf.Write(data)
+			buf.WriteString("\r\n")
+			streamWrite(ctx, conn, append([]byte(nil), buf.Bytes()...))
+			return feather.OK("")
+
+		case "end":
+			ctx, conn, rest, err := streamTarget(state, args[1:])
+			if err != nil {
+				return feather.Errorf("stream end: %v", err)
+			}
+			if ctx == nil {
+				return feather.OK("")
+			}
+			if len(rest) != 0 {
+				return feather.Error("wrong # args: should be \"stream end ?-to handle?\"")
+			}
+			ctx.mu.Lock()
+			boundary := ctx.boundary
+			ctx.mu.Unlock()
+			if boundary == "" {
+				return feather.Error("stream end: not a multipart stream")
+			}
+			streamWrite(ctx, conn, []byte("--"+boundary+"--\r\n"))
+			return feather.OK("")
+
+		default:
+			return feather.Errorf("stream: unknown subcommand %q (must be multipart, part, end)", subcmd)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkScriptSyntax reports unbalanced braces, brackets and quotes, and
+// text directly after a closing brace or quote, without evaluating
+// anything. The interpreter's own parser runs command substitutions as it
+// goes, so it can't be used on scripts that should only be checked.
+func checkScriptSyntax(script string) error {
+	p := &syntaxScanner{src: script}
+	return p.script(false)
+}
+
+type syntaxScanner struct {
+	src string
+	pos int
+}
+
+func (p *syntaxScanner) eof() bool { return p.pos >= len(p.src) }
+
+func (p *syntaxScanner) peek() byte { return p.src[p.pos] }
+
+// script scans commands until the end of input, or until the closing
+// bracket when nested inside a command substitution
+func (p *syntaxScanner) script(nested bool) error {
+	atCommandStart := true
+	for !p.eof() {
+		c := p.peek()
+		switch {
+		case c == ']' && nested:
+			return nil
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' || c == ';':
+			p.pos++
+			atCommandStart = true
+		case c == '\\' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '\n':
+			p.pos += 2
+		case c == '#' && atCommandStart:
+			p.comment()
+		default:
+			atCommandStart = false
+			if err := p.word(nested); err != nil {
+				return err
+			}
+		}
+	}
+	if nested {
+		return fmt.Errorf("missing close-bracket")
+	}
+	return nil
+}
+
+func (p *syntaxScanner) comment() {
+	for !p.eof() {
+		switch p.peek() {
+		case '\\':
+			p.pos += 2
+			continue
+		case '\n':
+			return
+		}
+		p.pos++
+	}
+}
+
+// word scans one word starting at the current position
+func (p *syntaxScanner) word(nested bool) error {
+	switch p.peek() {
+	case '{':
+		if err := p.braced(); err != nil {
+			return err
+		}
+		return p.wordEnd(nested, "close-brace")
+	case '"':
+		if err := p.quoted(); err != nil {
+			return err
+		}
+		return p.wordEnd(nested, "close-quote")
+	}
+	for !p.eof() {
+		switch c := p.peek(); c {
+		case ' ', '\t', '\r', '\n', ';':
+			return nil
+		case ']':
+			if nested {
+				return nil
+			}
+			p.pos++
+		case '\\':
+			p.pos += 2
+		case '[':
+			if err := p.substitution(); err != nil {
+				return err
+			}
+		default:
+			p.pos++
+		}
+	}
+	return nil
+}
+
+// wordEnd checks that a braced or quoted word is followed by a separator
+func (p *syntaxScanner) wordEnd(nested bool, what string) error {
+	if p.eof() {
+		return nil
+	}
+	switch p.peek() {
+	case ' ', '\t', '\r', '\n', ';':
+		return nil
+	case ']':
+		if nested {
+			return nil
+		}
+	}
+	return fmt.Errorf("extra characters after %s", what)
+}
+
+func (p *syntaxScanner) braced() error {
+	depth := 0
+	for !p.eof() {
+		switch p.peek() {
+		case '\\':
+			p.pos++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return nil
+			}
+		}
+		p.pos++
+	}
+	return fmt.Errorf("missing close-brace")
+}
+
+func (p *syntaxScanner) quoted() error {
+	p.pos++
+	for !p.eof() {
+		switch p.peek() {
+		case '\\':
+			p.pos += 2
+			continue
+		case '[':
+			if err := p.substitution(); err != nil {
+				return err
+			}
+			continue
+		case '"':
+			p.pos++
+			return nil
+		}
+		p.pos++
+	}
+	return fmt.Errorf("missing close-quote")
+}
+
+// substitution scans a bracketed command substitution including brackets
+func (p *syntaxScanner) substitution() error {
+	p.pos++
+	if err := p.script(true); err != nil {
+		return err
+	}
+	p.pos++
+	return nil
+}
+
+// tclQuote renders words as a Tcl list, so the result can be evaluated as a
+// command with each word passed through unchanged
+func tclQuote(words ...string) string {
+	var b strings.Builder
+	for n, w := range words {
+		if n > 0 {
+			b.WriteByte(' ')
+		}
+		if w == "" {
+			b.WriteString("{}")
+			continue
+		}
+		for _, r := range w {
+			switch r {
+			case '\n':
+				b.WriteString(`\n`)
+			case '\t':
+				b.WriteString(`\t`)
+			case '\r':
+				b.WriteString(`\r`)
+			case ' ', ';', '"', '$', '[', ']', '{', '}', '\\':
+				b.WriteByte('\\')
+				b.WriteRune(r)
+			default:
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// timer is a script scheduled by after or every
+type timer struct {
+	id      string
+	seq     int
+	script  string
+	channel string        // channel that scheduled it, whose command policy applies
+	stop    chan struct{} // closed by after cancel
+}
+
+// timerSet holds the pending timers by handle
+type timerSet struct {
+	mu     sync.Mutex
+	timers map[string]*timer
+	nextID int
+}
+
+var timers = &timerSet{timers: make(map[string]*timer)}
+
+func (ts *timerSet) add(kind, script, channel string) *timer {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.nextID++
+	t := &timer{id: kind + strconv.Itoa(ts.nextID), seq: ts.nextID, script: script, channel: channel, stop: make(chan struct{})}
+	ts.timers[t.id] = t
+	return t
+}
+
+// remove forgets the timer with handle id and reports whether it was pending
+func (ts *timerSet) remove(id string) (*timer, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.timers[id]
+	delete(ts.timers, id)
+	return t, ok
+}
+
+// ids returns the pending handles in the order they were created
+func (ts *timerSet) ids() []string {
+	ts.mu.Lock()
+	pending := make([]*timer, 0, len(ts.timers))
+	for _, t := range ts.timers {
+		pending = append(pending, t)
+	}
+	ts.mu.Unlock()
+	sort.Slice(pending, func(a, b int) bool { return pending[a].seq < pending[b].seq })
+	ids := make([]string, len(pending))
+	for j, t := range pending {
+		ids[j] = t.id
+	}
+	return ids
+}
+
+// fire runs a timer's script on the interpreter loop, on the channel that
+// scheduled it. Errors are logged: nothing is waiting for the result.
+func (t *timer) fire(state *ServerState) {
+	if _, err := state.EvalIn(t.channel, t.script); err != nil {
+		logf("%s: %v\n", t.id, err)
+	}
+}
+
+// after runs t once after d, unless it is cancelled first
+func (t *timer) after(state *ServerState, d time.Duration) {
+	wait := time.NewTimer(d)
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+	case <-t.stop:
+		return
+	case <-state.shutdown:
+		return
+	}
+	if _, ok := timers.remove(t.id); ok {
+		t.fire(state)
+	}
+}
+
+// every runs t each d until it is cancelled. A run that takes longer
+// than d delays the next one rather than overlapping it.
+func (t *timer) every(state *ServerState, d time.Duration) {
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.fire(state)
+		case <-t.stop:
+			return
+		case <-state.shutdown:
+			return
+		}
+	}
+}
+
+// parseTimerMS reads the delay of after and every
+func parseTimerMS(cmd, s string) (time.Duration, error) {
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("%s: expected non-negative integer milliseconds but got %q", cmd, s)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func registerTimerCommands(interp *feather.Interp, state *ServerState) {
+	registry.Register(&Command{
+		Name:  "after",
+		Help:  "Run a script once after a delay",
+		Usage: "after MS SCRIPT | after cancel HANDLE | after info",
+		Long: `after MS SCRIPT runs SCRIPT once, MS milliseconds from now, and returns
+a handle for after cancel. The script is evaluated at the top level on
+the interpreter loop between requests; an error is logged. It runs
+under the command policy (see acl) of where it was scheduled, so a
+timer set from a route can only do what the route could.
+
+after cancel stops a pending after or every timer and reports whether
+it was still pending. after info returns the handles of the pending
+timers.
+
+Example:
+  route POST /orders {
+      set id [save_order [request body]]
+      after 3600000 [list remind_unpaid $id]
+      respond $id
+  }`,
+		Subcommands: []*Command{
+			{Name: "cancel", Help: "Cancel an after or every timer", Usage: "after cancel HANDLE"},
+			{Name: "info", Help: "List the pending timers", Usage: "after info"},
+		},
+	})
+	registry.Register(&Command{
+		Name:  "every",
+		Help:  "Run a script repeatedly",
+		Usage: "every MS SCRIPT",
+		Long: `Run SCRIPT every MS milliseconds, first MS milliseconds from now, until
+after cancel is given the handle returned. Like after, the script runs
+on the interpreter loop and its errors are logged; they don't stop the
+timer. A run that takes longer than MS delays the next one instead of
+overlapping it.
+
+Example:
+  every 15000 {pubsub publish heartbeat ping}
+  set warm [every 300000 {cache set report [build_report]}]
+  after cancel $warm`,
+	})
+
+	registry.Register(&Command{
+		Name:  "sleep",
+		Help:  "Pause the script without holding up the server",
+		Usage: "sleep MS",
+		Long: `Pause the running script for MS milliseconds. Other requests, timers
+and the REPL are served meanwhile, so a handler that waits for a retry
+or a rate limit doesn't freeze the server.
+
+A sleeping script isn't a thread of its own: the scripts that run
+meanwhile are nested inside it, so scripts that sleep at the same time
+resume innermost first, as with await. A short sleep started before a
+long one resumes only after the long one ends, and a steady stream of
+sleeping handlers can hold back one that is due. At most 64 scripts can
+wait at once across sleep, await, chan and connection wait; past that
+they raise an error. Long waits belong in after or a job.
+
+Example:
+  route POST /import {
+      while {[catch {http post $upstream -body [request body]} res]} {
+          sleep 500
+      }
+      respond "ok"
+  }`,
+	})
+
+	interp.RegisterCommand("sleep", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 1 {
+			return feather.Error("wrong # args: should be \"sleep ms\"")
+		}
+		d, err := parseTimerMS("sleep", args[0].String())
+		if err != nil {
+			return feather.Error(err.Error())
+		}
+		if d == 0 {
+			return feather.OK("")
+		}
+		woken, err := state.serveUntil(i, nil, d)
+		if err != nil {
+			return feather.Errorf("sleep: %v", err)
+		}
+		if !woken {
+			select {
+			case <-state.shutdown:
+				return feather.Error("sleep: server shutting down")
+			default:
+			}
+		}
+		return feather.OK("")
+	})
+
+	interp.RegisterCommand("after", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"after ms script\"")
+		}
+		switch args[0].String() {
+		case "cancel":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"after cancel handle\"")
+			}
+			t, ok := timers.remove(args[1].String())
+			if ok {
+				close(t.stop)
+			}
+			return feather.OK(ok)
+		case "info":
+			if len(args) != 1 {
+				return feather.Error("wrong # args: should be \"after info\"")
+			}
+			return feather.OK(timers.ids())
+		}
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"after ms script\"")
+		}
+		d, err := parseTimerMS("after", args[0].String())
+		if err != nil {
+			return feather.Error(err.Error())
+		}
+		t := timers.add("after", args[1].String(), state.originChannel())
+		go t.after(state, d)
+		return feather.OK(t.id)
+	})
+
+	interp.RegisterCommand("every", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"every ms script\"")
+		}
+		d, err := parseTimerMS("every", args[0].String())
+		if err != nil {
+			return feather.Error(err.Error())
+		}
+		if d == 0 {
+			return feather.Error("every: interval must be at least 1ms")
+		}
+		t := timers.add("every", args[1].String(), state.originChannel())
+		go t.every(state, d)
+		return feather.OK(t.id)
+	})
+}
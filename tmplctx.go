@@ -0,0 +1,180 @@
+package main
+
+import (
+	"html/template"
+	"sort"
+	"sync"
+
+	"github.com/feather-lang/feather"
+)
+
+// templateContextKey is the reserved data key holding request info in
+// every template render
+const templateContextKey = "ctx"
+
+// templateFuncs are available in every template
+var templateFuncs = template.FuncMap{
+	"asset":    assetURL,
+	"markdown": markdownTemplateFunc,
+}
+
+var (
+	templateGlobalsMu sync.RWMutex
+	templateGlobals   = make(map[string]string)
+
+	// templateContextFuncs add entries to the ctx map
+	templateContextMu    sync.RWMutex
+	templateContextFuncs = make(map[string]func(state *ServerState, ctx *RequestContext) any)
+)
+
+// registerTemplateContext adds a key to the ctx map of every render made
+// during a request
+func registerTemplateContext(key string, fn func(state *ServerState, ctx *RequestContext) any) {
+	templateContextMu.Lock()
+	defer templateContextMu.Unlock()
+	templateContextFuncs[key] = fn
+}
+
+func init() {
+	registerTemplateContext("user", func(state *ServerState, ctx *RequestContext) any {
+		if ctx.authUser != "" {
+			return ctx.authUser
+		}
+		// Don't create a session just to render; only look at an existing one
+		if sess, err := state.sessions.load(ctx); err == nil && sess.data != nil {
+			return sess.data["user"]
+		}
+		return ""
+	})
+	registerTemplateContext("csrf", func(state *ServerState, ctx *RequestContext) any {
+		return templateCSRF{state: state, ctx: ctx}
+	})
+	registerTemplateContext("flash", func(state *ServerState, ctx *RequestContext) any {
+		// Only an existing session can hold messages
+		if sess, err := state.sessions.load(ctx); err != nil || sess.data == nil {
+			return []map[string]string{}
+		}
+		flashes, _ := state.sessions.takeFlashes(ctx)
+		out := make([]map[string]string, len(flashes))
+		for k, f := range flashes {
+			out[k] = map[string]string{"category": f.Category, "message": f.Message}
+		}
+		return out
+	})
+}
+
+// templateCSRF is the ctx.csrf value. The token, and the session holding
+// it, are only created when a template prints it, so pages without forms
+// don't start sessions.
+type templateCSRF struct {
+	state *ServerState
+	ctx   *RequestContext
+}
+
+func (c templateCSRF) String() string {
+	tok, err := c.state.sessions.csrfToken(c.ctx)
+	if err != nil {
+		return ""
+	}
+	return tok
+}
+
+// templateRequestContext describes the current request for templates
+func templateRequestContext(state *ServerState, ctx *RequestContext) map[string]any {
+	query := make(map[string]string)
+	for k, v := range ctx.Request.URL.Query() {
+		query[k] = v[0]
+	}
+	params := make(map[string]string, len(ctx.Params))
+	for k, v := range ctx.Params {
+		params[k] = v
+	}
+	m := map[string]any{
+		"method": ctx.Request.Method,
+		"path":   ctx.Request.URL.Path,
+		"url":    ctx.Request.URL.RequestURI(),
+		"host":   ctx.Request.Host,
+		"params": params,
+		"query":  query,
+	}
+	templateContextMu.RLock()
+	defer templateContextMu.RUnlock()
+	for k, fn := range templateContextFuncs {
+		m[k] = fn(state, ctx)
+	}
+	return m
+}
+
+// withTemplateContext adds the globals and, during a request, the ctx map
+// to render data. Values passed by the caller win over globals; ctx is
+// reserved and always replaced.
+func withTemplateContext(state *ServerState, data map[string]any) map[string]any {
+	templateGlobalsMu.RLock()
+	for k, v := range templateGlobals {
+		if _, ok := data[k]; !ok {
+			data[k] = v
+		}
+	}
+	templateGlobalsMu.RUnlock()
+	if ctx := state.GetRequestContext(); ctx != nil {
+		data[templateContextKey] = templateRequestContext(state, ctx)
+	} else {
+		delete(data, templateContextKey)
+	}
+	return data
+}
+
+// templateGlobalsCommand implements template globals
+func templateGlobalsCommand(i *feather.Interp, args []*feather.Obj) feather.Result {
+	if len(args) < 1 {
+		return feather.Error("wrong # args: should be \"template globals set|get|unset|list ?arg ...?\"")
+	}
+	switch args[0].String() {
+	case "set":
+		if len(args) != 3 {
+			return feather.Error("wrong # args: should be \"template globals set key value\"")
+		}
+		key := args[1].String()
+		if key == templateContextKey {
+			return feather.Errorf("template globals set: %q is reserved for request info", key)
+		}
+		templateGlobalsMu.Lock()
+		templateGlobals[key] = args[2].String()
+		templateGlobalsMu.Unlock()
+		return feather.OK(i.String(args[2].String()))
+	case "get":
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"template globals get key\"")
+		}
+		templateGlobalsMu.RLock()
+		v, ok := templateGlobals[args[1].String()]
+		templateGlobalsMu.RUnlock()
+		if !ok {
+			return feather.Errorf("template globals get: no global %q", args[1].String())
+		}
+		return feather.OK(i.String(v))
+	case "unset":
+		if len(args) != 2 {
+			return feather.Error("wrong # args: should be \"template globals unset key\"")
+		}
+		templateGlobalsMu.Lock()
+		delete(templateGlobals, args[1].String())
+		templateGlobalsMu.Unlock()
+		return feather.OK("")
+	case "list":
+		templateGlobalsMu.RLock()
+		keys := make([]string, 0, len(templateGlobals))
+		for k := range templateGlobals {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := make([]*feather.Obj, 0, 2*len(keys))
+		for _, k := range keys {
+			items = append(items, i.String(k), i.String(templateGlobals[k]))
+		}
+		templateGlobalsMu.RUnlock()
+		return feather.OK(i.List(items...))
+	default:
+		return feather.Errorf("template globals: unknown subcommand %q (must be set, get, unset, list)", args[0].String())
+	}
+}
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/feather-lang/feather"
+)
+
+// tomlTable is a table in key order. defined is set once a [header] or a
+// key/value has created it explicitly; inline tables can't be extended.
+type tomlTable struct {
+	keys    []string
+	vals    map[string]any // *tomlTable, *tomlArray or a scalar
+	defined bool
+	inline  bool
+}
+
+// tomlArray is an array value, or an array of tables from [[headers]]
+type tomlArray struct {
+	items  []any
+	tables bool
+}
+
+func newTOMLTable() *tomlTable {
+	return &tomlTable{vals: make(map[string]any)}
+}
+
+func (t *tomlTable) set(key string, v any) {
+	if _, ok := t.vals[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+	t.vals[key] = v
+}
+
+// tomlDateTime is an offset or local date/time, kept as written
+type tomlDateTime string
+
+// tomlParser reads TOML 1.0 documents
+type tomlParser struct {
+	s    string
+	k    int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool { return p.k >= len(p.s) }
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.k]
+}
+
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.s[p.k] == ' ' || p.s[p.k] == '\t') {
+		p.k++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() == '#' {
+		for !p.eof() && p.s[p.k] != '\n' {
+			p.k++
+		}
+	}
+}
+
+// skipBlank skips whitespace, comments and newlines
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		switch {
+		case strings.HasPrefix(p.s[p.k:], "\r\n"):
+			p.k += 2
+			p.line++
+		case p.peek() == '\n':
+			p.k++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine requires nothing but a comment before the next line
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	p.skipComment()
+	switch {
+	case p.eof():
+	case strings.HasPrefix(p.s[p.k:], "\r\n"):
+		p.k += 2
+		p.line++
+	case p.peek() == '\n':
+		p.k++
+		p.line++
+	default:
+		return p.errorf("expected end of line, got %q", p.rest())
+	}
+	return nil
+}
+
+func (p *tomlParser) rest() string {
+	r := p.s[p.k:]
+	if n := strings.IndexByte(r, '\n'); n >= 0 {
+		r = r[:n]
+	}
+	return r
+}
+
+func isTOMLBareKey(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// key reads a possibly dotted key: a.b."c d"
+func (p *tomlParser) key() ([]string, error) {
+	var parts []string
+	for {
+		p.skipSpace()
+		var part string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.basicString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		case c == '\'':
+			s, err := p.literalString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		case isTOMLBareKey(c):
+			start := p.k
+			for !p.eof() && isTOMLBareKey(p.s[p.k]) {
+				p.k++
+			}
+			part = p.s[start:p.k]
+		default:
+			return nil, p.errorf("expected key, got %q", p.rest())
+		}
+		parts = append(parts, part)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return parts, nil
+		}
+		p.k++
+	}
+}
+
+// descend walks path from t, creating implicit tables and entering the
+// last table of arrays of tables
+func (p *tomlParser) descend(t *tomlTable, path []string) (*tomlTable, error) {
+	for _, name := range path {
+		switch v := t.vals[name].(type) {
+		case nil:
+			child := newTOMLTable()
+			t.set(name, child)
+			t = child
+		case *tomlTable:
+			if v.inline {
+				return nil, p.errorf("can't extend inline table %s", name)
+			}
+			t = v
+		case *tomlArray:
+			if !v.tables {
+				return nil, p.errorf("%s is an array, not a table", name)
+			}
+			t = v.items[len(v.items)-1].(*tomlTable)
+		default:
+			return nil, p.errorf("%s is already a value", name)
+		}
+	}
+	return t, nil
+}
+
+func parseTOML(src string) (*tomlTable, error) {
+	p := &tomlParser{s: src, line: 1}
+	root := newTOMLTable()
+	current := root
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+		if p.peek() == '[' {
+			array := strings.HasPrefix(p.s[p.k:], "[[")
+			if array {
+				p.k += 2
+			} else {
+				p.k++
+			}
+			path, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			if !strings.HasPrefix(p.s[p.k:], closing) {
+				return nil, p.errorf("expected %s after table name", closing)
+			}
+			p.k += len(closing)
+			parent, err := p.descend(root, path[:len(path)-1])
+			if err != nil {
+				return nil, err
+			}
+			name := path[len(path)-1]
+			existing := parent.vals[name]
+			if array {
+				arr, ok := existing.(*tomlArray)
+				if existing == nil {
+					arr = &tomlArray{tables: true}
+					parent.set(name, arr)
+				} else if !ok || !arr.tables {
+					return nil, p.errorf("%s is already defined", strings.Join(path, "."))
+				}
+				current = newTOMLTable()
+				current.defined = true
+				arr.items = append(arr.items, current)
+			} else {
+				switch t := existing.(type) {
+				case nil:
+					current = newTOMLTable()
+					parent.set(name, current)
+				case *tomlTable:
+					if t.defined || t.inline {
+						return nil, p.errorf("table %s is already defined", strings.Join(path, "."))
+					}
+					current = t
+				default:
+					return nil, p.errorf("%s is already defined", strings.Join(path, "."))
+				}
+				current.defined = true
+			}
+			if err := p.endOfLine(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := p.keyValue(current); err != nil {
+			return nil, err
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// keyValue reads key = value into t
+func (p *tomlParser) keyValue(t *tomlTable) error {
+	path, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if p.peek() != '=' {
+		return p.errorf("expected = after key %s", strings.Join(path, "."))
+	}
+	p.k++
+	p.skipSpace()
+	v, err := p.value(0)
+	if err != nil {
+		return err
+	}
+	parent, err := p.descend(t, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	name := path[len(path)-1]
+	if _, dup := parent.vals[name]; dup {
+		return p.errorf("duplicate key %s", strings.Join(path, "."))
+	}
+	parent.set(name, v)
+	return nil
+}
+
+func (p *tomlParser) value(depth int) (any, error) {
+	if depth > maxJSONDepth {
+		return nil, p.errorf("nested too deeply")
+	}
+	switch c := p.peek(); {
+	case strings.HasPrefix(p.s[p.k:], `"""`):
+		return p.multilineBasicString()
+	case c == '"':
+		return p.basicString()
+	case strings.HasPrefix(p.s[p.k:], "'''"):
+		return p.multilineLiteralString()
+	case c == '\'':
+		return p.literalString()
+	case c == '[':
+		return p.array(depth)
+	case c == '{':
+		return p.inlineTable(depth)
+	}
+	return p.scalar()
+}
+
+func (p *tomlParser) array(depth int) (any, error) {
+	p.k++ // [
+	arr := &tomlArray{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.k++
+			return arr, nil
+		}
+		v, err := p.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr.items = append(arr.items, v)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.k++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array, got %q", p.rest())
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable(depth int) (any, error) {
+	p.k++ // {
+	t := newTOMLTable()
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.k++
+		t.inline = true
+		return t, nil
+	}
+	for {
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.k++
+		case '}':
+			p.k++
+			markInline(t)
+			return t, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table, got %q", p.rest())
+		}
+	}
+}
+
+// markInline freezes an inline table and the tables dotted keys created
+// inside it
+func markInline(t *tomlTable) {
+	t.inline = true
+	for _, v := range t.vals {
+		if child, ok := v.(*tomlTable); ok {
+			markInline(child)
+		}
+	}
+}
+
+// escape decodes a backslash escape in a basic string, after the backslash
+func (p *tomlParser) escape(b *strings.Builder) error {
+	if p.eof() {
+		return p.errorf("unterminated string")
+	}
+	c := p.s[p.k]
+	p.k++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if len(p.s)-p.k < n {
+			return p.errorf("bad \\%c escape", c)
+		}
+		r, err := strconv.ParseUint(p.s[p.k:p.k+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return p.errorf("bad \\%c escape %q", c, p.s[p.k:p.k+n])
+		}
+		b.WriteRune(rune(r))
+		p.k += n
+	default:
+		return p.errorf("bad escape \\%c", c)
+	}
+	return nil
+}
+
+func (p *tomlParser) basicString() (string, error) {
+	p.k++ // "
+	var b strings.Builder
+	for {
+		if p.eof() || p.s[p.k] == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.s[p.k]
+		p.k++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	p.k++ // '
+	end := strings.IndexAny(p.s[p.k:], "'\n")
+	if end < 0 || p.s[p.k+end] != '\'' {
+		return "", p.errorf("unterminated string")
+	}
+	s := p.s[p.k : p.k+end]
+	p.k += end + 1
+	return s, nil
+}
+
+// skipFirstNewline drops a newline right after the opening delimiter of a
+// multi-line string
+func (p *tomlParser) skipFirstNewline() {
+	if strings.HasPrefix(p.s[p.k:], "\r\n") {
+		p.k += 2
+		p.line++
+	} else if p.peek() == '\n' {
+		p.k++
+		p.line++
+	}
+}
+
+// closeMultiline consumes a closing delimiter, which may be preceded by
+// up to two quotes that belong to the content
+func (p *tomlParser) closeMultiline(delim string, b *strings.Builder) bool {
+	if !strings.HasPrefix(p.s[p.k:], delim) {
+		return false
+	}
+	extra := 0
+	for extra < 2 && p.k+3+extra < len(p.s) && p.s[p.k+3+extra] == delim[0] {
+		extra++
+	}
+	b.WriteString(p.s[p.k : p.k+extra])
+	p.k += 3 + extra
+	return true
+}
+
+func (p *tomlParser) multilineBasicString() (string, error) {
+	p.k += 3
+	p.skipFirstNewline()
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		if p.closeMultiline(`"""`, &b) {
+			return b.String(), nil
+		}
+		c := p.s[p.k]
+		p.k++
+		switch {
+		case c == '\\':
+			// A backslash at the end of a line trims the newline and the
+			// whitespace that follows
+			j := p.k
+			for j < len(p.s) && (p.s[j] == ' ' || p.s[j] == '\t') {
+				j++
+			}
+			if j < len(p.s) && (p.s[j] == '\n' || p.s[j] == '\r') {
+				p.k = j
+				for !p.eof() && strings.IndexByte(" \t\r\n", p.s[p.k]) >= 0 {
+					if p.s[p.k] == '\n' {
+						p.line++
+					}
+					p.k++
+				}
+				continue
+			}
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		case c == '\n':
+			p.line++
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) multilineLiteralString() (string, error) {
+	p.k += 3
+	p.skipFirstNewline()
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		if p.closeMultiline("'''", &b) {
+			return b.String(), nil
+		}
+		if p.s[p.k] == '\n' {
+			p.line++
+		}
+		b.WriteByte(p.s[p.k])
+		p.k++
+	}
+}
+
+// scalar reads a boolean, number or date/time
+func (p *tomlParser) scalar() (any, error) {
+	start := p.k
+	for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.s[p.k]) < 0 {
+		p.k++
+	}
+	tok := p.s[start:p.k]
+	// "1979-05-27 07:32:00" separates date and time with a space
+	if len(tok) == 10 && tok[4] == '-' && tok[7] == '-' && p.k+1 < len(p.s) && p.s[p.k] == ' ' && p.s[p.k+1] >= '0' && p.s[p.k+1] <= '9' {
+		p.k++
+		for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.s[p.k]) < 0 {
+			p.k++
+		}
+		tok = p.s[start:p.k]
+	}
+	switch tok {
+	case "":
+		return nil, p.errorf("expected value, got %q", p.rest())
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "+nan", "-nan":
+		return math.NaN(), nil
+	}
+	if len(tok) >= 8 && (tok[4] == '-' || tok[2] == ':') {
+		return tomlDateTime(tok), nil
+	}
+	if !validTOMLUnderscores(tok) {
+		return nil, p.errorf("invalid value %q", tok)
+	}
+	num := strings.ReplaceAll(tok, "_", "")
+	if len(num) > 2 && num[0] == '0' && strings.IndexByte("xob", num[1]) >= 0 {
+		n, err := strconv.ParseInt(num, 0, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %q", tok)
+		}
+		return n, nil
+	}
+	digits := strings.TrimLeft(num, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] != '.' && digits[1] != 'e' && digits[1] != 'E' {
+		return nil, p.errorf("leading zeros in %q", tok)
+	}
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return n, nil
+	}
+	if isJSONNumber(strings.TrimPrefix(num, "+")) {
+		if f, err := strconv.ParseFloat(num, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, p.errorf("invalid value %q", tok)
+}
+
+// validTOMLUnderscores reports whether every _ sits between two digits
+func validTOMLUnderscores(s string) bool {
+	isDigit := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	for k := 0; k < len(s); k++ {
+		if s[k] == '_' && (k == 0 || k == len(s)-1 || !isDigit(s[k-1]) || !isDigit(s[k+1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlToObj converts parsed TOML: tables become dicts in document order,
+// arrays lists, integers ints, floats doubles, booleans "true"/"false"
+// and date/times their text
+func tomlToObj(i *feather.InternalInterp, v any) feather.FeatherObj {
+	switch t := v.(type) {
+	case *tomlTable:
+		dict := i.NewDict()
+		for _, k := range t.keys {
+			dict = i.DictSet(dict, k, tomlToObj(i, t.vals[k]))
+		}
+		return dict
+	case *tomlArray:
+		list := i.NewList()
+		for _, item := range t.items {
+			list = i.ListAppend(list, tomlToObj(i, item))
+		}
+		return list
+	case int64:
+		return i.NewInt(t)
+	case float64:
+		return i.NewDouble(t)
+	case bool:
+		return i.InternString(strconv.FormatBool(t))
+	case tomlDateTime:
+		return i.InternString(string(t))
+	case string:
+		return i.InternString(t)
+	}
+	return i.InternString(fmt.Sprint(v))
+}
+
+// tomlEncoder writes a dict as a TOML document, choosing types from the
+// values like json stringify: dicts become tables, lists of dicts arrays
+// of tables, and other lists arrays
+type tomlEncoder struct {
+	i *feather.InternalInterp
+	b *strings.Builder
+}
+
+func tomlKey(k string) string {
+	if k == "" {
+		return `""`
+	}
+	for j := 0; j < len(k); j++ {
+		if !isTOMLBareKey(k[j]) {
+			return tomlQuote(k)
+		}
+	}
+	return k
+}
+
+// tomlQuote writes a basic string. strconv.Quote's escapes aren't all
+// valid TOML, so only the ones TOML defines are used.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isTableArray reports whether val is a non-empty list of dicts
+func (e *tomlEncoder) isTableArray(val feather.FeatherObj) bool {
+	if e.i.Type(val) != "list" {
+		return false
+	}
+	list, err := e.i.GetList(val)
+	if err != nil || len(list) == 0 {
+		return false
+	}
+	for _, item := range list {
+		if e.i.Type(item) != "dict" {
+			return false
+		}
+	}
+	return true
+}
+
+// inline writes a value on the right of =
+func (e *tomlEncoder) inline(val feather.FeatherObj, depth int) (string, error) {
+	if depth > maxJSONDepth {
+		return "", fmt.Errorf("nested too deeply")
+	}
+	switch e.i.Type(val) {
+	case "dict":
+		dict, order, err := e.i.GetDict(val)
+		if err != nil {
+			return "", err
+		}
+		parts := make([]string, 0, len(order))
+		for _, k := range order {
+			s, err := e.inline(dict[k], depth+1)
+			if err != nil {
+				return "", fmt.Errorf("key %s: %v", k, err)
+			}
+			parts = append(parts, tomlKey(k)+" = "+s)
+		}
+		if len(parts) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", nil
+	case "list":
+		list, err := e.i.GetList(val)
+		if err != nil {
+			return "", err
+		}
+		parts := make([]string, 0, len(list))
+		for idx, item := range list {
+			s, err := e.inline(item, depth+1)
+			if err != nil {
+				return "", fmt.Errorf("index %d: %v", idx, err)
+			}
+			parts = append(parts, s)
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	case "int":
+		n, err := e.i.GetInt(val)
+		return strconv.FormatInt(n, 10), err
+	case "double":
+		f, err := e.i.GetDouble(val)
+		return tomlFloat(f), err
+	}
+	s := e.i.GetString(val)
+	switch {
+	case s == "true" || s == "false":
+		return s, nil
+	case isJSONNumber(s):
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return s, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return tomlFloat(f), nil
+		}
+	}
+	return tomlQuote(s), nil
+}
+
+func tomlFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".en") {
+		s += ".0"
+	}
+	return s
+}
+
+// table writes the key/values of a dict, then its sub-tables under path
+func (e *tomlEncoder) table(val feather.FeatherObj, path []string, depth int) error {
+	if depth > maxJSONDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+	dict, order, err := e.i.GetDict(val)
+	if err != nil {
+		return err
+	}
+	for _, k := range order {
+		v := dict[k]
+		if e.i.Type(v) == "dict" || e.isTableArray(v) {
+			continue
+		}
+		s, err := e.inline(v, depth+1)
+		if err != nil {
+			return fmt.Errorf("key %s: %v", k, err)
+		}
+		e.b.WriteString(tomlKey(k) + " = " + s + "\n")
+	}
+	for _, k := range order {
+		v := dict[k]
+		sub := append(append([]string{}, path...), tomlKey(k))
+		switch {
+		case e.i.Type(v) == "dict":
+			e.b.WriteString("\n[" + strings.Join(sub, ".") + "]\n")
+			if err := e.table(v, sub, depth+1); err != nil {
+				return fmt.Errorf("key %s: %v", k, err)
+			}
+		case e.isTableArray(v):
+			list, _ := e.i.GetList(v)
+			for idx, item := range list {
+				e.b.WriteString("\n[[" + strings.Join(sub, ".") + "]]\n")
+				if err := e.table(item, sub, depth+1); err != nil {
+					return fmt.Errorf("key %s index %d: %v", k, idx, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func registerTOMLCommand(fi *feather.Interp, state *ServerState) {
+	tomlCmd := &Command{
+		Name:  "toml",
+		Help:  "Parse or write TOML",
+		Usage: "toml parse STR | toml load PATH | toml stringify DICT",
+		Long: `toml parse reads a TOML 1.0 document into a dict: tables become dicts
+(keeping key order), arrays and arrays of tables lists, integers ints,
+floats doubles, booleans "true" and "false", and dates and times their
+text. toml load does the same for a file or embed:// path, for config
+files at startup.
+
+toml stringify writes a dict as a document: nested dicts become [tables],
+lists of dicts [[arrays of tables]] and other values key = value lines,
+with types chosen as json stringify does.
+
+Example:
+  set cfg [toml load ./config.toml]
+  listen [dict get $cfg server port]`,
+		Subcommands: []*Command{
+			{Name: "parse", Help: "Decode a TOML string", Usage: "toml parse STR"},
+			{Name: "load", Help: "Decode a TOML file", Usage: "toml load PATH"},
+			{Name: "stringify", Help: "Encode a dict as TOML", Usage: "toml stringify DICT"},
+		},
+	}
+	registry.Register(tomlCmd)
+
+	// Low-level registration, like json, so the output isn't list-quoted
+	fi.Internal().Register("toml", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) != 2 {
+			i.SetErrorString("wrong # args: should be \"toml parse|load|stringify arg\"")
+			return feather.ResultError
+		}
+		switch sub := i.GetString(args[0]); sub {
+		case "parse", "load":
+			src := i.GetString(args[1])
+			if sub == "load" {
+				data, err := readPath(src)
+				if err != nil {
+					i.SetErrorString(fmt.Sprintf("toml load: %v", err))
+					return feather.ResultError
+				}
+				src = string(data)
+			}
+			doc, err := parseTOML(src)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("toml %s: %v", sub, err))
+				return feather.ResultError
+			}
+			i.SetResult(tomlToObj(i, doc))
+			return feather.ResultOK
+
+		case "stringify":
+			if _, _, err := i.GetDict(args[1]); err != nil {
+				i.SetErrorString(fmt.Sprintf("toml stringify: expected dict: %v", err))
+				return feather.ResultError
+			}
+			var b strings.Builder
+			e := &tomlEncoder{i: i, b: &b}
+			if err := e.table(args[1], nil, 0); err != nil {
+				i.SetErrorString(fmt.Sprintf("toml stringify: %v", err))
+				return feather.ResultError
+			}
+			i.SetResult(i.InternString(strings.TrimPrefix(b.String(), "\n")))
+			return feather.ResultOK
+
+		default:
+			i.SetErrorString(fmt.Sprintf("toml: unknown subcommand %q (must be parse, load, stringify)", sub))
+			return feather.ResultError
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+const (
+	totpPeriod = 30 // seconds per time step (RFC 6238 default)
+	totpDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// decodeTOTPSecret accepts base32 secrets as authenticator apps display
+// them: any case, with optional spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	s = strings.TrimRight(s, "=")
+	key, err := totpEncoding.DecodeString(s)
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid base32 secret")
+	}
+	return key, nil
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given counter
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+// totpVerify checks code against the steps within window of now
+func totpVerify(key []byte, code string, window int, now time.Time) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+	step := now.Unix() / totpPeriod
+	ok := 0
+	for d := -window; d <= window; d++ {
+		// Compare every candidate so timing doesn't reveal which step matched
+		ok |= subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step+int64(d)))), []byte(code))
+	}
+	return ok == 1
+}
+
+func registerTOTPCommand(interp *feather.Interp, state *ServerState) {
+	totpCmd := &Command{
+		Name:  "totp",
+		Help:  "Time-based one-time passwords for 2FA",
+		Usage: "totp SUBCOMMAND ?ARG ...?",
+		Long: `Implements RFC 6238 TOTP (SHA-1, 6 digits, 30 second steps), the
+defaults every authenticator app supports.
+
+Enrollment: generate a secret, store it with the user, and show the
+otpauth:// URI as a QR code. Login: verify the code the user types.
+
+Example:
+  set secret [totp secret]
+  set uri [totp uri alice@example.com MyApp $secret]
+  if {![totp verify $secret [form get code]]} { ... }`,
+		Subcommands: []*Command{
+			{Name: "secret", Help: "Generate a random base32 secret", Usage: "totp secret ?BYTES?"},
+			{Name: "uri", Help: "Build an otpauth:// provisioning URI", Usage: "totp uri ACCOUNT ISSUER SECRET"},
+			{Name: "code", Help: "Get the current code for a secret", Usage: "totp code SECRET"},
+			{Name: "verify", Help: "Check a code, allowing clock drift", Usage: "totp verify SECRET CODE ?-window N?"},
+		},
+	}
+	registry.Register(totpCmd)
+	interp.RegisterCommand("totp", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"totp subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "secret":
+			n := 20
+			if len(args) == 2 {
+				v, err := strconv.Atoi(args[1].String())
+				if err != nil || v < 10 || v > 64 {
+					return feather.Errorf("totp secret: bytes must be an integer between 10 and 64, got %q", args[1].String())
+				}
+				n = v
+			} else if len(args) != 1 {
+				return feather.Error("wrong # args: should be \"totp secret ?bytes?\"")
+			}
+			buf := make([]byte, n)
+			if _, err := rand.Read(buf); err != nil {
+				return feather.Errorf("totp secret: %v", err)
+			}
+			return feather.OK(i.String(totpEncoding.EncodeToString(buf)))
+		case "uri":
+			if len(args) != 4 {
+				return feather.Error("wrong # args: should be \"totp uri account issuer secret\"")
+			}
+			account, issuer, secret := args[1].String(), args[2].String(), args[3].String()
+			if _, err := decodeTOTPSecret(secret); err != nil {
+				return feather.Errorf("totp uri: %v", err)
+			}
+			q := url.Values{}
+			q.Set("secret", strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+			q.Set("issuer", issuer)
+			q.Set("algorithm", "SHA1")
+			q.Set("digits", strconv.Itoa(totpDigits))
+			q.Set("period", strconv.Itoa(totpPeriod))
+			label := url.PathEscape(issuer + ":" + account)
+			// Some authenticator apps show "+" literally, so encode spaces as %20
+			query := strings.ReplaceAll(q.Encode(), "+", "%20")
+			return feather.OK(i.String("otpauth://totp/" + label + "?" + query))
+		case "code":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"totp code secret\"")
+			}
+			key, err := decodeTOTPSecret(args[1].String())
+			if err != nil {
+				return feather.Errorf("totp code: %v", err)
+			}
+			return feather.OK(i.String(totpCode(key, uint64(time.Now().Unix()/totpPeriod))))
+		case "verify":
+			if len(args) != 3 && len(args) != 5 {
+				return feather.Error("wrong # args: should be \"totp verify secret code ?-window n?\"")
+			}
+			window := 1
+			if len(args) == 5 {
+				if args[3].String() != "-window" {
+					return feather.Errorf("totp verify: unknown option %q (must be -window)", args[3].String())
+				}
+				v, err := strconv.Atoi(args[4].String())
+				if err != nil || v < 0 || v > 10 {
+					return feather.Errorf("totp verify: -window must be an integer between 0 and 10, got %q", args[4].String())
+				}
+				window = v
+			}
+			key, err := decodeTOTPSecret(args[1].String())
+			if err != nil {
+				return feather.Errorf("totp verify: %v", err)
+			}
+			if totpVerify(key, args[2].String(), window, time.Now()) {
+				return feather.OK(1)
+			}
+			return feather.OK(0)
+		default:
+			return feather.Errorf("totp: unknown subcommand %q (must be secret, uri, code, verify)", subcmd)
+		}
+	})
+}
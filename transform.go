@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// transformMaxLine bounds how much is held back waiting for a newline
+// before a chunk is transformed anyway
+const transformMaxLine = 64 << 10
+
+// defaultTransformTypes are the content types transformed when -types
+// isn't given
+var defaultTransformTypes = []string{"text/*", "application/json", "application/javascript", "application/xml", "*+xml", "*+json"}
+
+// bodyTransform is a set of rewrites applied to a response as it streams
+type bodyTransform struct {
+	types    []string
+	replacer *strings.Replacer
+	regsubs  []regsubRule
+	headers  [][2]string
+	rebases  [][2]string
+	rebaseRe []*regexp.Regexp
+}
+
+type regsubRule struct {
+	re  *regexp.Regexp
+	sub string // in regexp.Expand syntax
+}
+
+// tclSubSpec converts a Tcl regsub substitution (& and \N) to Go's
+// ${N} expansion syntax
+func tclSubSpec(sub string) string {
+	var b strings.Builder
+	for k := 0; k < len(sub); k++ {
+		c := sub[k]
+		switch {
+		case c == '\\' && k+1 < len(sub) && sub[k+1] >= '0' && sub[k+1] <= '9':
+			fmt.Fprintf(&b, "${%c}", sub[k+1])
+			k++
+		case c == '\\' && k+1 < len(sub) && (sub[k+1] == '&' || sub[k+1] == '\\'):
+			b.WriteByte(sub[k+1])
+			k++
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// pairs parses a list of alternating items, as given to -replace etc.
+func pairs(i *feather.Interp, opt, val string) ([][2]string, error) {
+	items, err := i.ParseList(val)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opt, err)
+	}
+	if len(items)%2 != 0 {
+		return nil, fmt.Errorf("%s: expected a list of pairs", opt)
+	}
+	out := make([][2]string, 0, len(items)/2)
+	for k := 0; k < len(items); k += 2 {
+		out = append(out, [2]string{items[k].String(), items[k+1].String()})
+	}
+	return out, nil
+}
+
+func parseBodyTransform(i *feather.Interp, args []*feather.Obj) (*bodyTransform, error) {
+	t := &bodyTransform{types: defaultTransformTypes}
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("%s: missing value", args[len(args)-1].String())
+	}
+	for j := 0; j < len(args); j += 2 {
+		opt, val := args[j].String(), args[j+1].String()
+		switch opt {
+		case "-types":
+			items, err := i.ParseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("-types: %v", err)
+			}
+			t.types = make([]string, len(items))
+			for k, it := range items {
+				t.types[k] = it.String()
+			}
+		case "-replace":
+			p, err := pairs(i, opt, val)
+			if err != nil {
+				return nil, err
+			}
+			var oldnew []string
+			for _, kv := range p {
+				if kv[0] == "" {
+					return nil, fmt.Errorf("-replace: empty search string")
+				}
+				oldnew = append(oldnew, kv[0], kv[1])
+			}
+			t.replacer = strings.NewReplacer(oldnew...)
+		case "-regsub":
+			p, err := pairs(i, opt, val)
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range p {
+				re, err := regexp.Compile(kv[0])
+				if err != nil {
+					return nil, fmt.Errorf("-regsub: %v", err)
+				}
+				t.regsubs = append(t.regsubs, regsubRule{re: re, sub: tclSubSpec(kv[1])})
+			}
+		case "-header":
+			p, err := pairs(i, opt, val)
+			if err != nil {
+				return nil, err
+			}
+			t.headers = p
+		case "-rebase":
+			p, err := pairs(i, opt, val)
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range p {
+				// URLs in HTML attributes and CSS url(...)
+				re := regexp.MustCompile(`((?i:href|src|action|poster|content)\s*=\s*["']?|url\(\s*["']?)` + regexp.QuoteMeta(kv[0]))
+				t.rebaseRe = append(t.rebaseRe, re)
+			}
+			t.rebases = p
+		default:
+			return nil, fmt.Errorf("unknown option %q (must be -types, -replace, -regsub, -header, -rebase)", opt)
+		}
+	}
+	return t, nil
+}
+
+// parseMountTransform parses the value of a mount's -transform option,
+// a list of transform options; empty means none
+func parseMountTransform(i *feather.Interp, val string) (*bodyTransform, error) {
+	items, err := i.ParseList(val)
+	if err != nil {
+		return nil, fmt.Errorf("-transform: %v", err)
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	t, err := parseBodyTransform(i, items)
+	if err != nil {
+		return nil, fmt.Errorf("-transform: %v", err)
+	}
+	return t, nil
+}
+
+// matchesType reports whether a Content-Type is one to transform
+func (t *bodyTransform) matchesType(ct string) bool {
+	ct, _, _ = strings.Cut(ct, ";")
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	for _, pattern := range t.types {
+		if globMatch(pattern, ct) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *bodyTransform) apply(b []byte) []byte {
+	if t.replacer != nil {
+		b = []byte(t.replacer.Replace(string(b)))
+	}
+	for _, r := range t.regsubs {
+		b = r.re.ReplaceAll(b, []byte(r.sub))
+	}
+	for k, re := range t.rebaseRe {
+		b = re.ReplaceAll(b, []byte("${1}"+strings.ReplaceAll(t.rebases[k][1], "$", "$$")))
+	}
+	return b
+}
+
+// transformWriter applies a bodyTransform line by line as the response
+// is written, so large and streamed bodies aren't buffered whole. Matches
+// can't span lines.
+type transformWriter struct {
+	http.ResponseWriter
+	t           *bodyTransform
+	wroteHeader bool
+	active      bool
+	pending     []byte
+}
+
+func (w *transformWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	for _, kv := range w.t.headers {
+		h.Set(kv[0], kv[1])
+	}
+	if loc := h.Get("Location"); loc != "" {
+		for _, kv := range w.t.rebases {
+			if strings.HasPrefix(loc, kv[0]) {
+				h.Set("Location", kv[1]+strings.TrimPrefix(loc, kv[0]))
+				break
+			}
+		}
+	}
+	w.active = code != http.StatusPartialContent && code != http.StatusNoContent && code != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && w.t.matchesType(h.Get("Content-Type"))
+	if w.active {
+		h.Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *transformWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.active {
+		return w.ResponseWriter.Write(b)
+	}
+	w.pending = append(w.pending, b...)
+	cut := bytes.LastIndexByte(w.pending, '\n') + 1
+	if cut == 0 && len(w.pending) > transformMaxLine {
+		cut = len(w.pending)
+	}
+	if cut > 0 {
+		if _, err := w.ResponseWriter.Write(w.t.apply(w.pending[:cut])); err != nil {
+			return 0, err
+		}
+		w.pending = append(w.pending[:0], w.pending[cut:]...)
+	}
+	return len(b), nil
+}
+
+func (w *transformWriter) drain() {
+	if len(w.pending) > 0 {
+		w.ResponseWriter.Write(w.t.apply(w.pending))
+		w.pending = w.pending[:0]
+	}
+}
+
+func (w *transformWriter) Flush() {
+	w.drain()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *transformWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *transformWriter) close() {
+	w.drain()
+}
+
+func registerTransformCommand(interp *feather.Interp, state *ServerState) {
+	transformCmd := &Command{
+		Name:  "transform",
+		Help:  "Rewrite the response body as it streams",
+		Usage: "transform ?-types LIST? ?-replace PAIRS? ?-regsub PAIRS? ?-header PAIRS? ?-rebase PAIRS?",
+		Long: `Rewrite whatever the route sends after this point: sendfile,
+templates or respond. Bodies are processed line by line as they
+are written, so matches can't span lines. Responses with a
+Content-Encoding, range responses and content types not in -types pass
+through unchanged. transform can be called more than once; later calls
+see the output of earlier ones. Use it from a proc middleware to rewrite
+many routes at once.
+
+Static and proxy mounts are served before routes and middleware run, so
+they take the same options as a list in their own -transform option.
+
+Options:
+  -types LIST     Content type globs (default text/* and JSON, JS, XML)
+  -replace PAIRS  Literal substitutions {old new ...}
+  -regsub PAIRS   Regexp substitutions {re sub ...}; sub may use & and \1
+  -header PAIRS   Response headers to set {name value ...}
+  -rebase PAIRS   Rewrite absolute URLs {from to ...} in HTML attributes,
+                  CSS url() and the Location header
+
+Example:
+  proc whitelabel {} {
+      transform -replace {Acme Initech} \
+          -rebase {https://upstream.example.com https://www.example.org} \
+          -header {X-Frame-Options DENY}
+  }
+  use whitelabel -only {/docs/*}
+  proxy /docs https://upstream.example.com -compression identity \
+      -transform {-rebase {https://upstream.example.com https://www.example.org}}`,
+	}
+	registry.Register(transformCmd)
+	interp.RegisterCommand("transform", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		ctx := state.GetRequestContext()
+		if ctx == nil {
+			return feather.Error("transform: not in request context")
+		}
+		t, err := parseBodyTransform(i, args)
+		if err != nil {
+			return feather.Errorf("transform: %v", err)
+		}
+		ctx.mu.Lock()
+		written := ctx.Written
+		ctx.mu.Unlock()
+		if written {
+			return feather.Error("transform: response already started")
+		}
+		tw := &transformWriter{ResponseWriter: ctx.Writer, t: t}
+		ctx.wrapWriter(tw, tw.close)
+		return feather.OK("")
+	})
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// tusVersion is the only tus protocol version spoken
+const tusVersion = "1.0.0"
+
+// tusMount accepts resumable uploads (tus.io protocol) under a path prefix
+type tusMount struct {
+	Prefix     string
+	Dir        string
+	Max        int64 // largest accepted upload, 0 = unlimited
+	OnComplete string
+	Auth       *AuthSpec // nil = no authentication
+	locks      sync.Map  // upload ID -> *sync.Mutex, held while a PATCH runs
+}
+
+// tusUpload is stored next to the data as ID.info
+type tusUpload struct {
+	ID          string            `json:"id"`
+	Length      int64             `json:"length"`
+	Metadata    map[string]string `json:"metadata"`
+	RawMetadata string            `json:"raw_metadata"`
+	Created     time.Time         `json:"created"`
+}
+
+var (
+	tusMu     sync.RWMutex
+	tusMounts = make(map[string]*tusMount) // by prefix
+)
+
+// findTusMount returns the mount with the longest prefix matching p
+func findTusMount(p string) *tusMount {
+	tusMu.RLock()
+	defer tusMu.RUnlock()
+	var best *tusMount
+	for prefix, m := range tusMounts {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			if best == nil || len(prefix) > len(best.Prefix) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// parseTusMetadata decodes Upload-Metadata: comma separated "key base64"
+// pairs, where the value may be omitted
+func parseTusMetadata(h string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(h, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, enc, _ := strings.Cut(pair, " ")
+		val, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		meta[key] = string(val)
+	}
+	return meta, nil
+}
+
+// validTusID reports whether id looks like an ID made by tusMount.create,
+// so it is safe to use as a file name
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (m *tusMount) dataPath(id string) string { return filepath.Join(m.Dir, id) }
+func (m *tusMount) infoPath(id string) string { return filepath.Join(m.Dir, id+".info") }
+
+func (m *tusMount) load(id string) (*tusUpload, int64, error) {
+	data, err := os.ReadFile(m.infoPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	var up tusUpload
+	if err := json.Unmarshal(data, &up); err != nil {
+		return nil, 0, err
+	}
+	stat, err := os.Stat(m.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &up, stat.Size(), nil
+}
+
+// serveTus implements the tus core protocol plus the creation,
+// termination and checksum extensions
+func serveTus(state *ServerState, m *tusMount, w http.ResponseWriter, r *http.Request, eval func(string) (string, error)) {
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Cache-Control", "no-store")
+
+	if r.Method == "OPTIONS" {
+		h.Set("Tus-Version", tusVersion)
+		h.Set("Tus-Extension", "creation,termination,checksum")
+		h.Set("Tus-Checksum-Algorithm", "md5,sha1,sha256,sha512")
+		if m.Max > 0 {
+			h.Set("Tus-Max-Size", strconv.FormatInt(m.Max, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		h.Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	if m.Auth != nil {
+		ctx := &RequestContext{Writer: w, Request: r, Status: 200}
+		ok, err := m.Auth.authenticate(ctx, state.routeEval(ctx))
+		if err != nil {
+			logf("tus %s auth: %v\n", m.Prefix, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, m.Prefix), "/")
+	if id == "" {
+		if r.Method != "POST" {
+			h.Set("Allow", "OPTIONS, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		m.create(w, r)
+		return
+	}
+	if !validTusID(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		up, offset, err := m.load(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		h.Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+		if up.RawMetadata != "" {
+			h.Set("Upload-Metadata", up.RawMetadata)
+		}
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		m.patch(w, r, id, eval)
+	case "DELETE":
+		lock := m.lock(id)
+		if !lock.TryLock() {
+			http.Error(w, "upload in progress", http.StatusLocked)
+			return
+		}
+		defer lock.Unlock()
+		if _, _, err := m.load(id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		os.Remove(m.dataPath(id))
+		os.Remove(m.infoPath(id))
+		m.locks.Delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *tusMount) lock(id string) *sync.Mutex {
+	l, _ := m.locks.LoadOrStore(id, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+func (m *tusMount) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if m.Max > 0 && length > m.Max {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	raw := r.Header.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	up := &tusUpload{ID: hex.EncodeToString(b), Length: length, Metadata: meta, RawMetadata: raw, Created: time.Now().UTC()}
+	info, err := json.Marshal(up)
+	if err == nil {
+		err = os.WriteFile(m.dataPath(up.ID), nil, 0o644)
+	}
+	if err == nil {
+		err = os.WriteFile(m.infoPath(up.ID), info, 0o644)
+	}
+	if err != nil {
+		logf("tus %s create: %v\n", m.Prefix, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", m.Prefix+"/"+up.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (m *tusMount) patch(w http.ResponseWriter, r *http.Request, id string, eval func(string) (string, error)) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	lock := m.lock(id)
+	if !lock.TryLock() {
+		http.Error(w, "upload in progress", http.StatusLocked)
+		return
+	}
+	defer lock.Unlock()
+
+	up, offset, err := m.load(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	var checksum []byte
+	var sum func() []byte
+	var hashw io.Writer = io.Discard
+	if hdr := r.Header.Get("Upload-Checksum"); hdr != "" {
+		alg, enc, _ := strings.Cut(hdr, " ")
+		newHash, ok := cryptoHashes[alg]
+		if !ok {
+			http.Error(w, "unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+		if checksum, err = base64.StdEncoding.DecodeString(enc); err != nil {
+			http.Error(w, "invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+		hsh := newHash()
+		hashw, sum = hsh, func() []byte { return hsh.Sum(nil) }
+	}
+
+	f, err := os.OpenFile(m.dataPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	n, copyErr := io.Copy(io.MultiWriter(f, hashw), io.LimitReader(r.Body, up.Length-offset))
+
+	// A chunk with a checksum is all or nothing; without one, whatever
+	// arrived before a dropped connection is kept for the client to resume
+	if checksum != nil && (copyErr != nil || string(sum()) != string(checksum)) {
+		f.Truncate(offset)
+		if copyErr == nil {
+			http.Error(w, "checksum mismatch", 460)
+		}
+		return
+	}
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if copyErr != nil {
+		return
+	}
+
+	if offset == up.Length && m.OnComplete != "" {
+		info := tclQuote("id", up.ID, "path", m.dataPath(id), "size", strconv.FormatInt(up.Length, 10),
+			"metadata", tusMetadataDict(up.Metadata))
+		if _, err := eval(m.OnComplete + " " + tclQuote(info)); err != nil {
+			logf("tus %s onComplete %s: %v\n", m.Prefix, id, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusMetadataDict renders metadata as a dict with sorted keys
+func tusMetadataDict(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	words := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		words = append(words, k, meta[k])
+	}
+	return tclQuote(words...)
+}
+
+func registerTusCommand(interp *feather.Interp, state *ServerState) {
+	tusCmd := &Command{
+		Name:  "tus",
+		Help:  "Accept resumable uploads (tus.io protocol)",
+		Usage: "tus SUBCOMMAND ?ARG ...?",
+		Long: `Serve the tus 1.0.0 resumable upload protocol under a path prefix, with
+the creation, termination and checksum extensions, so clients such as
+tus-js-client and Uppy can pause and resume large uploads across flaky
+connections. Uploads are stored in DIR as ID (the data) and ID.info.
+
+When an upload's last byte arrives, the -onComplete proc is called with a
+dict of id, path, size and metadata (the client's Upload-Metadata). Move
+or delete the file there; an error fails the final request.
+
+-auth works as for webdav mount.
+
+Example:
+  proc uploaded {info} {
+      puts "[dict get $info metadata filename] stored at [dict get $info path]"
+  }
+  tus mount /uploads ./spool -max 5GB -onComplete uploaded`,
+		Subcommands: []*Command{
+			{Name: "mount", Help: "Accept uploads under PREFIX", Usage: "tus mount PREFIX DIR ?-max SIZE? ?-onComplete PROC? ?-auth PROC? ?-realm REALM?"},
+			{Name: "unmount", Help: "Stop accepting uploads under PREFIX", Usage: "tus unmount PREFIX"},
+			{Name: "mounts", Help: "List mounts as dicts", Usage: "tus mounts"},
+			{Name: "uploads", Help: "List the uploads of a mount as dicts", Usage: "tus uploads PREFIX"},
+		},
+	}
+	registry.Register(tusCmd)
+	interp.RegisterCommand("tus", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"tus subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "mount":
+			if len(args) < 3 || len(args)%2 != 1 {
+				return feather.Error("wrong # args: should be \"tus mount prefix dir ?-max size? ?-onComplete proc? ?-auth proc? ?-realm realm?\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			if prefix == "/" || strings.HasPrefix(prefix, "/_") {
+				return feather.Errorf("tus mount: invalid prefix %q", prefix)
+			}
+			dir := args[2].String()
+			info, err := os.Stat(dir)
+			if err != nil {
+				return feather.Errorf("tus mount: %v", err)
+			}
+			if !info.IsDir() {
+				return feather.Errorf("tus mount: %s is not a directory", dir)
+			}
+
+			m := &tusMount{Prefix: prefix, Dir: dir}
+			var authProc, realm string
+			for j := 3; j < len(args); j += 2 {
+				val := args[j+1].String()
+				switch args[j].String() {
+				case "-max":
+					if m.Max, err = parseByteSize(val); err != nil {
+						return feather.Errorf("tus mount: -max: %v", err)
+					}
+				case "-onComplete":
+					m.OnComplete = val
+				case "-auth":
+					authProc = val
+				case "-realm":
+					realm = val
+				default:
+					return feather.Errorf("tus mount: unknown option %q (must be -max, -onComplete, -auth, -realm)", args[j].String())
+				}
+			}
+			if authProc != "" {
+				if realm == "" {
+					realm = "Uploads"
+				}
+				m.Auth = &AuthSpec{Scheme: "basic", Realm: realm, Check: authProc}
+			}
+			tusMu.Lock()
+			tusMounts[prefix] = m
+			tusMu.Unlock()
+			return feather.OK("")
+
+		case "unmount":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"tus unmount prefix\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			tusMu.Lock()
+			delete(tusMounts, prefix)
+			tusMu.Unlock()
+			return feather.OK("")
+
+		case "mounts":
+			tusMu.RLock()
+			prefixes := make([]string, 0, len(tusMounts))
+			for p := range tusMounts {
+				prefixes = append(prefixes, p)
+			}
+			sort.Strings(prefixes)
+			items := make([]*feather.Obj, 0, len(prefixes))
+			for _, p := range prefixes {
+				m := tusMounts[p]
+				auth := ""
+				if m.Auth != nil {
+					auth = m.Auth.Check
+				}
+				items = append(items, i.DictKV("prefix", m.Prefix, "dir", m.Dir, "max", int(m.Max), "onComplete", m.OnComplete, "auth", auth))
+			}
+			tusMu.RUnlock()
+			return feather.OK(i.List(items...))
+
+		case "uploads":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"tus uploads prefix\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			tusMu.RLock()
+			m := tusMounts[prefix]
+			tusMu.RUnlock()
+			if m == nil {
+				return feather.Errorf("tus uploads: no mount at %q", prefix)
+			}
+			infos, err := filepath.Glob(filepath.Join(m.Dir, "*.info"))
+			if err != nil {
+				return feather.Errorf("tus uploads: %v", err)
+			}
+			sort.Strings(infos)
+			var items []*feather.Obj
+			for _, p := range infos {
+				id := strings.TrimSuffix(filepath.Base(p), ".info")
+				if !validTusID(id) {
+					continue
+				}
+				up, offset, err := m.load(id)
+				if err != nil {
+					continue
+				}
+				items = append(items, i.DictKV("id", up.ID, "length", int(up.Length), "offset", int(offset),
+					"created", up.Created.Format(time.RFC3339)))
+			}
+			return feather.OK(i.List(items...))
+
+		default:
+			return feather.Errorf("tus: unknown subcommand %q (must be mount, unmount, mounts, uploads)", subcmd)
+		}
+	})
+}
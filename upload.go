@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/feather-lang/feather"
+)
+
+// uploadChunk describes one chunk of a chunked upload, as sent by
+// resumable.js, flow.js (Uppy's and others' chunking) or Dropzone
+type uploadChunk struct {
+	Identifier string
+	Filename   string
+	Number     int   // 1-based
+	Total      int   // number of chunks
+	TotalSize  int64 // whole file, 0 = unknown
+}
+
+// uploadChunkParams reads the chunk parameters of the known client
+// libraries, falling back to plain identifier, chunk, chunks and filename
+func uploadChunkParams(fields map[string]string) (*uploadChunk, error) {
+	get := func(names ...string) string {
+		for _, n := range names {
+			if v := fields[n]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	c := &uploadChunk{
+		Identifier: get("resumableIdentifier", "flowIdentifier", "dzuuid", "identifier"),
+		Filename:   get("resumableFilename", "flowFilename", "filename"),
+	}
+	if c.Identifier == "" {
+		return nil, fmt.Errorf("missing upload identifier")
+	}
+	var err error
+	if v := get("dzchunkindex"); v != "" {
+		// Dropzone counts chunks from 0
+		c.Number, err = strconv.Atoi(v)
+		c.Number++
+	} else {
+		c.Number, err = strconv.Atoi(get("resumableChunkNumber", "flowChunkNumber", "chunk"))
+	}
+	if err != nil || c.Number < 1 {
+		return nil, fmt.Errorf("missing or invalid chunk number")
+	}
+	c.Total, err = strconv.Atoi(get("resumableTotalChunks", "flowTotalChunks", "dztotalchunkcount", "chunks"))
+	if err != nil || c.Total < 1 || c.Number > c.Total {
+		return nil, fmt.Errorf("missing or invalid chunk count")
+	}
+	if v := get("resumableTotalSize", "flowTotalSize", "dztotalfilesize", "size"); v != "" {
+		if c.TotalSize, err = strconv.ParseInt(v, 10, 64); err != nil || c.TotalSize < 0 {
+			return nil, fmt.Errorf("invalid total size %q", v)
+		}
+	}
+	return c, nil
+}
+
+// key maps the client's identifier to a safe file name
+func (c *uploadChunk) key() string {
+	sum := sha256.Sum256([]byte(c.Identifier))
+	return hex.EncodeToString(sum[:16])
+}
+
+// safeUploadName reduces a client file name to a harmless base name
+func safeUploadName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "upload"
+	}
+	return strings.TrimLeft(name, ".")
+}
+
+// uploadChunkData returns the chunk bytes: the file part of a multipart
+// request, or else the raw body
+func uploadChunkData(ctx *RequestContext, field string) ([]byte, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(ctx.Request.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		body, err := ctx.readBody()
+		return body, "", err
+	}
+	if _, err := formFields(ctx); err != nil {
+		return nil, "", err
+	}
+	files := ctx.Request.MultipartForm.File[field]
+	if len(files) == 0 {
+		return nil, "", fmt.Errorf("no file in field %q", field)
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return data, files[0].Filename, err
+}
+
+// assembleUpload concatenates the chunks in order into dst
+func assembleUpload(parts, dst string, total int) (int64, error) {
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for n := 1; n <= total; n++ {
+		in, err := os.Open(filepath.Join(parts, strconv.Itoa(n)))
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+		w, err := io.Copy(out, in)
+		in.Close()
+		size += w
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return size, os.Rename(tmp, dst)
+}
+
+func registerUploadCommand(interp *feather.Interp, state *ServerState) {
+	uploadCmd := &Command{
+		Name:  "upload",
+		Help:  "Reassemble chunked uploads from JS upload libraries",
+		Usage: "upload SUBCOMMAND ?ARG ...?",
+		Long: `upload assemble handles one chunk request from resumable.js, flow.js or
+Dropzone (or any client sending identifier, chunk, chunks and filename
+fields). Chunks may arrive in any order and more than once; each is stored
+once under DIR. When the last one is in, they are joined into
+DIR/KEY-FILENAME and -onComplete is called with a dict of identifier,
+filename, path and size. Move the file there.
+
+GET requests are chunk tests: the response status is 200 when the chunk is
+already stored and 204 when it still has to be sent.
+
+The result is a dict with state (received, duplicate, present, missing or
+complete), identifier, chunk and chunks, plus path and size once complete.
+
+Example:
+  proc stored {info} { puts "got [dict get $info filename]" }
+  route GET /upload { upload assemble ./spool }
+  route POST /upload { upload assemble ./spool -onComplete stored; respond ok }`,
+		Subcommands: []*Command{
+			{Name: "assemble", Help: "Store a chunk and join the file when complete", Usage: "upload assemble DIR ?-onComplete PROC? ?-field NAME?"},
+			{Name: "clean", Help: "Remove unfinished uploads older than a duration", Usage: "upload clean DIR ?-older DURATION?"},
+		},
+	}
+	registry.Register(uploadCmd)
+	interp.RegisterCommand("upload", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"upload subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "assemble":
+			ctx := state.GetRequestContext()
+			if ctx == nil {
+				return feather.Error("upload assemble: not in request context")
+			}
+			if len(args) < 2 || len(args)%2 != 0 {
+				return feather.Error("wrong # args: should be \"upload assemble dir ?-onComplete proc? ?-field name?\"")
+			}
+			dir := args[1].String()
+			var onComplete string
+			field := "file"
+			for j := 2; j < len(args); j += 2 {
+				switch args[j].String() {
+				case "-onComplete":
+					onComplete = args[j+1].String()
+				case "-field":
+					field = args[j+1].String()
+				default:
+					return feather.Errorf("upload assemble: unknown option %q (must be -onComplete, -field)", args[j].String())
+				}
+			}
+
+			fields, err := formFields(ctx)
+			if err != nil {
+				return feather.Errorf("upload assemble: %v", err)
+			}
+			c, err := uploadChunkParams(fields)
+			if err != nil {
+				return feather.Errorf("upload assemble: %v", err)
+			}
+			parts := filepath.Join(dir, c.key()+".parts")
+			part := filepath.Join(parts, strconv.Itoa(c.Number))
+			result := func(state string, extra ...any) feather.Result {
+				kv := append([]any{"state", state, "identifier", c.Identifier, "chunk", c.Number, "chunks", c.Total}, extra...)
+				return feather.OK(i.DictKV(kv...))
+			}
+
+			_, statErr := os.Stat(part)
+			if ctx.Request.Method == "GET" || ctx.Request.Method == "HEAD" {
+				ctx.mu.Lock()
+				defer ctx.mu.Unlock()
+				chunkState := "missing"
+				ctx.Status = 204
+				if statErr == nil {
+					chunkState = "present"
+					ctx.Status = 200
+				}
+				ctx.writeHeader()
+				return result(chunkState)
+			}
+
+			chunkState := "duplicate"
+			if statErr != nil {
+				data, name, err := uploadChunkData(ctx, field)
+				if err != nil {
+					return feather.Errorf("upload assemble: %v", err)
+				}
+				if c.Filename == "" {
+					c.Filename = name
+				}
+				if err := os.MkdirAll(parts, 0o755); err != nil {
+					return feather.Errorf("upload assemble: %v", err)
+				}
+				if err := os.WriteFile(part+".tmp", data, 0o644); err != nil {
+					return feather.Errorf("upload assemble: %v", err)
+				}
+				if err := os.Rename(part+".tmp", part); err != nil {
+					return feather.Errorf("upload assemble: %v", err)
+				}
+				chunkState = "received"
+			}
+
+			for n := 1; n <= c.Total; n++ {
+				if _, err := os.Stat(filepath.Join(parts, strconv.Itoa(n))); err != nil {
+					return result(chunkState)
+				}
+			}
+
+			if c.Filename == "" {
+				c.Filename = "upload"
+			}
+			dst := filepath.Join(dir, c.key()+"-"+safeUploadName(c.Filename))
+			size, err := assembleUpload(parts, dst, c.Total)
+			if err != nil {
+				return feather.Errorf("upload assemble: %v", err)
+			}
+			if c.TotalSize > 0 && size != c.TotalSize {
+				os.Remove(dst)
+				os.RemoveAll(parts)
+				return feather.Errorf("upload assemble: assembled %d bytes, expected %d", size, c.TotalSize)
+			}
+			os.RemoveAll(parts)
+			if onComplete != "" {
+				info := tclQuote("identifier", c.Identifier, "filename", c.Filename, "path", dst, "size", strconv.FormatInt(size, 10))
+				if _, err := i.Eval(onComplete + " " + tclQuote(info)); err != nil {
+					return feather.Errorf("upload assemble: %s: %v", onComplete, err)
+				}
+			}
+			return result("complete", "path", dst, "size", int(size))
+
+		case "clean":
+			if len(args) != 2 && len(args) != 4 {
+				return feather.Error("wrong # args: should be \"upload clean dir ?-older duration?\"")
+			}
+			older := 24 * time.Hour
+			if len(args) == 4 {
+				if args[2].String() != "-older" {
+					return feather.Errorf("upload clean: unknown option %q (must be -older)", args[2].String())
+				}
+				d, err := time.ParseDuration(args[3].String())
+				if err != nil || d < 0 {
+					return feather.Errorf("upload clean: invalid duration %q", args[3].String())
+				}
+				older = d
+			}
+			matches, err := filepath.Glob(filepath.Join(args[1].String(), "*.parts"))
+			if err != nil {
+				return feather.Errorf("upload clean: %v", err)
+			}
+			removed := 0
+			cutoff := time.Now().Add(-older)
+			for _, p := range matches {
+				if info, err := os.Stat(p); err == nil && info.IsDir() && info.ModTime().Before(cutoff) {
+					if os.RemoveAll(p) == nil {
+						removed++
+					}
+				}
+			}
+			return feather.OK(removed)
+
+		default:
+			return feather.Errorf("upload: unknown subcommand %q (must be assemble, clean)", subcmd)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// urlKeys are the dict keys produced by url parse and accepted by url build
+const urlKeys = "scheme, user, password, host, port, path, query, params, fragment"
+
+// parseURLDict splits u into a dict. params holds the decoded query
+// pairs in order; repeated names keep the last value.
+func parseURLDict(i *feather.Interp, u *url.URL) *feather.Obj {
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	params := i.Dict()
+	for _, pair := range strings.FieldsFunc(u.RawQuery, func(r rune) bool { return r == '&' || r == ';' }) {
+		k, v, _ := strings.Cut(pair, "=")
+		k, err1 := url.QueryUnescape(k)
+		v, err2 := url.QueryUnescape(v)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		feather.ObjDictSet(params, k, i.String(v))
+	}
+	return i.DictKV(
+		"scheme", u.Scheme,
+		"user", user,
+		"password", password,
+		"host", u.Hostname(),
+		"port", u.Port(),
+		"path", u.Path,
+		"query", u.RawQuery,
+		"params", params,
+		"fragment", u.Fragment,
+	)
+}
+
+// buildURL assembles a URL from a dict in the url parse format. params,
+// when present and not empty, replaces query.
+func buildURL(i *feather.Interp, d *feather.DictType) (string, error) {
+	get := func(k string) string {
+		if v, ok := d.Items[k]; ok {
+			return v.String()
+		}
+		return ""
+	}
+	for _, k := range d.Order {
+		if !strings.Contains(", "+urlKeys+",", ", "+k+",") {
+			return "", fmt.Errorf("unknown key %q (must be %s)", k, urlKeys)
+		}
+	}
+	u := &url.URL{Scheme: get("scheme"), Path: get("path"), Fragment: get("fragment"), RawQuery: get("query")}
+	if host := get("host"); host != "" {
+		u.Host = host
+		if port := get("port"); port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		}
+	}
+	if user := get("user"); user != "" {
+		if pw, ok := d.Items["password"]; ok && pw.String() != "" {
+			u.User = url.UserPassword(user, pw.String())
+		} else {
+			u.User = url.User(user)
+		}
+	}
+	if p, ok := d.Items["params"]; ok && p.String() != "" {
+		params, err := i.ParseDict(p.String())
+		if err != nil {
+			return "", fmt.Errorf("params: %v", err)
+		}
+		parts := make([]string, 0, len(params.Order))
+		for _, k := range params.Order {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(params.Items[k].String()))
+		}
+		u.RawQuery = strings.Join(parts, "&")
+	}
+	if u.Host != "" && u.Path != "" && !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	return u.String(), nil
+}
+
+func registerURLCommand(interp *feather.Interp, state *ServerState) {
+	urlCmd := &Command{
+		Name:  "url",
+		Help:  "Parse, build and escape URLs",
+		Usage: "url SUBCOMMAND ?ARG ...?",
+		Long: `url parse returns a dict with scheme, user, password, host, port, path,
+query (raw), params (decoded query as a dict) and fragment. url build takes
+the same dict, so a URL can be parsed, changed and rebuilt; params, when
+not empty, replaces query. A name repeated in the query (?q=1&q=2) keeps
+only its last value in params; query still has them all.
+
+Example:
+  set u [url parse $next]
+  dict set u params page 2
+  redirect [url build $u]`,
+		Subcommands: []*Command{
+			{Name: "parse", Help: "Split a URL into a dict", Usage: "url parse URL"},
+			{Name: "build", Help: "Assemble a URL from a dict", Usage: "url build DICT"},
+			{Name: "resolve", Help: "Resolve a reference against a base URL", Usage: "url resolve BASE REF"},
+			{Name: "encode", Help: "Escape text for a query string, or a path segment with -path", Usage: "url encode ?-path? STR"},
+			{Name: "decode", Help: "Unescape query string text, or a path with -path", Usage: "url decode ?-path? STR"},
+		},
+	}
+	registry.Register(urlCmd)
+	interp.RegisterCommand("url", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"url subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "parse":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"url parse url\"")
+			}
+			u, err := url.Parse(args[1].String())
+			if err != nil {
+				return feather.Errorf("url parse: %v", err)
+			}
+			return feather.OK(parseURLDict(i, u))
+		case "build":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"url build dict\"")
+			}
+			d, err := i.ParseDict(args[1].String())
+			if err != nil {
+				return feather.Errorf("url build: %v", err)
+			}
+			s, err := buildURL(i, d)
+			if err != nil {
+				return feather.Errorf("url build: %v", err)
+			}
+			return feather.OK(i.String(s))
+		case "resolve":
+			if len(args) != 3 {
+				return feather.Error("wrong # args: should be \"url resolve base ref\"")
+			}
+			base, err := url.Parse(args[1].String())
+			if err != nil {
+				return feather.Errorf("url resolve: %v", err)
+			}
+			ref, err := url.Parse(args[2].String())
+			if err != nil {
+				return feather.Errorf("url resolve: %v", err)
+			}
+			return feather.OK(i.String(base.ResolveReference(ref).String()))
+		case "encode", "decode":
+			pathMode := len(args) == 3 && args[1].String() == "-path"
+			if len(args) != 2 && !pathMode {
+				return feather.Errorf("wrong # args: should be \"url %s ?-path? str\"", subcmd)
+			}
+			s := args[len(args)-1].String()
+			if subcmd == "encode" {
+				if pathMode {
+					return feather.OK(i.String(url.PathEscape(s)))
+				}
+				return feather.OK(i.String(url.QueryEscape(s)))
+			}
+			var out string
+			var err error
+			if pathMode {
+				out, err = url.PathUnescape(s)
+			} else {
+				out, err = url.QueryUnescape(s)
+			}
+			if err != nil {
+				return feather.Errorf("url decode: %v", err)
+			}
+			return feather.OK(i.String(out))
+		default:
+			return feather.Errorf("url: unknown subcommand %q (must be parse, build, resolve, encode, decode)", subcmd)
+		}
+	})
+}
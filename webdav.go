@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/feather-lang/feather"
+	"golang.org/x/net/webdav"
+)
+
+// davMount exposes a directory over WebDAV under a path prefix
+type davMount struct {
+	Prefix   string
+	Dir      string
+	Auth     *AuthSpec // nil = no authentication
+	ReadOnly bool
+	handler  *webdav.Handler
+}
+
+var (
+	davMu     sync.RWMutex
+	davMounts = make(map[string]*davMount) // by prefix
+)
+
+// findDAVMount returns the mount with the longest prefix matching path
+func findDAVMount(path string) *davMount {
+	davMu.RLock()
+	defer davMu.RUnlock()
+	var best *davMount
+	for prefix, m := range davMounts {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			if best == nil || len(prefix) > len(best.Prefix) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// davReadMethods are the methods allowed on read-only mounts
+var davReadMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "PROPFIND": true}
+
+// serveDAV authenticates the request if the mount requires it and hands
+// it to the WebDAV handler
+func serveDAV(state *ServerState, m *davMount, w http.ResponseWriter, r *http.Request) {
+	if m.Auth != nil {
+		ctx := &RequestContext{Writer: w, Request: r, Status: 200}
+		ok, err := m.Auth.authenticate(ctx, state.routeEval(ctx))
+		if err != nil {
+			logf("webdav %s auth: %v\n", m.Prefix, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+	if m.ReadOnly && !davReadMethods[r.Method] {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS, PROPFIND")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	m.handler.ServeHTTP(w, r)
+}
+
+func registerWebDAVCommand(interp *feather.Interp, state *ServerState) {
+	webdavCmd := &Command{
+		Name:  "webdav",
+		Help:  "Serve a directory over WebDAV",
+		Usage: "webdav SUBCOMMAND ?ARG ...?",
+		Long: `Expose a directory over WebDAV (PROPFIND, MKCOL, PUT, MOVE, COPY, LOCK, ...)
+under a path prefix, for file sync clients and mounting as a network drive.
+Mounts take precedence over routes below their prefix.
+
+With -auth, requests must carry HTTP Basic credentials accepted by the
+proc (called with user and password, returns a boolean; see help auth).
+
+Example:
+  set davPassword [dict get [toml load secrets.toml] dav_password]
+  proc davUser {user pass} { auth equal $pass $::davPassword }
+  webdav mount /dav ./shared -auth davUser -readonly 0`,
+		Subcommands: []*Command{
+			{Name: "mount", Help: "Serve DIR under PREFIX", Usage: "webdav mount PREFIX DIR ?-auth PROC? ?-realm REALM? ?-readonly BOOL?"},
+			{Name: "unmount", Help: "Stop serving PREFIX", Usage: "webdav unmount PREFIX"},
+			{Name: "mounts", Help: "List mounts as dicts", Usage: "webdav mounts"},
+		},
+	}
+	registry.Register(webdavCmd)
+	interp.RegisterCommand("webdav", func(i *feather.Interp, cmd *feather.Obj, args []*feather.Obj) feather.Result {
+		if len(args) < 1 {
+			return feather.Error("wrong # args: should be \"webdav subcommand ?arg ...?\"")
+		}
+		subcmd := args[0].String()
+		switch subcmd {
+		case "mount":
+			if len(args) < 3 || len(args)%2 != 1 {
+				return feather.Error("wrong # args: should be \"webdav mount prefix dir ?-auth proc? ?-realm realm? ?-readonly bool?\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			if prefix == "/" || strings.HasPrefix(prefix, "/_") {
+				return feather.Errorf("webdav mount: invalid prefix %q", prefix)
+			}
+			dir := args[2].String()
+			info, err := os.Stat(dir)
+			if err != nil {
+				return feather.Errorf("webdav mount: %v", err)
+			}
+			if !info.IsDir() {
+				return feather.Errorf("webdav mount: %s is not a directory", dir)
+			}
+
+			m := &davMount{Prefix: prefix, Dir: dir}
+			var authProc, realm string
+			for j := 3; j < len(args); j += 2 {
+				val := args[j+1].String()
+				switch args[j].String() {
+				case "-auth":
+					authProc = val
+				case "-realm":
+					realm = val
+				case "-readonly":
+					m.ReadOnly = tclTrue(val)
+				default:
+					return feather.Errorf("webdav mount: unknown option %q (must be -auth, -realm, -readonly)", args[j].String())
+				}
+			}
+			if authProc != "" {
+				if realm == "" {
+					realm = "WebDAV"
+				}
+				m.Auth = &AuthSpec{Scheme: "basic", Realm: realm, Check: authProc}
+			}
+			m.handler = &webdav.Handler{
+				Prefix:     prefix,
+				FileSystem: webdav.Dir(dir),
+				LockSystem: webdav.NewMemLS(),
+				Logger: func(r *http.Request, err error) {
+					if err != nil {
+						logf("webdav %s %s: %v\n", r.Method, r.URL.Path, err)
+					}
+				},
+			}
+			davMu.Lock()
+			davMounts[prefix] = m
+			davMu.Unlock()
+			return feather.OK("")
+
+		case "unmount":
+			if len(args) != 2 {
+				return feather.Error("wrong # args: should be \"webdav unmount prefix\"")
+			}
+			prefix := "/" + strings.Trim(args[1].String(), "/")
+			davMu.Lock()
+			delete(davMounts, prefix)
+			davMu.Unlock()
+			return feather.OK("")
+
+		case "mounts":
+			davMu.RLock()
+			prefixes := make([]string, 0, len(davMounts))
+			for p := range davMounts {
+				prefixes = append(prefixes, p)
+			}
+			sort.Strings(prefixes)
+			items := make([]*feather.Obj, 0, len(prefixes))
+			for _, p := range prefixes {
+				m := davMounts[p]
+				auth := ""
+				if m.Auth != nil {
+					auth = m.Auth.Check
+				}
+				items = append(items, i.DictKV("prefix", m.Prefix, "dir", m.Dir, "auth", auth, "readonly", m.ReadOnly))
+			}
+			davMu.RUnlock()
+			return feather.OK(i.List(items...))
+
+		default:
+			return feather.Errorf("webdav: unknown subcommand %q (must be mount, unmount, mounts)", subcmd)
+		}
+	})
+}
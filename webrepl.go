@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handleReplBatch evaluates a JSON array of statements in order, streaming
+// each statement's output and result as SSE events whose id is the
+// statement's index. Evaluation stops at the first error unless the request
+// has ?continue=1. A final "done" event carries the number of statements run.
+func handleReplBatch(state *ServerState, w http.ResponseWriter, r *http.Request, body []byte) {
+	var statements []string
+	if err := json.Unmarshal(body, &statements); err != nil {
+		http.Error(w, fmt.Sprintf("batch eval: expected JSON array of strings: %v", err), http.StatusBadRequest)
+		return
+	}
+	keepGoing := r.URL.Query().Get("continue") == "1"
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ran := 0
+	for idx, stmt := range statements {
+		id := strconv.Itoa(idx)
+		evalCtx := &EvalContext{
+			Output: func(msg string) {
+				writeSSEWithID(w, "output", id, msg)
+				flusher.Flush()
+			},
+		}
+		state.SetEvalContext(evalCtx)
+		result, err := state.EvalIn(ChannelWeb, stmt)
+		state.SetEvalContext(nil)
+		ran++
+
+		if err != nil {
+			writeSSEWithID(w, "error", id, err.Error())
+			flusher.Flush()
+			if !keepGoing {
+				break
+			}
+			continue
+		}
+		// Always send a result, even an empty one, so clients know the
+		// statement finished
+		writeSSEWithID(w, "result", id, result.String())
+		flusher.Flush()
+	}
+
+	writeSSE(w, "done", strconv.Itoa(ran))
+	flusher.Flush()
+}
+
+// writeSSEWithID writes an SSE event with an id field
+func writeSSEWithID(w io.Writer, event, id, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	fmt.Fprintf(w, "id: %s\n", id)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// replSession is a shared web REPL session. Every input and its output are
+// broadcast to all attached browsers, for pair-debugging.
+type replSession struct {
+	name        string
+	mu          sync.Mutex
+	subscribers map[chan replEvent]string // channel -> participant name
+}
+
+// replEvent is one SSE event broadcast to session participants
+type replEvent struct {
+	event string
+	data  string
+}
+
+func (s *ServerState) replSession(name string) *replSession {
+	val, _ := s.replSessions.LoadOrStore(name, &replSession{
+		name:        name,
+		subscribers: make(map[chan replEvent]string),
+	})
+	return val.(*replSession)
+}
+
+// broadcast sends an event to every participant. Participants that can't
+// keep up miss events rather than stalling the session.
+func (rs *replSession) broadcast(event, data string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for ch := range rs.subscribers {
+		select {
+		case ch <- replEvent{event: event, data: data}:
+		default:
+		}
+	}
+}
+
+func (rs *replSession) join(user string) chan replEvent {
+	ch := make(chan replEvent, 64)
+	rs.mu.Lock()
+	rs.subscribers[ch] = user
+	rs.mu.Unlock()
+	rs.broadcast("join", user)
+	return ch
+}
+
+func (rs *replSession) leave(ch chan replEvent) {
+	rs.mu.Lock()
+	user := rs.subscribers[ch]
+	delete(rs.subscribers, ch)
+	rs.mu.Unlock()
+	rs.broadcast("leave", user)
+}
+
+func (rs *replSession) participants() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	users := make([]string, 0, len(rs.subscribers))
+	for _, u := range rs.subscribers {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// handleReplSession serves shared sessions:
+//
+//	GET  /_repl/session/NAME/events?user=U  SSE stream of session activity
+//	POST /_repl/session/NAME/eval?user=U    evaluate body, broadcast results
+func handleReplSession(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/_repl/session/")
+	name, action, _ := strings.Cut(rest, "/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		user = "anon"
+	}
+	session := state.replSession(name)
+
+	switch {
+	case action == "events" && r.Method == "GET":
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ch := session.join(user)
+		defer session.leave(ch)
+		writeSSE(w, "participants", strings.Join(session.participants(), " "))
+		flusher.Flush()
+
+		for {
+			select {
+			case ev := <-ch:
+				writeSSE(w, ev.event, ev.data)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-state.shutdown:
+				return
+			}
+		}
+
+	case action == "eval" && r.Method == "POST":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		session.broadcast("input", user+"\n"+string(body))
+
+		evalCtx := &EvalContext{
+			Output: func(msg string) {
+				session.broadcast("output", msg)
+			},
+		}
+		state.SetEvalContext(evalCtx)
+		result, err := state.EvalIn(ChannelWeb, string(body))
+		state.SetEvalContext(nil)
+		if err != nil {
+			session.broadcast("error", err.Error())
+		} else if result.String() != "" {
+			session.broadcast("result", result.String())
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
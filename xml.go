@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// maxXMLDepth bounds element nesting when decoding, like maxJSONDepth
+const maxXMLDepth = 512
+
+// xmlFieldName splits a schema field into its dict key and XML name.
+// "key=atom:link" maps the key to another name; "@href" is an attribute
+// and "#text" the element's character data.
+func xmlFieldName(node *SchemaNode) (key, name string) {
+	if k, n, ok := strings.Cut(node.Name, "="); ok {
+		return k, n
+	}
+	return strings.TrimPrefix(node.Name, "@"), node.Name
+}
+
+// xmlEncoder writes XML directly to a pooled buffer based on schema
+type xmlEncoder struct {
+	i   *feather.InternalInterp
+	buf *bytes.Buffer
+}
+
+func newXMLEncoder(i *feather.InternalInterp) *xmlEncoder {
+	return &xmlEncoder{i: i, buf: getBuffer()}
+}
+
+func (e *xmlEncoder) String() string {
+	return e.buf.String()
+}
+
+// release returns the encoder's buffer to the pool
+func (e *xmlEncoder) release() {
+	putBuffer(e.buf)
+	e.buf = nil
+}
+
+// scalar renders a string, number or bool field as text
+func (e *xmlEncoder) scalar(val feather.FeatherObj, node *SchemaNode) (string, error) {
+	s := schemaString(e.i, val)
+	switch node.Type {
+	case "number":
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return "", fmt.Errorf("invalid number: %s", s)
+		}
+	case "bool":
+		switch s {
+		case "1", "true":
+			s = "true"
+		case "0", "false":
+			s = "false"
+		default:
+			return "", fmt.Errorf("invalid bool: %s", s)
+		}
+	case "string":
+	default:
+		return "", fmt.Errorf("%s can't be an attribute or text", node.Type)
+	}
+	return s, nil
+}
+
+// encodeElement writes <name attrs>children</name> for a dict
+func (e *xmlEncoder) encodeElement(name string, dict map[string]feather.FeatherObj, schema []*SchemaNode) error {
+	e.buf.WriteString("<" + name)
+	for _, node := range schema {
+		key, attr := xmlFieldName(node)
+		val, ok := dict[key]
+		if !ok || !strings.HasPrefix(attr, "@") {
+			continue
+		}
+		s, err := e.scalar(val, node)
+		if err != nil {
+			return fmt.Errorf("field %s: %v", key, err)
+		}
+		e.buf.WriteString(" " + attr[1:] + `="`)
+		xml.EscapeText(e.buf, []byte(s))
+		e.buf.WriteByte('"')
+	}
+	e.buf.WriteByte('>')
+	for _, node := range schema {
+		key, child := xmlFieldName(node)
+		val, ok := dict[key]
+		if !ok || strings.HasPrefix(child, "@") {
+			continue
+		}
+		if err := e.encodeValue(child, val, node); err != nil {
+			return fmt.Errorf("field %s: %v", key, err)
+		}
+	}
+	e.buf.WriteString("</" + name + ">")
+	return nil
+}
+
+func (e *xmlEncoder) encodeValue(name string, val feather.FeatherObj, node *SchemaNode) error {
+	switch node.Type {
+	case "object":
+		dictVal, _, err := e.i.GetDict(val)
+		if err != nil {
+			return fmt.Errorf("expected dict for object: %v", err)
+		}
+		return e.encodeElement(name, dictVal, node.Children)
+
+	case "array":
+		list, err := e.i.GetList(val)
+		if err != nil {
+			return fmt.Errorf("expected list for array: %v", err)
+		}
+		// Arrays are repeated elements, as in RSS items and sitemap urls
+		for idx, item := range list {
+			if err := e.encodeValue(name, item, node.Children[0]); err != nil {
+				return fmt.Errorf("index %d: %v", idx, err)
+			}
+		}
+		return nil
+	}
+
+	s, err := e.scalar(val, node)
+	if err != nil {
+		return err
+	}
+	if name == "#text" {
+		xml.EscapeText(e.buf, []byte(s))
+		return nil
+	}
+	e.buf.WriteString("<" + name + ">")
+	xml.EscapeText(e.buf, []byte(s))
+	e.buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// xmlElement is a parsed element. Names keep their prefix as written
+// (atom:link), so schemas match documents without resolving namespaces.
+type xmlElement struct {
+	name     string
+	attrs    map[string]string
+	children []*xmlElement
+	text     strings.Builder
+}
+
+func xmlQName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// parseXML reads a document into an element tree. encoding/xml never
+// fetches or expands external entities.
+func parseXML(s string) (*xmlElement, error) {
+	dec := xml.NewDecoder(strings.NewReader(s))
+	var root *xmlElement
+	var stack []*xmlElement
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) >= maxXMLDepth {
+				return nil, fmt.Errorf("nested too deeply")
+			}
+			el := &xmlElement{name: xmlQName(t.Name), attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				el.attrs[xmlQName(a.Name)] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, el)
+			} else if root != nil {
+				return nil, fmt.Errorf("more than one root element")
+			} else {
+				root = el
+			}
+			stack = append(stack, el)
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1].name != xmlQName(t.Name) {
+				return nil, fmt.Errorf("unexpected </%s>", xmlQName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unclosed <%s>", stack[len(stack)-1].name)
+	}
+	return root, nil
+}
+
+// xmlScalar converts element text or an attribute value for a field
+func xmlScalar(s string, node *SchemaNode) (string, error) {
+	switch node.Type {
+	case "number":
+		s = strings.TrimSpace(s)
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return "", fmt.Errorf("invalid number: %s", s)
+		}
+	case "bool":
+		switch strings.TrimSpace(s) {
+		case "1", "true":
+			s = "1"
+		case "0", "false":
+			s = "0"
+		default:
+			return "", fmt.Errorf("invalid bool: %s", s)
+		}
+	}
+	return s, nil
+}
+
+// decodeXMLElement builds a dict from el's attributes, text and children,
+// in schema order
+func decodeXMLElement(i *feather.InternalInterp, el *xmlElement, schema []*SchemaNode) (feather.FeatherObj, error) {
+	dict := i.NewDict()
+	for _, node := range schema {
+		key, name := xmlFieldName(node)
+		var val feather.FeatherObj
+		switch {
+		case strings.HasPrefix(name, "@"):
+			s, ok := el.attrs[name[1:]]
+			if !ok {
+				continue
+			}
+			s, err := xmlScalar(s, node)
+			if err != nil {
+				return 0, fmt.Errorf("field %s: %v", key, err)
+			}
+			val = i.InternString(s)
+
+		case name == "#text":
+			s, err := xmlScalar(strings.TrimSpace(el.text.String()), node)
+			if err != nil {
+				return 0, fmt.Errorf("field %s: %v", key, err)
+			}
+			val = i.InternString(s)
+
+		case node.Type == "array":
+			list := i.NewList()
+			for _, child := range el.children {
+				if child.name != name {
+					continue
+				}
+				item, err := decodeXMLValue(i, child, node.Children[0])
+				if err != nil {
+					return 0, fmt.Errorf("field %s: %v", key, err)
+				}
+				list = i.ListAppend(list, item)
+			}
+			val = list
+
+		default:
+			var found *xmlElement
+			for _, child := range el.children {
+				if child.name == name {
+					found = child
+					break
+				}
+			}
+			if found == nil {
+				continue
+			}
+			v, err := decodeXMLValue(i, found, node)
+			if err != nil {
+				return 0, fmt.Errorf("field %s: %v", key, err)
+			}
+			val = v
+		}
+		dict = i.DictSet(dict, key, val)
+	}
+	return dict, nil
+}
+
+func decodeXMLValue(i *feather.InternalInterp, el *xmlElement, node *SchemaNode) (feather.FeatherObj, error) {
+	if node.Type == "object" {
+		return decodeXMLElement(i, el, node.Children)
+	}
+	s, err := xmlScalar(strings.TrimSpace(el.text.String()), node)
+	if err != nil {
+		return 0, err
+	}
+	return i.InternString(s), nil
+}
+
+func registerXMLCommand(fi *feather.Interp, state *ServerState) {
+	xmlCmd := &Command{
+		Name:  "xml",
+		Help:  "Encode or decode XML with schema",
+		Usage: "xml VALUE -as SCHEMA ?-root NAME? | xml STR -from SCHEMA",
+		Long: `xml takes the json schema DSL with a few additions for XML:
+  @name       an attribute of the enclosing element
+  #text       the enclosing element's text, next to its attributes
+  key=name    dict key key is XML name name, e.g. link=atom:link or
+              href=@href
+Arrays are repeated elements named after the field, with no wrapper, as in
+RSS <item>s and sitemap <url>s.
+
+-as encodes a dict as the root element (-root, default root) with an XML
+declaration. -from decodes the document's root element. Prefixes are
+matched as written (atom:link), without resolving namespaces, and
+external entities are never loaded.
+
+Example:
+  set feed [dict create version 2.0 channel [dict create title News item $items]]
+  respond -type application/rss+xml [xml $feed -root rss -as {
+      string @version
+      object channel { string title array item object { string title string link } }
+  }]`,
+		Subcommands: []*Command{
+			{Name: "-as", Help: "Encode TCL value to XML using schema", Usage: "xml VALUE -as SCHEMA ?-root NAME?"},
+			{Name: "-from", Help: "Decode XML to TCL value using schema", Usage: "xml STR -from SCHEMA"},
+		},
+	}
+	registry.Register(xmlCmd)
+
+	// Low-level registration, like json, so the output isn't list-quoted
+	fi.Internal().Register("xml", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		root := "root"
+		var rest []feather.FeatherObj
+		for j := 0; j < len(args); j++ {
+			if i.GetString(args[j]) == "-root" && j+1 < len(args) && j > 0 {
+				root = i.GetString(args[j+1])
+				j++
+				continue
+			}
+			rest = append(rest, args[j])
+		}
+		if len(rest) != 3 {
+			i.SetErrorString("wrong # args: should be \"xml value -as schema ?-root name?\" or \"xml str -from schema\"")
+			return feather.ResultError
+		}
+		schema, err := parseSchema(i.GetString(rest[2]))
+		if err != nil {
+			i.SetErrorString(fmt.Sprintf("xml: invalid schema: %v", err))
+			return feather.ResultError
+		}
+
+		switch flag := i.GetString(rest[1]); flag {
+		case "-as":
+			dictVal, _, err := i.GetDict(rest[0])
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("xml: expected dict: %v", err))
+				return feather.ResultError
+			}
+			enc := newXMLEncoder(i)
+			defer enc.release()
+			enc.buf.WriteString(xml.Header)
+			if err := enc.encodeElement(root, dictVal, schema); err != nil {
+				i.SetErrorString(fmt.Sprintf("xml: encode error: %v", err))
+				return feather.ResultError
+			}
+			i.SetResult(i.InternString(enc.String()))
+			return feather.ResultOK
+
+		case "-from":
+			el, err := parseXML(i.GetString(rest[0]))
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("xml: decode error: %v", err))
+				return feather.ResultError
+			}
+			dict, err := decodeXMLElement(i, el, schema)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("xml: decode error: %v", err))
+				return feather.ResultError
+			}
+			i.SetResult(dict)
+			return feather.ResultOK
+
+		default:
+			i.SetErrorString(fmt.Sprintf("xml: unknown flag %q (use -as or -from)", flag))
+			return feather.ResultError
+		}
+	})
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/feather-lang/feather"
+)
+
+// yamlNode is a parsed YAML value before it becomes a feather value
+type yamlNode struct {
+	kind   byte // 'm' mapping, 's' sequence, 'v' scalar
+	keys   []string
+	values []*yamlNode // mapping values in key order, or sequence items
+	value  string
+	quoted bool // quoted scalars stay strings
+}
+
+type yamlLine struct {
+	num    int // 1-based, for errors
+	indent int
+	text   string // without indentation
+}
+
+// yamlParser reads the block-structured subset of YAML 1.2 that config
+// files use: mappings, sequences, plain and quoted scalars, | and >
+// block scalars, flow [..] and {..} collections and comments. Anchors,
+// aliases and tags other than !!str are rejected.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func yamlError(line int, format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// stripYAMLComment removes a trailing comment, ignoring # inside quotes
+func stripYAMLComment(s string) string {
+	var quote byte
+	for k := 0; k < len(s); k++ {
+		c := s[k]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				k++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if k == 0 || s[k-1] == ' ' || strings.IndexByte("[{,:", s[k-1]) >= 0 {
+				quote = c
+			}
+		case c == '#' && (k == 0 || s[k-1] == ' ' || s[k-1] == '\t'):
+			return strings.TrimRight(s[:k], " \t")
+		}
+	}
+	return strings.TrimRight(s, " \t")
+}
+
+func parseYAML(src string) (*yamlNode, error) {
+	p := &yamlParser{}
+	for n, raw := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, yamlError(n+1, "tabs can't be used for indentation")
+		}
+		p.lines = append(p.lines, yamlLine{num: n + 1, indent: len(raw) - len(text), text: text})
+	}
+	// Only the first document is read
+	start := 0
+	for k, l := range p.lines {
+		if l.indent == 0 && (l.text == "---" || strings.HasPrefix(l.text, "--- ")) {
+			if p.hasContent(0, k) {
+				p.lines = p.lines[:k]
+				break
+			}
+			start = k + 1
+			if rest := strings.TrimSpace(l.text[3:]); rest != "" {
+				p.lines[k] = yamlLine{num: l.num, text: rest}
+				start = k
+			}
+		} else if l.indent == 0 && l.text == "..." {
+			p.lines = p.lines[:k]
+			break
+		}
+	}
+	p.pos = start
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return &yamlNode{kind: 'v', value: "null"}, nil
+	}
+	node, err := p.parseNode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		return nil, yamlError(l.num, "unexpected %q", l.text)
+	}
+	return node, nil
+}
+
+func (p *yamlParser) hasContent(from, to int) bool {
+	for _, l := range p.lines[from:to] {
+		if stripYAMLComment(l.text) != "" && !strings.HasPrefix(l.text, "%") {
+			return true
+		}
+	}
+	return false
+}
+
+// skipBlank moves past blank and comment-only lines
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		t := stripYAMLComment(p.lines[p.pos].text)
+		if t != "" && !strings.HasPrefix(t, "%") {
+			return
+		}
+		p.pos++
+	}
+}
+
+// splitYAMLKey splits "key: value" at the first ": " (or trailing ":")
+// outside quotes and brackets. ok is false when the line isn't a mapping
+// entry.
+func splitYAMLKey(s string) (key, rest string, ok bool) {
+	var quote byte
+	depth := 0
+	for k := 0; k < len(s); k++ {
+		c := s[k]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				k++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && k == 0:
+			quote = c
+		case c == '[' || c == '{':
+			if k == 0 {
+				return "", "", false // a flow collection, not a key
+			}
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ':' && depth <= 0 && (k+1 == len(s) || s[k+1] == ' '):
+			return strings.TrimSpace(s[:k]), strings.TrimSpace(s[k+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func isYAMLSeqItem(t string) bool {
+	return t == "-" || strings.HasPrefix(t, "- ")
+}
+
+// parseNode parses the block node starting at the current line, which
+// must be indented at least minIndent. depth bounds nesting.
+func (p *yamlParser) parseNode(minIndent, depth int) (*yamlNode, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("nested too deeply")
+	}
+	p.skipBlank()
+	l := p.lines[p.pos]
+	if l.indent < minIndent {
+		return &yamlNode{kind: 'v', value: "null"}, nil
+	}
+	text := stripYAMLComment(l.text)
+	if isYAMLSeqItem(text) {
+		return p.parseSequence(l.indent, depth)
+	}
+	if _, _, ok := splitYAMLKey(text); ok {
+		return p.parseMapping(l.indent, depth)
+	}
+	p.pos++
+	return p.parseInline(text, l, l.indent, depth)
+}
+
+func (p *yamlParser) parseSequence(indent, depth int) (*yamlNode, error) {
+	node := &yamlNode{kind: 's'}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			return node, nil
+		}
+		l := p.lines[p.pos]
+		text := stripYAMLComment(l.text)
+		if l.indent != indent || !isYAMLSeqItem(text) {
+			if l.indent > indent {
+				return nil, yamlError(l.num, "bad indentation")
+			}
+			return node, nil
+		}
+		var item *yamlNode
+		var err error
+		rest := strings.TrimLeft(text[1:], " ")
+		_, _, isKey := splitYAMLKey(rest)
+		switch {
+		case rest == "":
+			p.pos++
+			item, err = p.parseChild(indent, false, depth)
+		case !isKey && !isYAMLSeqItem(rest):
+			p.pos++
+			item, err = p.parseInline(rest, l, indent, depth)
+		default:
+			// "- key: v" and "- - x" start a nested block at the column
+			// after the dash; reparse the line from there
+			p.lines[p.pos] = yamlLine{num: l.num, indent: indent + len(text) - len(rest), text: rest}
+			item, err = p.parseNode(indent+1, depth+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.values = append(node.values, item)
+	}
+}
+
+func (p *yamlParser) parseMapping(indent, depth int) (*yamlNode, error) {
+	node := &yamlNode{kind: 'm'}
+	seen := make(map[string]bool)
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			return node, nil
+		}
+		l := p.lines[p.pos]
+		text := stripYAMLComment(l.text)
+		if l.indent != indent {
+			if l.indent > indent {
+				return nil, yamlError(l.num, "bad indentation")
+			}
+			return node, nil
+		}
+		key, rest, ok := splitYAMLKey(text)
+		if !ok {
+			return nil, yamlError(l.num, "expected key: value, got %q", text)
+		}
+		k, err := yamlScalar(key, l.num)
+		if err != nil {
+			return nil, err
+		}
+		if seen[k.value] {
+			return nil, yamlError(l.num, "duplicate key %q", k.value)
+		}
+		seen[k.value] = true
+		p.pos++
+
+		var val *yamlNode
+		if rest == "" {
+			val, err = p.parseChild(indent, true, depth)
+		} else {
+			val, err = p.parseInline(rest, l, indent, depth)
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.keys = append(node.keys, k.value)
+		node.values = append(node.values, val)
+	}
+}
+
+// parseChild parses the block value after "key:" or "-" on its own: more
+// indented lines, a sequence at the same indent (after a key, when
+// sameIndentSeq is set), or null
+func (p *yamlParser) parseChild(indent int, sameIndentSeq bool, depth int) (*yamlNode, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return &yamlNode{kind: 'v', value: "null"}, nil
+	}
+	l := p.lines[p.pos]
+	if l.indent > indent {
+		return p.parseNode(indent+1, depth+1)
+	}
+	if sameIndentSeq && l.indent == indent && isYAMLSeqItem(stripYAMLComment(l.text)) {
+		return p.parseSequence(indent, depth+1)
+	}
+	return &yamlNode{kind: 'v', value: "null"}, nil
+}
+
+// parseInline parses a value written after "key: " or on a line of its
+// own: a block scalar, a flow collection or a scalar, possibly continued
+// on more indented lines
+func (p *yamlParser) parseInline(text string, l yamlLine, indent, depth int) (*yamlNode, error) {
+	if strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") {
+		return nil, yamlError(l.num, "anchors and aliases are not supported")
+	}
+	if t, ok := strings.CutPrefix(text, "!!str "); ok {
+		n, err := p.parseInline(strings.TrimSpace(t), l, indent, depth)
+		if err == nil && n.kind == 'v' {
+			n.quoted = true
+		}
+		return n, err
+	}
+	if strings.HasPrefix(text, "!") {
+		return nil, yamlError(l.num, "tags are not supported")
+	}
+	if text[0] == '|' || text[0] == '>' {
+		return p.blockScalar(text, l, indent)
+	}
+	if text[0] == '[' || text[0] == '{' {
+		// Flow collections may span lines; gather until brackets balance
+		src := text
+		for !yamlFlowClosed(src) && p.pos < len(p.lines) {
+			src += " " + stripYAMLComment(p.lines[p.pos].text)
+			p.pos++
+		}
+		f := &yamlFlow{s: src, line: l.num}
+		node, err := f.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		if f.skipSpace(); f.k != len(f.s) {
+			return nil, yamlError(l.num, "unexpected %q after flow collection", f.s[f.k:])
+		}
+		return node, nil
+	}
+	// Plain and quoted scalars may continue on more indented lines
+	for p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		t := stripYAMLComment(next.text)
+		if t == "" || next.indent <= indent {
+			break
+		}
+		if _, _, ok := splitYAMLKey(t); ok && text[0] != '"' && text[0] != '\'' {
+			break
+		}
+		text += " " + t
+		p.pos++
+	}
+	return yamlScalar(text, l.num)
+}
+
+func yamlFlowClosed(s string) bool {
+	depth := 0
+	var quote byte
+	for k := 0; k < len(s); k++ {
+		c := s[k]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				k++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// blockScalar reads a | (literal) or > (folded) scalar from the following
+// more indented lines
+func (p *yamlParser) blockScalar(header string, l yamlLine, indent int) (*yamlNode, error) {
+	chomp := byte(0)
+	for _, c := range header[1:] {
+		switch {
+		case c == '-' || c == '+':
+			chomp = byte(c)
+		case c >= '1' && c <= '9':
+		default:
+			return nil, yamlError(l.num, "bad block scalar header %q", header)
+		}
+	}
+	var lines []string
+	blockIndent := -1
+	for p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.text == "" {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		if next.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = next.indent
+		}
+		if next.indent < blockIndent {
+			break
+		}
+		lines = append(lines, strings.Repeat(" ", next.indent-blockIndent)+next.text)
+		p.pos++
+	}
+	// Trailing blank lines belong to chomping, not content
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var b strings.Builder
+	for k, line := range lines {
+		if k > 0 {
+			switch {
+			case header[0] == '|', line == "", lines[k-1] == "",
+				strings.HasPrefix(line, " "), strings.HasPrefix(lines[k-1], " "):
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(line)
+	}
+	s := b.String()
+	switch {
+	case len(lines) == 0:
+	case chomp == '+':
+		s += "\n" + strings.Repeat("\n", trailing)
+	case chomp != '-':
+		s += "\n"
+	}
+	return &yamlNode{kind: 'v', value: s, quoted: true}, nil
+}
+
+// yamlScalar interprets a plain or quoted scalar
+func yamlScalar(s string, line int) (*yamlNode, error) {
+	switch {
+	case s == "":
+		return &yamlNode{kind: 'v', value: "null"}, nil
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return nil, yamlError(line, "unterminated string %s", s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, yamlError(line, "bad string %s: %v", s, err)
+		}
+		return &yamlNode{kind: 'v', value: v, quoted: true}, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, yamlError(line, "unterminated string %s", s)
+		}
+		return &yamlNode{kind: 'v', value: strings.ReplaceAll(s[1:len(s)-1], "''", "'"), quoted: true}, nil
+	case s[0] == '&' || s[0] == '*':
+		return nil, yamlError(line, "anchors and aliases are not supported")
+	}
+	if s == "~" || s == "null" || s == "Null" || s == "NULL" {
+		return &yamlNode{kind: 'v', value: "null"}, nil
+	}
+	switch strings.ToLower(s) {
+	case "true", "false":
+		return &yamlNode{kind: 'v', value: strings.ToLower(s)}, nil
+	}
+	return &yamlNode{kind: 'v', value: s}, nil
+}
+
+// yamlFlow parses a flow collection: [a, b] and {k: v}
+type yamlFlow struct {
+	s    string
+	k    int
+	line int
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.k < len(f.s) && (f.s[f.k] == ' ' || f.s[f.k] == '\t') {
+		f.k++
+	}
+}
+
+func (f *yamlFlow) value(depth int) (*yamlNode, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("nested too deeply")
+	}
+	f.skipSpace()
+	if f.k >= len(f.s) {
+		return nil, yamlError(f.line, "unterminated flow collection")
+	}
+	switch f.s[f.k] {
+	case '[':
+		f.k++
+		node := &yamlNode{kind: 's'}
+		for {
+			f.skipSpace()
+			if f.k < len(f.s) && f.s[f.k] == ']' {
+				f.k++
+				return node, nil
+			}
+			item, err := f.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			node.values = append(node.values, item)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.k++
+		node := &yamlNode{kind: 'm'}
+		for {
+			f.skipSpace()
+			if f.k < len(f.s) && f.s[f.k] == '}' {
+				f.k++
+				return node, nil
+			}
+			key, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+			val := &yamlNode{kind: 'v', value: "null"}
+			if f.k < len(f.s) && f.s[f.k] == ':' {
+				f.k++
+				if val, err = f.value(depth + 1); err != nil {
+					return nil, err
+				}
+			}
+			node.keys = append(node.keys, key.value)
+			node.values = append(node.values, val)
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f.scalar(false)
+}
+
+// separator consumes a comma, leaving a closing bracket for the caller
+func (f *yamlFlow) separator(end byte) error {
+	f.skipSpace()
+	if f.k < len(f.s) {
+		if f.s[f.k] == ',' {
+			f.k++
+			return nil
+		}
+		if f.s[f.k] == end {
+			return nil
+		}
+	}
+	return yamlError(f.line, "expected , or %c in flow collection", end)
+}
+
+func (f *yamlFlow) scalar(isKey bool) (*yamlNode, error) {
+	start := f.k
+	if f.k < len(f.s) && (f.s[f.k] == '"' || f.s[f.k] == '\'') {
+		q := f.s[f.k]
+		for f.k++; f.k < len(f.s); f.k++ {
+			if f.s[f.k] == '\\' && q == '"' {
+				f.k++
+			} else if f.s[f.k] == q {
+				if q == '\'' && f.k+1 < len(f.s) && f.s[f.k+1] == '\'' {
+					f.k++
+					continue
+				}
+				f.k++
+				break
+			}
+		}
+		return yamlScalar(f.s[start:f.k], f.line)
+	}
+	for f.k < len(f.s) {
+		c := f.s[f.k]
+		if c == ',' || c == ']' || c == '}' || (c == ':' && (isKey || f.k+1 == len(f.s) || f.s[f.k+1] == ' ')) {
+			break
+		}
+		f.k++
+	}
+	return yamlScalar(strings.TrimSpace(f.s[start:f.k]), f.line)
+}
+
+// yamlToObj converts a parsed node: mappings become dicts (in document
+// order), sequences lists, unquoted integers and floats numbers and
+// everything else strings, with null as "null" like json parse
+func yamlToObj(i *feather.InternalInterp, n *yamlNode) feather.FeatherObj {
+	switch n.kind {
+	case 'm':
+		dict := i.NewDict()
+		for k, key := range n.keys {
+			dict = i.DictSet(dict, key, yamlToObj(i, n.values[k]))
+		}
+		return dict
+	case 's':
+		list := i.NewList()
+		for _, v := range n.values {
+			list = i.ListAppend(list, yamlToObj(i, v))
+		}
+		return list
+	}
+	if !n.quoted {
+		switch v := yamlNumber(n.value).(type) {
+		case int64:
+			return i.NewInt(v)
+		case float64:
+			return i.NewDouble(v)
+		}
+	}
+	return i.InternString(n.value)
+}
+
+// yamlNumber returns the int64 or float64 a plain scalar denotes (decimal,
+// 0x hex or 0o octal integers; decimal floats), or nil
+func yamlNumber(s string) any {
+	if s == "" {
+		return nil
+	}
+	digits := strings.TrimLeft(s, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] != 'x' && digits[1] != 'o' && digits[1] != '.' {
+		return nil // 007 stays a string
+	}
+	if strings.ContainsRune(s, '_') {
+		return nil
+	}
+	if v, err := strconv.ParseInt(s, 0, 64); err == nil && (len(digits) < 2 || digits[1] != 'b') {
+		return v
+	}
+	if strings.ContainsAny(s, ".eE") && isJSONNumber(strings.TrimPrefix(s, "+")) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// yamlNeedsQuotes reports whether a string would read back as something
+// else, or not parse, if written plain
+func yamlNeedsQuotes(s string) bool {
+	if s == "" || s == "~" || strings.TrimSpace(s) != s {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") {
+		return len(s) == 1 || s[0] != '-' || s[1] == ' ' || !isJSONNumber(s)
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			return true
+		}
+	}
+	switch strings.ToLower(s) {
+	case "null", "true", "false", "yes", "no", "on", "off", "y", "n":
+		return true
+	}
+	return yamlNumber(s) != nil
+}
+
+// yamlEncoder writes values as block YAML, choosing mappings and
+// sequences from the value's type like json stringify
+type yamlEncoder struct {
+	i *feather.InternalInterp
+	b *strings.Builder
+}
+
+func (e *yamlEncoder) scalar(val feather.FeatherObj) string {
+	s := e.i.GetString(val)
+	switch e.i.Type(val) {
+	case "int", "double":
+		return s
+	}
+	if s == "true" || s == "false" || isJSONNumber(s) {
+		return s
+	}
+	if yamlNeedsQuotes(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (e *yamlEncoder) key(k string) string {
+	if yamlNeedsQuotes(k) {
+		return strconv.Quote(k)
+	}
+	return k
+}
+
+// collection returns the dict or list in val, or ok=false for scalars and
+// empty collections, which are written inline
+func (e *yamlEncoder) collection(val feather.FeatherObj) (kind string, ok bool) {
+	switch t := e.i.Type(val); t {
+	case "dict":
+		_, order, err := e.i.GetDict(val)
+		return t, err == nil && len(order) > 0
+	case "list":
+		list, err := e.i.GetList(val)
+		return t, err == nil && len(list) > 0
+	}
+	return "", false
+}
+
+func (e *yamlEncoder) inline(val feather.FeatherObj) string {
+	switch e.i.Type(val) {
+	case "dict":
+		return "{}"
+	case "list":
+		return "[]"
+	}
+	return e.scalar(val)
+}
+
+// encode writes val indented by indent. With inline set, the current
+// line already holds a "- " prefix and the first entry continues it.
+func (e *yamlEncoder) encode(val feather.FeatherObj, indent int, inline bool, depth int) error {
+	if depth > maxJSONDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+	pad := strings.Repeat(" ", indent)
+	kind, _ := e.collection(val)
+	switch kind {
+	case "dict":
+		dict, order, _ := e.i.GetDict(val)
+		for idx, k := range order {
+			if idx > 0 || !inline {
+				e.b.WriteString(pad)
+			}
+			e.b.WriteString(e.key(k) + ":")
+			if _, ok := e.collection(dict[k]); ok {
+				e.b.WriteByte('\n')
+				if err := e.encode(dict[k], indent+2, false, depth+1); err != nil {
+					return fmt.Errorf("key %s: %v", k, err)
+				}
+				continue
+			}
+			e.b.WriteString(" " + e.inline(dict[k]) + "\n")
+		}
+		return nil
+	case "list":
+		list, _ := e.i.GetList(val)
+		for idx, item := range list {
+			if idx > 0 || !inline {
+				e.b.WriteString(pad)
+			}
+			e.b.WriteString("- ")
+			if _, ok := e.collection(item); ok {
+				if err := e.encode(item, indent+2, true, depth+1); err != nil {
+					return fmt.Errorf("index %d: %v", idx, err)
+				}
+				continue
+			}
+			e.b.WriteString(e.inline(item) + "\n")
+		}
+		return nil
+	}
+	if !inline {
+		e.b.WriteString(pad)
+	}
+	e.b.WriteString(e.inline(val) + "\n")
+	return nil
+}
+
+func registerYAMLCommand(fi *feather.Interp, state *ServerState) {
+	yamlCmd := &Command{
+		Name:  "yaml",
+		Help:  "Parse or write YAML",
+		Usage: "yaml parse STR | yaml load PATH | yaml stringify VALUE",
+		Long: `yaml parse reads YAML the way json parse reads JSON: mappings become
+dicts (keeping key order), sequences lists, unquoted numbers ints or
+doubles, and true, false and null (or ~) those strings. yaml load does the
+same for a file or embed:// path, for config files at startup.
+
+Supported: block mappings and sequences, plain, quoted and multi-line
+scalars, | and > block scalars, flow [..] and {..} collections, comments
+and the first --- document. Anchors, aliases and tags other than !!str
+are errors.
+
+yaml stringify writes dicts as mappings and lists as sequences, and
+quotes strings that would otherwise read back as something else.
+
+Example:
+  set cfg [yaml load ./config.yaml]
+  listen [dict get $cfg server port]`,
+		Subcommands: []*Command{
+			{Name: "parse", Help: "Decode a YAML string", Usage: "yaml parse STR"},
+			{Name: "load", Help: "Decode a YAML file", Usage: "yaml load PATH"},
+			{Name: "stringify", Help: "Encode a value as YAML", Usage: "yaml stringify VALUE"},
+		},
+	}
+	registry.Register(yamlCmd)
+
+	// Low-level registration, like json, so the output isn't list-quoted
+	fi.Internal().Register("yaml", func(i *feather.InternalInterp, cmd feather.FeatherObj, args []feather.FeatherObj) feather.FeatherResult {
+		if len(args) != 2 {
+			i.SetErrorString("wrong # args: should be \"yaml parse|load|stringify arg\"")
+			return feather.ResultError
+		}
+		switch sub := i.GetString(args[0]); sub {
+		case "parse", "load":
+			src := i.GetString(args[1])
+			if sub == "load" {
+				data, err := readPath(src)
+				if err != nil {
+					i.SetErrorString(fmt.Sprintf("yaml load: %v", err))
+					return feather.ResultError
+				}
+				src = string(data)
+			}
+			node, err := parseYAML(src)
+			if err != nil {
+				i.SetErrorString(fmt.Sprintf("yaml %s: %v", sub, err))
+				return feather.ResultError
+			}
+			i.SetResult(yamlToObj(i, node))
+			return feather.ResultOK
+
+		case "stringify":
+			var b strings.Builder
+			e := &yamlEncoder{i: i, b: &b}
+			if err := e.encode(args[1], 0, false, 0); err != nil {
+				i.SetErrorString(fmt.Sprintf("yaml stringify: %v", err))
+				return feather.ResultError
+			}
+			i.SetResult(i.InternString(b.String()))
+			return feather.ResultOK
+
+		default:
+			i.SetErrorString(fmt.Sprintf("yaml: unknown subcommand %q (must be parse, load, stringify)", sub))
+			return feather.ResultError
+		}
+	})
+}